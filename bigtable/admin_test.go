@@ -0,0 +1,141 @@
+/*
+Copyright 2020 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package bigtable
+
+import (
+	"context"
+	"testing"
+
+	"cloud.google.com/go/bigtable/bttest"
+	"google.golang.org/api/iterator"
+	"google.golang.org/api/option"
+	"google.golang.org/grpc"
+)
+
+func TestInstanceAdminEmulator(t *testing.T) {
+	ctx := context.Background()
+	srv, err := bttest.NewServer("localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	conn, err := grpc.Dial(srv.Addr, grpc.WithInsecure(), grpc.WithBlock())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	iac, err := NewInstanceAdminClient(ctx, "my-project", option.WithGRPCConn(conn))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := iac.CreateInstance(ctx, &InstanceConf{
+		InstanceId:   "my-instance",
+		ClusterId:    "my-cluster",
+		DisplayName:  "My instance",
+		Zone:         "us-central1-b",
+		InstanceType: DEVELOPMENT,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := iac.UpdateInstanceWithClusters(ctx, &InstanceWithClustersConfig{
+		InstanceID:   "my-instance",
+		DisplayName:  "Production",
+		InstanceType: PRODUCTION,
+		Clusters:     []ClusterConfig{{ClusterID: "my-cluster", NumNodes: 5}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	info, err := iac.InstanceInfo(ctx, "my-instance")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.InstanceType != PRODUCTION || info.DisplayName != "Production" {
+		t.Errorf("got instance %+v", info)
+	}
+	ci, err := iac.GetCluster(ctx, "my-instance", "my-cluster")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ci.ServeNodes != 5 || ci.Zone != "us-central1-b" || ci.State != "READY" {
+		t.Errorf("got cluster %+v", ci)
+	}
+
+	if _, err := iac.CreateAppProfile(ctx, ProfileConf{
+		InstanceID:    "my-instance",
+		ProfileID:     "batch",
+		RoutingPolicy: SingleClusterRouting,
+		ClusterID:     "my-cluster",
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := iac.UpdateAppProfile(ctx, "my-instance", "batch", ProfileAttrsToUpdate{
+		Description:    "batch jobs",
+		RoutingPolicy:  MultiClusterRouting,
+		IgnoreWarnings: true,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	ap, err := iac.GetAppProfile(ctx, "my-instance", "batch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ap.Description != "batch jobs" || ap.GetMultiClusterRoutingUseAny() == nil {
+		t.Errorf("got app profile %v", ap)
+	}
+	var n int
+	it := iac.ListAppProfiles(ctx, "my-instance")
+	for {
+		_, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		n++
+	}
+	if n != 2 {
+		t.Errorf("got %d app profiles, want 2", n)
+	}
+	if err := iac.DeleteAppProfile(ctx, "my-instance", "batch"); err != nil {
+		t.Fatal(err)
+	}
+
+	h := iac.InstanceIAM("my-instance")
+	p, err := h.Policy(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Add("user:a@example.com", "roles/bigtable.reader")
+	if err := h.SetPolicy(ctx, p); err != nil {
+		t.Fatal(err)
+	}
+	if p, err = h.Policy(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if !p.HasRole("user:a@example.com", "roles/bigtable.reader") {
+		t.Errorf("policy %v lacks the new binding", p.Roles())
+	}
+
+	if err := iac.DeleteInstance(ctx, "my-instance"); err != nil {
+		t.Fatal(err)
+	}
+	if is, err := iac.Instances(ctx); err != nil || len(is) != 0 {
+		t.Errorf("Instances after DeleteInstance: got %v, %v", is, err)
+	}
+}
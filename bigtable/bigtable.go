@@ -164,10 +164,14 @@ func (t *Table) ReadRows(ctx context.Context, arg RowSet, f func(Row) bool, opts
 	ctx = mergeOutgoingMetadata(ctx, t.md)
 	ctx = trace.StartSpan(ctx, "cloud.google.com/go/bigtable.ReadRows")
 	defer func() { trace.EndSpan(ctx, err) }()
+	op := t.startOp(ctx, "ReadRows")
+	defer func() { op.end(err) }()
 
 	var prevRowKey string
+	var rows, cells int64
+	defer func() { op.record(RowsPerRead.M(rows), CellsPerRead.M(cells)) }()
 	attrMap := make(map[string]interface{})
-	err = gax.Invoke(ctx, func(ctx context.Context, _ gax.CallSettings) error {
+	err = gax.Invoke(ctx, op.attempt(func(ctx context.Context, _ gax.CallSettings) error {
 		if !arg.valid() {
 			// Empty row set, no need to make an API call.
 			// NOTE: we must return early if arg == RowList{} because reading
@@ -186,6 +190,7 @@ func (t *Table) ReadRows(ctx context.Context, arg RowSet, f func(Row) bool, opts
 		defer cancel()
 
 		startTime := time.Now()
+		op.record(SentBytes.M(int64(proto.Size(req))))
 		stream, err := t.c.client.ReadRows(ctx, req)
 		if err != nil {
 			return err
@@ -208,6 +213,7 @@ func (t *Table) ReadRows(ctx context.Context, arg RowSet, f func(Row) bool, opts
 			attrMap["time_secs"] = time.Since(startTime).Seconds()
 			attrMap["rowCount"] = len(res.Chunks)
 			trace.TracePrintf(ctx, attrMap, "Details in ReadRows")
+			op.record(ReceivedBytes.M(int64(proto.Size(res))))
 
 			for _, cc := range res.Chunks {
 				row, err := cr.Process(cc)
@@ -219,6 +225,10 @@ func (t *Table) ReadRows(ctx context.Context, arg RowSet, f func(Row) bool, opts
 					continue
 				}
 				prevRowKey = row.Key()
+				rows++
+				for _, items := range row {
+					cells += int64(len(items))
+				}
 				if !f(row) {
 					// Cancel and drain stream.
 					cancel()
@@ -237,7 +247,7 @@ func (t *Table) ReadRows(ctx context.Context, arg RowSet, f func(Row) bool, opts
 			}
 		}
 		return err
-	}, retryOptions...)
+	}), retryOptions...)
 
 	return err
 }
@@ -489,6 +499,8 @@ func (t *Table) Apply(ctx context.Context, row string, m *Mutation, opts ...Appl
 	ctx = mergeOutgoingMetadata(ctx, t.md)
 	ctx = trace.StartSpan(ctx, "cloud.google.com/go/bigtable/Apply")
 	defer func() { trace.EndSpan(ctx, err) }()
+	op := t.startOp(ctx, "Apply")
+	defer func() { op.end(err) }()
 
 	after := func(res proto.Message) {
 		for _, o := range opts {
@@ -508,11 +520,15 @@ func (t *Table) Apply(ctx context.Context, row string, m *Mutation, opts ...Appl
 			callOptions = retryOptions
 		}
 		var res *btpb.MutateRowResponse
-		err := gax.Invoke(ctx, func(ctx context.Context, _ gax.CallSettings) error {
+		err := gax.Invoke(ctx, op.attempt(func(ctx context.Context, _ gax.CallSettings) error {
 			var err error
+			op.record(SentBytes.M(int64(proto.Size(req))))
 			res, err = t.c.client.MutateRow(ctx, req)
+			if err == nil {
+				op.record(ReceivedBytes.M(int64(proto.Size(res))))
+			}
 			return err
-		}, callOptions...)
+		}), callOptions...)
 		if err == nil {
 			after(res)
 		}
@@ -541,11 +557,15 @@ func (t *Table) Apply(ctx context.Context, row string, m *Mutation, opts ...Appl
 		callOptions = retryOptions
 	}
 	var cmRes *btpb.CheckAndMutateRowResponse
-	err = gax.Invoke(ctx, func(ctx context.Context, _ gax.CallSettings) error {
+	err = gax.Invoke(ctx, op.attempt(func(ctx context.Context, _ gax.CallSettings) error {
 		var err error
+		op.record(SentBytes.M(int64(proto.Size(req))))
 		cmRes, err = t.c.client.CheckAndMutateRow(ctx, req)
+		if err == nil {
+			op.record(ReceivedBytes.M(int64(proto.Size(cmRes))))
+		}
 		return err
-	}, callOptions...)
+	}), callOptions...)
 	if err == nil {
 		after(cmRes)
 	}
@@ -665,6 +685,8 @@ func (t *Table) ApplyBulk(ctx context.Context, rowKeys []string, muts []*Mutatio
 	ctx = mergeOutgoingMetadata(ctx, t.md)
 	ctx = trace.StartSpan(ctx, "cloud.google.com/go/bigtable/ApplyBulk")
 	defer func() { trace.EndSpan(ctx, err) }()
+	op := t.startOp(ctx, "ApplyBulk")
+	defer func() { op.end(err) }()
 
 	if len(rowKeys) != len(muts) {
 		return nil, fmt.Errorf("mismatched rowKeys and mutation array lengths: %d, %d", len(rowKeys), len(muts))
@@ -680,24 +702,7 @@ func (t *Table) ApplyBulk(ctx context.Context, rowKeys []string, muts []*Mutatio
 	}
 
 	for _, group := range groupEntries(origEntries, maxMutations) {
-		attrMap := make(map[string]interface{})
-		err = gax.Invoke(ctx, func(ctx context.Context, _ gax.CallSettings) error {
-			attrMap["rowCount"] = len(group)
-			trace.TracePrintf(ctx, attrMap, "Row count in ApplyBulk")
-			err := t.doApplyBulk(ctx, group, opts...)
-			if err != nil {
-				// We want to retry the entire request with the current group
-				return err
-			}
-			group = t.getApplyBulkRetries(group)
-			if len(group) > 0 && len(idempotentRetryCodes) > 0 {
-				// We have at least one mutation that needs to be retried.
-				// Return an arbitrary error that is retryable according to callOptions.
-				return status.Errorf(idempotentRetryCodes[0], "Synthetic error: partial failure of ApplyBulk")
-			}
-			return nil
-		}, retryOptions...)
-		if err != nil {
+		if _, err = t.applyGroup(ctx, op, group, opts...); err != nil {
 			return nil, err
 		}
 	}
@@ -717,6 +722,38 @@ func (t *Table) ApplyBulk(ctx context.Context, rowKeys []string, muts []*Mutatio
 	return nil, nil
 }
 
+// applyGroup applies a group of entries in one request, retrying the entries
+// that fail with retryable errors. If the request fails, applyGroup returns the
+// entries whose outcome is unknown along with the error.
+func (t *Table) applyGroup(ctx context.Context, op *opRecorder, group []*entryErr, opts ...ApplyOption) ([]*entryErr, error) {
+	attrMap := make(map[string]interface{})
+	err := gax.Invoke(ctx, op.attempt(func(ctx context.Context, _ gax.CallSettings) error {
+		attrMap["rowCount"] = len(group)
+		trace.TracePrintf(ctx, attrMap, "Row count in ApplyBulk")
+		err := t.doApplyBulk(ctx, op, group, opts...)
+		if err != nil {
+			// We want to retry the entire request with the current group
+			return err
+		}
+		for _, entry := range group {
+			if entry.Err != nil {
+				op.recordWithStatus(entry.Err, MutationFailureCount.M(1))
+			}
+		}
+		group = t.getApplyBulkRetries(group)
+		if len(group) > 0 && len(idempotentRetryCodes) > 0 {
+			// We have at least one mutation that needs to be retried.
+			// Return an arbitrary error that is retryable according to callOptions.
+			return status.Errorf(idempotentRetryCodes[0], "Synthetic error: partial failure of ApplyBulk")
+		}
+		return nil
+	}), retryOptions...)
+	if err != nil {
+		return group, err
+	}
+	return nil, nil
+}
+
 // getApplyBulkRetries returns the entries that need to be retried
 func (t *Table) getApplyBulkRetries(entries []*entryErr) []*entryErr {
 	var retryEntries []*entryErr
@@ -731,7 +768,7 @@ func (t *Table) getApplyBulkRetries(entries []*entryErr) []*entryErr {
 }
 
 // doApplyBulk does the work of a single ApplyBulk invocation
-func (t *Table) doApplyBulk(ctx context.Context, entryErrs []*entryErr, opts ...ApplyOption) error {
+func (t *Table) doApplyBulk(ctx context.Context, op *opRecorder, entryErrs []*entryErr, opts ...ApplyOption) error {
 	after := func(res proto.Message) {
 		for _, o := range opts {
 			o.after(res)
@@ -747,6 +784,7 @@ func (t *Table) doApplyBulk(ctx context.Context, entryErrs []*entryErr, opts ...
 		AppProfileId: t.c.appProfile,
 		Entries:      entries,
 	}
+	op.record(SentBytes.M(int64(proto.Size(req))))
 	stream, err := t.c.client.MutateRows(ctx, req)
 	if err != nil {
 		return err
@@ -759,6 +797,7 @@ func (t *Table) doApplyBulk(ctx context.Context, entryErrs []*entryErr, opts ...
 		if err != nil {
 			return err
 		}
+		op.record(ReceivedBytes.M(int64(proto.Size(res))))
 
 		for i, entry := range res.Entries {
 			s := entry.Status
@@ -826,15 +865,29 @@ func (ts Timestamp) TruncateToMilliseconds() Timestamp {
 
 // ApplyReadModifyWrite applies a ReadModifyWrite to a specific row.
 // It returns the newly written cells.
-func (t *Table) ApplyReadModifyWrite(ctx context.Context, row string, m *ReadModifyWrite) (Row, error) {
+func (t *Table) ApplyReadModifyWrite(ctx context.Context, row string, m *ReadModifyWrite) (_ Row, err error) {
 	ctx = mergeOutgoingMetadata(ctx, t.md)
+	ctx = trace.StartSpan(ctx, "cloud.google.com/go/bigtable/ApplyReadModifyWrite")
+	defer func() { trace.EndSpan(ctx, err) }()
+	op := t.startOp(ctx, "ApplyReadModifyWrite")
+	defer func() { op.end(err) }()
+
 	req := &btpb.ReadModifyWriteRowRequest{
 		TableName:    t.c.fullTableName(t.table),
 		AppProfileId: t.c.appProfile,
 		RowKey:       []byte(row),
 		Rules:        m.ops,
 	}
-	res, err := t.c.client.ReadModifyWriteRow(ctx, req)
+	// ReadModifyWriteRow is not idempotent, so it is attempted only once.
+	var res *btpb.ReadModifyWriteRowResponse
+	err = op.attempt(func(ctx context.Context, _ gax.CallSettings) error {
+		op.record(SentBytes.M(int64(proto.Size(req))))
+		res, err = t.c.client.ReadModifyWriteRow(ctx, req)
+		if err == nil {
+			op.record(ReceivedBytes.M(int64(proto.Size(res))))
+		}
+		return err
+	})(ctx, gax.CallSettings{})
 	if err != nil {
 		return nil, err
 	}
@@ -887,10 +940,15 @@ func (m *ReadModifyWrite) Increment(family, column string, delta int64) {
 
 // SampleRowKeys returns a sample of row keys in the table. The returned row keys will delimit contiguous sections of
 // the table of approximately equal size, which can be used to break up the data for distributed tasks like mapreduces.
-func (t *Table) SampleRowKeys(ctx context.Context) ([]string, error) {
+func (t *Table) SampleRowKeys(ctx context.Context) (_ []string, err error) {
 	ctx = mergeOutgoingMetadata(ctx, t.md)
+	ctx = trace.StartSpan(ctx, "cloud.google.com/go/bigtable/SampleRowKeys")
+	defer func() { trace.EndSpan(ctx, err) }()
+	op := t.startOp(ctx, "SampleRowKeys")
+	defer func() { op.end(err) }()
+
 	var sampledRowKeys []string
-	err := gax.Invoke(ctx, func(ctx context.Context, _ gax.CallSettings) error {
+	err = gax.Invoke(ctx, op.attempt(func(ctx context.Context, _ gax.CallSettings) error {
 		sampledRowKeys = nil
 		req := &btpb.SampleRowKeysRequest{
 			TableName:    t.c.fullTableName(t.table),
@@ -899,6 +957,8 @@ func (t *Table) SampleRowKeys(ctx context.Context) ([]string, error) {
 		ctx, cancel := context.WithCancel(ctx) // for aborting the stream
 		defer cancel()
 
+		op.record(SentBytes.M(int64(proto.Size(req))))
+
 		stream, err := t.c.client.SampleRowKeys(ctx, req)
 		if err != nil {
 			return err
@@ -911,6 +971,7 @@ func (t *Table) SampleRowKeys(ctx context.Context) ([]string, error) {
 			if err != nil {
 				return err
 			}
+			op.record(ReceivedBytes.M(int64(proto.Size(res))))
 
 			key := string(res.RowKey)
 			if key == "" {
@@ -920,6 +981,6 @@ func (t *Table) SampleRowKeys(ctx context.Context) ([]string, error) {
 			sampledRowKeys = append(sampledRowKeys, key)
 		}
 		return nil
-	}, retryOptions...)
+	}), retryOptions...)
 	return sampledRowKeys, err
 }
@@ -48,7 +48,7 @@ import (
 	"github.com/google/btree"
 	btapb "google.golang.org/genproto/googleapis/bigtable/admin/v2"
 	btpb "google.golang.org/genproto/googleapis/bigtable/v2"
-	"google.golang.org/genproto/googleapis/longrunning"
+	iampb "google.golang.org/genproto/googleapis/iam/v1"
 	statpb "google.golang.org/genproto/googleapis/rpc/status"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
@@ -82,10 +82,16 @@ type Server struct {
 // It is a separate and unexported type so the API won't be cluttered with
 // methods that are only relevant to the fake's implementation.
 type server struct {
-	mu        sync.Mutex
-	tables    map[string]*table          // keyed by fully qualified name
-	instances map[string]*btapb.Instance // keyed by fully qualified name
-	gcc       chan int                   // set when gcloop starts, closed when server shuts down
+	mu          sync.Mutex
+	tables      map[string]*table            // keyed by fully qualified name
+	instances   map[string]*btapb.Instance   // keyed by fully qualified name
+	clusters    map[string]*btapb.Cluster    // keyed by fully qualified name
+	appProfiles map[string]*btapb.AppProfile // keyed by fully qualified name
+	iamPolicies map[string]*iampb.Policy     // keyed by instance name
+	etags       int64                        // number of etags generated
+	snapshots   map[string]*snapshot         // keyed by fully qualified name
+	gcc         chan int                     // set when gcloop starts, closed when server shuts down
+	persist     *persister                   // nil unless the server was created WithDataDir
 
 	// Any unimplemented methods will cause a panic.
 	btapb.BigtableTableAdminServer
@@ -97,6 +103,37 @@ type server struct {
 // The Server will be listening for gRPC connections, without TLS,
 // on the provided address. The resolved address is named by the Addr field.
 func NewServer(laddr string, opt ...grpc.ServerOption) (*Server, error) {
+	return NewServerWithOptions(laddr, GRPCServerOptions(opt...))
+}
+
+// A ServerOption is an option for NewServerWithOptions.
+type ServerOption interface {
+	set(*serverConfig)
+}
+
+type serverConfig struct {
+	grpcOpts []grpc.ServerOption
+	dataDir  string
+}
+
+// GRPCServerOptions returns a ServerOption that passes opts to the gRPC
+// server of the Server.
+func GRPCServerOptions(opts ...grpc.ServerOption) ServerOption {
+	return grpcServerOptions(opts)
+}
+
+type grpcServerOptions []grpc.ServerOption
+
+func (o grpcServerOptions) set(c *serverConfig) { c.grpcOpts = append(c.grpcOpts, o...) }
+
+// NewServerWithOptions is like NewServer, with options that are not gRPC
+// server options, such as WithDataDir.
+func NewServerWithOptions(laddr string, opts ...ServerOption) (*Server, error) {
+	var cfg serverConfig
+	for _, o := range opts {
+		o.set(&cfg)
+	}
+
 	l, err := net.Listen("tcp", laddr)
 	if err != nil {
 		return nil, err
@@ -105,12 +142,27 @@ func NewServer(laddr string, opt ...grpc.ServerOption) (*Server, error) {
 	s := &Server{
 		Addr: l.Addr().String(),
 		l:    l,
-		srv:  grpc.NewServer(opt...),
+		srv:  grpc.NewServer(cfg.grpcOpts...),
 		s: &server{
-			tables:    make(map[string]*table),
-			instances: make(map[string]*btapb.Instance),
+			tables:      make(map[string]*table),
+			instances:   make(map[string]*btapb.Instance),
+			clusters:    make(map[string]*btapb.Cluster),
+			appProfiles: make(map[string]*btapb.AppProfile),
+			iamPolicies: make(map[string]*iampb.Policy),
+			snapshots:   make(map[string]*snapshot),
 		},
 	}
+	if cfg.dataDir != "" {
+		p, err := newPersister(cfg.dataDir, s.s)
+		if err != nil {
+			l.Close()
+			return nil, err
+		}
+		s.s.persist = p
+		if len(s.s.tables) > 0 {
+			s.s.needGC()
+		}
+	}
 	btapb.RegisterBigtableInstanceAdminServer(s.srv, s.s)
 	btapb.RegisterBigtableTableAdminServer(s.srv, s.s)
 	btpb.RegisterBigtableServer(s.srv, s.s)
@@ -130,6 +182,12 @@ func (s *Server) Close() {
 
 	s.srv.Stop()
 	s.l.Close()
+
+	if s.s.persist != nil {
+		if err := s.s.persist.close(); err != nil {
+			log.Printf("bttest: saving tables: %v", err)
+		}
+	}
 }
 
 func (s *server) CreateTable(ctx context.Context, req *btapb.CreateTableRequest) (*btapb.Table, error) {
@@ -140,8 +198,13 @@ func (s *server) CreateTable(ctx context.Context, req *btapb.CreateTableRequest)
 		s.mu.Unlock()
 		return nil, status.Errorf(codes.AlreadyExists, "table %q already exists", tbl)
 	}
-	s.tables[tbl] = newTable(req)
+	t := newTable(req)
+	s.tables[tbl] = t
+	err := s.logSchema(tbl, t)
 	s.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
 
 	ct := &btapb.Table{
 		Name:           tbl,
@@ -154,10 +217,6 @@ func (s *server) CreateTable(ctx context.Context, req *btapb.CreateTableRequest)
 	return ct, nil
 }
 
-func (s *server) CreateTableFromSnapshot(context.Context, *btapb.CreateTableFromSnapshotRequest) (*longrunning.Operation, error) {
-	return nil, status.Errorf(codes.Unimplemented, "the emulator does not currently support snapshots")
-}
-
 func (s *server) ListTables(ctx context.Context, req *btapb.ListTablesRequest) (*btapb.ListTablesResponse, error) {
 	res := &btapb.ListTablesResponse{}
 	prefix := req.Parent + "/tables/"
@@ -196,6 +255,9 @@ func (s *server) DeleteTable(ctx context.Context, req *btapb.DeleteTableRequest)
 		return nil, status.Errorf(codes.NotFound, "table %q not found", req.Name)
 	}
 	delete(s.tables, req.Name)
+	if err := s.logDeleteTable(req.Name); err != nil {
+		return nil, err
+	}
 	return &emptypb.Empty{}, nil
 }
 
@@ -240,6 +302,9 @@ func (s *server) ModifyColumnFamilies(ctx context.Context, req *btapb.ModifyColu
 			tbl.families[mod.Id] = newcf
 		}
 	}
+	if err := s.logSchema(req.Name, tbl); err != nil {
+		return nil, err
+	}
 
 	s.needGC()
 	return &btapb.Table{
@@ -251,37 +316,28 @@ func (s *server) ModifyColumnFamilies(ctx context.Context, req *btapb.ModifyColu
 
 func (s *server) DropRowRange(ctx context.Context, req *btapb.DropRowRangeRequest) (*emptypb.Empty, error) {
 	s.mu.Lock()
-	defer s.mu.Unlock()
 	tbl, ok := s.tables[req.Name]
+	s.mu.Unlock()
 	if !ok {
 		return nil, status.Errorf(codes.NotFound, "table %q not found", req.Name)
 	}
 
-	if req.GetDeleteAllDataFromTable() {
-		tbl.rows = btree.New(btreeDegree)
-	} else {
+	var prefix string
+	if !req.GetDeleteAllDataFromTable() {
 		// Delete rows by prefix.
 		prefixBytes := req.GetRowKeyPrefix()
 		if prefixBytes == nil {
 			return nil, fmt.Errorf("missing row key prefix")
 		}
-		prefix := string(prefixBytes)
-
-		// The BTree does not specify what happens if rows are deleted during
-		// iteration, and it provides no "delete range" method.
-		// So we collect the rows first, then delete them one by one.
-		var rowsToDelete []*row
-		tbl.rows.AscendGreaterOrEqual(btreeKey(prefix), func(i btree.Item) bool {
-			r := i.(*row)
-			if strings.HasPrefix(r.key, prefix) {
-				rowsToDelete = append(rowsToDelete, r)
-				return true
-			}
-			return false // stop iteration
-		})
-		for _, r := range rowsToDelete {
-			tbl.rows.Delete(r)
-		}
+		prefix = string(prefixBytes)
+	}
+	// Drop and log the rows under the table lock, so that no write to them
+	// is logged after the drop. See lockRow.
+	tbl.mu.Lock()
+	defer tbl.mu.Unlock()
+	tbl.dropRows(prefix)
+	if err := s.logDropRows(req.Name, prefix); err != nil {
+		return nil, err
 	}
 	return &emptypb.Empty{}, nil
 }
@@ -316,20 +372,6 @@ func (s *server) CheckConsistency(ctx context.Context, req *btapb.CheckConsisten
 	}, nil
 }
 
-func (s *server) SnapshotTable(context.Context, *btapb.SnapshotTableRequest) (*longrunning.Operation, error) {
-	return nil, status.Errorf(codes.Unimplemented, "the emulator does not currently support snapshots")
-}
-
-func (s *server) GetSnapshot(context.Context, *btapb.GetSnapshotRequest) (*btapb.Snapshot, error) {
-	return nil, status.Errorf(codes.Unimplemented, "the emulator does not currently support snapshots")
-}
-func (s *server) ListSnapshots(context.Context, *btapb.ListSnapshotsRequest) (*btapb.ListSnapshotsResponse, error) {
-	return nil, status.Errorf(codes.Unimplemented, "the emulator does not currently support snapshots")
-}
-func (s *server) DeleteSnapshot(context.Context, *btapb.DeleteSnapshotRequest) (*emptypb.Empty, error) {
-	return nil, status.Errorf(codes.Unimplemented, "the emulator does not currently support snapshots")
-}
-
 func (s *server) ReadRows(req *btpb.ReadRowsRequest, stream btpb.Bigtable_ReadRowsServer) error {
 	s.mu.Lock()
 	tbl, ok := s.tables[req.TableName]
@@ -760,10 +802,15 @@ func (s *server) MutateRow(ctx context.Context, req *btpb.MutateRowRequest) (*bt
 		return nil, status.Errorf(codes.NotFound, "table %q not found", req.TableName)
 	}
 	fs := tbl.columnFamilies()
-	r := tbl.mutableRow(string(req.RowKey))
-	r.mu.Lock()
-	defer r.mu.Unlock()
-	if err := applyMutations(tbl, r, req.Mutations, fs); err != nil {
+	r, unlock := tbl.lockRow(string(req.RowKey))
+	defer unlock()
+	err := applyMutations(tbl, r, req.Mutations, fs)
+	// Log the row even if a mutation failed, since earlier ones may have
+	// been applied.
+	if lerr := s.logRow(req.TableName, r); err == nil {
+		err = lerr
+	}
+	if err != nil {
 		return nil, err
 	}
 	return &btpb.MutateRowResponse{}, nil
@@ -781,10 +828,13 @@ func (s *server) MutateRows(req *btpb.MutateRowsRequest, stream btpb.Bigtable_Mu
 	fs := tbl.columnFamilies()
 
 	for i, entry := range req.Entries {
-		r := tbl.mutableRow(string(entry.RowKey))
-		r.mu.Lock()
+		r, unlock := tbl.lockRow(string(entry.RowKey))
 		code, msg := int32(codes.OK), ""
-		if err := applyMutations(tbl, r, entry.Mutations, fs); err != nil {
+		err := applyMutations(tbl, r, entry.Mutations, fs)
+		if lerr := s.logRow(req.TableName, r); err == nil {
+			err = lerr
+		}
+		if err != nil {
 			code = int32(codes.Internal)
 			msg = err.Error()
 		}
@@ -792,7 +842,7 @@ func (s *server) MutateRows(req *btpb.MutateRowsRequest, stream btpb.Bigtable_Mu
 			Index:  int64(i),
 			Status: &statpb.Status{Code: code, Message: msg},
 		}
-		r.mu.Unlock()
+		unlock()
 	}
 	return stream.Send(res)
 }
@@ -808,9 +858,8 @@ func (s *server) CheckAndMutateRow(ctx context.Context, req *btpb.CheckAndMutate
 
 	fs := tbl.columnFamilies()
 
-	r := tbl.mutableRow(string(req.RowKey))
-	r.mu.Lock()
-	defer r.mu.Unlock()
+	r, unlock := tbl.lockRow(string(req.RowKey))
+	defer unlock()
 
 	// Figure out which mutation to apply.
 	whichMut := false
@@ -834,7 +883,11 @@ func (s *server) CheckAndMutateRow(ctx context.Context, req *btpb.CheckAndMutate
 		muts = req.TrueMutations
 	}
 
-	if err := applyMutations(tbl, r, muts, fs); err != nil {
+	err := applyMutations(tbl, r, muts, fs)
+	if lerr := s.logRow(req.TableName, r); err == nil {
+		err = lerr
+	}
+	if err != nil {
 		return nil, err
 	}
 	return res, nil
@@ -968,12 +1021,11 @@ func (s *server) ReadModifyWriteRow(ctx context.Context, req *btpb.ReadModifyWri
 	fs := tbl.columnFamilies()
 
 	rowKey := string(req.RowKey)
-	r := tbl.mutableRow(rowKey)
 	resultRow := newRow(rowKey) // copy of updated cells
 
 	// This must be done before the row lock, acquired below, is released.
-	r.mu.Lock()
-	defer r.mu.Unlock()
+	r, unlock := tbl.lockRow(rowKey)
+	defer unlock()
 	// Assume all mutations apply to the most recent version of the cell.
 	// TODO(dsymonds): Verify this assumption and document it in the proto.
 	for _, rule := range req.Rules {
@@ -1027,6 +1079,9 @@ func (s *server) ReadModifyWriteRow(ctx context.Context, req *btpb.ReadModifyWri
 		resultFamily.cellsByColumn(col)           // create the column
 		resultFamily.cells[col] = []cell{newCell} // overwrite the cells
 	}
+	if err := s.logRow(req.TableName, r); err != nil {
+		return nil, err
+	}
 
 	// Build the response using the result row
 	res := &btpb.Row{
@@ -1196,6 +1251,29 @@ func (t *table) mutableRow(key string) *row {
 	return r
 }
 
+// lockRow returns the row with the given key, creating it if needed, with
+// t.mu held for reading and the row locked. The caller must call unlock
+// when it is done with the row.
+//
+// Holding t.mu keeps the row in the table while it is written and logged,
+// so its record in the write-ahead log cannot follow that of a concurrent
+// DropRowRange, which holds t.mu for writing.
+func (t *table) lockRow(key string) (r *row, unlock func()) {
+	for {
+		r = t.mutableRow(key)
+		t.mu.RLock()
+		if i := t.rows.Get(btreeKey(key)); i != nil && i.(*row) == r {
+			r.mu.Lock()
+			return r, func() {
+				r.mu.Unlock()
+				t.mu.RUnlock()
+			}
+		}
+		// The row was dropped before we locked the table.
+		t.mu.RUnlock()
+	}
+}
+
 func (t *table) gc() {
 	// This method doesn't add or remove rows, so we only need a read lock for the table.
 	t.mu.RLock()
@@ -15,10 +15,17 @@
 package bttest
 
 import (
+	"bytes"
 	"context"
 	"regexp"
+	"sort"
+	"strconv"
+	"strings"
 
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
 	"github.com/golang/protobuf/ptypes/empty"
+	"github.com/golang/protobuf/ptypes/timestamp"
 	btapb "google.golang.org/genproto/googleapis/bigtable/admin/v2"
 	iampb "google.golang.org/genproto/googleapis/iam/v1"
 	"google.golang.org/genproto/googleapis/longrunning"
@@ -28,26 +35,297 @@ import (
 
 var _ btapb.BigtableInstanceAdminServer = (*server)(nil)
 
-var errUnimplemented = status.Error(codes.Unimplemented, "unimplemented feature")
+// Defaults for resources created by the instance admin API.
+const (
+	defaultAppProfileID = "default"
+	minResourceIDLen    = 6
+	maxInstanceIDLen    = 33
+	maxClusterIDLen     = 30
+)
+
+var (
+	regProjectName  = regexp.MustCompile(`^projects/[^/]+$`)
+	regLocationName = regexp.MustCompile(`^projects/[^/]+/locations/[^/]+$`)
+	regResourceID   = regexp.MustCompile(`^[a-z][a-z0-9\-]+[a-z0-9]$`)
+	regAppProfileID = regexp.MustCompile(`^[_a-zA-Z0-9][-_.a-zA-Z0-9]*$`)
+)
+
+// validateResourceID checks the ID of a new instance or cluster.
+func validateResourceID(kind, id string, maxLen int) error {
+	if len(id) < minResourceIDLen || len(id) > maxLen || !regResourceID.MatchString(id) {
+		return status.Errorf(codes.InvalidArgument,
+			"invalid %s ID %q: must be %d to %d lowercase letters, digits or hyphens, starting with a letter",
+			kind, id, minResourceIDLen, maxLen)
+	}
+	return nil
+}
+
+func validateDisplayName(name string) error {
+	if n := len(name); n < 4 || n > 30 {
+		return status.Errorf(codes.InvalidArgument, "display name %q must be 4 to 30 characters", name)
+	}
+	return nil
+}
+
+// validateCluster checks the settings of a new cluster of an instance of the
+// given type.
+func validateCluster(c *btapb.Cluster, typ btapb.Instance_Type) error {
+	if !regLocationName.MatchString(c.GetLocation()) {
+		return status.Errorf(codes.InvalidArgument, "invalid cluster location %q", c.GetLocation())
+	}
+	return validateServeNodes(c.GetServeNodes(), typ)
+}
+
+func validateServeNodes(n int32, typ btapb.Instance_Type) error {
+	if typ == btapb.Instance_DEVELOPMENT {
+		if n != 0 {
+			return status.Error(codes.InvalidArgument, "serve_nodes must not be set for development instances")
+		}
+		return nil
+	}
+	if n < 1 {
+		return status.Errorf(codes.InvalidArgument, "serve_nodes must be at least 1 for production instances, got %d", n)
+	}
+	return nil
+}
+
+// initInstanceAdmin creates the maps of the instance admin model, which are
+// nil in servers that are not created by NewServer. It requires s.mu.
+func (s *server) initInstanceAdmin() {
+	if s.instances == nil {
+		s.instances = make(map[string]*btapb.Instance)
+	}
+	if s.clusters == nil {
+		s.clusters = make(map[string]*btapb.Cluster)
+	}
+	if s.appProfiles == nil {
+		s.appProfiles = make(map[string]*btapb.AppProfile)
+	}
+	if s.iamPolicies == nil {
+		s.iamPolicies = make(map[string]*iampb.Policy)
+	}
+}
+
+// newEtag returns an etag that differs from all those previously returned.
+// It requires s.mu.
+func (s *server) newEtag() string {
+	s.etags++
+	return strconv.FormatInt(s.etags, 10)
+}
+
+// instanceClusters returns the names of the clusters of an instance, in
+// order. It requires s.mu.
+func (s *server) instanceClusters(instance string) []string {
+	var names []string
+	for name := range s.clusters {
+		if strings.HasPrefix(name, instance+"/clusters/") {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// instanceOf returns the name of the instance of a cluster or app profile.
+func instanceOf(name string) string {
+	for _, coll := range []string{"/clusters/", "/appProfiles/"} {
+		if i := strings.Index(name, coll); i >= 0 {
+			return name[:i]
+		}
+	}
+	return name
+}
+
+// operationTimes returns the request and finish times of an operation that
+// completes immediately.
+func operationTimes() (*timestamp.Timestamp, error) {
+	return ptypes.TimestampProto(timeNow())
+}
 
 func (s *server) CreateInstance(ctx context.Context, req *btapb.CreateInstanceRequest) (*longrunning.Operation, error) {
-	return nil, errUnimplemented
+	if !regProjectName.MatchString(req.Parent) {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid parent %q", req.Parent)
+	}
+	if err := validateResourceID("instance", req.InstanceId, maxInstanceIDLen); err != nil {
+		return nil, err
+	}
+	if req.Instance == nil {
+		return nil, status.Error(codes.InvalidArgument, "instance is required")
+	}
+	if err := validateDisplayName(req.Instance.DisplayName); err != nil {
+		return nil, err
+	}
+	typ := req.Instance.Type
+	if typ == btapb.Instance_TYPE_UNSPECIFIED {
+		typ = btapb.Instance_PRODUCTION
+	}
+	if len(req.Clusters) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "at least one cluster is required")
+	}
+	if typ == btapb.Instance_DEVELOPMENT && len(req.Clusters) > 1 {
+		return nil, status.Error(codes.InvalidArgument, "development instances can have only one cluster")
+	}
+	for id, c := range req.Clusters {
+		if err := validateResourceID("cluster", id, maxClusterIDLen); err != nil {
+			return nil, err
+		}
+		if err := validateCluster(c, typ); err != nil {
+			return nil, err
+		}
+	}
+	now, err := operationTimes()
+	if err != nil {
+		return nil, err
+	}
+	name := req.Parent + "/instances/" + req.InstanceId
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.initInstanceAdmin()
+	if _, ok := s.instances[name]; ok {
+		return nil, status.Errorf(codes.AlreadyExists, "instance %q already exists", name)
+	}
+	inst := proto.Clone(req.Instance).(*btapb.Instance)
+	inst.Name = name
+	inst.Type = typ
+	inst.State = btapb.Instance_READY
+	s.instances[name] = inst
+	var clusterIDs []string
+	for id, c := range req.Clusters {
+		s.clusters[name+"/clusters/"+id] = newCluster(name+"/clusters/"+id, c)
+		clusterIDs = append(clusterIDs, id)
+	}
+	// As in production, every instance has a default app profile. It routes
+	// to the only cluster of a single-cluster instance.
+	ap := &btapb.AppProfile{
+		Name: name + "/appProfiles/" + defaultAppProfileID,
+		Etag: s.newEtag(),
+	}
+	if len(clusterIDs) == 1 {
+		ap.RoutingPolicy = &btapb.AppProfile_SingleClusterRouting_{SingleClusterRouting: &btapb.AppProfile_SingleClusterRouting{
+			ClusterId:                clusterIDs[0],
+			AllowTransactionalWrites: true,
+		}}
+	} else {
+		ap.RoutingPolicy = &btapb.AppProfile_MultiClusterRoutingUseAny_{MultiClusterRoutingUseAny: &btapb.AppProfile_MultiClusterRoutingUseAny{}}
+	}
+	s.appProfiles[ap.Name] = ap
+	md := &btapb.CreateInstanceMetadata{OriginalRequest: req, RequestTime: now, FinishTime: now}
+	return doneOperation(name, md, inst)
+}
+
+// newCluster returns a ready cluster with the settings of c.
+func newCluster(name string, c *btapb.Cluster) *btapb.Cluster {
+	nc := proto.Clone(c).(*btapb.Cluster)
+	nc.Name = name
+	nc.State = btapb.Cluster_READY
+	if nc.DefaultStorageType == btapb.StorageType_STORAGE_TYPE_UNSPECIFIED {
+		nc.DefaultStorageType = btapb.StorageType_SSD
+	}
+	return nc
 }
 
 func (s *server) GetInstance(ctx context.Context, req *btapb.GetInstanceRequest) (*btapb.Instance, error) {
-	return nil, errUnimplemented
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	inst, ok := s.instances[req.Name]
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "instance %q not found", req.Name)
+	}
+	return proto.Clone(inst).(*btapb.Instance), nil
 }
 
 func (s *server) ListInstances(ctx context.Context, req *btapb.ListInstancesRequest) (*btapb.ListInstancesResponse, error) {
-	return nil, errUnimplemented
+	if !regProjectName.MatchString(req.Parent) {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid parent %q", req.Parent)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var names []string
+	for name := range s.instances {
+		if strings.HasPrefix(name, req.Parent+"/instances/") {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	res := &btapb.ListInstancesResponse{}
+	for _, name := range names {
+		res.Instances = append(res.Instances, proto.Clone(s.instances[name]).(*btapb.Instance))
+	}
+	return res, nil
 }
 
 func (s *server) UpdateInstance(ctx context.Context, req *btapb.Instance) (*btapb.Instance, error) {
-	return nil, errUnimplemented
+	paths := []string{"display_name", "labels"}
+	if req.Type != btapb.Instance_TYPE_UNSPECIFIED {
+		paths = append(paths, "type")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.updateInstance(req, paths)
 }
 
 func (s *server) PartialUpdateInstance(ctx context.Context, req *btapb.PartialUpdateInstanceRequest) (*longrunning.Operation, error) {
-	return nil, errUnimplemented
+	if len(req.GetUpdateMask().GetPaths()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "update_mask is required")
+	}
+	if req.Instance == nil {
+		return nil, status.Error(codes.InvalidArgument, "instance is required")
+	}
+	now, err := operationTimes()
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	inst, err := s.updateInstance(req.Instance, req.UpdateMask.Paths)
+	if err != nil {
+		return nil, err
+	}
+	md := &btapb.UpdateInstanceMetadata{OriginalRequest: req, RequestTime: now, FinishTime: now}
+	return doneOperation(inst.Name, md, inst)
+}
+
+// updateInstance sets the fields of an instance named by paths to their
+// values in req, and returns a copy of the updated instance. It requires
+// s.mu.
+func (s *server) updateInstance(req *btapb.Instance, paths []string) (*btapb.Instance, error) {
+	old, ok := s.instances[req.Name]
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "instance %q not found", req.Name)
+	}
+	inst := proto.Clone(old).(*btapb.Instance)
+	for _, path := range paths {
+		switch path {
+		case "display_name":
+			if err := validateDisplayName(req.DisplayName); err != nil {
+				return nil, err
+			}
+			inst.DisplayName = req.DisplayName
+		case "labels":
+			inst.Labels = req.Labels
+		case "type":
+			switch {
+			case req.Type == btapb.Instance_TYPE_UNSPECIFIED:
+				return nil, status.Error(codes.InvalidArgument, "instance type must be specified")
+			case inst.Type == btapb.Instance_PRODUCTION && req.Type == btapb.Instance_DEVELOPMENT:
+				return nil, status.Error(codes.InvalidArgument, "cannot change a production instance to a development instance")
+			}
+			inst.Type = req.Type
+		default:
+			return nil, status.Errorf(codes.InvalidArgument, "unsupported update_mask path %q", path)
+		}
+	}
+	if old.Type == btapb.Instance_DEVELOPMENT && inst.Type == btapb.Instance_PRODUCTION {
+		// Upgraded clusters get the minimum number of nodes.
+		for _, name := range s.instanceClusters(inst.Name) {
+			if c := s.clusters[name]; c.ServeNodes == 0 {
+				c.ServeNodes = 1
+			}
+		}
+	}
+	s.instances[req.Name] = inst
+	return proto.Clone(inst).(*btapb.Instance), nil
 }
 
 var (
@@ -74,6 +352,27 @@ func (s *server) DeleteInstance(ctx context.Context, req *btapb.DeleteInstanceRe
 		return nil, status.Errorf(codes.NotFound, "instance %q not found", name)
 	}
 
+	// Delete the instance's clusters, app profiles and tables.
+	for n := range s.clusters {
+		if instanceOf(n) == name {
+			delete(s.clusters, n)
+		}
+	}
+	for n := range s.appProfiles {
+		if instanceOf(n) == name {
+			delete(s.appProfiles, n)
+		}
+	}
+	for n := range s.tables {
+		if strings.HasPrefix(n, name+"/tables/") {
+			delete(s.tables, n)
+			if err := s.logDeleteTable(n); err != nil {
+				return nil, err
+			}
+		}
+	}
+	delete(s.iamPolicies, name)
+
 	// Then finally remove the instance.
 	delete(s.instances, name)
 
@@ -81,53 +380,319 @@ func (s *server) DeleteInstance(ctx context.Context, req *btapb.DeleteInstanceRe
 }
 
 func (s *server) CreateCluster(ctx context.Context, req *btapb.CreateClusterRequest) (*longrunning.Operation, error) {
-	return nil, errUnimplemented
+	if err := validateResourceID("cluster", req.ClusterId, maxClusterIDLen); err != nil {
+		return nil, err
+	}
+	if req.Cluster == nil {
+		return nil, status.Error(codes.InvalidArgument, "cluster is required")
+	}
+	now, err := operationTimes()
+	if err != nil {
+		return nil, err
+	}
+	name := req.Parent + "/clusters/" + req.ClusterId
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.initInstanceAdmin()
+	inst, ok := s.instances[req.Parent]
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "instance %q not found", req.Parent)
+	}
+	if _, ok := s.clusters[name]; ok {
+		return nil, status.Errorf(codes.AlreadyExists, "cluster %q already exists", name)
+	}
+	if inst.Type == btapb.Instance_DEVELOPMENT {
+		return nil, status.Error(codes.FailedPrecondition, "development instances can have only one cluster")
+	}
+	if err := validateCluster(req.Cluster, inst.Type); err != nil {
+		return nil, err
+	}
+	c := newCluster(name, req.Cluster)
+	s.clusters[name] = c
+	md := &btapb.CreateClusterMetadata{OriginalRequest: req, RequestTime: now, FinishTime: now}
+	return doneOperation(name, md, c)
 }
 
 func (s *server) GetCluster(ctx context.Context, req *btapb.GetClusterRequest) (*btapb.Cluster, error) {
-	return nil, errUnimplemented
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c, ok := s.clusters[req.Name]
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "cluster %q not found", req.Name)
+	}
+	return proto.Clone(c).(*btapb.Cluster), nil
 }
 
 func (s *server) ListClusters(ctx context.Context, req *btapb.ListClustersRequest) (*btapb.ListClustersResponse, error) {
-	return nil, errUnimplemented
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var names []string
+	if strings.HasSuffix(req.Parent, "/instances/-") {
+		// The clusters of all the instances of the project.
+		prefix := strings.TrimSuffix(req.Parent, "-")
+		for name := range s.clusters {
+			if strings.HasPrefix(name, prefix) {
+				names = append(names, name)
+			}
+		}
+		sort.Strings(names)
+	} else {
+		if _, ok := s.instances[req.Parent]; !ok {
+			return nil, status.Errorf(codes.NotFound, "instance %q not found", req.Parent)
+		}
+		names = s.instanceClusters(req.Parent)
+	}
+	res := &btapb.ListClustersResponse{}
+	for _, name := range names {
+		res.Clusters = append(res.Clusters, proto.Clone(s.clusters[name]).(*btapb.Cluster))
+	}
+	return res, nil
 }
 
 func (s *server) UpdateCluster(ctx context.Context, req *btapb.Cluster) (*longrunning.Operation, error) {
-	return nil, errUnimplemented
+	now, err := operationTimes()
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c, ok := s.clusters[req.Name]
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "cluster %q not found", req.Name)
+	}
+	if err := validateServeNodes(req.ServeNodes, s.instances[instanceOf(req.Name)].GetType()); err != nil {
+		return nil, err
+	}
+	// Only the number of nodes of a cluster can be changed.
+	c.ServeNodes = req.ServeNodes
+	md := &btapb.UpdateClusterMetadata{OriginalRequest: req, RequestTime: now, FinishTime: now}
+	return doneOperation(req.Name, md, c)
 }
 
 func (s *server) DeleteCluster(ctx context.Context, req *btapb.DeleteClusterRequest) (*empty.Empty, error) {
-	return nil, errUnimplemented
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.clusters[req.Name]; !ok {
+		return nil, status.Errorf(codes.NotFound, "cluster %q not found", req.Name)
+	}
+	instance := instanceOf(req.Name)
+	if len(s.instanceClusters(instance)) == 1 {
+		return nil, status.Errorf(codes.FailedPrecondition, "cannot delete %q, the last cluster of its instance", req.Name)
+	}
+	clusterID := req.Name[strings.LastIndex(req.Name, "/")+1:]
+	for name, ap := range s.appProfiles {
+		if instanceOf(name) == instance && ap.GetSingleClusterRouting().GetClusterId() == clusterID {
+			return nil, status.Errorf(codes.FailedPrecondition, "cannot delete %q: app profile %q routes to it", req.Name, name)
+		}
+	}
+	delete(s.clusters, req.Name)
+	return new(empty.Empty), nil
+}
+
+// validateRoutingPolicy checks the routing policy of an app profile of an
+// instance. It requires s.mu.
+func (s *server) validateRoutingPolicy(instance string, ap *btapb.AppProfile, ignoreWarnings bool) error {
+	switch p := ap.RoutingPolicy.(type) {
+	case *btapb.AppProfile_SingleClusterRouting_:
+		id := p.SingleClusterRouting.GetClusterId()
+		if _, ok := s.clusters[instance+"/clusters/"+id]; !ok {
+			return status.Errorf(codes.InvalidArgument, "cluster %q not found in instance %q", id, instance)
+		}
+	case *btapb.AppProfile_MultiClusterRoutingUseAny_:
+		if len(s.instanceClusters(instance)) < 2 && !ignoreWarnings {
+			return status.Errorf(codes.FailedPrecondition,
+				"instance %q has only one cluster, so multi-cluster routing has no effect; set ignore_warnings to proceed", instance)
+		}
+	default:
+		return status.Error(codes.InvalidArgument, "a routing policy is required")
+	}
+	return nil
 }
 
 func (s *server) CreateAppProfile(ctx context.Context, req *btapb.CreateAppProfileRequest) (*btapb.AppProfile, error) {
-	return nil, errUnimplemented
+	if !regAppProfileID.MatchString(req.AppProfileId) {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid app profile ID %q", req.AppProfileId)
+	}
+	if req.AppProfile == nil {
+		return nil, status.Error(codes.InvalidArgument, "app profile is required")
+	}
+	name := req.Parent + "/appProfiles/" + req.AppProfileId
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.initInstanceAdmin()
+	if _, ok := s.instances[req.Parent]; !ok {
+		return nil, status.Errorf(codes.NotFound, "instance %q not found", req.Parent)
+	}
+	if _, ok := s.appProfiles[name]; ok {
+		return nil, status.Errorf(codes.AlreadyExists, "app profile %q already exists", name)
+	}
+	if err := s.validateRoutingPolicy(req.Parent, req.AppProfile, req.IgnoreWarnings); err != nil {
+		return nil, err
+	}
+	ap := proto.Clone(req.AppProfile).(*btapb.AppProfile)
+	ap.Name = name
+	ap.Etag = s.newEtag()
+	s.appProfiles[name] = ap
+	return proto.Clone(ap).(*btapb.AppProfile), nil
 }
 
 func (s *server) GetAppProfile(ctx context.Context, req *btapb.GetAppProfileRequest) (*btapb.AppProfile, error) {
-	return nil, errUnimplemented
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ap, ok := s.appProfiles[req.Name]
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "app profile %q not found", req.Name)
+	}
+	return proto.Clone(ap).(*btapb.AppProfile), nil
 }
 
 func (s *server) ListAppProfiles(ctx context.Context, req *btapb.ListAppProfilesRequest) (*btapb.ListAppProfilesResponse, error) {
-	return nil, errUnimplemented
+	prefix := req.Parent + "/appProfiles/"
+	all := strings.HasSuffix(req.Parent, "/instances/-")
+	if all {
+		// The app profiles of all the instances of the project.
+		prefix = strings.TrimSuffix(req.Parent, "-")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.instances[req.Parent]; !ok && !all {
+		return nil, status.Errorf(codes.NotFound, "instance %q not found", req.Parent)
+	}
+	var names []string
+	for name := range s.appProfiles {
+		if strings.HasPrefix(name, prefix) && name > req.PageToken {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	res := &btapb.ListAppProfilesResponse{}
+	if req.PageSize > 0 && len(names) > int(req.PageSize) {
+		names = names[:req.PageSize]
+		res.NextPageToken = names[len(names)-1]
+	}
+	for _, name := range names {
+		res.AppProfiles = append(res.AppProfiles, proto.Clone(s.appProfiles[name]).(*btapb.AppProfile))
+	}
+	return res, nil
 }
 
 func (s *server) UpdateAppProfile(ctx context.Context, req *btapb.UpdateAppProfileRequest) (*longrunning.Operation, error) {
-	return nil, errUnimplemented
+	if len(req.GetUpdateMask().GetPaths()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "update_mask is required")
+	}
+	if req.AppProfile == nil {
+		return nil, status.Error(codes.InvalidArgument, "app profile is required")
+	}
+	name := req.AppProfile.Name
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	old, ok := s.appProfiles[name]
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "app profile %q not found", name)
+	}
+	if req.AppProfile.Etag != "" && req.AppProfile.Etag != old.Etag {
+		return nil, status.Errorf(codes.Aborted, "app profile %q was modified concurrently: etag %q does not match %q",
+			name, req.AppProfile.Etag, old.Etag)
+	}
+	ap := proto.Clone(old).(*btapb.AppProfile)
+	routingChanged := false
+	for _, path := range req.UpdateMask.Paths {
+		switch path {
+		case "description":
+			ap.Description = req.AppProfile.Description
+		case "multi_cluster_routing_use_any":
+			if req.AppProfile.GetMultiClusterRoutingUseAny() == nil {
+				return nil, status.Errorf(codes.InvalidArgument, "update_mask path %q requires multi_cluster_routing_use_any", path)
+			}
+			ap.RoutingPolicy = req.AppProfile.RoutingPolicy
+			routingChanged = true
+		case "single_cluster_routing":
+			if req.AppProfile.GetSingleClusterRouting() == nil {
+				return nil, status.Errorf(codes.InvalidArgument, "update_mask path %q requires single_cluster_routing", path)
+			}
+			ap.RoutingPolicy = req.AppProfile.RoutingPolicy
+			routingChanged = true
+		default:
+			return nil, status.Errorf(codes.InvalidArgument, "unsupported update_mask path %q", path)
+		}
+	}
+	if routingChanged {
+		if err := s.validateRoutingPolicy(instanceOf(name), ap, req.IgnoreWarnings); err != nil {
+			return nil, err
+		}
+	}
+	ap.Etag = s.newEtag()
+	s.appProfiles[name] = ap
+	return doneOperation(name, &btapb.UpdateAppProfileMetadata{}, ap)
 }
 
 func (s *server) DeleteAppProfile(ctx context.Context, req *btapb.DeleteAppProfileRequest) (*empty.Empty, error) {
-	return nil, errUnimplemented
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.appProfiles[req.Name]; !ok {
+		return nil, status.Errorf(codes.NotFound, "app profile %q not found", req.Name)
+	}
+	delete(s.appProfiles, req.Name)
+	return new(empty.Empty), nil
+}
+
+// iamPolicy returns the IAM policy of an instance, which is empty until it is
+// first set. It requires s.mu.
+func (s *server) iamPolicy(resource string) (*iampb.Policy, error) {
+	if _, ok := s.instances[resource]; !ok {
+		return nil, status.Errorf(codes.NotFound, "instance %q not found", resource)
+	}
+	s.initInstanceAdmin()
+	p, ok := s.iamPolicies[resource]
+	if !ok {
+		p = &iampb.Policy{Etag: []byte(s.newEtag())}
+		s.iamPolicies[resource] = p
+	}
+	return p, nil
 }
 
 func (s *server) GetIamPolicy(ctx context.Context, req *iampb.GetIamPolicyRequest) (*iampb.Policy, error) {
-	return nil, errUnimplemented
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	p, err := s.iamPolicy(req.Resource)
+	if err != nil {
+		return nil, err
+	}
+	return proto.Clone(p).(*iampb.Policy), nil
 }
 
+// SetIamPolicy replaces the policy of an instance. If the new policy has an
+// etag, it must match the current one, as in production.
 func (s *server) SetIamPolicy(ctx context.Context, req *iampb.SetIamPolicyRequest) (*iampb.Policy, error) {
-	return nil, errUnimplemented
+	if req.Policy == nil {
+		return nil, status.Error(codes.InvalidArgument, "policy is required")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	old, err := s.iamPolicy(req.Resource)
+	if err != nil {
+		return nil, err
+	}
+	if len(req.Policy.Etag) > 0 && !bytes.Equal(req.Policy.Etag, old.Etag) {
+		return nil, status.Errorf(codes.Aborted, "the policy of %q was modified concurrently", req.Resource)
+	}
+	p := proto.Clone(req.Policy).(*iampb.Policy)
+	p.Etag = []byte(s.newEtag())
+	s.iamPolicies[req.Resource] = p
+	return proto.Clone(p).(*iampb.Policy), nil
 }
 
+// TestIamPermissions grants every permission, since the emulator does not
+// check them.
 func (s *server) TestIamPermissions(ctx context.Context, req *iampb.TestIamPermissionsRequest) (*iampb.TestIamPermissionsResponse, error) {
-	return nil, errUnimplemented
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.instances[req.Resource]; !ok {
+		return nil, status.Errorf(codes.NotFound, "instance %q not found", req.Resource)
+	}
+	return &iampb.TestIamPermissionsResponse{Permissions: req.Permissions}, nil
 }
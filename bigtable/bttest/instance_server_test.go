@@ -15,10 +15,16 @@
 package bttest
 
 import (
+	"bytes"
 	"context"
+	"reflect"
 	"testing"
 
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
 	btapb "google.golang.org/genproto/googleapis/bigtable/admin/v2"
+	iampb "google.golang.org/genproto/googleapis/iam/v1"
+	field_mask "google.golang.org/genproto/protobuf/field_mask"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 )
@@ -86,3 +92,277 @@ func TestDeleteInstance(t *testing.T) {
 		}
 	}
 }
+
+func TestInstanceAdmin(t *testing.T) {
+	ctx := context.Background()
+	s := &server{}
+	const (
+		project  = "projects/my-project"
+		instance = project + "/instances/my-instance"
+	)
+	createReq := &btapb.CreateInstanceRequest{
+		Parent:     project,
+		InstanceId: "my-instance",
+		Instance:   &btapb.Instance{DisplayName: "My instance", Type: btapb.Instance_DEVELOPMENT},
+		Clusters: map[string]*btapb.Cluster{
+			"my-cluster": {Location: project + "/locations/us-central1-b"},
+		},
+	}
+	op, err := s.CreateInstance(ctx, createReq)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !op.Done {
+		t.Error("CreateInstance operation not done")
+	}
+	if _, err := s.CreateInstance(ctx, createReq); status.Code(err) != codes.AlreadyExists {
+		t.Errorf("duplicate instance: got %v, want AlreadyExists", err)
+	}
+	inst, err := s.GetInstance(ctx, &btapb.GetInstanceRequest{Name: instance})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if inst.State != btapb.Instance_READY || inst.DisplayName != "My instance" {
+		t.Errorf("got instance %v", inst)
+	}
+	aps, err := s.ListAppProfiles(ctx, &btapb.ListAppProfilesRequest{Parent: instance})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(aps.AppProfiles) != 1 || aps.AppProfiles[0].GetSingleClusterRouting().GetClusterId() != "my-cluster" {
+		t.Errorf("got app profiles %v, want the default profile", aps.AppProfiles)
+	}
+
+	// Development instances have one cluster, until they are upgraded.
+	clusterReq := &btapb.CreateClusterRequest{
+		Parent:    instance,
+		ClusterId: "other-cluster",
+		Cluster:   &btapb.Cluster{Location: project + "/locations/us-east1-c", ServeNodes: 3},
+	}
+	if _, err := s.CreateCluster(ctx, clusterReq); status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("second development cluster: got %v, want FailedPrecondition", err)
+	}
+	if _, err := s.PartialUpdateInstance(ctx, &btapb.PartialUpdateInstanceRequest{
+		Instance:   &btapb.Instance{Name: instance, Type: btapb.Instance_PRODUCTION, DisplayName: "x"},
+		UpdateMask: &field_mask.FieldMask{Paths: []string{"type"}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.PartialUpdateInstance(ctx, &btapb.PartialUpdateInstanceRequest{
+		Instance:   &btapb.Instance{Name: instance, Type: btapb.Instance_DEVELOPMENT},
+		UpdateMask: &field_mask.FieldMask{Paths: []string{"type"}},
+	}); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("downgrade: got %v, want InvalidArgument", err)
+	}
+	if _, err := s.CreateCluster(ctx, clusterReq); err != nil {
+		t.Fatal(err)
+	}
+	cl, err := s.ListClusters(ctx, &btapb.ListClustersRequest{Parent: project + "/instances/-"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cl.Clusters) != 2 || cl.Clusters[0].ServeNodes != 1 || cl.Clusters[1].ServeNodes != 3 {
+		t.Errorf("got clusters %v", cl.Clusters)
+	}
+	if _, err := s.UpdateCluster(ctx, &btapb.Cluster{Name: instance + "/clusters/other-cluster", ServeNodes: 0}); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("zero nodes: got %v, want InvalidArgument", err)
+	}
+
+	// The default profile routes to my-cluster, so it cannot be deleted.
+	myCluster := &btapb.DeleteClusterRequest{Name: instance + "/clusters/my-cluster"}
+	if _, err := s.DeleteCluster(ctx, myCluster); status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("delete routed cluster: got %v, want FailedPrecondition", err)
+	}
+	def, err := s.GetAppProfile(ctx, &btapb.GetAppProfileRequest{Name: instance + "/appProfiles/default"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	update := &btapb.UpdateAppProfileRequest{
+		AppProfile: &btapb.AppProfile{
+			Name:          def.Name,
+			Etag:          def.Etag,
+			RoutingPolicy: &btapb.AppProfile_MultiClusterRoutingUseAny_{MultiClusterRoutingUseAny: &btapb.AppProfile_MultiClusterRoutingUseAny{}},
+		},
+		UpdateMask: &field_mask.FieldMask{Paths: []string{"multi_cluster_routing_use_any"}},
+	}
+	if _, err := s.UpdateAppProfile(ctx, update); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.UpdateAppProfile(ctx, update); status.Code(err) != codes.Aborted {
+		t.Errorf("stale etag: got %v, want Aborted", err)
+	}
+	if _, err := s.DeleteCluster(ctx, myCluster); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.DeleteCluster(ctx, &btapb.DeleteClusterRequest{Name: instance + "/clusters/other-cluster"}); status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("delete last cluster: got %v, want FailedPrecondition", err)
+	}
+
+	if _, err := s.DeleteInstance(ctx, &btapb.DeleteInstanceRequest{Name: instance}); err != nil {
+		t.Fatal(err)
+	}
+	if len(s.clusters) != 0 || len(s.appProfiles) != 0 {
+		t.Errorf("after DeleteInstance: got clusters %v and app profiles %v", s.clusters, s.appProfiles)
+	}
+}
+
+func TestCreateInstanceValidation(t *testing.T) {
+	ctx := context.Background()
+	s := &server{}
+	valid := func() *btapb.CreateInstanceRequest {
+		return &btapb.CreateInstanceRequest{
+			Parent:     "projects/p",
+			InstanceId: "my-instance",
+			Instance:   &btapb.Instance{DisplayName: "My instance"},
+			Clusters: map[string]*btapb.Cluster{
+				"my-cluster": {Location: "projects/p/locations/us-central1-b", ServeNodes: 3},
+			},
+		}
+	}
+	for _, test := range []struct {
+		desc   string
+		modify func(*btapb.CreateInstanceRequest)
+	}{
+		{"bad parent", func(r *btapb.CreateInstanceRequest) { r.Parent = "p" }},
+		{"short ID", func(r *btapb.CreateInstanceRequest) { r.InstanceId = "abc" }},
+		{"uppercase ID", func(r *btapb.CreateInstanceRequest) { r.InstanceId = "My-instance" }},
+		{"short display name", func(r *btapb.CreateInstanceRequest) { r.Instance.DisplayName = "x" }},
+		{"no clusters", func(r *btapb.CreateInstanceRequest) { r.Clusters = nil }},
+		{"no location", func(r *btapb.CreateInstanceRequest) { r.Clusters["my-cluster"].Location = "" }},
+		{"no nodes", func(r *btapb.CreateInstanceRequest) { r.Clusters["my-cluster"].ServeNodes = 0 }},
+		{"development nodes", func(r *btapb.CreateInstanceRequest) { r.Instance.Type = btapb.Instance_DEVELOPMENT }},
+	} {
+		req := valid()
+		test.modify(req)
+		if _, err := s.CreateInstance(ctx, req); status.Code(err) != codes.InvalidArgument {
+			t.Errorf("%s: got %v, want InvalidArgument", test.desc, err)
+		}
+	}
+	if len(s.instances) != 0 {
+		t.Errorf("invalid requests created instances %v", s.instances)
+	}
+}
+
+func TestAppProfiles(t *testing.T) {
+	ctx := context.Background()
+	s := &server{}
+	const instance = "projects/p/instances/my-instance"
+	if _, err := s.CreateInstance(ctx, &btapb.CreateInstanceRequest{
+		Parent:     "projects/p",
+		InstanceId: "my-instance",
+		Instance:   &btapb.Instance{DisplayName: "My instance"},
+		Clusters: map[string]*btapb.Cluster{
+			"my-cluster": {Location: "projects/p/locations/us-central1-b", ServeNodes: 1},
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	multi := &btapb.AppProfile{
+		RoutingPolicy: &btapb.AppProfile_MultiClusterRoutingUseAny_{MultiClusterRoutingUseAny: &btapb.AppProfile_MultiClusterRoutingUseAny{}},
+	}
+	req := &btapb.CreateAppProfileRequest{Parent: instance, AppProfileId: "multi", AppProfile: multi}
+	if _, err := s.CreateAppProfile(ctx, req); status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("multi-cluster routing with one cluster: got %v, want FailedPrecondition", err)
+	}
+	req.IgnoreWarnings = true
+	if _, err := s.CreateAppProfile(ctx, req); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.CreateAppProfile(ctx, &btapb.CreateAppProfileRequest{
+		Parent:       instance,
+		AppProfileId: "single",
+		AppProfile: &btapb.AppProfile{
+			RoutingPolicy: &btapb.AppProfile_SingleClusterRouting_{SingleClusterRouting: &btapb.AppProfile_SingleClusterRouting{ClusterId: "no-such-cluster"}},
+		},
+	}); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("unknown cluster: got %v, want InvalidArgument", err)
+	}
+	if _, err := s.CreateAppProfile(ctx, &btapb.CreateAppProfileRequest{
+		Parent:       instance,
+		AppProfileId: "none",
+		AppProfile:   &btapb.AppProfile{},
+	}); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("no routing policy: got %v, want InvalidArgument", err)
+	}
+
+	var names []string
+	listReq := &btapb.ListAppProfilesRequest{Parent: instance, PageSize: 1}
+	for {
+		res, err := s.ListAppProfiles(ctx, listReq)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, ap := range res.AppProfiles {
+			names = append(names, ap.Name)
+		}
+		if res.NextPageToken == "" {
+			break
+		}
+		listReq.PageToken = res.NextPageToken
+	}
+	if want := []string{instance + "/appProfiles/default", instance + "/appProfiles/multi"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("got app profiles %v, want %v", names, want)
+	}
+
+	op, err := s.UpdateAppProfile(ctx, &btapb.UpdateAppProfileRequest{
+		AppProfile: &btapb.AppProfile{Name: instance + "/appProfiles/multi", Description: "new"},
+		UpdateMask: &field_mask.FieldMask{Paths: []string{"description"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ap btapb.AppProfile
+	if err := ptypes.UnmarshalAny(op.GetResponse(), &ap); err != nil {
+		t.Fatal(err)
+	}
+	if ap.Description != "new" || ap.GetMultiClusterRoutingUseAny() == nil {
+		t.Errorf("updated app profile: got %v", &ap)
+	}
+	if _, err := s.DeleteAppProfile(ctx, &btapb.DeleteAppProfileRequest{Name: ap.Name}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.GetAppProfile(ctx, &btapb.GetAppProfileRequest{Name: ap.Name}); status.Code(err) != codes.NotFound {
+		t.Errorf("deleted app profile: got %v, want NotFound", err)
+	}
+}
+
+func TestInstanceIAM(t *testing.T) {
+	ctx := context.Background()
+	const instance = "projects/p/instances/my-instance"
+	s := &server{instances: map[string]*btapb.Instance{instance: {Name: instance}}}
+
+	if _, err := s.GetIamPolicy(ctx, &iampb.GetIamPolicyRequest{Resource: "projects/p/instances/other"}); status.Code(err) != codes.NotFound {
+		t.Errorf("unknown instance: got %v, want NotFound", err)
+	}
+	p, err := s.GetIamPolicy(ctx, &iampb.GetIamPolicyRequest{Resource: instance})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Bindings = []*iampb.Binding{{Role: "roles/bigtable.reader", Members: []string{"user:a@example.com"}}}
+	p2, err := s.SetIamPolicy(ctx, &iampb.SetIamPolicyRequest{Resource: instance, Policy: p})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(p2.Etag, p.Etag) || len(p2.Bindings) != 1 {
+		t.Errorf("SetIamPolicy: got %v", p2)
+	}
+	// Setting a policy read before the last change fails.
+	if _, err := s.SetIamPolicy(ctx, &iampb.SetIamPolicyRequest{Resource: instance, Policy: p}); status.Code(err) != codes.Aborted {
+		t.Errorf("stale etag: got %v, want Aborted", err)
+	}
+	got, err := s.GetIamPolicy(ctx, &iampb.GetIamPolicyRequest{Resource: instance})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !proto.Equal(got, p2) {
+		t.Errorf("GetIamPolicy: got %v, want %v", got, p2)
+	}
+	perms := []string{"bigtable.instances.get", "bigtable.tables.create"}
+	res, err := s.TestIamPermissions(ctx, &iampb.TestIamPermissionsRequest{Resource: instance, Permissions: perms})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(res.Permissions, perms) {
+		t.Errorf("TestIamPermissions: got %v, want %v", res.Permissions, perms)
+	}
+}
@@ -0,0 +1,583 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bttest
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/google/btree"
+	btapb "google.golang.org/genproto/googleapis/bigtable/admin/v2"
+)
+
+// WithDataDir returns an option for NewServerWithOptions that stores the
+// server's tables in dir, creating it if necessary. Tables already stored in
+// dir are loaded when the server starts.
+//
+// Changes are appended to a write-ahead log in dir, which is compacted into
+// a single state file every minute, or sooner if it grows large. Server.Close
+// compacts the log, so a server that is shut down cleanly leaves only the
+// state file. Snapshots are not stored.
+//
+// At most one server may use a directory at a time.
+func WithDataDir(dir string) ServerOption {
+	return dataDirOption(dir)
+}
+
+type dataDirOption string
+
+func (d dataDirOption) set(c *serverConfig) { c.dataDir = string(d) }
+
+const (
+	stateFileName  = "state.json"
+	walFileName    = "wal.jsonl"
+	oldWALFileName = "wal.old.jsonl"
+)
+
+// The size at which the write-ahead log is compacted, and the interval at
+// which it is compacted if it is not empty. Variables for testing.
+var (
+	walCompactSize     int64 = 64 << 20
+	walCompactInterval       = time.Minute
+)
+
+// A persister keeps a copy of the server's tables in a directory, as a state
+// file plus a log of the changes made since it was written.
+//
+// Changes are logged after they are made in memory, under the lock of the
+// row or table they change. Row writes also hold the table lock for reading,
+// and DropRowRange holds it for writing, so the records of a table's rows
+// are in the order of the changes. Every record replaces whole rows or table
+// schemas, so replaying a record that is already reflected in the state
+// file has no effect.
+type persister struct {
+	dir string
+	s   *server
+
+	compactMu sync.Mutex // held during compaction
+
+	mu      sync.Mutex // guards the fields below
+	wal     *os.File
+	walSize int64
+
+	compactc chan struct{} // signals compactLoop
+	done     chan struct{} // closed by close
+	wg       sync.WaitGroup
+}
+
+// A walRecord is a line of the write-ahead log.
+type walRecord struct {
+	Op     string     `json:"op"`
+	Table  string     `json:"table"`
+	Schema *tableData `json:"schema,omitempty"` // for opPutTable
+	Row    *rowData   `json:"row,omitempty"`    // for opPutRow
+	Prefix []byte     `json:"prefix,omitempty"` // for opDropRows; empty drops all rows
+}
+
+const (
+	opPutTable    = "table"
+	opDeleteTable = "deleteTable"
+	opPutRow      = "row"
+	opDropRows    = "dropRows"
+)
+
+type tableData struct {
+	Counter  uint64                `json:"counter"`
+	Families map[string]familyData `json:"families"`
+	Rows     []*rowData            `json:"rows,omitempty"`
+}
+
+type familyData struct {
+	Name   string `json:"name"`
+	Order  uint64 `json:"order"`
+	GCRule []byte `json:"gcRule,omitempty"` // an encoded btapb.GcRule
+}
+
+type rowData struct {
+	Key      []byte          `json:"key"`
+	Families []rowFamilyData `json:"families,omitempty"`
+}
+
+type rowFamilyData struct {
+	Name    string       `json:"name"`
+	Order   uint64       `json:"order"`
+	Columns []columnData `json:"columns"`
+}
+
+type columnData struct {
+	Qualifier []byte     `json:"qualifier"`
+	Cells     []cellData `json:"cells"`
+}
+
+type cellData struct {
+	TS    int64  `json:"ts"`
+	Value []byte `json:"value"`
+}
+
+// newPersister loads the tables stored in dir into s, compacts them into a
+// new state file and starts a new write-ahead log.
+func newPersister(dir string, s *server) (*persister, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	p := &persister{
+		dir:      dir,
+		s:        s,
+		compactc: make(chan struct{}, 1),
+		done:     make(chan struct{}),
+	}
+	if err := p.load(); err != nil {
+		return nil, fmt.Errorf("bttest: loading %s: %v", dir, err)
+	}
+	// Write everything loaded to the state file, so the logs can be removed.
+	if err := p.writeState(); err != nil {
+		return nil, err
+	}
+	for _, name := range []string{oldWALFileName, walFileName} {
+		if err := os.Remove(p.path(name)); err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+	wal, err := os.OpenFile(p.path(walFileName), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	p.wal = wal
+	p.wg.Add(1)
+	go p.compactLoop()
+	return p, nil
+}
+
+func (p *persister) path(name string) string {
+	return filepath.Join(p.dir, name)
+}
+
+// load reads the state file and replays the logs into p.s.tables.
+func (p *persister) load() error {
+	buf, err := ioutil.ReadFile(p.path(stateFileName))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err == nil {
+		var state map[string]*tableData
+		if err := json.Unmarshal(buf, &state); err != nil {
+			return fmt.Errorf("%s: %v", stateFileName, err)
+		}
+		for name, td := range state {
+			t, err := tableFromData(td)
+			if err != nil {
+				return err
+			}
+			p.s.tables[name] = t
+		}
+	}
+	// A log left by an interrupted compaction precedes the current one.
+	for _, name := range []string{oldWALFileName, walFileName} {
+		if err := p.replay(name); err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// replay applies the records of the named log to p.s.tables.
+func (p *persister) replay(name string) error {
+	buf, err := ioutil.ReadFile(p.path(name))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	lines := bytes.Split(buf, []byte("\n"))
+	for i, line := range lines {
+		if len(line) == 0 {
+			continue
+		}
+		var rec walRecord
+		if err := json.Unmarshal(line, &rec); err != nil {
+			if i == len(lines)-1 {
+				// The last record was only partly written before a crash.
+				log.Printf("bttest: ignoring incomplete record at end of %s", p.path(name))
+				return nil
+			}
+			return err
+		}
+		if err := applyRecord(p.s.tables, &rec); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// applyRecord applies a log record to tables.
+func applyRecord(tables map[string]*table, rec *walRecord) error {
+	switch rec.Op {
+	case opPutTable:
+		nt, err := tableFromData(rec.Schema)
+		if err != nil {
+			return err
+		}
+		if t, ok := tables[rec.Table]; ok {
+			nt.rows = t.rows
+		}
+		tables[rec.Table] = nt
+	case opDeleteTable:
+		delete(tables, rec.Table)
+	case opPutRow:
+		t, ok := tables[rec.Table]
+		if !ok {
+			// The table was deleted while the row was being written.
+			return nil
+		}
+		r := rec.Row.row()
+		if r.isEmpty() {
+			t.rows.Delete(r)
+		} else {
+			t.rows.ReplaceOrInsert(r)
+		}
+	case opDropRows:
+		if t, ok := tables[rec.Table]; ok {
+			t.dropRows(string(rec.Prefix))
+		}
+	default:
+		return fmt.Errorf("unknown operation %q", rec.Op)
+	}
+	return nil
+}
+
+// append writes a record to the log.
+func (p *persister) append(rec *walRecord) error {
+	buf, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	buf = append(buf, '\n')
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.wal == nil {
+		return fmt.Errorf("bttest: server is closed")
+	}
+	n, err := p.wal.Write(buf)
+	p.walSize += int64(n)
+	if err != nil {
+		return err
+	}
+	if p.walSize >= walCompactSize {
+		select {
+		case p.compactc <- struct{}{}:
+		default: // A compaction is already pending.
+		}
+	}
+	return nil
+}
+
+func (p *persister) compactLoop() {
+	defer p.wg.Done()
+	ticker := time.NewTicker(walCompactInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.compactc:
+		case <-ticker.C:
+			p.mu.Lock()
+			empty := p.walSize == 0
+			p.mu.Unlock()
+			if empty {
+				continue
+			}
+		case <-p.done:
+			return
+		}
+		if err := p.compact(); err != nil {
+			log.Printf("bttest: compacting %s: %v", p.dir, err)
+		}
+	}
+}
+
+// compact writes the current tables to the state file and discards the log.
+func (p *persister) compact() error {
+	p.compactMu.Lock()
+	defer p.compactMu.Unlock()
+
+	// Start a new log. Changes logged from now on may or may not be in the
+	// state we write, so their records must be kept. If a previous
+	// compaction failed, the old log is still needed, and the current one
+	// is kept too.
+	oldPath := p.path(oldWALFileName)
+	if _, err := os.Stat(oldPath); os.IsNotExist(err) {
+		p.mu.Lock()
+		err := p.rotate()
+		p.mu.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+	if err := p.writeState(); err != nil {
+		return err
+	}
+	if err := os.Remove(oldPath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// rotate renames the log and starts a new one. p.mu must be held.
+func (p *persister) rotate() error {
+	if err := p.wal.Close(); err != nil {
+		return err
+	}
+	p.wal = nil
+	if err := os.Rename(p.path(walFileName), p.path(oldWALFileName)); err != nil {
+		return err
+	}
+	wal, err := os.OpenFile(p.path(walFileName), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	p.wal = wal
+	p.walSize = 0
+	return nil
+}
+
+// writeState atomically replaces the state file with the server's tables.
+func (p *persister) writeState() error {
+	p.s.mu.Lock()
+	tables := make(map[string]*table, len(p.s.tables))
+	for name, t := range p.s.tables {
+		tables[name] = t
+	}
+	p.s.mu.Unlock()
+
+	// Read the tables without holding s.mu, since ModifyColumnFamilies
+	// acquires s.mu while holding a table's lock.
+	state := make(map[string]*tableData, len(tables))
+	for name, t := range tables {
+		state[name] = t.data()
+	}
+	buf, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(p.dir, stateFileName+".tmp")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(buf)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), p.path(stateFileName))
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+// close compacts the log and closes it.
+func (p *persister) close() error {
+	close(p.done)
+	p.wg.Wait()
+	err := p.compact()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if cerr := p.wal.Close(); err == nil {
+		err = cerr
+	}
+	p.wal = nil
+	return err
+}
+
+// logRow logs the current contents of the row r of the named table.
+// r.mu must be held, and the table's mu held for reading; see lockRow.
+func (s *server) logRow(tbl string, r *row) error {
+	if s.persist == nil {
+		return nil
+	}
+	return s.persist.append(&walRecord{Op: opPutRow, Table: tbl, Row: newRowData(r)})
+}
+
+// logSchema logs the column families of the named table. t.mu must be held,
+// or t must not yet be shared.
+func (s *server) logSchema(tbl string, t *table) error {
+	if s.persist == nil {
+		return nil
+	}
+	return s.persist.append(&walRecord{Op: opPutTable, Table: tbl, Schema: t.schema()})
+}
+
+// logDeleteTable logs the deletion of the named table.
+func (s *server) logDeleteTable(tbl string) error {
+	if s.persist == nil {
+		return nil
+	}
+	return s.persist.append(&walRecord{Op: opDeleteTable, Table: tbl})
+}
+
+// logDropRows logs the deletion of the rows of the named table whose keys
+// begin with prefix. The table's mu must be held.
+func (s *server) logDropRows(tbl, prefix string) error {
+	if s.persist == nil {
+		return nil
+	}
+	return s.persist.append(&walRecord{Op: opDropRows, Table: tbl, Prefix: []byte(prefix)})
+}
+
+// logTable logs the column families and rows of the named table, which must
+// not yet be shared.
+func (s *server) logTable(tbl string, t *table) error {
+	if s.persist == nil {
+		return nil
+	}
+	if err := s.logSchema(tbl, t); err != nil {
+		return err
+	}
+	var err error
+	t.rows.Ascend(func(i btree.Item) bool {
+		err = s.logRow(tbl, i.(*row))
+		return err == nil
+	})
+	return err
+}
+
+// schema returns the column families of t. t.mu must be held.
+func (t *table) schema() *tableData {
+	td := &tableData{
+		Counter:  t.counter,
+		Families: make(map[string]familyData, len(t.families)),
+	}
+	for id, cf := range t.families {
+		fd := familyData{Name: cf.name, Order: cf.order}
+		if cf.gcRule != nil {
+			// Marshaling a valid message cannot fail.
+			fd.GCRule, _ = proto.Marshal(cf.gcRule)
+		}
+		td.Families[id] = fd
+	}
+	return td
+}
+
+// data returns the column families and rows of t.
+func (t *table) data() *tableData {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	td := t.schema()
+	t.rows.Ascend(func(i btree.Item) bool {
+		r := i.(*row)
+		r.mu.Lock()
+		if !r.isEmpty() {
+			td.Rows = append(td.Rows, newRowData(r))
+		}
+		r.mu.Unlock()
+		return true
+	})
+	return td
+}
+
+// tableFromData returns a table with the column families and rows of td.
+func tableFromData(td *tableData) (*table, error) {
+	t := &table{
+		counter:  td.Counter,
+		families: make(map[string]*columnFamily, len(td.Families)),
+		rows:     btree.New(btreeDegree),
+	}
+	for id, fd := range td.Families {
+		cf := &columnFamily{name: fd.Name, order: fd.Order}
+		if fd.GCRule != nil {
+			cf.gcRule = &btapb.GcRule{}
+			if err := proto.Unmarshal(fd.GCRule, cf.gcRule); err != nil {
+				return nil, err
+			}
+		}
+		t.families[id] = cf
+	}
+	for _, rd := range td.Rows {
+		t.rows.ReplaceOrInsert(rd.row())
+	}
+	return t, nil
+}
+
+// dropRows deletes the rows whose keys begin with prefix.
+func (t *table) dropRows(prefix string) {
+	if prefix == "" {
+		t.rows = btree.New(btreeDegree)
+		return
+	}
+	// The BTree does not specify what happens if rows are deleted during
+	// iteration, and it provides no "delete range" method.
+	// So we collect the rows first, then delete them one by one.
+	var rowsToDelete []*row
+	t.rows.AscendGreaterOrEqual(btreeKey(prefix), func(i btree.Item) bool {
+		r := i.(*row)
+		if strings.HasPrefix(r.key, prefix) {
+			rowsToDelete = append(rowsToDelete, r)
+			return true
+		}
+		return false // stop iteration
+	})
+	for _, r := range rowsToDelete {
+		t.rows.Delete(r)
+	}
+}
+
+// newRowData returns the contents of r. r.mu must be held.
+func newRowData(r *row) *rowData {
+	rd := &rowData{Key: []byte(r.key)}
+	for _, fam := range r.sortedFamilies() {
+		fd := rowFamilyData{Name: fam.name, Order: fam.order}
+		for _, col := range fam.colNames {
+			cd := columnData{Qualifier: []byte(col)}
+			for _, c := range fam.cells[col] {
+				cd.Cells = append(cd.Cells, cellData{TS: c.ts, Value: c.value})
+			}
+			fd.Columns = append(fd.Columns, cd)
+		}
+		rd.Families = append(rd.Families, fd)
+	}
+	return rd
+}
+
+// row returns a row with the contents of rd.
+func (rd *rowData) row() *row {
+	r := newRow(string(rd.Key))
+	for _, fd := range rd.Families {
+		f := r.getOrCreateFamily(fd.Name, fd.Order)
+		for _, cd := range fd.Columns {
+			col := string(cd.Qualifier)
+			f.cellsByColumn(col) // create the column
+			cs := make([]cell, 0, len(cd.Cells))
+			for _, c := range cd.Cells {
+				cs = append(cs, cell{ts: c.TS, value: c.Value})
+			}
+			f.cells[col] = cs
+		}
+	}
+	return r
+}
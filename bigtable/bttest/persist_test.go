@@ -0,0 +1,353 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bttest
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	btapb "google.golang.org/genproto/googleapis/bigtable/admin/v2"
+	btpb "google.golang.org/genproto/googleapis/bigtable/v2"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const persistInstance = "projects/p/instances/i"
+
+func newPersistentServer(t *testing.T, dir string) *Server {
+	t.Helper()
+	srv, err := NewServerWithOptions("localhost:0", WithDataDir(dir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return srv
+}
+
+// populate creates tables t1 and t2, writes to them and changes t1's column
+// families.
+func populate(t *testing.T, s *server) {
+	t.Helper()
+	ctx := context.Background()
+	for _, id := range []string{"t1", "t2"} {
+		if _, err := s.CreateTable(ctx, &btapb.CreateTableRequest{
+			Parent:  persistInstance,
+			TableId: id,
+			Table: &btapb.Table{
+				ColumnFamilies: map[string]*btapb.ColumnFamily{"cf": {}},
+			},
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t1 := persistInstance + "/tables/t1"
+	for _, key := range []string{"a1", "a2", "b1", "\xff"} {
+		setPersistCell(t, s, t1, key, "v-"+key)
+	}
+	// Overwrite a cell, and append to another with a server-side timestamp.
+	setPersistCell(t, s, t1, "b1", "v2")
+	if _, err := s.ReadModifyWriteRow(ctx, &btpb.ReadModifyWriteRowRequest{
+		TableName: t1,
+		RowKey:    []byte("a1"),
+		Rules: []*btpb.ReadModifyWriteRule{{
+			FamilyName:      "cf",
+			ColumnQualifier: []byte("col"),
+			Rule:            &btpb.ReadModifyWriteRule_AppendValue{AppendValue: []byte("+")},
+		}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.DropRowRange(ctx, &btapb.DropRowRangeRequest{
+		Name:   t1,
+		Target: &btapb.DropRowRangeRequest_RowKeyPrefix{RowKeyPrefix: []byte("a2")},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.ModifyColumnFamilies(ctx, &btapb.ModifyColumnFamiliesRequest{
+		Name: t1,
+		Modifications: []*btapb.ModifyColumnFamiliesRequest_Modification{{
+			Id: "cf2",
+			Mod: &btapb.ModifyColumnFamiliesRequest_Modification_Create{Create: &btapb.ColumnFamily{
+				GcRule: &btapb.GcRule{Rule: &btapb.GcRule_MaxNumVersions{MaxNumVersions: 2}},
+			}},
+		}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.DeleteTable(ctx, &btapb.DeleteTableRequest{Name: persistInstance + "/tables/t2"}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func setPersistCell(t *testing.T, s *server, tbl, key, value string) {
+	t.Helper()
+	if _, err := s.MutateRow(context.Background(), &btpb.MutateRowRequest{
+		TableName: tbl,
+		RowKey:    []byte(key),
+		Mutations: []*btpb.Mutation{{
+			Mutation: &btpb.Mutation_SetCell_{SetCell: &btpb.Mutation_SetCell{
+				FamilyName:      "cf",
+				ColumnQualifier: []byte("col"),
+				TimestampMicros: 1000,
+				Value:           []byte(value),
+			}},
+		}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// firstValue returns the latest value of the first column of the row.
+func firstValue(t *testing.T, s *server, tbl, key string) string {
+	t.Helper()
+	mock := &MockReadRowsServer{}
+	err := s.ReadRows(&btpb.ReadRowsRequest{
+		TableName: tbl,
+		Rows:      &btpb.RowSet{RowKeys: [][]byte{[]byte(key)}},
+	}, mock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mock.responses) != 1 || len(mock.responses[0].Chunks) == 0 {
+		t.Fatalf("got %v, want one row", mock.responses)
+	}
+	return string(mock.responses[0].Chunks[0].Value)
+}
+
+// checkPopulated checks that s has the contents written by populate.
+func checkPopulated(t *testing.T, s *server) {
+	t.Helper()
+	ctx := context.Background()
+	t1 := persistInstance + "/tables/t1"
+	for key, want := range map[string]string{"a1": "v-a1+", "b1": "v2", "\xff": "v-\xff"} {
+		if got := firstValue(t, s, t1, key); got != want {
+			t.Errorf("row %q: got %q, want %q", key, got, want)
+		}
+	}
+	mock := &MockReadRowsServer{}
+	if err := s.ReadRows(&btpb.ReadRowsRequest{TableName: t1}, mock); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(mock.responses); n != 3 {
+		t.Errorf("got %d rows, want 3", n)
+	}
+	tbl, err := s.GetTable(ctx, &btapb.GetTableRequest{Name: t1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := tbl.ColumnFamilies["cf2"].GetGcRule().GetMaxNumVersions(); got != 2 {
+		t.Errorf("cf2: got max versions %d, want 2", got)
+	}
+	if _, err := s.GetTable(ctx, &btapb.GetTableRequest{Name: persistInstance + "/tables/t2"}); status.Code(err) != codes.NotFound {
+		t.Errorf("deleted table: got %v, want NotFound", err)
+	}
+}
+
+func TestPersistence(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bttest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	srv := newPersistentServer(t, dir)
+	populate(t, srv.s)
+	srv.Close()
+	// A clean shutdown leaves only the state file.
+	if _, err := os.Stat(filepath.Join(dir, walFileName)); err != nil {
+		t.Fatal(err)
+	}
+	if fi, _ := os.Stat(filepath.Join(dir, walFileName)); fi.Size() != 0 {
+		t.Errorf("log has %d bytes after Close, want 0", fi.Size())
+	}
+
+	srv = newPersistentServer(t, dir)
+	checkPopulated(t, srv.s)
+	srv.Close()
+}
+
+func TestPersistenceRecovery(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bttest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	srv := newPersistentServer(t, dir)
+	populate(t, srv.s)
+	// Simulate a crash part way through writing a record.
+	f, err := os.OpenFile(filepath.Join(dir, walFileName), os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteString(`{"op":"row","ta`); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	// Without closing srv, load the directory into another server.
+	srv2 := newPersistentServer(t, dir)
+	checkPopulated(t, srv2.s)
+	srv2.Close()
+	srv.srv.Stop()
+	srv.l.Close()
+}
+
+func TestPersistenceCompaction(t *testing.T) {
+	defer func(n int64) { walCompactSize = n }(walCompactSize)
+	walCompactSize = 1
+
+	dir, err := ioutil.TempDir("", "bttest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	srv := newPersistentServer(t, dir)
+	populate(t, srv.s)
+	// Compact explicitly as well, in case the background compaction has
+	// not finished.
+	if err := srv.s.persist.compact(); err != nil {
+		t.Fatal(err)
+	}
+	setPersistCell(t, srv.s, persistInstance+"/tables/t1", "b1", "v2")
+
+	srv2 := newPersistentServer(t, dir)
+	checkPopulated(t, srv2.s)
+	srv2.Close()
+	srv.srv.Stop()
+	srv.l.Close()
+}
+
+func TestPersistencePeriodicCompaction(t *testing.T) {
+	defer func(d time.Duration) { walCompactInterval = d }(walCompactInterval)
+	walCompactInterval = 10 * time.Millisecond
+
+	dir, err := ioutil.TempDir("", "bttest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	srv := newPersistentServer(t, dir)
+	populate(t, srv.s)
+	// The log is compacted without growing large.
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		fi, err := os.Stat(filepath.Join(dir, walFileName))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fi.Size() == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("log still has %d bytes", fi.Size())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	srv2 := newPersistentServer(t, dir)
+	checkPopulated(t, srv2.s)
+	srv2.Close()
+	srv.srv.Stop()
+	srv.l.Close()
+}
+
+// rowKeys returns the keys of the rows of the named table.
+func rowKeys(t *testing.T, s *server, tbl string) []string {
+	t.Helper()
+	mock := &MockReadRowsServer{}
+	if err := s.ReadRows(&btpb.ReadRowsRequest{TableName: tbl}, mock); err != nil {
+		t.Fatal(err)
+	}
+	var keys []string
+	for _, resp := range mock.responses {
+		keys = append(keys, string(resp.Chunks[0].RowKey))
+	}
+	return keys
+}
+
+func TestPersistenceDropRowsRace(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bttest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	srv := newPersistentServer(t, dir)
+	populate(t, srv.s)
+	t1 := persistInstance + "/tables/t1"
+	// Write rows while they are being dropped. The log must record the
+	// writes and drops in the order they were made in memory.
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 200; j++ {
+				if _, err := srv.s.MutateRow(context.Background(), &btpb.MutateRowRequest{
+					TableName: t1,
+					RowKey:    []byte(fmt.Sprintf("r%d-%03d", i, j)),
+					Mutations: []*btpb.Mutation{{
+						Mutation: &btpb.Mutation_SetCell_{SetCell: &btpb.Mutation_SetCell{
+							FamilyName:      "cf",
+							ColumnQualifier: []byte("col"),
+							TimestampMicros: 1000,
+						}},
+					}},
+				}); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(i)
+	}
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	for dropping := true; dropping; {
+		select {
+		case <-done:
+			dropping = false
+		default:
+		}
+		if _, err := srv.s.DropRowRange(context.Background(), &btapb.DropRowRangeRequest{
+			Name:   t1,
+			Target: &btapb.DropRowRangeRequest_RowKeyPrefix{RowKeyPrefix: []byte("r")},
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want := rowKeys(t, srv.s, t1)
+
+	// Without closing srv, which would compact the log, load the directory
+	// into another server.
+	srv2 := newPersistentServer(t, dir)
+	if got := rowKeys(t, srv2.s, t1); !reflect.DeepEqual(got, want) {
+		t.Errorf("got rows %q, want %q", got, want)
+	}
+	srv2.Close()
+	srv.srv.Stop()
+	srv.l.Close()
+}
@@ -0,0 +1,285 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bttest
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
+	emptypb "github.com/golang/protobuf/ptypes/empty"
+	"github.com/google/btree"
+	btapb "google.golang.org/genproto/googleapis/bigtable/admin/v2"
+	"google.golang.org/genproto/googleapis/longrunning"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// maxSnapshotTTL is the longest a snapshot may live, and the TTL of
+// snapshots created without one.
+const maxSnapshotTTL = 365 * 24 * time.Hour
+
+// timeNow is the clock used for snapshot expiry. Variable for testing.
+var timeNow = time.Now
+
+// A snapshot is a point-in-time copy of a table.
+type snapshot struct {
+	proto *btapb.Snapshot
+	tbl   *table
+}
+
+func (sn *snapshot) expired(now time.Time) bool {
+	dt, err := ptypes.Timestamp(sn.proto.DeleteTime)
+	return err == nil && !now.Before(dt)
+}
+
+// liveSnapshot returns the named snapshot, deleting it if it has expired.
+// s.mu must be held.
+func (s *server) liveSnapshot(name string) (*snapshot, bool) {
+	sn, ok := s.snapshots[name]
+	if !ok {
+		return nil, false
+	}
+	if sn.expired(timeNow()) {
+		delete(s.snapshots, name)
+		return nil, false
+	}
+	return sn, true
+}
+
+func (s *server) SnapshotTable(ctx context.Context, req *btapb.SnapshotTableRequest) (*longrunning.Operation, error) {
+	reqTime := timeNow()
+	if req.SnapshotId == "" {
+		return nil, status.Error(codes.InvalidArgument, "snapshot ID must not be empty")
+	}
+	// Tables are named <instance>/tables/<table>, and clusters
+	// <instance>/clusters/<cluster>.
+	if i := strings.Index(req.Name, "/tables/"); i < 0 || !strings.HasPrefix(req.Cluster, req.Name[:i]+"/clusters/") {
+		return nil, status.Errorf(codes.InvalidArgument, "cluster %q is not in the instance of table %q", req.Cluster, req.Name)
+	}
+	ttl := maxSnapshotTTL
+	if req.Ttl != nil {
+		d, err := ptypes.Duration(req.Ttl)
+		if err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid TTL: %v", err)
+		}
+		if d <= 0 || d > maxSnapshotTTL {
+			return nil, status.Errorf(codes.InvalidArgument, "TTL %v must be positive and at most %v", d, maxSnapshotTTL)
+		}
+		ttl = d
+	}
+	name := req.Cluster + "/snapshots/" + req.SnapshotId
+
+	s.mu.Lock()
+	tbl, ok := s.tables[req.Name]
+	s.mu.Unlock()
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "table %q not found", req.Name)
+	}
+	// Copy the table without holding s.mu, since ModifyColumnFamilies
+	// acquires s.mu while holding the table's lock.
+	cp := tbl.copy()
+	createTime, err := ptypes.TimestampProto(reqTime)
+	if err != nil {
+		return nil, err
+	}
+	deleteTime, err := ptypes.TimestampProto(reqTime.Add(ttl))
+	if err != nil {
+		return nil, err
+	}
+	sn := &snapshot{
+		proto: &btapb.Snapshot{
+			Name: name,
+			SourceTable: &btapb.Table{
+				Name:           req.Name,
+				ColumnFamilies: toColumnFamilies(cp.families),
+				Granularity:    btapb.Table_MILLIS,
+			},
+			DataSizeBytes: cp.dataSize(),
+			CreateTime:    createTime,
+			DeleteTime:    deleteTime,
+			State:         btapb.Snapshot_READY,
+			Description:   req.Description,
+		},
+		tbl: cp,
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.liveSnapshot(name); ok {
+		return nil, status.Errorf(codes.AlreadyExists, "snapshot %q already exists", name)
+	}
+	if s.snapshots == nil {
+		s.snapshots = make(map[string]*snapshot)
+	}
+	s.snapshots[name] = sn
+	return doneOperation(name, &btapb.SnapshotTableMetadata{
+		OriginalRequest: req,
+		RequestTime:     createTime,
+		FinishTime:      createTime,
+	}, sn.proto)
+}
+
+func (s *server) GetSnapshot(ctx context.Context, req *btapb.GetSnapshotRequest) (*btapb.Snapshot, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sn, ok := s.liveSnapshot(req.Name)
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "snapshot %q not found", req.Name)
+	}
+	return sn.proto, nil
+}
+
+func (s *server) ListSnapshots(ctx context.Context, req *btapb.ListSnapshotsRequest) (*btapb.ListSnapshotsResponse, error) {
+	prefix := req.Parent + "/snapshots/"
+	if strings.HasSuffix(req.Parent, "/clusters/-") {
+		// All the clusters of the instance.
+		prefix = strings.TrimSuffix(req.Parent, "-")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var names []string
+	for name := range s.snapshots {
+		if strings.HasPrefix(name, prefix) && name > req.PageToken {
+			if _, ok := s.liveSnapshot(name); ok {
+				names = append(names, name)
+			}
+		}
+	}
+	sort.Strings(names)
+	res := &btapb.ListSnapshotsResponse{}
+	if req.PageSize > 0 && len(names) > int(req.PageSize) {
+		names = names[:req.PageSize]
+		res.NextPageToken = names[len(names)-1]
+	}
+	for _, name := range names {
+		res.Snapshots = append(res.Snapshots, s.snapshots[name].proto)
+	}
+	return res, nil
+}
+
+func (s *server) DeleteSnapshot(ctx context.Context, req *btapb.DeleteSnapshotRequest) (*emptypb.Empty, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.liveSnapshot(req.Name); !ok {
+		return nil, status.Errorf(codes.NotFound, "snapshot %q not found", req.Name)
+	}
+	delete(s.snapshots, req.Name)
+	return &emptypb.Empty{}, nil
+}
+
+func (s *server) CreateTableFromSnapshot(ctx context.Context, req *btapb.CreateTableFromSnapshotRequest) (*longrunning.Operation, error) {
+	reqTime, err := ptypes.TimestampProto(timeNow())
+	if err != nil {
+		return nil, err
+	}
+	tbl := req.Parent + "/tables/" + req.TableId
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sn, ok := s.liveSnapshot(req.SourceSnapshot)
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "snapshot %q not found", req.SourceSnapshot)
+	}
+	if _, ok := s.tables[tbl]; ok {
+		return nil, status.Errorf(codes.AlreadyExists, "table %q already exists", tbl)
+	}
+	// Copy the snapshot again, so that it is unaffected by writes to the
+	// new table.
+	cp := sn.tbl.copy()
+	s.tables[tbl] = cp
+	if err := s.logTable(tbl, cp); err != nil {
+		return nil, err
+	}
+	return doneOperation(tbl, &btapb.CreateTableFromSnapshotMetadata{
+		OriginalRequest: req,
+		RequestTime:     reqTime,
+		FinishTime:      reqTime,
+	}, &btapb.Table{
+		Name:           tbl,
+		ColumnFamilies: toColumnFamilies(cp.families),
+		Granularity:    btapb.Table_MILLIS,
+	})
+}
+
+// doneOperation returns a completed long-running operation on the named
+// resource, with the given metadata and response.
+func doneOperation(name string, md, res proto.Message) (*longrunning.Operation, error) {
+	mdAny, err := ptypes.MarshalAny(md)
+	if err != nil {
+		return nil, err
+	}
+	resAny, err := ptypes.MarshalAny(res)
+	if err != nil {
+		return nil, err
+	}
+	return &longrunning.Operation{
+		Name:     name + "/operations/" + ptypes.TimestampString(ptypes.TimestampNow()),
+		Metadata: mdAny,
+		Done:     true,
+		Result:   &longrunning.Operation_Response{Response: resAny},
+	}, nil
+}
+
+// copy returns a deep copy of the table, including its cell values.
+func (t *table) copy() *table {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	nt := &table{
+		counter:  t.counter,
+		families: make(map[string]*columnFamily),
+		rows:     btree.New(btreeDegree),
+	}
+	for id, cf := range t.families {
+		ncf := *cf
+		nt.families[id] = &ncf
+	}
+	t.rows.Ascend(func(i btree.Item) bool {
+		r := i.(*row)
+		r.mu.Lock()
+		nr := r.copy()
+		r.mu.Unlock()
+		for _, fam := range nr.families {
+			for _, cs := range fam.cells {
+				for i := range cs {
+					cs[i].value = append([]byte(nil), cs[i].value...)
+					cs[i].labels = append([]string(nil), cs[i].labels...)
+				}
+			}
+			fam.colNames = append([]string(nil), fam.colNames...)
+		}
+		nt.rows.ReplaceOrInsert(nr)
+		return true
+	})
+	return nt
+}
+
+// dataSize returns the approximate size of the table's data in bytes.
+func (t *table) dataSize() int64 {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	var n int64
+	t.rows.Ascend(func(i btree.Item) bool {
+		r := i.(*row)
+		r.mu.Lock()
+		n += int64(r.size())
+		r.mu.Unlock()
+		return true
+	})
+	return n
+}
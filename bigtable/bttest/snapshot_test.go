@@ -0,0 +1,198 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bttest
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/ptypes"
+	btapb "google.golang.org/genproto/googleapis/bigtable/admin/v2"
+	btpb "google.golang.org/genproto/googleapis/bigtable/v2"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestSnapshots(t *testing.T) {
+	defer func(f func() time.Time) { timeNow = f }(timeNow)
+	now := time.Unix(1e9, 0)
+	timeNow = func() time.Time { return now }
+
+	ctx := context.Background()
+	s := &server{tables: make(map[string]*table)}
+	const (
+		instance = "projects/p/instances/i"
+		cluster  = instance + "/clusters/c"
+		tblName  = instance + "/tables/t"
+		snapName = cluster + "/snapshots/s"
+	)
+	if _, err := s.CreateTable(ctx, &btapb.CreateTableRequest{
+		Parent:  instance,
+		TableId: "t",
+		Table: &btapb.Table{
+			ColumnFamilies: map[string]*btapb.ColumnFamily{"cf": {}},
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	setCell := func(tbl, key, value string) {
+		t.Helper()
+		_, err := s.MutateRow(ctx, &btpb.MutateRowRequest{
+			TableName: tbl,
+			RowKey:    []byte(key),
+			Mutations: []*btpb.Mutation{{
+				Mutation: &btpb.Mutation_SetCell_{SetCell: &btpb.Mutation_SetCell{
+					FamilyName:      "cf",
+					ColumnQualifier: []byte("col"),
+					TimestampMicros: 1000,
+					Value:           []byte(value),
+				}},
+			}},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	setCell(tblName, "row", "before")
+
+	op, err := s.SnapshotTable(ctx, &btapb.SnapshotTableRequest{
+		Name:       tblName,
+		Cluster:    cluster,
+		SnapshotId: "s",
+		Ttl:        ptypes.DurationProto(time.Hour),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !op.Done {
+		t.Fatal("SnapshotTable operation not done")
+	}
+	var snap btapb.Snapshot
+	if err := ptypes.UnmarshalAny(op.GetResponse(), &snap); err != nil {
+		t.Fatal(err)
+	}
+	if snap.Name != snapName || snap.SourceTable.Name != tblName || snap.DataSizeBytes != int64(len("before")) {
+		t.Errorf("got snapshot %v", &snap)
+	}
+	if _, err := s.SnapshotTable(ctx, &btapb.SnapshotTableRequest{Name: tblName, Cluster: cluster, SnapshotId: "s"}); status.Code(err) != codes.AlreadyExists {
+		t.Errorf("duplicate snapshot: got %v, want AlreadyExists", err)
+	}
+	if _, err := s.SnapshotTable(ctx, &btapb.SnapshotTableRequest{Name: tblName, Cluster: "projects/p/instances/other/clusters/c", SnapshotId: "x"}); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("wrong instance: got %v, want InvalidArgument", err)
+	}
+
+	// Later writes to the table do not affect the snapshot.
+	setCell(tblName, "row", "after")
+	if _, err := s.CreateTableFromSnapshot(ctx, &btapb.CreateTableFromSnapshotRequest{
+		Parent:         instance,
+		TableId:        "restored",
+		SourceSnapshot: snapName,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	restored := instance + "/tables/restored"
+	if got := cellValue(t, s, restored, "row"); got != "before" {
+		t.Errorf("restored table: got %q, want %q", got, "before")
+	}
+	// Nor do writes to the restored table.
+	setCell(restored, "row", "restored")
+	if got := cellValue(t, s.snapshots[snapName].tbl.copyServer(), "t", "row"); got != "before" {
+		t.Errorf("snapshot: got %q, want %q", got, "before")
+	}
+
+	for _, parent := range []string{cluster, instance + "/clusters/-"} {
+		res, err := s.ListSnapshots(ctx, &btapb.ListSnapshotsRequest{Parent: parent})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(res.Snapshots) != 1 || res.Snapshots[0].Name != snapName {
+			t.Errorf("ListSnapshots(%s): got %v", parent, res.Snapshots)
+		}
+	}
+
+	// The snapshot expires after its TTL.
+	now = now.Add(time.Hour)
+	if _, err := s.GetSnapshot(ctx, &btapb.GetSnapshotRequest{Name: snapName}); status.Code(err) != codes.NotFound {
+		t.Errorf("expired snapshot: got %v, want NotFound", err)
+	}
+	if _, err := s.DeleteSnapshot(ctx, &btapb.DeleteSnapshotRequest{Name: snapName}); status.Code(err) != codes.NotFound {
+		t.Errorf("delete expired snapshot: got %v, want NotFound", err)
+	}
+}
+
+func TestListSnapshotsPaging(t *testing.T) {
+	ctx := context.Background()
+	s := &server{tables: make(map[string]*table)}
+	const instance = "projects/p/instances/i"
+	if _, err := s.CreateTable(ctx, &btapb.CreateTableRequest{Parent: instance, TableId: "t"}); err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"a", "b", "c"} {
+		if _, err := s.SnapshotTable(ctx, &btapb.SnapshotTableRequest{
+			Name:       instance + "/tables/t",
+			Cluster:    instance + "/clusters/c",
+			SnapshotId: id,
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var got []string
+	req := &btapb.ListSnapshotsRequest{Parent: instance + "/clusters/c", PageSize: 2}
+	for {
+		res, err := s.ListSnapshots(ctx, req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, sn := range res.Snapshots {
+			got = append(got, sn.Name)
+		}
+		if res.NextPageToken == "" {
+			break
+		}
+		req.PageToken = res.NextPageToken
+	}
+	if len(got) != 3 {
+		t.Errorf("got %v, want 3 snapshots", got)
+	}
+	if _, err := s.DeleteSnapshot(ctx, &btapb.DeleteSnapshotRequest{Name: got[0]}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.GetSnapshot(ctx, &btapb.GetSnapshotRequest{Name: got[0]}); status.Code(err) != codes.NotFound {
+		t.Errorf("deleted snapshot: got %v, want NotFound", err)
+	}
+}
+
+// copyServer returns a server holding a copy of t as the table "t".
+func (t *table) copyServer() *server {
+	return &server{tables: map[string]*table{"t": t.copy()}}
+}
+
+// cellValue returns the latest value of the only cell in the row.
+func cellValue(t *testing.T, s *server, tbl, key string) string {
+	t.Helper()
+	mock := &MockReadRowsServer{}
+	err := s.ReadRows(&btpb.ReadRowsRequest{
+		TableName: tbl,
+		Rows:      &btpb.RowSet{RowKeys: [][]byte{[]byte(key)}},
+	}, mock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mock.responses) != 1 || len(mock.responses[0].Chunks) != 1 {
+		t.Fatalf("got %v, want one cell", mock.responses)
+	}
+	return string(mock.responses[0].Chunks[0].Value)
+}
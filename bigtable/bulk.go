@@ -0,0 +1,249 @@
+/*
+Copyright 2020 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package bigtable
+
+import (
+	"context"
+	"errors"
+	"runtime"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/internal/trace"
+	"github.com/golang/protobuf/proto"
+	"google.golang.org/api/support/bundler"
+	btpb "google.golang.org/genproto/googleapis/bigtable/v2"
+)
+
+// ErrBulkMutatorClosed is the error of the results of mutations applied after
+// a BulkMutator has been closed.
+var ErrBulkMutatorClosed = errors.New("bigtable: BulkMutator is closed")
+
+// ErrOversizedMutation is the error of the result of a mutation that is larger
+// than its BulkMutator's BufferedByteLimit.
+var ErrOversizedMutation = bundler.ErrOversizedItem
+
+// BulkMutatorSettings control the batching of mutations by a BulkMutator.
+// Zero fields are replaced by the corresponding fields of
+// DefaultBulkMutatorSettings.
+type BulkMutatorSettings struct {
+	// Send a non-empty batch after this delay has passed.
+	DelayThreshold time.Duration
+
+	// Send a batch when it has this many row mutations.
+	CountThreshold int
+
+	// Send a batch when its size in bytes reaches this value.
+	ByteThreshold int
+
+	// The maximum number of MutateRows requests in flight at once.
+	//
+	// Defaults to a multiple of GOMAXPROCS.
+	NumGoroutines int
+
+	// The maximum time that the client will spend sending a batch, including
+	// retries.
+	Timeout time.Duration
+
+	// The maximum number of bytes of mutations that the BulkMutator holds in
+	// memory, including those being sent. Apply blocks while this limit
+	// would be exceeded.
+	BufferedByteLimit int
+}
+
+// DefaultBulkMutatorSettings holds the default values for BulkMutatorSettings.
+var DefaultBulkMutatorSettings = BulkMutatorSettings{
+	DelayThreshold:    10 * time.Millisecond,
+	CountThreshold:    100,
+	ByteThreshold:     1e6,
+	Timeout:           60 * time.Second,
+	BufferedByteLimit: 100 * 1e6,
+}
+
+// A BulkMutator applies mutations to the rows of a table in batches. It is
+// an alternative to Table.ApplyBulk for callers that produce mutations one at
+// a time: it batches them by count, size and delay, bounds the number of
+// requests in flight and the memory held by pending mutations, and retries
+// the mutations that fail with retryable errors, as ApplyBulk does.
+//
+// A BulkMutator is safe to use concurrently. It must be closed with Close
+// when no longer needed.
+type BulkMutator struct {
+	t       *Table
+	timeout time.Duration
+	bundler *bundler.Bundler
+
+	mu     sync.RWMutex
+	closed bool
+}
+
+// BulkMutator returns a new BulkMutator that applies mutations to t, batched
+// according to settings.
+func (t *Table) BulkMutator(settings BulkMutatorSettings) *BulkMutator {
+	d := DefaultBulkMutatorSettings
+	if settings.DelayThreshold > 0 {
+		d.DelayThreshold = settings.DelayThreshold
+	}
+	if settings.CountThreshold > 0 {
+		d.CountThreshold = settings.CountThreshold
+	}
+	if settings.ByteThreshold > 0 {
+		d.ByteThreshold = settings.ByteThreshold
+	}
+	if settings.Timeout > 0 {
+		d.Timeout = settings.Timeout
+	}
+	if settings.BufferedByteLimit > 0 {
+		d.BufferedByteLimit = settings.BufferedByteLimit
+	}
+	bm := &BulkMutator{t: t, timeout: d.Timeout}
+	bm.bundler = bundler.NewBundler(&bulkEntry{}, func(items interface{}) {
+		bm.applyBatch(items.([]*bulkEntry))
+	})
+	bm.bundler.DelayThreshold = d.DelayThreshold
+	bm.bundler.BundleCountThreshold = d.CountThreshold
+	bm.bundler.BundleByteThreshold = d.ByteThreshold
+	bm.bundler.BufferedByteLimit = d.BufferedByteLimit
+	// A mutation larger than the memory limit could never be added.
+	bm.bundler.BundleByteLimit = d.BufferedByteLimit
+	if settings.NumGoroutines > 0 {
+		bm.bundler.HandlerLimit = settings.NumGoroutines
+	} else {
+		bm.bundler.HandlerLimit = 10 * runtime.GOMAXPROCS(0)
+	}
+	return bm
+}
+
+// Apply adds a mutation of the row with the given key to the current batch.
+// It returns a non-nil ApplyResult, which will be ready when the mutation has
+// been applied or has failed.
+//
+// Apply blocks while the BulkMutator's BufferedByteLimit would be exceeded,
+// until enough earlier mutations have been sent or ctx is done. The context
+// is otherwise not used: the mutation is sent with a context bounded by the
+// BulkMutator's Timeout.
+//
+// Conditional mutations cannot be applied in bulk, and their results hold an
+// error.
+func (bm *BulkMutator) Apply(ctx context.Context, rowKey string, m *Mutation) *ApplyResult {
+	r := &ApplyResult{ready: make(chan struct{})}
+	if m.cond != nil {
+		r.set(errors.New("conditional mutations cannot be applied in bulk"))
+		return r
+	}
+	bm.mu.RLock()
+	defer bm.mu.RUnlock()
+	if bm.closed {
+		r.set(ErrBulkMutatorClosed)
+		return r
+	}
+	e := &bulkEntry{
+		entry: &entryErr{Entry: &btpb.MutateRowsRequest_Entry{RowKey: []byte(rowKey), Mutations: m.ops}},
+		res:   r,
+	}
+	if err := bm.bundler.AddWait(ctx, e, proto.Size(e.entry.Entry)); err != nil {
+		r.set(err)
+	}
+	return r
+}
+
+// Flush sends all pending mutations, and returns when they have been applied
+// or have failed.
+func (bm *BulkMutator) Flush() {
+	bm.bundler.Flush()
+}
+
+// Close sends all pending mutations, and returns when they have been applied
+// or have failed. The results of later calls to Apply hold
+// ErrBulkMutatorClosed.
+func (bm *BulkMutator) Close() {
+	bm.mu.Lock()
+	bm.closed = true
+	bm.mu.Unlock()
+	bm.bundler.Flush()
+}
+
+// applyBatch sends a batch of entries and sets their results.
+func (bm *BulkMutator) applyBatch(batch []*bulkEntry) {
+	ctx, cancel := context.WithTimeout(context.Background(), bm.timeout)
+	defer cancel()
+	ctx = mergeOutgoingMetadata(ctx, bm.t.md)
+	var err error
+	ctx = trace.StartSpan(ctx, "cloud.google.com/go/bigtable/BulkMutator.Apply")
+	defer func() { trace.EndSpan(ctx, err) }()
+	op := bm.t.startOp(ctx, "BulkMutator")
+	defer func() { op.end(err) }()
+
+	entries := make([]*entryErr, len(batch))
+	for i, e := range batch {
+		entries[i] = e.entry
+	}
+	for _, group := range groupEntries(entries, maxMutations) {
+		unknown, gerr := bm.t.applyGroup(ctx, op, group)
+		// The entries whose outcome is unknown failed with the request's
+		// error, unless the server reported a more specific one.
+		for _, e := range unknown {
+			if e.Err == nil {
+				e.Err = gerr
+			}
+		}
+		// The span and the operation record the first failure.
+		if err == nil {
+			err = gerr
+		}
+	}
+	for _, e := range batch {
+		e.res.set(e.entry.Err)
+	}
+}
+
+type bulkEntry struct {
+	entry *entryErr
+	res   *ApplyResult
+}
+
+// An ApplyResult holds the result of a call to BulkMutator.Apply.
+type ApplyResult struct {
+	ready chan struct{}
+	err   error
+}
+
+// Ready returns a channel that is closed when the result is ready.
+// When the Ready channel is closed, Get is guaranteed not to block.
+func (r *ApplyResult) Ready() <-chan struct{} { return r.ready }
+
+// Get returns the error, if any, of applying the mutation. Get blocks until
+// the mutation has been applied or has failed, or the context is done.
+func (r *ApplyResult) Get(ctx context.Context) error {
+	// If the result is already ready, return it even if the context is done.
+	select {
+	case <-r.Ready():
+		return r.err
+	default:
+	}
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-r.Ready():
+		return r.err
+	}
+}
+
+func (r *ApplyResult) set(err error) {
+	r.err = err
+	close(r.ready)
+}
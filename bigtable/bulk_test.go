@@ -0,0 +1,213 @@
+/*
+Copyright 2020 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package bigtable
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"go.opencensus.io/stats/view"
+	btpb "google.golang.org/genproto/googleapis/bigtable/v2"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestBulkMutator(t *testing.T) {
+	ctx := context.Background()
+	var (
+		mu       sync.Mutex
+		requests int
+	)
+	counter := func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		if strings.HasSuffix(info.FullMethod, "MutateRows") {
+			mu.Lock()
+			requests++
+			mu.Unlock()
+		}
+		return handler(srv, ss)
+	}
+	tbl, cleanup, err := setupFakeServer(grpc.StreamInterceptor(counter))
+	if err != nil {
+		t.Fatalf("fake server setup: %v", err)
+	}
+	defer cleanup()
+
+	bm := tbl.BulkMutator(BulkMutatorSettings{CountThreshold: 10, DelayThreshold: time.Hour})
+	const n = 35
+	var results []*ApplyResult
+	for i := 0; i < n; i++ {
+		m := NewMutation()
+		m.Set("cf", "col", 1000, []byte(fmt.Sprint(i)))
+		results = append(results, bm.Apply(ctx, fmt.Sprintf("row%02d", i), m))
+	}
+	// The first three batches are full, and are sent without waiting.
+	for _, r := range results[:30] {
+		if err := r.Get(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	bm.Close()
+	for _, r := range results[30:] {
+		select {
+		case <-r.Ready():
+		default:
+			t.Fatal("result not ready after Close")
+		}
+		if err := r.Get(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if requests != 4 {
+		t.Errorf("got %d MutateRows requests, want 4", requests)
+	}
+	var rows int
+	if err := tbl.ReadRows(ctx, RowRange{}, func(Row) bool { rows++; return true }); err != nil {
+		t.Fatal(err)
+	}
+	if rows != n {
+		t.Errorf("got %d rows, want %d", rows, n)
+	}
+
+	if err := bm.Apply(ctx, "row", NewMutation()).Get(ctx); err != ErrBulkMutatorClosed {
+		t.Errorf("Apply after Close: got %v, want %v", err, ErrBulkMutatorClosed)
+	}
+}
+
+func TestBulkMutatorErrors(t *testing.T) {
+	ctx := context.Background()
+	tbl, cleanup, err := setupFakeServer()
+	if err != nil {
+		t.Fatalf("fake server setup: %v", err)
+	}
+	defer cleanup()
+
+	bm := tbl.BulkMutator(BulkMutatorSettings{BufferedByteLimit: 100})
+	defer bm.Close()
+	cond := NewCondMutation(RowKeyFilter("x"), NewMutation(), nil)
+	if err := bm.Apply(ctx, "row", cond).Get(ctx); err == nil {
+		t.Error("conditional mutation: got nil, want error")
+	}
+	big := NewMutation()
+	big.Set("cf", "col", 1000, make([]byte, 100))
+	if err := bm.Apply(ctx, "row", big).Get(ctx); err != ErrOversizedMutation {
+		t.Errorf("oversized mutation: got %v, want %v", err, ErrOversizedMutation)
+	}
+	bad := NewMutation()
+	bad.Set("nosuchfamily", "col", 1000, nil)
+	if err := bm.Apply(ctx, "row", bad).Get(ctx); err == nil {
+		t.Error("unknown family: got nil, want error")
+	}
+}
+
+func TestBulkMutatorRetries(t *testing.T) {
+	ctx := context.Background()
+	attempt := 0
+	errInjector := func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		if !strings.HasSuffix(info.FullMethod, "MutateRows") {
+			return handler(srv, ss)
+		}
+		req := new(btpb.MutateRowsRequest)
+		must(ss.RecvMsg(req))
+		attempt++
+		switch attempt {
+		case 1:
+			// The first entry is retried; the third fails permanently.
+			return writeMutateRowsResponse(ss, codes.Unavailable, codes.OK, codes.FailedPrecondition)
+		case 2:
+			if got := len(req.Entries); got != 1 || string(req.Entries[0].RowKey) != "row1" {
+				t.Errorf("retry: got %d entries, want row1 only", got)
+			}
+			return writeMutateRowsResponse(ss, codes.OK)
+		default:
+			t.Errorf("unexpected attempt %d", attempt)
+			return nil
+		}
+	}
+	tbl, cleanup, err := setupFakeServer(grpc.StreamInterceptor(errInjector))
+	if err != nil {
+		t.Fatalf("fake server setup: %v", err)
+	}
+	defer cleanup()
+
+	bm := tbl.BulkMutator(BulkMutatorSettings{CountThreshold: 3})
+	var results []*ApplyResult
+	for i := 1; i <= 3; i++ {
+		m := NewMutation()
+		m.Set("cf", "col", 1000, nil)
+		results = append(results, bm.Apply(ctx, fmt.Sprintf("row%d", i), m))
+	}
+	bm.Close()
+	for i, want := range []codes.Code{codes.OK, codes.OK, codes.FailedPrecondition} {
+		if got := status.Code(results[i].Get(ctx)); got != want {
+			t.Errorf("row%d: got %v, want %v", i+1, got, want)
+		}
+	}
+}
+
+func TestBulkMutatorGroupErrors(t *testing.T) {
+	if err := view.Register(OperationLatencyView); err != nil {
+		t.Fatal(err)
+	}
+	defer view.Unregister(OperationLatencyView)
+
+	ctx := context.Background()
+	attempt := 0
+	errInjector := func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		if !strings.HasSuffix(info.FullMethod, "MutateRows") {
+			return handler(srv, ss)
+		}
+		req := new(btpb.MutateRowsRequest)
+		must(ss.RecvMsg(req))
+		attempt++
+		if attempt == 1 {
+			// The first group fails; the second succeeds.
+			return status.Errorf(codes.PermissionDenied, "")
+		}
+		return writeMutateRowsResponse(ss, codes.OK)
+	}
+	tbl, cleanup, err := setupFakeServer(grpc.StreamInterceptor(errInjector))
+	if err != nil {
+		t.Fatalf("fake server setup: %v", err)
+	}
+	defer cleanup()
+
+	// Two entries too large to be sent in one request.
+	bm := tbl.BulkMutator(BulkMutatorSettings{CountThreshold: 2, DelayThreshold: time.Minute})
+	var results []*ApplyResult
+	for i := 1; i <= 2; i++ {
+		m := NewMutation()
+		for j := 0; j < maxMutations/2+1; j++ {
+			m.DeleteRow()
+		}
+		results = append(results, bm.Apply(ctx, fmt.Sprintf("row%d", i), m))
+	}
+	bm.Close()
+	for i, want := range []codes.Code{codes.PermissionDenied, codes.OK} {
+		if got := status.Code(results[i].Get(ctx)); got != want {
+			t.Errorf("row%d: got %v, want %v", i+1, got, want)
+		}
+	}
+	// The operation failed with the error of the first group.
+	if data := viewData(t, OperationLatencyView, tagsOf("BulkMutator", "PermissionDenied")); data == nil {
+		t.Error("no failed BulkMutator operation recorded")
+	}
+}
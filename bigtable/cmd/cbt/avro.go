@@ -0,0 +1,388 @@
+/*
+Copyright 2020 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+// This file reads and writes Avro object container files
+// (https://avro.apache.org/docs/1.9.2/spec.html#Object+Container+Files)
+// whose records have the schema avroRowSchema. It is the schema used by the
+// Cloud Dataflow templates that export Bigtable tables to Avro and import
+// them back, so their files can be imported with cbt and vice versa.
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"cloud.google.com/go/bigtable"
+)
+
+const avroRowSchema = `{"type":"record","name":"BigtableRow","namespace":"com.google.cloud.teleport.bigtable",` +
+	`"fields":[{"name":"key","type":"bytes"},{"name":"cells","type":{"type":"array","items":` +
+	`{"type":"record","name":"BigtableCell","fields":[{"name":"family","type":"string"},` +
+	`{"name":"qualifier","type":"bytes"},{"name":"timestamp","type":"long"},{"name":"value","type":"bytes"}]}}}]}`
+
+var avroMagic = []byte("Obj\x01")
+
+const (
+	avroSyncSize = 16
+
+	// The maximum size of a key or value of the metadata of a file.
+	maxAvroMetadataSize = 1 << 20
+
+	// Flush a block of the file when it holds this many rows, or this many
+	// bytes.
+	avroBlockRows  = 1000
+	avroBlockBytes = 1 << 20
+)
+
+// avroWriter writes rows to an Avro file, compressed with the deflate codec.
+type avroWriter struct {
+	w     io.Writer
+	sync  [avroSyncSize]byte
+	block bytes.Buffer
+	rows  int
+}
+
+func newAvroWriter(w io.Writer) (*avroWriter, error) {
+	aw := &avroWriter{w: w}
+	if _, err := rand.Read(aw.sync[:]); err != nil {
+		return nil, err
+	}
+	var hdr bytes.Buffer
+	hdr.Write(avroMagic)
+	// The metadata map, as one block of two entries.
+	appendAvroLong(&hdr, 2)
+	appendAvroBytes(&hdr, []byte("avro.schema"))
+	appendAvroBytes(&hdr, []byte(avroRowSchema))
+	appendAvroBytes(&hdr, []byte("avro.codec"))
+	appendAvroBytes(&hdr, []byte("deflate"))
+	appendAvroLong(&hdr, 0)
+	hdr.Write(aw.sync[:])
+	if _, err := w.Write(hdr.Bytes()); err != nil {
+		return nil, err
+	}
+	return aw, nil
+}
+
+func (aw *avroWriter) write(r *rowRecord) error {
+	appendAvroBytes(&aw.block, []byte(r.key))
+	if len(r.cells) > 0 {
+		appendAvroLong(&aw.block, int64(len(r.cells)))
+		for _, c := range r.cells {
+			appendAvroBytes(&aw.block, []byte(c.family))
+			appendAvroBytes(&aw.block, []byte(c.qualifier))
+			appendAvroLong(&aw.block, int64(c.timestamp))
+			appendAvroBytes(&aw.block, c.value)
+		}
+	}
+	appendAvroLong(&aw.block, 0)
+	aw.rows++
+	if aw.rows >= avroBlockRows || aw.block.Len() >= avroBlockBytes {
+		return aw.flush()
+	}
+	return nil
+}
+
+// flush writes the pending rows as a block.
+func (aw *avroWriter) flush() error {
+	if aw.rows == 0 {
+		return nil
+	}
+	var data bytes.Buffer
+	fw, err := flate.NewWriter(&data, flate.DefaultCompression)
+	if err != nil {
+		return err
+	}
+	if _, err := fw.Write(aw.block.Bytes()); err != nil {
+		return err
+	}
+	if err := fw.Close(); err != nil {
+		return err
+	}
+	var hdr bytes.Buffer
+	appendAvroLong(&hdr, int64(aw.rows))
+	appendAvroLong(&hdr, int64(data.Len()))
+	for _, b := range [][]byte{hdr.Bytes(), data.Bytes(), aw.sync[:]} {
+		if _, err := aw.w.Write(b); err != nil {
+			return err
+		}
+	}
+	aw.block.Reset()
+	aw.rows = 0
+	return nil
+}
+
+func (aw *avroWriter) close() error {
+	return aw.flush()
+}
+
+func appendAvroLong(b *bytes.Buffer, n int64) {
+	// Avro longs are zig-zag varints, like Go's.
+	var buf [binary.MaxVarintLen64]byte
+	b.Write(buf[:binary.PutVarint(buf[:], n)])
+}
+
+func appendAvroBytes(b *bytes.Buffer, p []byte) {
+	appendAvroLong(b, int64(len(p)))
+	b.Write(p)
+}
+
+// avroReader reads rows from an Avro file written by avroWriter or by the
+// Dataflow export template.
+type avroReader struct {
+	r     *bufio.Reader
+	codec string
+	sync  [avroSyncSize]byte
+	block *bytes.Reader // the rest of the current block
+	rows  int64         // the number of rows left in the current block
+}
+
+func newAvroReader(r io.Reader) (*avroReader, error) {
+	ar := &avroReader{r: bufio.NewReader(r)}
+	magic := make([]byte, len(avroMagic))
+	if _, err := io.ReadFull(ar.r, magic); err != nil || !bytes.Equal(magic, avroMagic) {
+		return nil, errors.New("not an Avro object container file")
+	}
+	meta := map[string][]byte{}
+	for {
+		n, err := readAvroBlockCount(ar.r)
+		if err != nil {
+			return nil, err
+		}
+		if n == 0 {
+			break
+		}
+		for i := int64(0); i < n; i++ {
+			k, err := readAvroBytes(ar.r, maxAvroMetadataSize)
+			if err != nil {
+				return nil, err
+			}
+			v, err := readAvroBytes(ar.r, maxAvroMetadataSize)
+			if err != nil {
+				return nil, err
+			}
+			meta[string(k)] = v
+		}
+	}
+	if err := checkAvroSchema(meta["avro.schema"]); err != nil {
+		return nil, err
+	}
+	switch ar.codec = string(meta["avro.codec"]); ar.codec {
+	case "", "null", "deflate":
+	default:
+		return nil, fmt.Errorf("unsupported Avro codec %q", ar.codec)
+	}
+	if _, err := io.ReadFull(ar.r, ar.sync[:]); err != nil {
+		return nil, err
+	}
+	return ar, nil
+}
+
+// read returns the next row, or io.EOF at the end of the file.
+func (ar *avroReader) read() (*rowRecord, error) {
+	for ar.rows == 0 {
+		if err := ar.nextBlock(); err != nil {
+			return nil, err
+		}
+	}
+	ar.rows--
+	key, err := readAvroBytes(ar.block, int64(ar.block.Len()))
+	if err != nil {
+		return nil, err
+	}
+	r := &rowRecord{key: string(key)}
+	for {
+		n, err := readAvroBlockCount(ar.block)
+		if err != nil {
+			return nil, err
+		}
+		if n == 0 {
+			break
+		}
+		for i := int64(0); i < n; i++ {
+			var c cell
+			fam, err := readAvroBytes(ar.block, int64(ar.block.Len()))
+			if err != nil {
+				return nil, err
+			}
+			qual, err := readAvroBytes(ar.block, int64(ar.block.Len()))
+			if err != nil {
+				return nil, err
+			}
+			ts, err := binary.ReadVarint(ar.block)
+			if err != nil {
+				return nil, err
+			}
+			if c.value, err = readAvroBytes(ar.block, int64(ar.block.Len())); err != nil {
+				return nil, err
+			}
+			c.family, c.qualifier, c.timestamp = string(fam), string(qual), bigtable.Timestamp(ts)
+			r.cells = append(r.cells, c)
+		}
+	}
+	return r, nil
+}
+
+// nextBlock reads the next block of the file.
+func (ar *avroReader) nextBlock() error {
+	rows, err := binary.ReadVarint(ar.r)
+	if err == io.EOF {
+		return io.EOF
+	}
+	if err != nil {
+		return err
+	}
+	size, err := binary.ReadVarint(ar.r)
+	if err != nil {
+		return err
+	}
+	if rows < 0 || size < 0 {
+		return errors.New("corrupt Avro block header")
+	}
+	// The block is read as it arrives, rather than into a buffer of the size
+	// of the header, so that a corrupt size cannot exhaust memory.
+	var buf bytes.Buffer
+	if _, err := io.CopyN(&buf, ar.r, size); err == io.EOF {
+		return errors.New("corrupt Avro data: truncated block")
+	} else if err != nil {
+		return err
+	}
+	data := buf.Bytes()
+	var sync [avroSyncSize]byte
+	if _, err := io.ReadFull(ar.r, sync[:]); err != nil {
+		return err
+	}
+	if sync != ar.sync {
+		return errors.New("corrupt Avro file: bad sync marker")
+	}
+	if ar.codec == "deflate" {
+		if data, err = ioutil.ReadAll(flate.NewReader(bytes.NewReader(data))); err != nil {
+			return err
+		}
+	}
+	ar.block = bytes.NewReader(data)
+	ar.rows = rows
+	return nil
+}
+
+type byteReader interface {
+	io.Reader
+	io.ByteReader
+}
+
+// readAvroBlockCount reads the item count of a block of an array or map.
+// A negative count is followed by the size of the block, which is skipped.
+func readAvroBlockCount(r byteReader) (int64, error) {
+	n, err := binary.ReadVarint(r)
+	if err != nil {
+		return 0, err
+	}
+	if n < 0 {
+		if _, err := binary.ReadVarint(r); err != nil {
+			return 0, err
+		}
+		n = -n
+	}
+	return n, nil
+}
+
+// readAvroBytes reads bytes or a string of at most max bytes.
+func readAvroBytes(r byteReader, max int64) ([]byte, error) {
+	n, err := binary.ReadVarint(r)
+	if err != nil {
+		return nil, err
+	}
+	if n < 0 {
+		return nil, errors.New("corrupt Avro data: negative length")
+	}
+	if n > max {
+		return nil, fmt.Errorf("corrupt Avro data: length %d exceeds %d", n, max)
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// checkAvroSchema reports whether schema describes the same records as
+// avroRowSchema. Names and namespaces may differ.
+func checkAvroSchema(schema []byte) error {
+	type field struct {
+		Name string          `json:"name"`
+		Type json.RawMessage `json:"type"`
+	}
+	type record struct {
+		Type   string  `json:"type"`
+		Fields []field `json:"fields"`
+	}
+	type array struct {
+		Type  string `json:"type"`
+		Items record `json:"items"`
+	}
+	errSchema := fmt.Errorf("unsupported Avro schema %s; want %s", schema, avroRowSchema)
+	match := func(r record, names, types []string) bool {
+		if r.Type != "record" || len(r.Fields) != len(names) {
+			return false
+		}
+		for i, f := range r.Fields {
+			if f.Name != names[i] || (types[i] != "" && avroTypeName(f.Type) != types[i]) {
+				return false
+			}
+		}
+		return true
+	}
+	var row record
+	if err := json.Unmarshal(schema, &row); err != nil {
+		return errSchema
+	}
+	if !match(row, []string{"key", "cells"}, []string{"bytes", ""}) {
+		return errSchema
+	}
+	var cells array
+	if err := json.Unmarshal(row.Fields[1].Type, &cells); err != nil || cells.Type != "array" {
+		return errSchema
+	}
+	if !match(cells.Items, []string{"family", "qualifier", "timestamp", "value"}, []string{"string", "bytes", "long", "bytes"}) {
+		return errSchema
+	}
+	return nil
+}
+
+// avroTypeName returns the name of a primitive type, which may be given as a
+// string such as "string", or as an object such as
+// {"type": "string", "avro.java.string": "String"}.
+func avroTypeName(t json.RawMessage) string {
+	var name string
+	if err := json.Unmarshal(t, &name); err == nil {
+		return name
+	}
+	var obj struct {
+		Type string `json:"type"`
+	}
+	if err := json.Unmarshal(t, &obj); err == nil {
+		return obj.Type
+	}
+	return ""
+}
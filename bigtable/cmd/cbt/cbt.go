@@ -22,6 +22,7 @@ import (
 	"bytes"
 	"context"
 	"encoding/csv"
+	"errors"
 	"flag"
 	"fmt"
 	"go/format"
@@ -247,10 +248,14 @@ var commands = []struct {
 	Required   cbtconfig.RequiredFlags
 }{
 	{
-		Name:     "count",
-		Desc:     "Count rows in a table",
-		do:       doCount,
-		Usage:    "cbt count <table-id>",
+		Name: "count",
+		Desc: "Count rows in a table",
+		do:   doCount,
+		Usage: "cbt count <table-id> [filter=<filter>]\n" +
+			"  filter=<filter>                     Count only rows with cells matching this filter (see 'cbt help read')\n\n" +
+			"    Examples:\n" +
+			"      cbt count mobile-time-series\n" +
+			"      cbt count mobile-time-series filter='(family(\"stats_summary\") | value(\"android\"))'",
 		Required: cbtconfig.ProjectAndInstanceRequired,
 	},
 	{
@@ -375,6 +380,36 @@ var commands = []struct {
 		Usage:    "cbt doc",
 		Required: cbtconfig.NoneRequired,
 	},
+	{
+		Name: "export",
+		Desc: "Export rows of a table to a CSV, JSON lines or Avro file",
+		do:   doExport,
+		Usage: "cbt export <table-id> <file> [format=<csv|jsonl|avro>] [columns=<family>:<qualifier>,...]" +
+			" [key=<field>] [family=<family>] [mapping=<field>=<family>:<qualifier>,...] [start=<row-key>]" +
+			" [end=<row-key>] [prefix=<row-key-prefix>] [regex=<regex>] [count=<n>] [cells-per-column=<n>]" +
+			" [filter=<filter>] [app-profile=<app-profile-id>]\n" +
+			"  file                                        The file to write, or - for standard output\n" +
+			"  format=<csv|jsonl|avro>                     The format of the file; by default, given by its extension\n" +
+			"  columns=<family>:<qualifier>,...            Export only these columns, comma-separated; required for CSV\n" +
+			"  key=<field>                                 The CSV or JSON field holding the row key (default \"rowkey\")\n" +
+			"  family=<family>                             Name the columns of this family by their qualifiers alone\n" +
+			"  mapping=<field>=<family>:<qualifier>,...    Name these columns by these CSV or JSON fields\n" +
+			"  start=<row-key>                             Start exporting at this row\n" +
+			"  end=<row-key>                               Stop exporting before this row\n" +
+			"  prefix=<row-key-prefix>                     Export rows with this prefix\n" +
+			"  regex=<regex>                               Export rows with keys matching this regex\n" +
+			"  count=<n>                                   Export only this many rows\n" +
+			"  cells-per-column=<n>                        Export only this many cells per column\n" +
+			"  filter=<filter>                             Export only cells matching this filter (see 'cbt help read')\n" +
+			"  app-profile=<app-profile-id>                The app profile ID to use for the request\n\n" +
+			"    CSV and JSON lines files hold the latest value of each column of a row. CSV fields and JSON\n" +
+			"    fields are named <family>:<qualifier> unless named by family or mapping. Avro files hold\n" +
+			"    every cell along with its timestamp, in the format of the Cloud Dataflow Bigtable templates.\n\n" +
+			"    Examples:\n" +
+			"      cbt export mobile-time-series phones.csv prefix=phone columns=stats_summary:os_build,stats_summary:os_name family=stats_summary\n" +
+			"      cbt export mobile-time-series backup.avro",
+		Required: cbtconfig.ProjectAndInstanceRequired,
+	},
 	{
 		Name: "help",
 		Desc: "Print help text",
@@ -383,6 +418,31 @@ var commands = []struct {
 			"    Example: cbt help createtable",
 		Required: cbtconfig.NoneRequired,
 	},
+	{
+		Name: "import",
+		Desc: "Import rows into a table from a CSV, JSON lines or Avro file",
+		do:   doImport,
+		Usage: "cbt import <table-id> <file> [format=<csv|jsonl|avro>] [key=<field>] [family=<family>]" +
+			" [mapping=<field>=<family>:<qualifier>,...] [timestamp=<micros>] [batch-size=<n>]" +
+			" [concurrency=<n>] [app-profile=<app-profile-id>]\n" +
+			"  file                                        The file to read, or - for standard input\n" +
+			"  format=<csv|jsonl|avro>                     The format of the file; by default, given by its extension\n" +
+			"  key=<field>                                 The CSV or JSON field holding the row key (default \"rowkey\")\n" +
+			"  family=<family>                             The family of fields not named <family>:<qualifier>\n" +
+			"  mapping=<field>=<family>:<qualifier>,...    Write these CSV or JSON fields to these columns\n" +
+			"  timestamp=<micros>                          The timestamp of cells read from CSV or JSON (default now)\n" +
+			"  batch-size=<n>                              Write this many rows per request (default 500)\n" +
+			"  concurrency=<n>                             Send up to this many requests at once (default 4)\n" +
+			"  app-profile=<app-profile-id>                The app profile ID to use for the request\n\n" +
+			"    CSV files must start with a header naming their fields. Empty CSV fields and null JSON\n" +
+			"    fields are not written; JSON fields that are not strings are written as JSON text.\n" +
+			"    Avro files are read in the format of the Cloud Dataflow Bigtable templates, with the\n" +
+			"    timestamps of their cells.\n\n" +
+			"    Examples:\n" +
+			"      cbt import mobile-time-series phones.csv key=id family=stats_summary\n" +
+			"      cbt import mobile-time-series backup.avro concurrency=8",
+		Required: cbtconfig.ProjectAndInstanceRequired,
+	},
 	{
 		Name:     "listinstances",
 		Desc:     "List instances in a project",
@@ -402,10 +462,11 @@ var commands = []struct {
 		Desc: "Read from a single row",
 		do:   doLookup,
 		Usage: "cbt lookup <table-id> <row-key> [columns=<family>:<qualifier>,...] [cells-per-column=<n>] " +
-			" [app-profile=<app profile id>]\n" +
+			" [filter=<filter>] [app-profile=<app profile id>]\n" +
 			"  row-key                             String or raw bytes. Raw bytes must be enclosed in single quotes and have a dollar-sign prefix\n" +
 			"  columns=<family>:<qualifier>,...    Read only these columns, comma-separated\n" +
 			"  cells-per-column=<n>                Read only this number of cells per column\n" +
+			"  filter=<filter>                     Read only cells matching this filter (see 'cbt help read')\n" +
 			"  app-profile=<app-profile-id>        The app profile ID to use for the request\n\n" +
 			" Example: cbt lookup mobile-time-series phone#4c410523#20190501 columns=stats_summary:os_build,os_name cells-per-column=1\n" +
 			" Example: cbt lookup mobile-time-series $'\\x41\\x42'",
@@ -433,7 +494,7 @@ var commands = []struct {
 		do:   doRead,
 		Usage: "cbt read <table-id> [start=<row-key>] [end=<row-key>] [prefix=<row-key-prefix>]" +
 			" [regex=<regex>] [columns=<family>:<qualifier>,...] [count=<n>] [cells-per-column=<n>]" +
-			" [app-profile=<app-profile-id>]\n" +
+			" [filter=<filter>] [app-profile=<app-profile-id>]\n" +
 			"  start=<row-key>                     Start reading at this row\n" +
 			"  end=<row-row>                       Stop reading before this row\n" +
 			"  prefix=<row-key-prefix>             Read rows with this prefix\n" +
@@ -441,11 +502,14 @@ var commands = []struct {
 			"  columns=<family>:<qualifier>,...    Read only these columns, comma-separated\n" +
 			"  count=<n>                           Read only this many rows\n" +
 			"  cells-per-column=<n>                Read only this many cells per column\n" +
+			"  filter=<filter>                     Read only cells matching this filter\n" +
 			"  app-profile=<app-profile-id>        The app profile ID to use for the request\n\n" +
+			filterHelp + "\n\n" +
 			"    Examples: (see 'set' examples to create data to read)\n" +
 			"      cbt read mobile-time-series prefix=phone columns=stats_summary:os_build,os_name count=10\n" +
 			"      cbt read mobile-time-series start=phone#4c410523#20190501 end=phone#4c410523#20190601\n" +
-			"      cbt read mobile-time-series regex=\"phone.*\" cells-per-column=1\n\n" +
+			"      cbt read mobile-time-series regex=\"phone.*\" cells-per-column=1\n" +
+			"      cbt read mobile-time-series filter='(column(\"os_.*\") | timestamp_range(\"2019-05-01T00:00:00Z\", \"\"))'\n\n" +
 			"   Note: Using a regex without also specifying start, end, prefix, or count results in a full\n" +
 			"   table scan, which can be slow.\n",
 		Required: cbtconfig.ProjectAndInstanceRequired,
@@ -578,16 +642,28 @@ var commands = []struct {
 }
 
 func doCount(ctx context.Context, args ...string) {
-	if len(args) != 1 {
-		log.Fatal("usage: cbt count <table>")
+	if len(args) < 1 {
+		log.Fatal("usage: cbt count <table> [filter=<filter>]")
+	}
+	parsed, err := parseArgs(args[1:], []string{"filter"})
+	if err != nil {
+		log.Fatal(err)
+	}
+	filter := bigtable.StripValueFilter()
+	if s := parsed["filter"]; s != "" {
+		f, err := parseFilter(s)
+		if err != nil {
+			log.Fatal(err)
+		}
+		filter = bigtable.ChainFilters(f, filter)
 	}
 	tbl := getClient(bigtable.ClientConfig{}).Open(args[0])
 
 	n := 0
-	err := tbl.ReadRows(ctx, bigtable.InfiniteRange(""), func(_ bigtable.Row) bool {
+	err = tbl.ReadRows(ctx, bigtable.InfiniteRange(""), func(_ bigtable.Row) bool {
 		n++
 		return true
-	}, bigtable.RowFilter(bigtable.StripValueFilter()))
+	}, bigtable.RowFilter(filter))
 	if err != nil {
 		log.Fatalf("Reading rows: %v", err)
 	}
@@ -896,7 +972,7 @@ var docTemplate = template.Must(template.New("doc").Funcs(template.FuncMap{
 
 // DO NOT EDIT. THIS IS AUTOMATICALLY GENERATED.
 // Run "go generate" to regenerate.
-//go:generate go run cbt.go gcpolicy.go -o cbtdoc.go doc
+//go:generate go run cbt.go gcpolicy.go filter.go avro.go importexport.go -o cbtdoc.go doc
 
 /*
 ` + docIntroTemplate + `
@@ -968,7 +1044,7 @@ func doLookup(ctx context.Context, args ...string) {
 			"[app-profile=<app profile id>]")
 	}
 
-	parsed, err := parseArgs(args[2:], []string{"columns", "cells-per-column", "app-profile"})
+	parsed, err := parseArgs(args[2:], []string{"columns", "cells-per-column", "filter", "app-profile"})
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -988,6 +1064,13 @@ func doLookup(ctx context.Context, args ...string) {
 		}
 		filters = append(filters, columnFilters)
 	}
+	if filter := parsed["filter"]; filter != "" {
+		f, err := parseFilter(filter)
+		if err != nil {
+			log.Fatal(err)
+		}
+		filters = append(filters, f)
+	}
 
 	if len(filters) > 1 {
 		opts = append(opts, bigtable.RowFilter(bigtable.ChainFilters(filters...)))
@@ -1101,7 +1184,7 @@ func doRead(ctx context.Context, args ...string) {
 	}
 
 	parsed, err := parseArgs(args[1:], []string{
-		"start", "end", "prefix", "columns", "count", "cells-per-column", "regex", "app-profile", "limit",
+		"start", "end", "prefix", "columns", "count", "cells-per-column", "regex", "filter", "app-profile", "limit",
 	})
 	if err != nil {
 		log.Fatal(err)
@@ -1110,11 +1193,30 @@ func doRead(ctx context.Context, args ...string) {
 		// Be nicer; we used to support this, but renamed it to "end".
 		log.Fatal("Unknown arg key 'limit'; did you mean 'end'?")
 	}
+	rr, opts, err := parseReadArgs(parsed)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// TODO(dsymonds): Support filters.
+	tbl := getClient(bigtable.ClientConfig{AppProfile: parsed["app-profile"]}).Open(args[0])
+	err = tbl.ReadRows(ctx, rr, func(r bigtable.Row) bool {
+		printRow(r)
+		return true
+	}, opts...)
+	if err != nil {
+		log.Fatalf("Reading rows: %v", err)
+	}
+}
+
+// parseReadArgs returns the row range and read options given by the start,
+// end, prefix, count, cells-per-column, regex, columns and filter args of
+// read.
+func parseReadArgs(parsed map[string]string) (rr bigtable.RowRange, opts []bigtable.ReadOption, err error) {
 	if (parsed["start"] != "" || parsed["end"] != "") && parsed["prefix"] != "" {
-		log.Fatal(`"start"/"end" may not be mixed with "prefix"`)
+		return rr, nil, errors.New(`"start"/"end" may not be mixed with "prefix"`)
 	}
 
-	var rr bigtable.RowRange
 	if start, end := parsed["start"], parsed["end"]; end != "" {
 		rr = bigtable.NewRange(start, end)
 	} else if start != "" {
@@ -1124,11 +1226,10 @@ func doRead(ctx context.Context, args ...string) {
 		rr = bigtable.PrefixRange(prefix)
 	}
 
-	var opts []bigtable.ReadOption
 	if count := parsed["count"]; count != "" {
 		n, err := strconv.ParseInt(count, 0, 64)
 		if err != nil {
-			log.Fatalf("Bad count %q: %v", count, err)
+			return rr, nil, fmt.Errorf("Bad count %q: %v", count, err)
 		}
 		opts = append(opts, bigtable.LimitRows(n))
 	}
@@ -1137,7 +1238,7 @@ func doRead(ctx context.Context, args ...string) {
 	if cellsPerColumn := parsed["cells-per-column"]; cellsPerColumn != "" {
 		n, err := strconv.Atoi(cellsPerColumn)
 		if err != nil {
-			log.Fatalf("Bad number of cells per column %q: %v", cellsPerColumn, err)
+			return rr, nil, fmt.Errorf("Bad number of cells per column %q: %v", cellsPerColumn, err)
 		}
 		filters = append(filters, bigtable.LatestNFilter(n))
 	}
@@ -1147,26 +1248,24 @@ func doRead(ctx context.Context, args ...string) {
 	if columns := parsed["columns"]; columns != "" {
 		columnFilters, err := parseColumnsFilter(columns)
 		if err != nil {
-			log.Fatal(err)
+			return rr, nil, err
 		}
 		filters = append(filters, columnFilters)
 	}
+	if filter := parsed["filter"]; filter != "" {
+		f, err := parseFilter(filter)
+		if err != nil {
+			return rr, nil, err
+		}
+		filters = append(filters, f)
+	}
 
 	if len(filters) > 1 {
 		opts = append(opts, bigtable.RowFilter(bigtable.ChainFilters(filters...)))
 	} else if len(filters) == 1 {
 		opts = append(opts, bigtable.RowFilter(filters[0]))
 	}
-
-	// TODO(dsymonds): Support filters.
-	tbl := getClient(bigtable.ClientConfig{AppProfile: parsed["app-profile"]}).Open(args[0])
-	err = tbl.ReadRows(ctx, rr, func(r bigtable.Row) bool {
-		printRow(r)
-		return true
-	}, opts...)
-	if err != nil {
-		log.Fatalf("Reading rows: %v", err)
-	}
+	return rr, opts, nil
 }
 
 var setArg = regexp.MustCompile(`([^:]+):([^=]*)=(.*)`)
@@ -14,7 +14,7 @@
 
 // DO NOT EDIT. THIS IS AUTOMATICALLY GENERATED.
 // Run "go generate" to regenerate.
-//go:generate go run cbt.go gcpolicy.go -o cbtdoc.go doc
+//go:generate go run cbt.go gcpolicy.go filter.go avro.go importexport.go -o cbtdoc.go doc
 
 /*
 The `cbt` tool is a command-line tool that allows you to interact with Cloud Bigtable.
@@ -41,7 +41,9 @@ The commands are:
     deleteallrows             Delete all rows
     deletetable               Delete a table
     doc                       Print godoc-suitable documentation for cbt
+    export                    Export rows of a table to a CSV, JSON lines or Avro file
     help                      Print help text
+    import                    Import rows into a table from a CSV, JSON lines or Avro file
     listinstances             List instances in a project
     listclusters              List clusters in an instance
     lookup                    Read from a single row
@@ -109,7 +111,12 @@ All values are optional and can be overridden at the command prompt.
 Count rows in a table
 
 Usage:
-	cbt count <table-id>
+	cbt count <table-id> [filter=<filter>]
+	  filter=<filter>                     Count only rows with cells matching this filter (see 'cbt help read')
+
+	    Examples:
+	      cbt count mobile-time-series
+	      cbt count mobile-time-series filter='(family("stats_summary") | value("android"))'
 
 
 
@@ -261,6 +268,36 @@ Usage:
 
 
 
+Export rows of a table to a CSV, JSON lines or Avro file
+
+Usage:
+	cbt export <table-id> <file> [format=<csv|jsonl|avro>] [columns=<family>:<qualifier>,...] [key=<field>] [family=<family>] [mapping=<field>=<family>:<qualifier>,...] [start=<row-key>] [end=<row-key>] [prefix=<row-key-prefix>] [regex=<regex>] [count=<n>] [cells-per-column=<n>] [filter=<filter>] [app-profile=<app-profile-id>]
+	  file                                        The file to write, or - for standard output
+	  format=<csv|jsonl|avro>                     The format of the file; by default, given by its extension
+	  columns=<family>:<qualifier>,...            Export only these columns, comma-separated; required for CSV
+	  key=<field>                                 The CSV or JSON field holding the row key (default "rowkey")
+	  family=<family>                             Name the columns of this family by their qualifiers alone
+	  mapping=<field>=<family>:<qualifier>,...    Name these columns by these CSV or JSON fields
+	  start=<row-key>                             Start exporting at this row
+	  end=<row-key>                               Stop exporting before this row
+	  prefix=<row-key-prefix>                     Export rows with this prefix
+	  regex=<regex>                               Export rows with keys matching this regex
+	  count=<n>                                   Export only this many rows
+	  cells-per-column=<n>                        Export only this many cells per column
+	  filter=<filter>                             Export only cells matching this filter (see 'cbt help read')
+	  app-profile=<app-profile-id>                The app profile ID to use for the request
+
+	    CSV and JSON lines files hold the latest value of each column of a row. CSV fields and JSON
+	    fields are named <family>:<qualifier> unless named by family or mapping. Avro files hold
+	    every cell along with its timestamp, in the format of the Cloud Dataflow Bigtable templates.
+
+	    Examples:
+	      cbt export mobile-time-series phones.csv prefix=phone columns=stats_summary:os_build,stats_summary:os_name family=stats_summary
+	      cbt export mobile-time-series backup.avro
+
+
+
+
 Print help text
 
 Usage:
@@ -271,6 +308,32 @@ Usage:
 
 
 
+Import rows into a table from a CSV, JSON lines or Avro file
+
+Usage:
+	cbt import <table-id> <file> [format=<csv|jsonl|avro>] [key=<field>] [family=<family>] [mapping=<field>=<family>:<qualifier>,...] [timestamp=<micros>] [batch-size=<n>] [concurrency=<n>] [app-profile=<app-profile-id>]
+	  file                                        The file to read, or - for standard input
+	  format=<csv|jsonl|avro>                     The format of the file; by default, given by its extension
+	  key=<field>                                 The CSV or JSON field holding the row key (default "rowkey")
+	  family=<family>                             The family of fields not named <family>:<qualifier>
+	  mapping=<field>=<family>:<qualifier>,...    Write these CSV or JSON fields to these columns
+	  timestamp=<micros>                          The timestamp of cells read from CSV or JSON (default now)
+	  batch-size=<n>                              Write this many rows per request (default 500)
+	  concurrency=<n>                             Send up to this many requests at once (default 4)
+	  app-profile=<app-profile-id>                The app profile ID to use for the request
+
+	    CSV files must start with a header naming their fields. Empty CSV fields and null JSON
+	    fields are not written; JSON fields that are not strings are written as JSON text.
+	    Avro files are read in the format of the Cloud Dataflow Bigtable templates, with the
+	    timestamps of their cells.
+
+	    Examples:
+	      cbt import mobile-time-series phones.csv key=id family=stats_summary
+	      cbt import mobile-time-series backup.avro concurrency=8
+
+
+
+
 List instances in a project
 
 Usage:
@@ -290,10 +353,11 @@ Usage:
 Read from a single row
 
 Usage:
-	cbt lookup <table-id> <row-key> [columns=<family>:<qualifier>,...] [cells-per-column=<n>]  [app-profile=<app profile id>]
+	cbt lookup <table-id> <row-key> [columns=<family>:<qualifier>,...] [cells-per-column=<n>]  [filter=<filter>] [app-profile=<app profile id>]
 	  row-key                             String or raw bytes. Raw bytes must be enclosed in single quotes and have a dollar-sign prefix
 	  columns=<family>:<qualifier>,...    Read only these columns, comma-separated
 	  cells-per-column=<n>                Read only this number of cells per column
+	  filter=<filter>                     Read only cells matching this filter (see 'cbt help read')
 	  app-profile=<app-profile-id>        The app profile ID to use for the request
 
 	 Example: cbt lookup mobile-time-series phone#4c410523#20190501 columns=stats_summary:os_build,os_name cells-per-column=1
@@ -324,7 +388,7 @@ Usage:
 Read rows
 
 Usage:
-	cbt read <table-id> [start=<row-key>] [end=<row-key>] [prefix=<row-key-prefix>] [regex=<regex>] [columns=<family>:<qualifier>,...] [count=<n>] [cells-per-column=<n>] [app-profile=<app-profile-id>]
+	cbt read <table-id> [start=<row-key>] [end=<row-key>] [prefix=<row-key-prefix>] [regex=<regex>] [columns=<family>:<qualifier>,...] [count=<n>] [cells-per-column=<n>] [filter=<filter>] [app-profile=<app-profile-id>]
 	  start=<row-key>                     Start reading at this row
 	  end=<row-row>                       Stop reading before this row
 	  prefix=<row-key-prefix>             Read rows with this prefix
@@ -332,12 +396,37 @@ Usage:
 	  columns=<family>:<qualifier>,...    Read only these columns, comma-separated
 	  count=<n>                           Read only this many rows
 	  cells-per-column=<n>                Read only this many cells per column
+	  filter=<filter>                     Read only cells matching this filter
 	  app-profile=<app-profile-id>        The app profile ID to use for the request
 
+	    Filters have this syntax, which the String method of bigtable.Filter also uses:
+	      row("<regex>")                            Cells of rows whose keys match the regex
+	      family("<regex>")                         Cells of families matching the regex
+	      column("<regex>")                         Cells of columns whose qualifiers match the regex
+	      value("<regex>")                          Cells whose values match the regex
+	      latest(<n>)                               The latest n cells of each column
+	      column_range("<family>", "<start>", "<end>")
+	                                                Cells of columns of the family from start until end
+	      value_range("<start>", "<end>")           Cells with values from start until end
+	      timestamp_range(<start>, <end>)           Cells with timestamps from start until end, in
+	                                                microseconds or as quoted RFC 3339 times
+	      cells_per_row_offset(<n>)                 All but the first n cells of each row
+	      cells_per_row_limit(<n>)                  The first n cells of each row
+	      sample(<p>)                               Rows sampled with probability p
+	      strip_value()                             Cells with their values replaced by empty values
+	      pass_all()                                All cells
+	      block_all()                               No cells
+	      condition(<filter>, <true>[, <false>])    The true filter for rows with cells matching the
+	                                                first filter, the false filter for other rows
+	      (<filter> | <filter> | ...)               The cells matching each filter in turn (a chain)
+	      (<filter> + <filter> + ...)               The cells matching any of the filters (an interleave)
+	    Strings are Go string literals; an empty string is no bound of a range.
+
 	    Examples: (see 'set' examples to create data to read)
 	      cbt read mobile-time-series prefix=phone columns=stats_summary:os_build,os_name count=10
 	      cbt read mobile-time-series start=phone#4c410523#20190501 end=phone#4c410523#20190601
 	      cbt read mobile-time-series regex="phone.*" cells-per-column=1
+	      cbt read mobile-time-series filter='(column("os_.*") | timestamp_range("2019-05-01T00:00:00Z", ""))'
 
 	   Note: Using a regex without also specifying start, end, prefix, or count results in a full
 	   table scan, which can be slow.
@@ -0,0 +1,375 @@
+/*
+Copyright 2020 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"text/scanner"
+	"time"
+
+	"cloud.google.com/go/bigtable"
+)
+
+// filterHelp describes the filter syntax in the usage of commands.
+const filterHelp = `    Filters have this syntax, which the String method of bigtable.Filter also uses:
+      row("<regex>")                            Cells of rows whose keys match the regex
+      family("<regex>")                         Cells of families matching the regex
+      column("<regex>")                         Cells of columns whose qualifiers match the regex
+      value("<regex>")                          Cells whose values match the regex
+      latest(<n>)                               The latest n cells of each column
+      column_range("<family>", "<start>", "<end>")
+                                                Cells of columns of the family from start until end
+      value_range("<start>", "<end>")           Cells with values from start until end
+      timestamp_range(<start>, <end>)           Cells with timestamps from start until end, in
+                                                microseconds or as quoted RFC 3339 times
+      cells_per_row_offset(<n>)                 All but the first n cells of each row
+      cells_per_row_limit(<n>)                  The first n cells of each row
+      sample(<p>)                               Rows sampled with probability p
+      strip_value()                             Cells with their values replaced by empty values
+      pass_all()                                All cells
+      block_all()                               No cells
+      condition(<filter>, <true>[, <false>])    The true filter for rows with cells matching the
+                                                first filter, the false filter for other rows
+      (<filter> | <filter> | ...)               The cells matching each filter in turn (a chain)
+      (<filter> + <filter> + ...)               The cells matching any of the filters (an interleave)
+    Strings are Go string literals; an empty string is no bound of a range.`
+
+// parseFilter parses a filter in the syntax of the String method of
+// bigtable.Filter:
+//     filter ::= term ("|" term)* | term ("+" term)*
+//     term   ::= "(" [filter] ")" | name "(" [arg ("," arg)*] ")"
+//     arg    ::= string | number | filter
+func parseFilter(s string) (bigtable.Filter, error) {
+	p := &filterParser{}
+	p.s.Init(strings.NewReader(s))
+	p.s.Mode = scanner.ScanIdents | scanner.ScanInts | scanner.ScanFloats | scanner.ScanStrings | scanner.ScanRawStrings
+	p.s.Error = func(_ *scanner.Scanner, msg string) {
+		if p.scanErr == nil {
+			p.scanErr = p.errorf("%s", msg)
+		}
+	}
+	p.next()
+	f, err := p.filter()
+	if err == nil && p.tok != scanner.EOF {
+		err = p.errorf("unexpected %s", p.s.TokenText())
+	}
+	if p.scanErr != nil {
+		err = p.scanErr
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid filter: %v", err)
+	}
+	return f, nil
+}
+
+type filterParser struct {
+	s       scanner.Scanner
+	tok     rune
+	scanErr error
+}
+
+func (p *filterParser) next() { p.tok = p.s.Scan() }
+
+func (p *filterParser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("at offset %d: %s", p.s.Position.Offset, fmt.Sprintf(format, args...))
+}
+
+func (p *filterParser) expect(tok rune) error {
+	if p.tok != tok {
+		if p.tok == scanner.EOF {
+			return p.errorf("want %q, got end of filter", tok)
+		}
+		return p.errorf("want %q, got %s", tok, p.s.TokenText())
+	}
+	p.next()
+	return nil
+}
+
+func (p *filterParser) filter() (bigtable.Filter, error) {
+	f, err := p.term()
+	if err != nil {
+		return nil, err
+	}
+	if p.tok != '|' && p.tok != '+' {
+		return f, nil
+	}
+	return p.list(f)
+}
+
+// list parses the rest of a chain or interleave whose first filter is f.
+func (p *filterParser) list(f bigtable.Filter) (bigtable.Filter, error) {
+	op := p.tok
+	sub := []bigtable.Filter{f}
+	for p.tok == '|' || p.tok == '+' {
+		if p.tok != op {
+			return nil, p.errorf("cannot mix | and + without parentheses")
+		}
+		p.next()
+		f, err := p.term()
+		if err != nil {
+			return nil, err
+		}
+		sub = append(sub, f)
+	}
+	if op == '|' {
+		return bigtable.ChainFilters(sub...), nil
+	}
+	return bigtable.InterleaveFilters(sub...), nil
+}
+
+func (p *filterParser) term() (bigtable.Filter, error) {
+	switch p.tok {
+	case '(':
+		// A parenthesized filter is a chain, as in the String form of a
+		// chain of one filter.
+		p.next()
+		if p.tok == ')' {
+			p.next()
+			return bigtable.ChainFilters(), nil
+		}
+		f, err := p.term()
+		if err != nil {
+			return nil, err
+		}
+		if p.tok == '|' || p.tok == '+' {
+			if f, err = p.list(f); err != nil {
+				return nil, err
+			}
+		} else {
+			f = bigtable.ChainFilters(f)
+		}
+		if err := p.expect(')'); err != nil {
+			return nil, err
+		}
+		return f, nil
+
+	case scanner.Ident:
+		name := p.s.TokenText()
+		newFilter, ok := filterFuncs[name]
+		if !ok {
+			return nil, p.errorf("unknown filter %q", name)
+		}
+		p.next()
+		if err := p.expect('('); err != nil {
+			return nil, err
+		}
+		var args []interface{}
+		if p.tok != ')' {
+			for {
+				arg, err := p.arg()
+				if err != nil {
+					return nil, err
+				}
+				args = append(args, arg)
+				if p.tok != ',' {
+					break
+				}
+				p.next()
+			}
+		}
+		if err := p.expect(')'); err != nil {
+			return nil, err
+		}
+		f, err := newFilter(args)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", name, err)
+		}
+		return f, nil
+
+	case scanner.EOF:
+		return nil, p.errorf("unexpected end of filter")
+
+	default:
+		return nil, p.errorf("unexpected %s", p.s.TokenText())
+	}
+}
+
+// arg returns a string, an int64, a float64 or a bigtable.Filter.
+func (p *filterParser) arg() (interface{}, error) {
+	sign := ""
+	if p.tok == '-' {
+		sign = "-"
+		p.next()
+		if p.tok != scanner.Int && p.tok != scanner.Float {
+			return nil, p.errorf("want a number after -")
+		}
+	}
+	text := p.s.TokenText()
+	switch p.tok {
+	case scanner.String, scanner.RawString:
+		p.next()
+		s, err := strconv.Unquote(text)
+		if err != nil {
+			return nil, p.errorf("bad string %s", text)
+		}
+		return s, nil
+
+	case scanner.Int:
+		p.next()
+		n, err := strconv.ParseInt(sign+text, 0, 64)
+		if err != nil {
+			return nil, p.errorf("bad integer %s: %v", text, err)
+		}
+		return n, nil
+
+	case scanner.Float:
+		p.next()
+		f, err := strconv.ParseFloat(sign+text, 64)
+		if err != nil {
+			return nil, p.errorf("bad number %s: %v", text, err)
+		}
+		return f, nil
+
+	default:
+		return p.filter()
+	}
+}
+
+var filterFuncs = map[string]func(args []interface{}) (bigtable.Filter, error){
+	"row":                  regexpFilter(bigtable.RowKeyFilter),
+	"family":               regexpFilter(bigtable.FamilyFilter),
+	"column":               regexpFilter(bigtable.ColumnFilter),
+	"value":                regexpFilter(bigtable.ValueFilter),
+	"latest":               countFilter(bigtable.LatestNFilter),
+	"cells_per_row_offset": countFilter(bigtable.CellsPerRowOffsetFilter),
+	"cells_per_row_limit":  countFilter(bigtable.CellsPerRowLimitFilter),
+	"strip_value":          constFilter(bigtable.StripValueFilter),
+	"pass_all":             constFilter(bigtable.PassAllFilter),
+	"block_all":            constFilter(bigtable.BlockAllFilter),
+
+	"column_range": func(args []interface{}) (bigtable.Filter, error) {
+		s, err := stringArgs(args, 3)
+		if err != nil {
+			return nil, err
+		}
+		return bigtable.ColumnRangeFilter(s[0], s[1], s[2]), nil
+	},
+
+	"value_range": func(args []interface{}) (bigtable.Filter, error) {
+		s, err := stringArgs(args, 2)
+		if err != nil {
+			return nil, err
+		}
+		var start, end []byte
+		if s[0] != "" {
+			start = []byte(s[0])
+		}
+		if s[1] != "" {
+			end = []byte(s[1])
+		}
+		return bigtable.ValueRangeFilter(start, end), nil
+	},
+
+	"timestamp_range": func(args []interface{}) (bigtable.Filter, error) {
+		if len(args) != 2 {
+			return nil, fmt.Errorf("want 2 arguments, got %d", len(args))
+		}
+		var ts [2]bigtable.Timestamp
+		for i, arg := range args {
+			switch arg := arg.(type) {
+			case int64:
+				ts[i] = bigtable.Timestamp(arg)
+			case string:
+				if arg == "" {
+					continue
+				}
+				t, err := time.Parse(time.RFC3339Nano, arg)
+				if err != nil {
+					return nil, fmt.Errorf("argument %d: %v", i+1, err)
+				}
+				ts[i] = bigtable.Time(t)
+			default:
+				return nil, fmt.Errorf("argument %d: want a timestamp", i+1)
+			}
+		}
+		return bigtable.TimestampRangeFilterMicros(ts[0], ts[1]), nil
+	},
+
+	"sample": func(args []interface{}) (bigtable.Filter, error) {
+		if len(args) != 1 {
+			return nil, fmt.Errorf("want 1 argument, got %d", len(args))
+		}
+		p, ok := args[0].(float64)
+		if !ok || p <= 0 || p >= 1 {
+			return nil, errors.New("want a probability between 0 and 1")
+		}
+		return bigtable.RowSampleFilter(p), nil
+	},
+
+	"condition": func(args []interface{}) (bigtable.Filter, error) {
+		if len(args) != 2 && len(args) != 3 {
+			return nil, fmt.Errorf("want 2 or 3 arguments, got %d", len(args))
+		}
+		var f [3]bigtable.Filter
+		for i, arg := range args {
+			var ok bool
+			if f[i], ok = arg.(bigtable.Filter); !ok {
+				return nil, fmt.Errorf("argument %d: want a filter", i+1)
+			}
+		}
+		return bigtable.ConditionFilter(f[0], f[1], f[2]), nil
+	},
+}
+
+func regexpFilter(newFilter func(string) bigtable.Filter) func([]interface{}) (bigtable.Filter, error) {
+	return func(args []interface{}) (bigtable.Filter, error) {
+		s, err := stringArgs(args, 1)
+		if err != nil {
+			return nil, err
+		}
+		return newFilter(s[0]), nil
+	}
+}
+
+func countFilter(newFilter func(int) bigtable.Filter) func([]interface{}) (bigtable.Filter, error) {
+	return func(args []interface{}) (bigtable.Filter, error) {
+		if len(args) != 1 {
+			return nil, fmt.Errorf("want 1 argument, got %d", len(args))
+		}
+		n, ok := args[0].(int64)
+		if !ok || n < 0 || n > 1<<31-1 {
+			return nil, errors.New("want a non-negative integer")
+		}
+		return newFilter(int(n)), nil
+	}
+}
+
+func constFilter(newFilter func() bigtable.Filter) func([]interface{}) (bigtable.Filter, error) {
+	return func(args []interface{}) (bigtable.Filter, error) {
+		if len(args) != 0 {
+			return nil, fmt.Errorf("want no arguments, got %d", len(args))
+		}
+		return newFilter(), nil
+	}
+}
+
+func stringArgs(args []interface{}, n int) ([]string, error) {
+	if len(args) != n {
+		return nil, fmt.Errorf("want %d arguments, got %d", n, len(args))
+	}
+	s := make([]string, n)
+	for i, arg := range args {
+		var ok bool
+		if s[i], ok = arg.(string); !ok {
+			return nil, fmt.Errorf("argument %d: want a string", i+1)
+		}
+	}
+	return s, nil
+}
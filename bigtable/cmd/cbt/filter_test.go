@@ -0,0 +1,197 @@
+/*
+Copyright 2020 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/bigtable"
+)
+
+func TestParseFilter(t *testing.T) {
+	for _, test := range []struct {
+		in   string
+		want bigtable.Filter
+	}{
+		{`row("a.*")`, bigtable.RowKeyFilter("a.*")},
+		{"row(`a\\d+`)", bigtable.RowKeyFilter(`a\d+`)},
+		{`family("f")`, bigtable.FamilyFilter("f")},
+		{`column("q\x00")`, bigtable.ColumnFilter("q\x00")},
+		{`value("v|w")`, bigtable.ValueFilter("v|w")},
+		{`latest(3)`, bigtable.LatestNFilter(3)},
+		{`strip_value()`, bigtable.StripValueFilter()},
+		{`pass_all()`, bigtable.PassAllFilter()},
+		{`block_all()`, bigtable.BlockAllFilter()},
+		{`cells_per_row_offset(2)`, bigtable.CellsPerRowOffsetFilter(2)},
+		{`cells_per_row_limit(0x10)`, bigtable.CellsPerRowLimitFilter(16)},
+		{`sample(0.25)`, bigtable.RowSampleFilter(0.25)},
+		{`column_range("f", "a", "")`, bigtable.ColumnRangeFilter("f", "a", "")},
+		{`value_range("", "\xff")`, bigtable.ValueRangeFilter(nil, []byte{0xff})},
+		{`timestamp_range(1000, 0)`, bigtable.TimestampRangeFilterMicros(1000, 0)},
+		{
+			`timestamp_range("2020-01-02T03:04:05Z", "")`,
+			bigtable.TimestampRangeFilter(time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC), time.Time{}),
+		},
+		{`()`, bigtable.ChainFilters()},
+		{`((latest(1)))`, bigtable.ChainFilters(bigtable.ChainFilters(bigtable.LatestNFilter(1)))},
+		{
+			` family("f") | column("q")|latest(1) `,
+			bigtable.ChainFilters(bigtable.FamilyFilter("f"), bigtable.ColumnFilter("q"), bigtable.LatestNFilter(1)),
+		},
+		{
+			`family("f") + (family("g") | latest(2))`,
+			bigtable.InterleaveFilters(
+				bigtable.FamilyFilter("f"),
+				bigtable.ChainFilters(bigtable.FamilyFilter("g"), bigtable.LatestNFilter(2))),
+		},
+		{
+			`condition(value("x"), strip_value())`,
+			bigtable.ConditionFilter(bigtable.ValueFilter("x"), bigtable.StripValueFilter(), nil),
+		},
+		{
+			`condition((family("f") | value("x")), pass_all(), (row("a") + row("b")))`,
+			bigtable.ConditionFilter(
+				bigtable.ChainFilters(bigtable.FamilyFilter("f"), bigtable.ValueFilter("x")),
+				bigtable.PassAllFilter(),
+				bigtable.InterleaveFilters(bigtable.RowKeyFilter("a"), bigtable.RowKeyFilter("b"))),
+		},
+	} {
+		got, err := parseFilter(test.in)
+		if err != nil {
+			t.Errorf("parseFilter(%q): %v", test.in, err)
+			continue
+		}
+		if got.String() != test.want.String() {
+			t.Errorf("parseFilter(%q) = %s, want %s", test.in, got, test.want)
+		}
+	}
+}
+
+// The String form of every filter parses back to the same filter.
+func TestParseFilterString(t *testing.T) {
+	for _, f := range []bigtable.Filter{
+		bigtable.RowKeyFilter(`"quoted" \d (a|b) , +`),
+		bigtable.FamilyFilter("fam"),
+		bigtable.ColumnFilter("\xff\x00binary"),
+		bigtable.ValueFilter(""),
+		bigtable.LatestNFilter(5),
+		bigtable.StripValueFilter(),
+		bigtable.TimestampRangeFilterMicros(1000, 2000),
+		bigtable.TimestampRangeFilterMicros(-1, 0),
+		bigtable.ColumnRangeFilter("f", "", "z"),
+		bigtable.ValueRangeFilter([]byte("a"), nil),
+		bigtable.CellsPerRowOffsetFilter(1),
+		bigtable.CellsPerRowLimitFilter(2),
+		bigtable.RowSampleFilter(1e-7),
+		bigtable.PassAllFilter(),
+		bigtable.BlockAllFilter(),
+		bigtable.ChainFilters(),
+		bigtable.ChainFilters(bigtable.FamilyFilter("f")),
+		bigtable.InterleaveFilters(bigtable.FamilyFilter("f"), bigtable.FamilyFilter("g")),
+		bigtable.ConditionFilter(bigtable.ValueFilter("v"), nil, bigtable.StripValueFilter()),
+		bigtable.ChainFilters(
+			bigtable.InterleaveFilters(bigtable.ColumnFilter("a"), bigtable.ChainFilters(bigtable.ColumnFilter("b"))),
+			bigtable.ConditionFilter(bigtable.PassAllFilter(), bigtable.LatestNFilter(1), nil)),
+	} {
+		got, err := parseFilter(f.String())
+		if err != nil {
+			t.Errorf("parseFilter(%q): %v", f, err)
+			continue
+		}
+		if got.String() != f.String() {
+			t.Errorf("parseFilter(%q) = %s", f, got)
+		}
+	}
+}
+
+func TestParseFilterErrors(t *testing.T) {
+	for _, test := range []struct {
+		in, want string
+	}{
+		{``, "unexpected end of filter"},
+		{`row`, `want '('`},
+		{`row("a"`, `want ')'`},
+		{`row("a") extra`, "unexpected extra"},
+		{`rows("a")`, `unknown filter "rows"`},
+		{`row(1)`, "argument 1: want a string"},
+		{`row("a", "b")`, "want 1 arguments, got 2"},
+		{`row("unterminated)`, "literal not terminated"},
+		{`latest("1")`, "want a non-negative integer"},
+		{`latest(-1)`, "want a non-negative integer"},
+		{`latest(1.5)`, "want a non-negative integer"},
+		{`strip_value(1)`, "want no arguments"},
+		{`sample(1)`, "want a probability"},
+		{`sample(2.0)`, "want a probability"},
+		{`timestamp_range("yesterday", 0)`, "argument 1"},
+		{`timestamp_range(pass_all(), 0)`, "argument 1: want a timestamp"},
+		{`condition(pass_all())`, "want 2 or 3 arguments"},
+		{`condition(pass_all(), "x")`, "argument 2: want a filter"},
+		{`row("a") | row("b") + row("c")`, "cannot mix | and +"},
+		{`row("a") |`, "unexpected end of filter"},
+		{`latest(-)`, "want a number after -"},
+	} {
+		_, err := parseFilter(test.in)
+		if err == nil {
+			t.Errorf("parseFilter(%q) succeeded, want error", test.in)
+			continue
+		}
+		if !strings.Contains(err.Error(), test.want) {
+			t.Errorf("parseFilter(%q): got error %q, want it to contain %q", test.in, err, test.want)
+		}
+	}
+}
+
+func TestFilterRead(t *testing.T) {
+	ctx := context.Background()
+	tbl, cleanup := setupTable(t)
+	defer cleanup()
+
+	for _, row := range []string{"a", "b", "c"} {
+		mut := bigtable.NewMutation()
+		mut.Set("cf", "q", 1000, []byte(row+"1"))
+		mut.Set("cf", "q", 2000, []byte(row+"2"))
+		mut.Set("other", "q", 1000, []byte("x"))
+		if err := tbl.Apply(ctx, row, mut); err != nil {
+			t.Fatal(err)
+		}
+	}
+	f, err := parseFilter(`(row("[ab]") | family("cf") | latest(1)) + (row("c") | timestamp_range(0, 2000))`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	err = tbl.ReadRows(ctx, bigtable.InfiniteRange(""), func(r bigtable.Row) bool {
+		for _, items := range r {
+			for _, item := range items {
+				got = append(got, r.Key()+"/"+item.Column+"="+string(item.Value))
+			}
+		}
+		return true
+	}, bigtable.RowFilter(f))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(got)
+	want := "a/cf:q=a2 b/cf:q=b2 c/cf:q=c1 c/other:q=x"
+	if strings.Join(got, " ") != want {
+		t.Errorf("read %v, want %s", got, want)
+	}
+}
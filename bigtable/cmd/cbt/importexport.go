@@ -0,0 +1,646 @@
+/*
+Copyright 2020 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/bigtable"
+)
+
+const (
+	defaultKeyField          = "rowkey"
+	defaultImportBatchSize   = 500
+	defaultImportConcurrency = 4
+	progressInterval         = 5 * time.Second
+)
+
+// cell is a cell of a row in an imported or exported file.
+type cell struct {
+	family, qualifier string
+	timestamp         bigtable.Timestamp
+	value             []byte
+}
+
+// rowRecord is a row in an imported or exported file.
+type rowRecord struct {
+	key   string
+	cells []cell
+}
+
+// newRowRecord returns the cells of r, ordered by family and then as read:
+// by qualifier, newest first.
+func newRowRecord(r bigtable.Row) *rowRecord {
+	rec := &rowRecord{key: r.Key()}
+	var fams []string
+	for fam := range r {
+		fams = append(fams, fam)
+	}
+	sort.Strings(fams)
+	for _, fam := range fams {
+		for _, item := range r[fam] {
+			rec.cells = append(rec.cells, cell{
+				family:    fam,
+				qualifier: strings.TrimPrefix(item.Column, fam+":"),
+				timestamp: item.Timestamp,
+				value:     item.Value,
+			})
+		}
+	}
+	return rec
+}
+
+// latest returns the value of the newest cell of a column, and false if the
+// row has no cells in the column.
+func (r *rowRecord) latest(family, qualifier string) ([]byte, bool) {
+	for _, c := range r.cells {
+		if c.family == family && c.qualifier == qualifier {
+			return c.value, true
+		}
+	}
+	return nil, false
+}
+
+func (r *rowRecord) mutation() *bigtable.Mutation {
+	mut := bigtable.NewMutation()
+	for _, c := range r.cells {
+		mut.Set(c.family, c.qualifier, c.timestamp, c.value)
+	}
+	return mut
+}
+
+type rowReader interface {
+	// read returns the next row, or io.EOF at the end of the file.
+	read() (*rowRecord, error)
+}
+
+type rowWriter interface {
+	write(*rowRecord) error
+	// close flushes the rows written, without closing the underlying file.
+	close() error
+}
+
+// columnMapping maps the fields of CSV and JSON records to columns.
+type columnMapping struct {
+	key     string            // the field holding the row key
+	family  string            // the family of fields that are not mapped
+	columns map[string]string // field name to family:qualifier
+	fields  map[string]string // family:qualifier to field name
+}
+
+// parseColumnMapping parses the key, family and mapping arguments of import
+// and export. mapping is of the form <field>=<family>:<qualifier>,...
+func parseColumnMapping(key, family, mapping string) (*columnMapping, error) {
+	if key == "" {
+		key = defaultKeyField
+	}
+	m := &columnMapping{
+		key:     key,
+		family:  family,
+		columns: map[string]string{},
+		fields:  map[string]string{},
+	}
+	for _, entry := range strings.FieldsFunc(mapping, func(c rune) bool { return c == ',' }) {
+		i := strings.Index(entry, "=")
+		if i <= 0 {
+			return nil, fmt.Errorf("Bad mapping %q: want <field>=<family>:<qualifier>", entry)
+		}
+		field, column := entry[:i], entry[i+1:]
+		if j := strings.Index(column, ":"); j <= 0 {
+			return nil, fmt.Errorf("Bad mapping %q: want <field>=<family>:<qualifier>", entry)
+		}
+		m.columns[field] = column
+		m.fields[column] = field
+	}
+	return m, nil
+}
+
+// column returns the column of a field. Fields that are not mapped name
+// their column as <family>:<qualifier>, or are in the default family.
+func (m *columnMapping) column(field string) (family, qualifier string, err error) {
+	column, ok := m.columns[field]
+	if !ok {
+		column = field
+	}
+	if i := strings.Index(column, ":"); i > 0 {
+		return column[:i], column[i+1:], nil
+	}
+	if m.family == "" {
+		return "", "", fmt.Errorf("field %q is not of the form <family>:<qualifier>; use family= or mapping= to map it to a column", field)
+	}
+	return m.family, column, nil
+}
+
+// field returns the field name of a column.
+func (m *columnMapping) field(family, qualifier string) string {
+	if f, ok := m.fields[family+":"+qualifier]; ok {
+		return f
+	}
+	if family == m.family {
+		return qualifier
+	}
+	return family + ":" + qualifier
+}
+
+// csvReader reads rows from a CSV file whose first record names the fields.
+// Empty fields have no cells.
+type csvReader struct {
+	r       *csv.Reader
+	ts      bigtable.Timestamp
+	keyIdx  int
+	columns [][2]string // family and qualifier of each field
+}
+
+func newCSVReader(r io.Reader, m *columnMapping, ts bigtable.Timestamp) (*csvReader, error) {
+	cr := &csvReader{r: csv.NewReader(r), ts: ts, keyIdx: -1}
+	header, err := cr.r.Read()
+	if err == io.EOF {
+		return nil, errors.New("CSV file has no header")
+	}
+	if err != nil {
+		return nil, err
+	}
+	for i, field := range header {
+		if field == m.key {
+			cr.keyIdx = i
+			cr.columns = append(cr.columns, [2]string{})
+			continue
+		}
+		fam, qual, err := m.column(field)
+		if err != nil {
+			return nil, err
+		}
+		cr.columns = append(cr.columns, [2]string{fam, qual})
+	}
+	if cr.keyIdx < 0 {
+		return nil, fmt.Errorf("CSV header has no row key field %q", m.key)
+	}
+	return cr, nil
+}
+
+func (cr *csvReader) read() (*rowRecord, error) {
+	record, err := cr.r.Read()
+	if err != nil {
+		return nil, err
+	}
+	rec := &rowRecord{key: record[cr.keyIdx]}
+	for i, v := range record {
+		if i == cr.keyIdx || v == "" {
+			continue
+		}
+		rec.cells = append(rec.cells, cell{
+			family:    cr.columns[i][0],
+			qualifier: cr.columns[i][1],
+			timestamp: cr.ts,
+			value:     []byte(v),
+		})
+	}
+	return rec, nil
+}
+
+// csvWriter writes the latest value of the given columns of each row.
+type csvWriter struct {
+	w       *csv.Writer
+	columns [][2]string
+}
+
+func newCSVWriter(w io.Writer, columns [][2]string, m *columnMapping) (*csvWriter, error) {
+	cw := &csvWriter{w: csv.NewWriter(w), columns: columns}
+	header := []string{m.key}
+	for _, c := range columns {
+		header = append(header, m.field(c[0], c[1]))
+	}
+	return cw, cw.w.Write(header)
+}
+
+func (cw *csvWriter) write(r *rowRecord) error {
+	record := []string{r.key}
+	for _, c := range cw.columns {
+		v, _ := r.latest(c[0], c[1])
+		record = append(record, string(v))
+	}
+	return cw.w.Write(record)
+}
+
+func (cw *csvWriter) close() error {
+	cw.w.Flush()
+	return cw.w.Error()
+}
+
+// jsonReader reads rows from a file of JSON objects, usually one per line.
+// String fields hold the value of a cell. Other fields hold their JSON text,
+// except for nulls, which have no cells.
+type jsonReader struct {
+	d  *json.Decoder
+	m  *columnMapping
+	ts bigtable.Timestamp
+}
+
+func newJSONReader(r io.Reader, m *columnMapping, ts bigtable.Timestamp) *jsonReader {
+	return &jsonReader{d: json.NewDecoder(r), m: m, ts: ts}
+}
+
+func (jr *jsonReader) read() (*rowRecord, error) {
+	var obj map[string]json.RawMessage
+	if err := jr.d.Decode(&obj); err != nil {
+		return nil, err
+	}
+	rec := &rowRecord{}
+	if err := json.Unmarshal(obj[jr.m.key], &rec.key); err != nil || obj[jr.m.key] == nil {
+		return nil, fmt.Errorf("JSON record has no string row key field %q", jr.m.key)
+	}
+	var fields []string
+	for f := range obj {
+		if f != jr.m.key {
+			fields = append(fields, f)
+		}
+	}
+	sort.Strings(fields)
+	for _, f := range fields {
+		raw := obj[f]
+		if string(raw) == "null" {
+			continue
+		}
+		fam, qual, err := jr.m.column(f)
+		if err != nil {
+			return nil, err
+		}
+		var s string
+		value := []byte(raw)
+		if err := json.Unmarshal(raw, &s); err == nil {
+			value = []byte(s)
+		} else {
+			var buf bytes.Buffer
+			if err := json.Compact(&buf, raw); err != nil {
+				return nil, err
+			}
+			value = buf.Bytes()
+		}
+		rec.cells = append(rec.cells, cell{family: fam, qualifier: qual, timestamp: jr.ts, value: value})
+	}
+	return rec, nil
+}
+
+// jsonWriter writes each row as a JSON object on its own line, holding the
+// latest value of each column of the row as a string.
+type jsonWriter struct {
+	w *bufio.Writer
+	m *columnMapping
+}
+
+func newJSONWriter(w io.Writer, m *columnMapping) *jsonWriter {
+	return &jsonWriter{w: bufio.NewWriter(w), m: m}
+}
+
+func (jw *jsonWriter) write(r *rowRecord) error {
+	var buf bytes.Buffer
+	writeField := func(name string, value []byte) {
+		if buf.Len() == 0 {
+			buf.WriteByte('{')
+		} else {
+			buf.WriteByte(',')
+		}
+		n, _ := json.Marshal(name)
+		v, _ := json.Marshal(string(value))
+		buf.Write(n)
+		buf.WriteByte(':')
+		buf.Write(v)
+	}
+	writeField(jw.m.key, []byte(r.key))
+	seen := map[[2]string]bool{}
+	for _, c := range r.cells {
+		col := [2]string{c.family, c.qualifier}
+		if seen[col] {
+			continue // an older version
+		}
+		seen[col] = true
+		writeField(jw.m.field(c.family, c.qualifier), c.value)
+	}
+	buf.WriteString("}\n")
+	_, err := jw.w.Write(buf.Bytes())
+	return err
+}
+
+func (jw *jsonWriter) close() error {
+	return jw.w.Flush()
+}
+
+// fileFormat returns the format argument, or the format implied by the
+// file's extension.
+func fileFormat(format, file string) (string, error) {
+	if format == "" {
+		switch strings.ToLower(filepath.Ext(file)) {
+		case ".csv":
+			format = "csv"
+		case ".json", ".jsonl", ".ndjson":
+			format = "jsonl"
+		case ".avro":
+			format = "avro"
+		default:
+			return "", fmt.Errorf("cannot tell the format of %q; use format=csv, format=jsonl or format=avro", file)
+		}
+	}
+	switch format {
+	case "csv", "jsonl", "avro":
+		return format, nil
+	}
+	return "", fmt.Errorf("Unknown format %q; must be csv, jsonl or avro", format)
+}
+
+// progress reports the number of rows processed, at most once per interval.
+type progress struct {
+	w        io.Writer
+	verb     string
+	interval time.Duration
+	n        int64
+	last     time.Time
+}
+
+func newProgress(w io.Writer, verb string) *progress {
+	return &progress{w: w, verb: verb, interval: progressInterval, last: time.Now()}
+}
+
+func (p *progress) add(n int) {
+	p.n += int64(n)
+	if now := time.Now(); now.Sub(p.last) >= p.interval {
+		fmt.Fprintf(p.w, "%s %d rows\n", p.verb, p.n)
+		p.last = now
+	}
+}
+
+type bulkApplier interface {
+	ApplyBulk(ctx context.Context, rowKeys []string, muts []*bigtable.Mutation, opts ...bigtable.ApplyOption) ([]error, error)
+}
+
+// importRows applies the rows read from r to tbl, in batches of batchSize
+// rows with up to concurrency batches in flight. It returns the number of
+// rows imported. If some rows fail, it returns the first error along with
+// the number of failures.
+func importRows(ctx context.Context, tbl bulkApplier, r rowReader, batchSize, concurrency int, prog *progress) (int64, error) {
+	type batch struct {
+		keys []string
+		muts []*bigtable.Mutation
+	}
+	var (
+		mu       sync.Mutex
+		imported int64
+		failed   int64
+		firstErr error
+		wg       sync.WaitGroup
+	)
+	fail := func(n int, err error) {
+		failed += int64(n)
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	batches := make(chan batch)
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for b := range batches {
+				errs, err := tbl.ApplyBulk(ctx, b.keys, b.muts)
+				mu.Lock()
+				ok := len(b.keys)
+				if err != nil {
+					fail(len(b.keys), err)
+					ok = 0
+				}
+				for i, err := range errs {
+					if err != nil {
+						fail(1, fmt.Errorf("row %q: %v", b.keys[i], err))
+						ok--
+					}
+				}
+				imported += int64(ok)
+				prog.add(len(b.keys))
+				mu.Unlock()
+			}
+		}()
+	}
+
+	var (
+		b       batch
+		read    int64 // rows read so far; the workers own imported and failed
+		readErr error
+	)
+	for {
+		rec, err := r.read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			readErr = fmt.Errorf("Reading row %d: %v", read+1, err)
+			break
+		}
+		read++
+		b.keys = append(b.keys, rec.key)
+		b.muts = append(b.muts, rec.mutation())
+		if len(b.keys) == batchSize {
+			batches <- b
+			b = batch{}
+		}
+	}
+	if readErr == nil && len(b.keys) > 0 {
+		batches <- b
+	}
+	close(batches)
+	wg.Wait()
+
+	if readErr != nil {
+		return imported, readErr
+	}
+	if failed > 0 {
+		return imported, fmt.Errorf("%d rows failed to import; the first error was: %v", failed, firstErr)
+	}
+	return imported, nil
+}
+
+// exportRows writes the rows of tbl in rr to w. It returns the number of
+// rows written.
+func exportRows(ctx context.Context, tbl *bigtable.Table, rr bigtable.RowSet, opts []bigtable.ReadOption, w rowWriter, prog *progress) (int64, error) {
+	var (
+		n        int64
+		writeErr error
+	)
+	err := tbl.ReadRows(ctx, rr, func(r bigtable.Row) bool {
+		if writeErr = w.write(newRowRecord(r)); writeErr != nil {
+			return false
+		}
+		n++
+		prog.add(1)
+		return true
+	}, opts...)
+	if writeErr != nil {
+		return n, fmt.Errorf("Writing rows: %v", writeErr)
+	}
+	if err != nil {
+		return n, fmt.Errorf("Reading rows: %v", err)
+	}
+	if err := w.close(); err != nil {
+		return n, fmt.Errorf("Writing rows: %v", err)
+	}
+	return n, nil
+}
+
+func doImport(ctx context.Context, args ...string) {
+	if len(args) < 2 {
+		log.Fatal("usage: cbt import <table-id> <file> [format=<csv|jsonl|avro>] [args ...]")
+	}
+	parsed, err := parseArgs(args[2:], []string{
+		"format", "key", "family", "mapping", "timestamp", "batch-size", "concurrency", "app-profile",
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	format, err := fileFormat(parsed["format"], args[1])
+	if err != nil {
+		log.Fatal(err)
+	}
+	m, err := parseColumnMapping(parsed["key"], parsed["family"], parsed["mapping"])
+	if err != nil {
+		log.Fatal(err)
+	}
+	ts := bigtable.Now().TruncateToMilliseconds()
+	if s := parsed["timestamp"]; s != "" {
+		n, err := strconv.ParseInt(s, 0, 64)
+		if err != nil {
+			log.Fatalf("Bad timestamp %q: %v", s, err)
+		}
+		ts = bigtable.Timestamp(n)
+	}
+	batchSize, concurrency := defaultImportBatchSize, defaultImportConcurrency
+	for arg, p := range map[string]*int{"batch-size": &batchSize, "concurrency": &concurrency} {
+		if s := parsed[arg]; s != "" {
+			if *p, err = strconv.Atoi(s); err != nil || *p < 1 {
+				log.Fatalf("Bad %s %q", arg, s)
+			}
+		}
+	}
+
+	in := os.Stdin
+	if args[1] != "-" {
+		if in, err = os.Open(args[1]); err != nil {
+			log.Fatal(err)
+		}
+		defer in.Close()
+	}
+	var r rowReader
+	switch format {
+	case "csv":
+		r, err = newCSVReader(in, m, ts)
+	case "jsonl":
+		r = newJSONReader(in, m, ts)
+	case "avro":
+		r, err = newAvroReader(in)
+	}
+	if err != nil {
+		log.Fatalf("Reading %s: %v", args[1], err)
+	}
+
+	tbl := getClient(bigtable.ClientConfig{AppProfile: parsed["app-profile"]}).Open(args[0])
+	n, err := importRows(ctx, tbl, r, batchSize, concurrency, newProgress(os.Stderr, "Imported"))
+	fmt.Fprintf(os.Stderr, "Imported %d rows into %s\n", n, args[0])
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func doExport(ctx context.Context, args ...string) {
+	if len(args) < 2 {
+		log.Fatal("usage: cbt export <table-id> <file> [format=<csv|jsonl|avro>] [args ...]")
+	}
+	parsed, err := parseArgs(args[2:], []string{
+		"format", "key", "family", "mapping", "start", "end", "prefix", "regex", "columns", "count",
+		"cells-per-column", "filter", "app-profile",
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	format, err := fileFormat(parsed["format"], args[1])
+	if err != nil {
+		log.Fatal(err)
+	}
+	m, err := parseColumnMapping(parsed["key"], parsed["family"], parsed["mapping"])
+	if err != nil {
+		log.Fatal(err)
+	}
+	rr, opts, err := parseReadArgs(parsed)
+	if err != nil {
+		log.Fatal(err)
+	}
+	var csvColumns [][2]string
+	if format == "csv" {
+		for _, c := range strings.FieldsFunc(parsed["columns"], func(c rune) bool { return c == ',' }) {
+			i := strings.Index(c, ":")
+			if i <= 0 || i == len(c)-1 {
+				log.Fatalf("Bad column %q: CSV export requires columns of the form <family>:<qualifier>", c)
+			}
+			csvColumns = append(csvColumns, [2]string{c[:i], c[i+1:]})
+		}
+		if len(csvColumns) == 0 {
+			log.Fatal("CSV export requires columns=<family>:<qualifier>,...")
+		}
+	}
+
+	out := os.Stdout
+	if args[1] != "-" {
+		if out, err = os.Create(args[1]); err != nil {
+			log.Fatal(err)
+		}
+	}
+	var w rowWriter
+	switch format {
+	case "csv":
+		w, err = newCSVWriter(out, csvColumns, m)
+	case "jsonl":
+		w = newJSONWriter(out, m)
+	case "avro":
+		w, err = newAvroWriter(out)
+	}
+	if err != nil {
+		log.Fatalf("Writing %s: %v", args[1], err)
+	}
+
+	tbl := getClient(bigtable.ClientConfig{AppProfile: parsed["app-profile"]}).Open(args[0])
+	n, err := exportRows(ctx, tbl, rr, opts, w, newProgress(os.Stderr, "Exported"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	if out != os.Stdout {
+		if err := out.Close(); err != nil {
+			log.Fatal(err)
+		}
+	}
+	fmt.Fprintf(os.Stderr, "Exported %d rows from %s\n", n, args[0])
+}
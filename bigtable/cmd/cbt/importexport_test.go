@@ -0,0 +1,472 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"cloud.google.com/go/bigtable"
+	"cloud.google.com/go/bigtable/bttest"
+	"github.com/google/go-cmp/cmp"
+	"google.golang.org/api/option"
+	"google.golang.org/grpc"
+)
+
+var cmpRecords = cmp.AllowUnexported(rowRecord{}, cell{})
+
+func readAll(t *testing.T, r rowReader) []*rowRecord {
+	t.Helper()
+	var recs []*rowRecord
+	for {
+		rec, err := r.read()
+		if err == io.EOF {
+			return recs
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		recs = append(recs, rec)
+	}
+}
+
+func writeAll(t *testing.T, w rowWriter, recs []*rowRecord) {
+	t.Helper()
+	for _, rec := range recs {
+		if err := w.write(rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAvroRoundTrip(t *testing.T) {
+	var recs []*rowRecord
+	// Enough rows for several blocks.
+	for i := 0; i < 2500; i++ {
+		recs = append(recs, &rowRecord{
+			key: strings.Repeat("k", i%7) + string(rune('a'+i%26)),
+			cells: []cell{
+				{family: "f", qualifier: "q", timestamp: bigtable.Timestamp(i * 1000), value: []byte("v")},
+				{family: "f", qualifier: "q", timestamp: -1, value: []byte{0, 1, 2}},
+				{family: "g", qualifier: "", timestamp: 0, value: nil},
+			},
+		})
+	}
+	recs = append(recs, &rowRecord{key: "empty"})
+
+	var buf bytes.Buffer
+	w, err := newAvroWriter(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeAll(t, w, recs)
+	r, err := newAvroReader(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := readAll(t, r)
+	// Values are read back as empty rather than nil slices.
+	if diff := cmp.Diff(got, recs, cmpRecords, cmp.Comparer(func(a, b []byte) bool { return bytes.Equal(a, b) })); diff != "" {
+		t.Errorf("got=-, want=+:\n%s", diff)
+	}
+}
+
+func TestAvroSchema(t *testing.T) {
+	if err := checkAvroSchema([]byte(avroRowSchema)); err != nil {
+		t.Errorf("checkAvroSchema(avroRowSchema): %v", err)
+	}
+	// The schema written by the Dataflow templates' Java code annotates strings.
+	javaSchema := strings.Replace(avroRowSchema, `"type":"string"`, `"type":{"type":"string","avro.java.string":"String"}`, 1)
+	if err := checkAvroSchema([]byte(javaSchema)); err != nil {
+		t.Errorf("checkAvroSchema(%s): %v", javaSchema, err)
+	}
+	for _, schema := range []string{
+		`{"type":"record","name":"R","fields":[{"name":"key","type":"bytes"}]}`,
+		strings.Replace(avroRowSchema, `"type":"long"`, `"type":"int"`, 1),
+		`"bytes"`,
+	} {
+		if err := checkAvroSchema([]byte(schema)); err == nil {
+			t.Errorf("checkAvroSchema(%s) succeeded, want error", schema)
+		}
+	}
+	if _, err := newAvroReader(strings.NewReader("key,value\n")); err == nil {
+		t.Error("newAvroReader of a CSV file succeeded, want error")
+	}
+}
+
+func TestAvroCorrupt(t *testing.T) {
+	sync := bytes.Repeat([]byte{1}, avroSyncSize)
+	var hdr bytes.Buffer
+	hdr.Write(avroMagic)
+	appendAvroLong(&hdr, 1)
+	appendAvroBytes(&hdr, []byte("avro.schema"))
+	appendAvroBytes(&hdr, []byte(avroRowSchema))
+	appendAvroLong(&hdr, 0)
+	hdr.Write(sync)
+
+	// Lengths larger than the data that follows them are errors, rather
+	// than allocations of that size.
+	var hugeMeta bytes.Buffer
+	hugeMeta.Write(avroMagic)
+	appendAvroLong(&hugeMeta, 1)
+	appendAvroLong(&hugeMeta, 1<<50)
+	if _, err := newAvroReader(&hugeMeta); err == nil || !strings.Contains(err.Error(), "corrupt Avro data") {
+		t.Errorf("huge metadata key: got %v, want a corrupt Avro data error", err)
+	}
+
+	hugeBlock := bytes.NewBuffer(append([]byte(nil), hdr.Bytes()...))
+	appendAvroLong(hugeBlock, 1)
+	appendAvroLong(hugeBlock, 1<<50)
+	hugeBlock.WriteString("short")
+
+	var block bytes.Buffer
+	appendAvroLong(&block, 1<<50) // the length of the row key
+	hugeKey := bytes.NewBuffer(append([]byte(nil), hdr.Bytes()...))
+	appendAvroLong(hugeKey, 1)
+	appendAvroBytes(hugeKey, block.Bytes())
+	hugeKey.Write(sync)
+
+	for name, in := range map[string]*bytes.Buffer{"huge block": hugeBlock, "huge row key": hugeKey} {
+		r, err := newAvroReader(in)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if _, err := r.read(); err == nil || !strings.Contains(err.Error(), "corrupt Avro data") {
+			t.Errorf("%s: got %v, want a corrupt Avro data error", name, err)
+		}
+	}
+}
+
+func TestColumnMapping(t *testing.T) {
+	m, err := parseColumnMapping("id", "cf", "name=other:n,full=fam:a:b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		field, fam, qual string
+	}{
+		{"name", "other", "n"},
+		{"full", "fam", "a:b"},
+		{"q", "cf", "q"},
+		{"x:y", "x", "y"},
+	} {
+		fam, qual, err := m.column(test.field)
+		if err != nil {
+			t.Errorf("column(%q): %v", test.field, err)
+			continue
+		}
+		if fam != test.fam || qual != test.qual {
+			t.Errorf("column(%q) = %q, %q, want %q, %q", test.field, fam, qual, test.fam, test.qual)
+		}
+		if got := m.field(fam, qual); got != test.field {
+			t.Errorf("field(%q, %q) = %q, want %q", fam, qual, got, test.field)
+		}
+	}
+
+	m, err = parseColumnMapping("", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.key != defaultKeyField {
+		t.Errorf("key = %q, want %q", m.key, defaultKeyField)
+	}
+	if _, _, err := m.column("q"); err == nil {
+		t.Error("column of a field with no family succeeded, want error")
+	}
+	for _, mapping := range []string{"name", "=f:q", "name=q", "name=:q"} {
+		if _, err := parseColumnMapping("", "", mapping); err == nil {
+			t.Errorf("parseColumnMapping(%q) succeeded, want error", mapping)
+		}
+	}
+}
+
+func TestCSV(t *testing.T) {
+	m, err := parseColumnMapping("id", "cf", "name=other:n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	const in = "id,name,a,b\nr1,alice,1,\nr2,\"bob, jr\",,x\n"
+	r, err := newCSVReader(strings.NewReader(in), m, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := readAll(t, r)
+	want := []*rowRecord{
+		{key: "r1", cells: []cell{
+			{family: "other", qualifier: "n", timestamp: 1000, value: []byte("alice")},
+			{family: "cf", qualifier: "a", timestamp: 1000, value: []byte("1")},
+		}},
+		{key: "r2", cells: []cell{
+			{family: "other", qualifier: "n", timestamp: 1000, value: []byte("bob, jr")},
+			{family: "cf", qualifier: "b", timestamp: 1000, value: []byte("x")},
+		}},
+	}
+	if diff := cmp.Diff(got, want, cmpRecords); diff != "" {
+		t.Errorf("got=-, want=+:\n%s", diff)
+	}
+
+	var buf bytes.Buffer
+	w, err := newCSVWriter(&buf, [][2]string{{"other", "n"}, {"cf", "a"}, {"cf", "b"}}, m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeAll(t, w, want)
+	if got := buf.String(); got != in {
+		t.Errorf("CSV written:\n%s\nwant:\n%s", got, in)
+	}
+
+	for _, in := range []string{"", "name\nalice\n", "id,q\nr1,v\n"} {
+		m, _ := parseColumnMapping("id", "", "name=cf:n")
+		if _, err := newCSVReader(strings.NewReader(in), m, 0); err == nil {
+			t.Errorf("newCSVReader(%q) succeeded, want error", in)
+		}
+	}
+}
+
+func TestJSON(t *testing.T) {
+	m, err := parseColumnMapping("", "cf", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	const in = `{"rowkey":"r1","a":"x","other:b":{"n": [1, 2]},"c":null,"d":3}
+{"rowkey":"r2"}
+`
+	r := newJSONReader(strings.NewReader(in), m, 5)
+	got := readAll(t, r)
+	want := []*rowRecord{
+		{key: "r1", cells: []cell{
+			{family: "cf", qualifier: "a", timestamp: 5, value: []byte("x")},
+			{family: "cf", qualifier: "d", timestamp: 5, value: []byte("3")},
+			{family: "other", qualifier: "b", timestamp: 5, value: []byte(`{"n":[1,2]}`)},
+		}},
+		{key: "r2"},
+	}
+	if diff := cmp.Diff(got, want, cmpRecords); diff != "" {
+		t.Errorf("got=-, want=+:\n%s", diff)
+	}
+
+	var buf bytes.Buffer
+	w := newJSONWriter(&buf, m)
+	writeAll(t, w, []*rowRecord{
+		{key: "r1", cells: []cell{
+			{family: "cf", qualifier: "a", timestamp: 2, value: []byte("new")},
+			{family: "cf", qualifier: "a", timestamp: 1, value: []byte("old")},
+			{family: "other", qualifier: "b", timestamp: 1, value: []byte(`"quoted"`)},
+		}},
+	})
+	const wantJSON = `{"rowkey":"r1","a":"new","other:b":"\"quoted\""}` + "\n"
+	if got := buf.String(); got != wantJSON {
+		t.Errorf("JSON written: %s, want %s", got, wantJSON)
+	}
+
+	for _, in := range []string{`{"a":"x"}`, `{"rowkey":1}`, `{"rowkey":"r","f:q":"v"`} {
+		if _, err := newJSONReader(strings.NewReader(in), m, 0).read(); err == nil {
+			t.Errorf("read(%s) succeeded, want error", in)
+		}
+	}
+}
+
+func TestFileFormat(t *testing.T) {
+	for _, test := range []struct {
+		format, file, want string
+	}{
+		{"", "rows.csv", "csv"},
+		{"", "ROWS.JSONL", "jsonl"},
+		{"", "rows.json", "jsonl"},
+		{"", "backup.avro", "avro"},
+		{"csv", "-", "csv"},
+		{"avro", "rows.json", "avro"},
+	} {
+		got, err := fileFormat(test.format, test.file)
+		if err != nil || got != test.want {
+			t.Errorf("fileFormat(%q, %q) = %q, %v, want %q", test.format, test.file, got, err, test.want)
+		}
+	}
+	for _, test := range [][2]string{{"", "-"}, {"", "rows.txt"}, {"xml", "rows.csv"}} {
+		if _, err := fileFormat(test[0], test[1]); err == nil {
+			t.Errorf("fileFormat(%q, %q) succeeded, want error", test[0], test[1])
+		}
+	}
+}
+
+func setupTable(t *testing.T) (*bigtable.Table, func()) {
+	t.Helper()
+	ctx := context.Background()
+	srv, err := bttest.NewServer("localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := grpc.Dial(srv.Addr, grpc.WithInsecure())
+	if err != nil {
+		t.Fatal(err)
+	}
+	adminClient, err := bigtable.NewAdminClient(ctx, "project", "instance", option.WithGRPCConn(conn))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := adminClient.CreateTable(ctx, "table"); err != nil {
+		t.Fatal(err)
+	}
+	for _, fam := range []string{"cf", "other"} {
+		if err := adminClient.CreateColumnFamily(ctx, "table", fam); err != nil {
+			t.Fatal(err)
+		}
+	}
+	client, err := bigtable.NewClient(ctx, "project", "instance", option.WithGRPCConn(conn))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client.Open("table"), func() {
+		client.Close()
+		adminClient.Close()
+		srv.Close()
+	}
+}
+
+func TestImportExport(t *testing.T) {
+	ctx := context.Background()
+	tbl, cleanup := setupTable(t)
+	defer cleanup()
+
+	var csvIn strings.Builder
+	csvIn.WriteString("rowkey,a,other:b\n")
+	for i := 0; i < 26; i++ {
+		c := string(rune('a' + i))
+		csvIn.WriteString("row-" + c + "," + c + ",\n")
+	}
+	csvIn.WriteString("row-z,,last\n")
+	m, err := parseColumnMapping("", "cf", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := newCSVReader(strings.NewReader(csvIn.String()), m, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := importRows(ctx, tbl, r, 4, 3, newProgress(ioutil.Discard, "Imported"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 27 {
+		t.Errorf("imported %d rows, want 27", n)
+	}
+
+	// Avro files hold every cell, and can be imported again.
+	var avroOut bytes.Buffer
+	aw, err := newAvroWriter(&avroOut)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err = exportRows(ctx, tbl, bigtable.PrefixRange("row-y"), nil, aw, newProgress(ioutil.Discard, "Exported"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Errorf("exported %d rows, want 1", n)
+	}
+	if _, err := exportRows(ctx, tbl, bigtable.PrefixRange("row-z"), nil, aw, newProgress(ioutil.Discard, "Exported")); err != nil {
+		t.Fatal(err)
+	}
+	ar, err := newAvroReader(&avroOut)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := readAll(t, ar)
+	want := []*rowRecord{
+		{key: "row-y", cells: []cell{{family: "cf", qualifier: "a", timestamp: 1000, value: []byte("y")}}},
+		{key: "row-z", cells: []cell{
+			{family: "cf", qualifier: "a", timestamp: 1000, value: []byte("z")},
+			{family: "other", qualifier: "b", timestamp: 1000, value: []byte("last")},
+		}},
+	}
+	if diff := cmp.Diff(got, want, cmpRecords); diff != "" {
+		t.Errorf("Avro export: got=-, want=+:\n%s", diff)
+	}
+
+	// Newer cells replace older ones in CSV and JSON exports.
+	jr := newJSONReader(strings.NewReader(`{"rowkey":"row-a","a":"A"}`), m, 2000)
+	if _, err := importRows(ctx, tbl, jr, 10, 1, newProgress(ioutil.Discard, "Imported")); err != nil {
+		t.Fatal(err)
+	}
+	var jsonOut bytes.Buffer
+	opts := []bigtable.ReadOption{bigtable.LimitRows(2)}
+	if _, err := exportRows(ctx, tbl, bigtable.InfiniteRange(""), opts, newJSONWriter(&jsonOut, m), newProgress(ioutil.Discard, "Exported")); err != nil {
+		t.Fatal(err)
+	}
+	const wantJSON = `{"rowkey":"row-a","a":"A"}` + "\n" + `{"rowkey":"row-b","a":"b"}` + "\n"
+	if got := jsonOut.String(); got != wantJSON {
+		t.Errorf("JSON export:\n%s\nwant:\n%s", got, wantJSON)
+	}
+
+	// The read arguments of export include filters.
+	rr, opts, err := parseReadArgs(map[string]string{"prefix": "row-z", "filter": `family("other")`})
+	if err != nil {
+		t.Fatal(err)
+	}
+	jsonOut.Reset()
+	if _, err := exportRows(ctx, tbl, rr, opts, newJSONWriter(&jsonOut, m), newProgress(ioutil.Discard, "Exported")); err != nil {
+		t.Fatal(err)
+	}
+	const wantFiltered = `{"rowkey":"row-z","other:b":"last"}` + "\n"
+	if got := jsonOut.String(); got != wantFiltered {
+		t.Errorf("filtered JSON export:\n%s\nwant:\n%s", got, wantFiltered)
+	}
+}
+
+func TestImportErrors(t *testing.T) {
+	ctx := context.Background()
+	tbl, cleanup := setupTable(t)
+	defer cleanup()
+
+	m, err := parseColumnMapping("", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	in := "rowkey,cf:a,nosuchfamily:b\nr1,x,\nr2,,y\nr3,z,\n"
+	r, err := newCSVReader(strings.NewReader(in), m, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := importRows(ctx, tbl, r, 1, 2, newProgress(ioutil.Discard, "Imported"))
+	if err == nil {
+		t.Fatal("import to an unknown family succeeded, want error")
+	}
+	if n != 2 {
+		t.Errorf("imported %d rows, want 2", n)
+	}
+	if !strings.Contains(err.Error(), "1 rows failed") {
+		t.Errorf("error %q does not report the failed row", err)
+	}
+
+	// A malformed record stops the import.
+	r, err = newCSVReader(strings.NewReader("rowkey,cf:a\nr1,x\nr2,x,extra\n"), m, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = importRows(ctx, tbl, r, 1, 1, newProgress(ioutil.Discard, "Imported"))
+	if err == nil {
+		t.Fatal("import of a malformed CSV file succeeded, want error")
+	}
+	if !strings.Contains(err.Error(), "Reading row 2") {
+		t.Errorf("error %q does not report the malformed row", err)
+	}
+}
@@ -21,6 +21,9 @@ import (
 	"flag"
 	"fmt"
 	"log"
+	"os"
+	"os/signal"
+	"syscall"
 
 	"cloud.google.com/go/bigtable/bttest"
 	"google.golang.org/grpc"
@@ -29,6 +32,7 @@ import (
 var (
 	host = flag.String("host", "localhost", "the address to bind to on the local machine")
 	port = flag.Int("port", 9000, "the port number to bind to on the local machine")
+	dir  = flag.String("dir", "", "if set, the directory in which to store tables across restarts")
 )
 
 const (
@@ -38,15 +42,24 @@ const (
 func main() {
 	grpc.EnableTracing = false
 	flag.Parse()
-	opts := []grpc.ServerOption{
-		grpc.MaxRecvMsgSize(maxMsgSize),
-		grpc.MaxSendMsgSize(maxMsgSize),
+	opts := []bttest.ServerOption{
+		bttest.GRPCServerOptions(
+			grpc.MaxRecvMsgSize(maxMsgSize),
+			grpc.MaxSendMsgSize(maxMsgSize),
+		),
 	}
-	srv, err := bttest.NewServer(fmt.Sprintf("%s:%d", *host, *port), opts...)
+	if *dir != "" {
+		opts = append(opts, bttest.WithDataDir(*dir))
+	}
+	srv, err := bttest.NewServerWithOptions(fmt.Sprintf("%s:%d", *host, *port), opts...)
 	if err != nil {
 		log.Fatalf("failed to start emulator: %v", err)
 	}
 
 	fmt.Printf("Cloud Bigtable emulator running on %s\n", srv.Addr)
-	select {}
+	// Shut down cleanly on interrupt, so that stored tables are compacted.
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, os.Interrupt, syscall.SIGTERM)
+	<-sigc
+	srv.Close()
 }
@@ -25,6 +25,11 @@ import (
 )
 
 // A Filter represents a row filter.
+//
+// The String method of a Filter returns it in the filter syntax of the cbt
+// tool, for example
+//     (family("stats") | column("os_.*") | latest(1))
+// The arguments of filters are Go string literals, integers and filters.
 type Filter interface {
 	String() string
 	proto() *btpb.RowFilter
@@ -88,7 +93,7 @@ func RowKeyFilter(pattern string) Filter { return rowKeyFilter(pattern) }
 
 type rowKeyFilter string
 
-func (rkf rowKeyFilter) String() string { return fmt.Sprintf("row(%s)", string(rkf)) }
+func (rkf rowKeyFilter) String() string { return fmt.Sprintf("row(%q)", string(rkf)) }
 
 func (rkf rowKeyFilter) proto() *btpb.RowFilter {
 	return &btpb.RowFilter{Filter: &btpb.RowFilter_RowKeyRegexFilter{RowKeyRegexFilter: []byte(rkf)}}
@@ -101,7 +106,7 @@ func FamilyFilter(pattern string) Filter { return familyFilter(pattern) }
 
 type familyFilter string
 
-func (ff familyFilter) String() string { return fmt.Sprintf("col(%s:)", string(ff)) }
+func (ff familyFilter) String() string { return fmt.Sprintf("family(%q)", string(ff)) }
 
 func (ff familyFilter) proto() *btpb.RowFilter {
 	return &btpb.RowFilter{Filter: &btpb.RowFilter_FamilyNameRegexFilter{FamilyNameRegexFilter: string(ff)}}
@@ -114,7 +119,7 @@ func ColumnFilter(pattern string) Filter { return columnFilter(pattern) }
 
 type columnFilter string
 
-func (cf columnFilter) String() string { return fmt.Sprintf("col(.*:%s)", string(cf)) }
+func (cf columnFilter) String() string { return fmt.Sprintf("column(%q)", string(cf)) }
 
 func (cf columnFilter) proto() *btpb.RowFilter {
 	return &btpb.RowFilter{Filter: &btpb.RowFilter_ColumnQualifierRegexFilter{ColumnQualifierRegexFilter: []byte(cf)}}
@@ -127,7 +132,7 @@ func ValueFilter(pattern string) Filter { return valueFilter(pattern) }
 
 type valueFilter string
 
-func (vf valueFilter) String() string { return fmt.Sprintf("value_match(%s)", string(vf)) }
+func (vf valueFilter) String() string { return fmt.Sprintf("value(%q)", string(vf)) }
 
 func (vf valueFilter) proto() *btpb.RowFilter {
 	return &btpb.RowFilter{Filter: &btpb.RowFilter_ValueRegexFilter{ValueRegexFilter: []byte(vf)}}
@@ -138,7 +143,7 @@ func LatestNFilter(n int) Filter { return latestNFilter(n) }
 
 type latestNFilter int32
 
-func (lnf latestNFilter) String() string { return fmt.Sprintf("col(*,%d)", lnf) }
+func (lnf latestNFilter) String() string { return fmt.Sprintf("latest(%d)", lnf) }
 
 func (lnf latestNFilter) proto() *btpb.RowFilter {
 	return &btpb.RowFilter{Filter: &btpb.RowFilter_CellsPerColumnLimitFilter{CellsPerColumnLimitFilter: int32(lnf)}}
@@ -181,7 +186,7 @@ type timestampRangeFilter struct {
 }
 
 func (trf timestampRangeFilter) String() string {
-	return fmt.Sprintf("timestamp_range(%v,%v)", trf.startTime, trf.endTime)
+	return fmt.Sprintf("timestamp_range(%d, %d)", trf.startTime, trf.endTime)
 }
 
 func (trf timestampRangeFilter) proto() *btpb.RowFilter {
@@ -206,7 +211,7 @@ type columnRangeFilter struct {
 }
 
 func (crf columnRangeFilter) String() string {
-	return fmt.Sprintf("columnRangeFilter(%s,%s,%s)", crf.family, crf.start, crf.end)
+	return fmt.Sprintf("column_range(%q, %q, %q)", crf.family, crf.start, crf.end)
 }
 
 func (crf columnRangeFilter) proto() *btpb.RowFilter {
@@ -232,7 +237,7 @@ type valueRangeFilter struct {
 }
 
 func (vrf valueRangeFilter) String() string {
-	return fmt.Sprintf("valueRangeFilter(%s,%s)", vrf.start, vrf.end)
+	return fmt.Sprintf("value_range(%q, %q)", vrf.start, vrf.end)
 }
 
 func (vrf valueRangeFilter) proto() *btpb.RowFilter {
@@ -264,7 +269,15 @@ type conditionFilter struct {
 }
 
 func (cf conditionFilter) String() string {
-	return fmt.Sprintf("conditionFilter(%s,%s,%s)", cf.predicateFilter, cf.trueFilter, cf.falseFilter)
+	// A nil filter matches nothing, as BlockAllFilter does.
+	tf, ff := Filter(blockAllFilter{}), Filter(blockAllFilter{})
+	if cf.trueFilter != nil {
+		tf = cf.trueFilter
+	}
+	if cf.falseFilter != nil {
+		ff = cf.falseFilter
+	}
+	return fmt.Sprintf("condition(%s, %s, %s)", cf.predicateFilter, tf, ff)
 }
 
 func (cf conditionFilter) proto() *btpb.RowFilter {
@@ -322,7 +335,7 @@ func RowSampleFilter(p float64) Filter {
 type rowSampleFilter float64
 
 func (rsf rowSampleFilter) String() string {
-	return fmt.Sprintf("filter(%f)", rsf)
+	return fmt.Sprintf("sample(%v)", float64(rsf))
 }
 
 func (rsf rowSampleFilter) proto() *btpb.RowFilter {
@@ -334,7 +347,7 @@ func PassAllFilter() Filter { return passAllFilter{} }
 
 type passAllFilter struct{}
 
-func (paf passAllFilter) String() string { return "passAllFilter()" }
+func (paf passAllFilter) String() string { return "pass_all()" }
 
 func (paf passAllFilter) proto() *btpb.RowFilter {
 	return &btpb.RowFilter{Filter: &btpb.RowFilter_PassAllFilter{PassAllFilter: true}}
@@ -345,7 +358,7 @@ func BlockAllFilter() Filter { return blockAllFilter{} }
 
 type blockAllFilter struct{}
 
-func (baf blockAllFilter) String() string { return "blockAllFilter()" }
+func (baf blockAllFilter) String() string { return "block_all()" }
 
 func (baf blockAllFilter) proto() *btpb.RowFilter {
 	return &btpb.RowFilter{Filter: &btpb.RowFilter_BlockAllFilter{BlockAllFilter: true}}
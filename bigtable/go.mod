@@ -9,6 +9,7 @@ require (
 	github.com/google/btree v1.0.0
 	github.com/google/go-cmp v0.4.0
 	github.com/googleapis/gax-go/v2 v2.0.5
+	go.opencensus.io v0.22.3
 	golang.org/x/net v0.0.0-20200226121028-0de0cce0169b // indirect
 	golang.org/x/oauth2 v0.0.0-20200107190931-bf48bf16ab8d
 	golang.org/x/tools v0.0.0-20200227222343-706bc42d1f0d // indirect
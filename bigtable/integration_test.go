@@ -1474,10 +1474,6 @@ func TestIntegration_AdminSnapshot(t *testing.T) {
 	}
 	defer testEnv.Close()
 
-	if !testEnv.Config().UseProd {
-		t.Skip("emulator doesn't support snapshots")
-	}
-
 	timeout := 2 * time.Second
 	if testEnv.Config().UseProd {
 		timeout = 5 * time.Minute
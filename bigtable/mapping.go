@@ -0,0 +1,416 @@
+/*
+Copyright 2020 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package bigtable
+
+import (
+	"encoding"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/internal/fields"
+	"github.com/golang/protobuf/proto"
+)
+
+var (
+	typeOfGoTime            = reflect.TypeOf(time.Time{})
+	typeOfReadItems         = reflect.TypeOf([]ReadItem(nil))
+	typeOfProtoMessage      = reflect.TypeOf((*proto.Message)(nil)).Elem()
+	typeOfBinaryMarshaler   = reflect.TypeOf((*encoding.BinaryMarshaler)(nil)).Elem()
+	typeOfBinaryUnmarshaler = reflect.TypeOf((*encoding.BinaryUnmarshaler)(nil)).Elem()
+)
+
+// ToStruct populates the struct pointed to by p with the row's cells.
+//
+// A struct field is mapped to a column by a tag of the form
+//
+//	`bigtable:"family:column"`
+//
+// optionally followed by comma-separated options. Fields without a bigtable
+// tag, or with the tag "-", are ignored. The fields of embedded structs are
+// mapped as if they were fields of the outer struct.
+//
+// A field is set from the latest cell of its column, and is left unchanged if
+// the row has no cells in the column. Cell values are decoded according to
+// the field's type:
+//   - []byte and string hold the value's bytes.
+//   - Signed and unsigned integers are 8-byte big-endian values, the encoding
+//     used by ReadModifyWrite.Increment. Overflow is an error.
+//   - float64 and float32 are 8-byte and 4-byte big-endian IEEE 754 values.
+//   - bool is a single byte, 0 or 1.
+//   - time.Time is a Timestamp, as an 8-byte big-endian value.
+//   - Types implementing proto.Message hold the encoded message.
+//   - Types whose pointers implement encoding.BinaryUnmarshaler are decoded
+//     with UnmarshalBinary.
+//   - Pointers to any of these types are allocated as needed.
+//
+// These options may follow the column in the tag:
+//   - json: The value is JSON, and the field may be of any type that
+//     encoding/json supports.
+//   - allversions: The field is a slice, and is set to all the cells of the
+//     column, newest first, each decoded as described above.
+//   - omitempty: Mutation.SetStruct does not write the field if it holds the
+//     zero value, or an empty slice or map.
+//
+// A field of type []ReadItem is set to all the cells of its column, without
+// decoding.
+//
+// Filters such as LatestNFilter and ColumnFilter control which cells are read.
+func (r Row) ToStruct(p interface{}) error {
+	v := reflect.ValueOf(p)
+	if v.Kind() != reflect.Ptr || v.IsNil() || v.Elem().Kind() != reflect.Struct {
+		return errors.New("bigtable: ToStruct requires a non-nil pointer to a struct")
+	}
+	v = v.Elem()
+	fs, err := columnFieldCache.Fields(v.Type())
+	if err != nil {
+		return err
+	}
+	for _, f := range fs {
+		ct := f.ParsedTag.(columnTag)
+		if ct.family == "" {
+			continue
+		}
+		items := r.columnItems(ct.family, ct.column)
+		if len(items) == 0 {
+			continue
+		}
+		fv, err := fieldByIndexAlloc(v, f.Index)
+		if err != nil {
+			return err
+		}
+		switch {
+		case fv.Type() == typeOfReadItems:
+			fv.Set(reflect.ValueOf(append([]ReadItem(nil), items...)))
+		case ct.allVersions:
+			s := reflect.MakeSlice(fv.Type(), len(items), len(items))
+			for i, item := range items {
+				if err := decodeCell(item.Value, s.Index(i), ct.json); err != nil {
+					return fmt.Errorf("bigtable: column %s: %v", f.Name, err)
+				}
+			}
+			fv.Set(s)
+		default:
+			if err := decodeCell(items[0].Value, fv, ct.json); err != nil {
+				return fmt.Errorf("bigtable: column %s: %v", f.Name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// columnItems returns the items of the row in family:column, in the order
+// they were read.
+func (r Row) columnItems(family, column string) []ReadItem {
+	col := family + ":" + column
+	var items []ReadItem
+	for _, item := range r[family] {
+		if item.Column == col {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// SetStruct adds a Set to the mutation for each field of the struct src,
+// which may also be a pointer to a struct, with the given timestamp. Fields
+// are mapped to columns and encoded as described in Row.ToStruct. Nil
+// pointers, and fields with the allversions option or of type []ReadItem,
+// are not written.
+//
+// If SetStruct returns an error, the mutation is unchanged.
+func (m *Mutation) SetStruct(ts Timestamp, src interface{}) error {
+	v := reflect.ValueOf(src)
+	if v.Kind() == reflect.Ptr && !v.IsNil() {
+		v = v.Elem()
+	}
+	if v.Kind() != reflect.Struct {
+		return fmt.Errorf("bigtable: SetStruct requires a struct or a non-nil pointer to a struct, got %T", src)
+	}
+	fs, err := columnFieldCache.Fields(v.Type())
+	if err != nil {
+		return err
+	}
+	nm := &Mutation{}
+	for _, f := range fs {
+		ct := f.ParsedTag.(columnTag)
+		if ct.family == "" || ct.allVersions || f.Type == typeOfReadItems {
+			continue
+		}
+		fv, ok := fieldByIndex(v, f.Index)
+		if !ok {
+			continue // in a nil embedded pointer
+		}
+		if fv.Kind() == reflect.Ptr && fv.IsNil() {
+			continue
+		}
+		if ct.omitEmpty && isEmptyValue(fv) {
+			continue
+		}
+		b, err := encodeCell(fv, ct.json)
+		if err != nil {
+			return fmt.Errorf("bigtable: column %s: %v", f.Name, err)
+		}
+		nm.Set(ct.family, ct.column, ts, b)
+	}
+	m.ops = append(m.ops, nm.ops...)
+	return nil
+}
+
+// columnTag is the parsed form of a bigtable struct tag.
+type columnTag struct {
+	family, column string // family is empty for untagged fields
+	json           bool
+	allVersions    bool
+	omitEmpty      bool
+}
+
+// parseColumnTag interprets bigtable struct tags.
+func parseColumnTag(t reflect.StructTag) (name string, keep bool, other interface{}, err error) {
+	if _, ok := t.Lookup("bigtable"); !ok {
+		return "", true, columnTag{}, nil
+	}
+	name, keep, opts, err := fields.ParseStandardTag("bigtable", t)
+	if err != nil {
+		return "", false, nil, fmt.Errorf("bigtable: %v", err)
+	}
+	if !keep {
+		return "", false, nil, nil
+	}
+	i := strings.Index(name, ":")
+	if i <= 0 {
+		return "", false, nil, fmt.Errorf("bigtable: tag %q is not of the form family:column", name)
+	}
+	ct := columnTag{family: name[:i], column: name[i+1:]}
+	for _, opt := range opts {
+		switch opt {
+		case "json":
+			ct.json = true
+		case "allversions":
+			ct.allVersions = true
+		case "omitempty":
+			ct.omitEmpty = true
+		default:
+			return "", false, nil, fmt.Errorf("bigtable: unknown tag option %q", opt)
+		}
+	}
+	// Fields are named by their Go names, so that several fields may map to
+	// the same column.
+	return "", true, ct, nil
+}
+
+func isColumnLeafType(t reflect.Type) bool {
+	return t == typeOfGoTime
+}
+
+var columnFieldCache = fields.NewCache(parseColumnTag, nil, isColumnLeafType)
+
+// fieldByIndex returns the field of the struct v with the given index, and
+// false if it is inside a nil embedded pointer.
+func fieldByIndex(v reflect.Value, index []int) (reflect.Value, bool) {
+	for i, x := range index {
+		if i > 0 && v.Kind() == reflect.Ptr {
+			if v.IsNil() {
+				return reflect.Value{}, false
+			}
+			v = v.Elem()
+		}
+		v = v.Field(x)
+	}
+	return v, true
+}
+
+// fieldByIndexAlloc is like fieldByIndex, but allocates nil embedded
+// pointers.
+func fieldByIndexAlloc(v reflect.Value, index []int) (reflect.Value, error) {
+	for i, x := range index {
+		if i > 0 && v.Kind() == reflect.Ptr {
+			if v.IsNil() {
+				if !v.CanSet() {
+					return reflect.Value{}, fmt.Errorf("bigtable: cannot set embedded pointer to unexported struct %v", v.Type().Elem())
+				}
+				v.Set(reflect.New(v.Type().Elem()))
+			}
+			v = v.Elem()
+		}
+		v = v.Field(x)
+	}
+	return v, nil
+}
+
+// encodeCell returns the cell value for v, which is not a nil pointer.
+func encodeCell(v reflect.Value, asJSON bool) ([]byte, error) {
+	if asJSON {
+		return json.Marshal(v.Interface())
+	}
+	t := v.Type()
+	switch {
+	case t.Implements(typeOfProtoMessage):
+		return proto.Marshal(v.Interface().(proto.Message))
+	case t.Implements(typeOfBinaryMarshaler):
+		return v.Interface().(encoding.BinaryMarshaler).MarshalBinary()
+	case v.CanAddr() && reflect.PtrTo(t).Implements(typeOfBinaryMarshaler):
+		return v.Addr().Interface().(encoding.BinaryMarshaler).MarshalBinary()
+	case t == typeOfGoTime:
+		return encodeUint64(uint64(Time(v.Interface().(time.Time)))), nil
+	}
+	switch v.Kind() {
+	case reflect.Ptr:
+		return encodeCell(v.Elem(), false)
+	case reflect.Slice:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return append([]byte(nil), v.Bytes()...), nil
+		}
+	case reflect.String:
+		return []byte(v.String()), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return encodeUint64(uint64(v.Int())), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return encodeUint64(v.Uint()), nil
+	case reflect.Float64:
+		return encodeUint64(math.Float64bits(v.Float())), nil
+	case reflect.Float32:
+		b := make([]byte, 4)
+		binary.BigEndian.PutUint32(b, math.Float32bits(float32(v.Float())))
+		return b, nil
+	case reflect.Bool:
+		if v.Bool() {
+			return []byte{1}, nil
+		}
+		return []byte{0}, nil
+	}
+	return nil, fmt.Errorf("cannot encode type %v", t)
+}
+
+func encodeUint64(x uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, x)
+	return b
+}
+
+// decodeCell sets v, which must be settable, from the cell value b.
+func decodeCell(b []byte, v reflect.Value, asJSON bool) error {
+	if asJSON {
+		return json.Unmarshal(b, v.Addr().Interface())
+	}
+	t := v.Type()
+	if t.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			v.Set(reflect.New(t.Elem()))
+		}
+		if t.Implements(typeOfProtoMessage) {
+			return proto.Unmarshal(b, v.Interface().(proto.Message))
+		}
+		return decodeCell(b, v.Elem(), false)
+	}
+	if reflect.PtrTo(t).Implements(typeOfBinaryUnmarshaler) {
+		return v.Addr().Interface().(encoding.BinaryUnmarshaler).UnmarshalBinary(b)
+	}
+	if t == typeOfGoTime {
+		x, err := decodeUint64(b)
+		if err != nil {
+			return err
+		}
+		v.Set(reflect.ValueOf(Timestamp(x).Time()))
+		return nil
+	}
+	switch v.Kind() {
+	case reflect.Slice:
+		if t.Elem().Kind() == reflect.Uint8 {
+			v.SetBytes(append([]byte(nil), b...))
+			return nil
+		}
+	case reflect.String:
+		v.SetString(string(b))
+		return nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		x, err := decodeUint64(b)
+		if err != nil {
+			return err
+		}
+		if v.OverflowInt(int64(x)) {
+			return fmt.Errorf("value %d overflows %v", int64(x), t)
+		}
+		v.SetInt(int64(x))
+		return nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		x, err := decodeUint64(b)
+		if err != nil {
+			return err
+		}
+		if v.OverflowUint(x) {
+			return fmt.Errorf("value %d overflows %v", x, t)
+		}
+		v.SetUint(x)
+		return nil
+	case reflect.Float64:
+		x, err := decodeUint64(b)
+		if err != nil {
+			return err
+		}
+		v.SetFloat(math.Float64frombits(x))
+		return nil
+	case reflect.Float32:
+		if len(b) != 4 {
+			return fmt.Errorf("got %d bytes, want 4", len(b))
+		}
+		v.SetFloat(float64(math.Float32frombits(binary.BigEndian.Uint32(b))))
+		return nil
+	case reflect.Bool:
+		if len(b) != 1 || b[0] > 1 {
+			return fmt.Errorf("invalid bool value %q", b)
+		}
+		v.SetBool(b[0] == 1)
+		return nil
+	}
+	return fmt.Errorf("cannot decode type %v", t)
+}
+
+func decodeUint64(b []byte) (uint64, error) {
+	if len(b) != 8 {
+		return 0, fmt.Errorf("got %d bytes, want 8", len(b))
+	}
+	return binary.BigEndian.Uint64(b), nil
+}
+
+// isEmptyValue is taken from the encoding/json package in the
+// standard library.
+func isEmptyValue(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return v.Len() == 0
+	case reflect.Bool:
+		return !v.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int() == 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return v.Uint() == 0
+	case reflect.Float32, reflect.Float64:
+		return v.Float() == 0
+	case reflect.Interface, reflect.Ptr:
+		return v.IsNil()
+	}
+	if v.Type() == typeOfGoTime {
+		return v.Interface().(time.Time).IsZero()
+	}
+	return false
+}
@@ -0,0 +1,164 @@
+/*
+Copyright 2020 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package bigtable
+
+import (
+	"testing"
+	"time"
+
+	"cloud.google.com/go/internal/testutil"
+	"github.com/google/go-cmp/cmp"
+	"github.com/golang/protobuf/proto"
+	btpb "google.golang.org/genproto/googleapis/bigtable/v2"
+)
+
+type mappedInner struct {
+	Note string `bigtable:"meta:note"`
+}
+
+type mapped struct {
+	mappedInner
+	Name     string            `bigtable:"info:name"`
+	Raw      []byte            `bigtable:"info:raw"`
+	Count    int64             `bigtable:"stats:count"`
+	Small    uint8             `bigtable:"stats:small"`
+	Ratio    float64           `bigtable:"stats:ratio"`
+	Ok       bool              `bigtable:"stats:ok"`
+	When     time.Time         `bigtable:"info:when"`
+	Ptr      *int32            `bigtable:"stats:ptr"`
+	Tags     map[string]string `bigtable:"info:tags,json"`
+	Range    *btpb.RowRange    `bigtable:"info:range"`
+	Empty    string            `bigtable:"info:empty,omitempty"`
+	Ignored  string
+	Skipped  string     `bigtable:"-"`
+	History  []string   `bigtable:"info:name,allversions"`
+	RawItems []ReadItem `bigtable:"info:name"`
+}
+
+// mutationRow returns the row that results from applying the SetCell
+// operations of m to an empty row, with the latest cells first.
+func mutationRow(m *Mutation) Row {
+	r := Row{}
+	for i := len(m.ops) - 1; i >= 0; i-- {
+		sc := m.ops[i].GetSetCell()
+		r[sc.FamilyName] = append(r[sc.FamilyName], ReadItem{
+			Column:    sc.FamilyName + ":" + string(sc.ColumnQualifier),
+			Timestamp: Timestamp(sc.TimestampMicros),
+			Value:     sc.Value,
+		})
+	}
+	return r
+}
+
+func TestStructRoundTrip(t *testing.T) {
+	ptr := int32(-7)
+	in := mapped{
+		mappedInner: mappedInner{Note: "n"},
+		Name:        "gopher",
+		Raw:         []byte{0, 1, 2},
+		Count:       -42,
+		Small:       200,
+		Ratio:       0.25,
+		Ok:          true,
+		When:        time.Unix(1500000000, 123000),
+		Ptr:         &ptr,
+		Tags:        map[string]string{"a": "b"},
+		Range:       &btpb.RowRange{StartKey: &btpb.RowRange_StartKeyClosed{StartKeyClosed: []byte("k")}},
+		Ignored:     "x",
+		Skipped:     "y",
+	}
+	var m Mutation
+	if err := m.SetStruct(Timestamp(1000), &in); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(m.ops), 11; got != want {
+		t.Errorf("got %d mutations, want %d", got, want)
+	}
+	var out mapped
+	if err := mutationRow(&m).ToStruct(&out); err != nil {
+		t.Fatal(err)
+	}
+	if !proto.Equal(out.Range, in.Range) {
+		t.Errorf("Range: got %v, want %v", out.Range, in.Range)
+	}
+	if len(out.RawItems) != 1 || string(out.RawItems[0].Value) != "gopher" {
+		t.Errorf("RawItems: got %v", out.RawItems)
+	}
+	want := in
+	want.Ignored, want.Skipped = "", ""
+	want.History = []string{"gopher"}
+	want.RawItems = out.RawItems
+	want.Range, out.Range = nil, nil
+	if !testutil.Equal(out, want, cmp.AllowUnexported(mapped{})) {
+		t.Errorf("got %+v\nwant %+v", out, want)
+	}
+}
+
+func TestToStructAllVersions(t *testing.T) {
+	r := Row{"stats": {
+		{Column: "stats:count", Timestamp: 2000, Value: encodeUint64(2)},
+		{Column: "stats:count", Timestamp: 1000, Value: encodeUint64(1)},
+		{Column: "stats:other", Timestamp: 1000, Value: encodeUint64(9)},
+	}}
+	var s struct {
+		Latest int     `bigtable:"stats:count"`
+		All    []int64 `bigtable:"stats:count,allversions"`
+		Absent string  `bigtable:"info:absent"`
+	}
+	s.Absent = "unchanged"
+	if err := r.ToStruct(&s); err != nil {
+		t.Fatal(err)
+	}
+	if s.Latest != 2 || !testutil.Equal(s.All, []int64{2, 1}) || s.Absent != "unchanged" {
+		t.Errorf("got %+v", s)
+	}
+}
+
+func TestToStructErrors(t *testing.T) {
+	r := Row{"f": {{Column: "f:c", Value: encodeUint64(300)}}}
+	var small struct {
+		C int8 `bigtable:"f:c"`
+	}
+	if err := r.ToStruct(&small); err == nil {
+		t.Error("overflow: got nil, want error")
+	}
+	var short struct {
+		C bool `bigtable:"f:c"`
+	}
+	if err := r.ToStruct(&short); err == nil {
+		t.Error("wrong length: got nil, want error")
+	}
+	var badTag struct {
+		C string `bigtable:"nocolumn"`
+	}
+	if err := r.ToStruct(&badTag); err == nil {
+		t.Error("bad tag: got nil, want error")
+	}
+	if err := r.ToStruct(small); err == nil {
+		t.Error("non-pointer: got nil, want error")
+	}
+	var unsupported struct {
+		C chan int `bigtable:"f:c"`
+	}
+	var m Mutation
+	if err := m.SetStruct(Now(), unsupported); err == nil {
+		t.Error("unsupported type: got nil, want error")
+	}
+	if len(m.ops) != 0 {
+		t.Errorf("failed SetStruct added %d mutations", len(m.ops))
+	}
+}
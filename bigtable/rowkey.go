@@ -0,0 +1,256 @@
+/*
+Copyright 2020 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package bigtable
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// EncodeRowKey returns a row key made of the given parts, encoded so that
+// the byte order of keys is the order of their parts: keys are ordered by
+// their first parts, then by their second parts, and so on.
+//
+// Each part must be a string, a []byte, a signed or unsigned integer, a
+// time.Time, or the result of calling Descending on one of these. Strings
+// and byte slices are ordered by their bytes, integers numerically, and times
+// chronologically. Times must be between the years 1678 and 2262, and are
+// stored to the nanosecond, without their location.
+//
+// The encoding of the first n parts of a key is a prefix of the key, so
+// PrefixRange(EncodeRowKey(a, b)) is the range of keys whose first two parts
+// are a and b.
+func EncodeRowKey(parts ...interface{}) (string, error) {
+	var b []byte
+	for i, p := range parts {
+		var err error
+		b, err = appendKeyPart(b, p, false)
+		if err != nil {
+			return "", fmt.Errorf("bigtable: row key part %d: %v", i, err)
+		}
+	}
+	return string(b), nil
+}
+
+// DecodeRowKey decodes a row key built by EncodeRowKey into dst, which must
+// hold a pointer to a value of the type of each part of the key, in order. A
+// part encoded with Descending must be decoded into Descending of a pointer.
+//
+// It is an error if the key has more or fewer parts than dst.
+func DecodeRowKey(key string, dst ...interface{}) error {
+	b := []byte(key)
+	for i, d := range dst {
+		var err error
+		b, err = decodeKeyPart(b, d, false)
+		if err != nil {
+			return fmt.Errorf("bigtable: row key part %d: %v", i, err)
+		}
+	}
+	if len(b) > 0 {
+		return fmt.Errorf("bigtable: %d bytes left over after decoding row key", len(b))
+	}
+	return nil
+}
+
+// Descending returns a row key part that is ordered in reverse, for use with
+// EncodeRowKey and DecodeRowKey. For example, a key part of
+// Descending(time.Now()) sorts recent rows first.
+func Descending(part interface{}) interface{} {
+	return descending{part}
+}
+
+type descending struct{ part interface{} }
+
+const (
+	keyEscape     = 0x00
+	keyEscapedNul = 0xff
+	keyTerminator = 0x01
+)
+
+var errKeyTruncated = errors.New("row key is truncated")
+
+// appendKeyPart appends the encoding of p to b. If desc is true, the bytes
+// of the encoding are inverted.
+func appendKeyPart(b []byte, p interface{}, desc bool) ([]byte, error) {
+	start := len(b)
+	switch x := p.(type) {
+	case descending:
+		return appendKeyPart(b, x.part, !desc)
+	case string:
+		b = appendKeyBytes(b, []byte(x))
+	case []byte:
+		b = appendKeyBytes(b, x)
+	case int:
+		b = appendKeyInt(b, int64(x))
+	case int8:
+		b = appendKeyInt(b, int64(x))
+	case int16:
+		b = appendKeyInt(b, int64(x))
+	case int32:
+		b = appendKeyInt(b, int64(x))
+	case int64:
+		b = appendKeyInt(b, x)
+	case uint:
+		b = appendKeyUint(b, uint64(x))
+	case uint8:
+		b = appendKeyUint(b, uint64(x))
+	case uint16:
+		b = appendKeyUint(b, uint64(x))
+	case uint32:
+		b = appendKeyUint(b, uint64(x))
+	case uint64:
+		b = appendKeyUint(b, x)
+	case time.Time:
+		b = appendKeyInt(b, x.UnixNano())
+	default:
+		return nil, fmt.Errorf("unsupported type %T", p)
+	}
+	if desc {
+		for i := start; i < len(b); i++ {
+			b[i] = ^b[i]
+		}
+	}
+	return b, nil
+}
+
+// appendKeyBytes appends x to b, escaping NUL bytes and adding a terminator
+// so that no encoding is a prefix of another.
+func appendKeyBytes(b, x []byte) []byte {
+	for _, c := range x {
+		if c == keyEscape {
+			b = append(b, keyEscape, keyEscapedNul)
+		} else {
+			b = append(b, c)
+		}
+	}
+	return append(b, keyEscape, keyTerminator)
+}
+
+func appendKeyInt(b []byte, x int64) []byte {
+	// Flipping the sign bit orders negative numbers before positive ones.
+	return appendKeyUint(b, uint64(x)^(1<<63))
+}
+
+func appendKeyUint(b []byte, x uint64) []byte {
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], x)
+	return append(b, buf[:]...)
+}
+
+// decodeKeyPart decodes the first part of b into d, and returns the rest of
+// b. If desc is true, the bytes of the encoding are inverted.
+func decodeKeyPart(b []byte, d interface{}, desc bool) ([]byte, error) {
+	switch x := d.(type) {
+	case descending:
+		return decodeKeyPart(b, x.part, !desc)
+	case *string:
+		s, rest, err := decodeKeyBytes(b, desc)
+		*x = string(s)
+		return rest, err
+	case *[]byte:
+		s, rest, err := decodeKeyBytes(b, desc)
+		*x = s
+		return rest, err
+	case *time.Time:
+		n, rest, err := decodeKeyUint(b, desc)
+		*x = time.Unix(0, int64(n^(1<<63)))
+		return rest, err
+	}
+	n, rest, err := decodeKeyUint(b, desc)
+	if err != nil {
+		return nil, err
+	}
+	i := int64(n ^ (1 << 63))
+	overflow := false
+	switch x := d.(type) {
+	case *int:
+		*x = int(i)
+		overflow = int64(*x) != i
+	case *int8:
+		*x = int8(i)
+		overflow = int64(*x) != i
+	case *int16:
+		*x = int16(i)
+		overflow = int64(*x) != i
+	case *int32:
+		*x = int32(i)
+		overflow = int64(*x) != i
+	case *int64:
+		*x = i
+	case *uint:
+		*x = uint(n)
+		overflow = uint64(*x) != n
+	case *uint8:
+		*x = uint8(n)
+		overflow = uint64(*x) != n
+	case *uint16:
+		*x = uint16(n)
+		overflow = uint64(*x) != n
+	case *uint32:
+		*x = uint32(n)
+		overflow = uint64(*x) != n
+	case *uint64:
+		*x = n
+	default:
+		return nil, fmt.Errorf("unsupported type %T", d)
+	}
+	if overflow {
+		return nil, fmt.Errorf("value overflows %T", d)
+	}
+	return rest, nil
+}
+
+func decodeKeyBytes(b []byte, desc bool) ([]byte, []byte, error) {
+	inv := byte(0)
+	if desc {
+		inv = 0xff
+	}
+	var s []byte
+	for i := 0; i < len(b); i++ {
+		c := b[i] ^ inv
+		if c != keyEscape {
+			s = append(s, c)
+			continue
+		}
+		if i+1 == len(b) {
+			break
+		}
+		switch b[i+1] ^ inv {
+		case keyEscapedNul:
+			s = append(s, 0)
+			i++
+		case keyTerminator:
+			return s, b[i+2:], nil
+		default:
+			return nil, nil, fmt.Errorf("invalid escape at byte %d", i+1)
+		}
+	}
+	return nil, nil, errKeyTruncated
+}
+
+func decodeKeyUint(b []byte, desc bool) (uint64, []byte, error) {
+	if len(b) < 8 {
+		return 0, nil, errKeyTruncated
+	}
+	n := binary.BigEndian.Uint64(b)
+	if desc {
+		n = ^n
+	}
+	return n, b[8:], nil
+}
@@ -0,0 +1,108 @@
+/*
+Copyright 2020 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package bigtable
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func mustEncodeRowKey(t *testing.T, parts ...interface{}) string {
+	t.Helper()
+	k, err := EncodeRowKey(parts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return k
+}
+
+func TestRowKeyOrder(t *testing.T) {
+	t0 := time.Unix(1500000000, 0)
+	// Each list of keys is in increasing order.
+	for _, keys := range [][][]interface{}{
+		{{""}, {"\x00"}, {"\x00\x00"}, {"\x00\x01"}, {"a"}, {"a\x00"}, {"ab"}, {"b"}},
+		{{"a", "z"}, {"a\x00", "a"}, {"ab", "a"}},
+		{{int64(-1 << 63)}, {-100}, {-1}, {0}, {1}, {int8(100)}, {int64(1<<63 - 1)}},
+		{{uint8(0)}, {uint32(1)}, {uint64(1 << 63)}, {^uint64(0)}},
+		{{time.Unix(-1e9, 0)}, {t0}, {t0.Add(time.Nanosecond)}, {t0.Add(time.Hour)}},
+		{{Descending("b")}, {Descending("ab")}, {Descending("a")}, {Descending("")}},
+		{{Descending(1)}, {Descending(0)}, {Descending(-1)}},
+		{{"x", Descending(t0.Add(time.Hour))}, {"x", Descending(t0)}, {"y", Descending(t0.Add(time.Hour))}},
+		{{[]byte("a"), 2}, {[]byte("a"), 10}, {[]byte("b"), 1}},
+	} {
+		for i := 1; i < len(keys); i++ {
+			a, b := mustEncodeRowKey(t, keys[i-1]...), mustEncodeRowKey(t, keys[i]...)
+			if a >= b {
+				t.Errorf("key %v (%q) does not sort before %v (%q)", keys[i-1], a, keys[i], b)
+			}
+		}
+	}
+}
+
+func TestRowKeyRoundTrip(t *testing.T) {
+	when := time.Unix(1500000000, 123456789)
+	key := mustEncodeRowKey(t, "us\x00er", -5, uint16(7), when, Descending("desc\x00"), Descending(int64(-3)), []byte{0xff, 0})
+	var (
+		s, d  string
+		i     int
+		u     uint16
+		tm    time.Time
+		di    int64
+		bytes []byte
+	)
+	if err := DecodeRowKey(key, &s, &i, &u, &tm, Descending(&d), Descending(&di), &bytes); err != nil {
+		t.Fatal(err)
+	}
+	if s != "us\x00er" || i != -5 || u != 7 || !tm.Equal(when) || d != "desc\x00" || di != -3 || string(bytes) != "\xff\x00" {
+		t.Errorf("got %q %d %d %v %q %d %q", s, i, u, tm, d, di, bytes)
+	}
+
+	prefix := mustEncodeRowKey(t, "us\x00er", -5)
+	if !strings.HasPrefix(key, prefix) {
+		t.Errorf("key %q does not start with %q", key, prefix)
+	}
+}
+
+func TestRowKeyErrors(t *testing.T) {
+	if _, err := EncodeRowKey("a", 1.5); err == nil {
+		t.Error("float part: got nil, want error")
+	}
+	key := mustEncodeRowKey(t, "a", 300)
+	var (
+		s  string
+		n  int
+		n8 int8
+		f  float64
+	)
+	for _, test := range []struct {
+		key string
+		dst []interface{}
+	}{
+		{key, []interface{}{&s, &n8}},    // overflow
+		{key, []interface{}{&s}},         // left over bytes
+		{key, []interface{}{&s, &n, &n}}, // too few bytes
+		{key[:len(key)-1], []interface{}{&s, &n}},
+		{"a", []interface{}{&s}},         // no terminator
+		{"a\x00\x02", []interface{}{&s}}, // bad escape
+		{key, []interface{}{&s, &f}},     // wrong type
+	} {
+		if err := DecodeRowKey(test.key, test.dst...); err == nil {
+			t.Errorf("DecodeRowKey(%q, %d parts): got nil, want error", test.key, len(test.dst))
+		}
+	}
+}
@@ -0,0 +1,225 @@
+/*
+Copyright 2020 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package bigtable
+
+import (
+	"context"
+	"time"
+
+	gax "github.com/googleapis/gax-go/v2"
+	"go.opencensus.io/stats"
+	"go.opencensus.io/stats/view"
+	"go.opencensus.io/tag"
+	"google.golang.org/grpc/status"
+)
+
+// The following keys tag the measures of data operations.
+var (
+	// The ID of the table.
+	keyTable = tag.MustNewKey("table")
+	// The ID of the app profile, absent for the instance's default profile.
+	keyAppProfile = tag.MustNewKey("app_profile")
+	// The Table method: ReadRows, Apply, ApplyBulk, ApplyReadModifyWrite,
+	// SampleRowKeys, or BulkMutator for the requests of a BulkMutator.
+	keyMethod = tag.MustNewKey("method")
+	// The gRPC status code of the operation, attempt or mutation, such as
+	// "OK" or "Unavailable".
+	keyStatus = tag.MustNewKey("status")
+)
+
+const statsPrefix = "cloud.google.com/go/bigtable/"
+
+// The following are measures recorded by the data operations of a Table.
+var (
+	// OperationLatency is a measure of the number of milliseconds taken by a
+	// data operation, including retries.
+	// It is EXPERIMENTAL and subject to change or removal without notice.
+	OperationLatency = stats.Float64(statsPrefix+"op_latency", "The latency in milliseconds of data operations, including retries", stats.UnitMilliseconds)
+
+	// AttemptLatency is a measure of the number of milliseconds taken by each
+	// attempt of a data operation.
+	// It is EXPERIMENTAL and subject to change or removal without notice.
+	AttemptLatency = stats.Float64(statsPrefix+"attempt_latency", "The latency in milliseconds of each attempt of data operations", stats.UnitMilliseconds)
+
+	// RetryCount is a measure of the number of attempts of data operations
+	// after their first.
+	// It is EXPERIMENTAL and subject to change or removal without notice.
+	RetryCount = stats.Int64(statsPrefix+"retry_count", "Number of retried attempts of data operations", stats.UnitDimensionless)
+
+	// RowsPerRead is a measure of the number of rows returned by each call to
+	// ReadRows.
+	// It is EXPERIMENTAL and subject to change or removal without notice.
+	RowsPerRead = stats.Int64(statsPrefix+"rows_per_read", "Number of rows returned by each ReadRows call", stats.UnitDimensionless)
+
+	// CellsPerRead is a measure of the number of cells returned by each call to
+	// ReadRows.
+	// It is EXPERIMENTAL and subject to change or removal without notice.
+	CellsPerRead = stats.Int64(statsPrefix+"cells_per_read", "Number of cells returned by each ReadRows call", stats.UnitDimensionless)
+
+	// MutationFailureCount is a measure of the number of row mutations that
+	// failed in attempts of ApplyBulk, including those that were retried.
+	// It is EXPERIMENTAL and subject to change or removal without notice.
+	MutationFailureCount = stats.Int64(statsPrefix+"mutation_failure_count", "Number of failed row mutations in MutateRows attempts", stats.UnitDimensionless)
+
+	// SentBytes is a measure of the size of the requests of data operations.
+	// It is EXPERIMENTAL and subject to change or removal without notice.
+	SentBytes = stats.Int64(statsPrefix+"sent_bytes", "Number of bytes sent in requests of data operations", stats.UnitBytes)
+
+	// ReceivedBytes is a measure of the size of the responses of data
+	// operations.
+	// It is EXPERIMENTAL and subject to change or removal without notice.
+	ReceivedBytes = stats.Int64(statsPrefix+"received_bytes", "Number of bytes received in responses of data operations", stats.UnitBytes)
+)
+
+var (
+	// OperationLatencyView is a distribution of OperationLatency.
+	// It is EXPERIMENTAL and subject to change or removal without notice.
+	OperationLatencyView *view.View
+
+	// AttemptLatencyView is a distribution of AttemptLatency.
+	// It is EXPERIMENTAL and subject to change or removal without notice.
+	AttemptLatencyView *view.View
+
+	// RetryCountView is a cumulative sum of RetryCount.
+	// It is EXPERIMENTAL and subject to change or removal without notice.
+	RetryCountView *view.View
+
+	// RowsPerReadView is a distribution of RowsPerRead.
+	// It is EXPERIMENTAL and subject to change or removal without notice.
+	RowsPerReadView *view.View
+
+	// CellsPerReadView is a distribution of CellsPerRead.
+	// It is EXPERIMENTAL and subject to change or removal without notice.
+	CellsPerReadView *view.View
+
+	// MutationFailureCountView is a cumulative sum of MutationFailureCount.
+	// It is EXPERIMENTAL and subject to change or removal without notice.
+	MutationFailureCountView *view.View
+
+	// SentBytesView is a cumulative sum of SentBytes.
+	// It is EXPERIMENTAL and subject to change or removal without notice.
+	SentBytesView *view.View
+
+	// ReceivedBytesView is a cumulative sum of ReceivedBytes.
+	// It is EXPERIMENTAL and subject to change or removal without notice.
+	ReceivedBytesView *view.View
+)
+
+// DefaultViews holds the default OpenCensus views of data operations. Register
+// them with view.Register to collect the metrics of a client.
+// It is EXPERIMENTAL and subject to change or removal without notice.
+var DefaultViews []*view.View
+
+func init() {
+	OperationLatencyView = createDistView(OperationLatency, latencyBounds, keyTable, keyAppProfile, keyMethod, keyStatus)
+	AttemptLatencyView = createDistView(AttemptLatency, latencyBounds, keyTable, keyAppProfile, keyMethod, keyStatus)
+	RetryCountView = createCountView(RetryCount, keyTable, keyAppProfile, keyMethod)
+	RowsPerReadView = createDistView(RowsPerRead, countBounds, keyTable, keyAppProfile)
+	CellsPerReadView = createDistView(CellsPerRead, countBounds, keyTable, keyAppProfile)
+	MutationFailureCountView = createCountView(MutationFailureCount, keyTable, keyAppProfile, keyMethod, keyStatus)
+	SentBytesView = createCountView(SentBytes, keyTable, keyAppProfile, keyMethod)
+	ReceivedBytesView = createCountView(ReceivedBytes, keyTable, keyAppProfile, keyMethod)
+
+	DefaultViews = []*view.View{
+		OperationLatencyView,
+		AttemptLatencyView,
+		RetryCountView,
+		RowsPerReadView,
+		CellsPerReadView,
+		MutationFailureCountView,
+		SentBytesView,
+		ReceivedBytesView,
+	}
+}
+
+var (
+	latencyBounds = []float64{0, 1, 2, 5, 10, 20, 50, 100, 200, 500, 1000, 2000, 5000, 10000, 20000, 60000}
+	countBounds   = []float64{0, 1, 10, 100, 1000, 10000, 100000, 1000000}
+)
+
+func createCountView(m stats.Measure, keys ...tag.Key) *view.View {
+	return &view.View{
+		Name:        m.Name(),
+		Description: m.Description(),
+		TagKeys:     keys,
+		Measure:     m,
+		Aggregation: view.Sum(),
+	}
+}
+
+func createDistView(m stats.Measure, bounds []float64, keys ...tag.Key) *view.View {
+	return &view.View{
+		Name:        m.Name(),
+		Description: m.Description(),
+		TagKeys:     keys,
+		Measure:     m,
+		Aggregation: view.Distribution(bounds...),
+	}
+}
+
+// opRecorder records the measures of a data operation and its attempts.
+type opRecorder struct {
+	ctx   context.Context // tagged with the table, app profile and method
+	start time.Time
+}
+
+func (t *Table) startOp(ctx context.Context, method string) *opRecorder {
+	tctx, err := tag.New(ctx,
+		tag.Upsert(keyTable, t.table),
+		tag.Upsert(keyAppProfile, t.c.appProfile),
+		tag.Upsert(keyMethod, method))
+	if err != nil {
+		// The values are not valid tag values; record the measures untagged.
+		tctx = ctx
+	}
+	return &opRecorder{ctx: tctx, start: time.Now()}
+}
+
+// attempt returns call, recording each call as an attempt of the operation,
+// and each call after the first as a retry. An operation that sends several
+// requests, such as ApplyBulk with many entries, wraps the call of each
+// request separately.
+func (r *opRecorder) attempt(call gax.APICall) gax.APICall {
+	attempts := 0
+	return func(ctx context.Context, settings gax.CallSettings) error {
+		attempts++
+		if attempts > 1 {
+			stats.Record(r.ctx, RetryCount.M(1))
+		}
+		start := time.Now()
+		err := call(ctx, settings)
+		r.recordWithStatus(err, AttemptLatency.M(sinceMillis(start)))
+		return err
+	}
+}
+
+// end records the end of the operation with the given error.
+func (r *opRecorder) end(err error) {
+	r.recordWithStatus(err, OperationLatency.M(sinceMillis(r.start)))
+}
+
+func (r *opRecorder) record(ms ...stats.Measurement) {
+	stats.Record(r.ctx, ms...)
+}
+
+func (r *opRecorder) recordWithStatus(err error, ms ...stats.Measurement) {
+	stats.RecordWithTags(r.ctx, []tag.Mutator{tag.Upsert(keyStatus, status.Code(err).String())}, ms...)
+}
+
+func sinceMillis(t time.Time) float64 {
+	return float64(time.Since(t)) / float64(time.Millisecond)
+}
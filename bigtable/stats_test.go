@@ -0,0 +1,231 @@
+/*
+Copyright 2020 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package bigtable
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"go.opencensus.io/stats/view"
+	btpb "google.golang.org/genproto/googleapis/bigtable/v2"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// viewData returns the data of the row of v with the given tags, or nil.
+func viewData(t *testing.T, v *view.View, tags map[string]string) view.AggregationData {
+	t.Helper()
+	rows, err := view.RetrieveData(v.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+rows:
+	for _, row := range rows {
+		if len(row.Tags) != len(tags) {
+			continue
+		}
+		for _, tg := range row.Tags {
+			if tags[tg.Key.Name()] != tg.Value {
+				continue rows
+			}
+		}
+		return row.Data
+	}
+	return nil
+}
+
+// tagsOf returns the tags of operations on the table of setupFakeServer. The
+// client uses the default app profile, so there is no app_profile tag.
+func tagsOf(method, status string) map[string]string {
+	tags := map[string]string{"table": "table"}
+	if method != "" {
+		tags["method"] = method
+	}
+	if status != "" {
+		tags["status"] = status
+	}
+	return tags
+}
+
+func TestStats(t *testing.T) {
+	if err := view.Register(DefaultViews...); err != nil {
+		t.Fatal(err)
+	}
+	defer view.Unregister(DefaultViews...)
+
+	ctx := context.Background()
+	tbl, cleanup, err := setupFakeServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+
+	for _, row := range []string{"a", "b", "c"} {
+		mut := NewMutation()
+		mut.Set("cf", "q", 1000, []byte("v"))
+		mut.Set("cf", "r", 1000, []byte("v"))
+		if err := tbl.Apply(ctx, row, mut); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tbl.ReadRows(ctx, InfiniteRange(""), func(Row) bool { return true }); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tbl.ReadRow(ctx, "missing"); err != nil {
+		t.Fatal(err)
+	}
+	rmw := NewReadModifyWrite()
+	rmw.AppendValue("nosuchfamily", "q", []byte("v"))
+	_, rmwErr := tbl.ApplyReadModifyWrite(ctx, "a", rmw)
+	if rmwErr == nil {
+		t.Fatal("ApplyReadModifyWrite to an unknown family succeeded")
+	}
+	if _, err := tbl.SampleRowKeys(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		method, status string
+		want           int64
+	}{
+		{"Apply", "OK", 3},
+		{"ReadRows", "OK", 2},
+		{"ApplyReadModifyWrite", status.Code(rmwErr).String(), 1},
+		{"SampleRowKeys", "OK", 1},
+	} {
+		for _, v := range []*view.View{OperationLatencyView, AttemptLatencyView} {
+			data := viewData(t, v, tagsOf(test.method, test.status))
+			if data == nil {
+				t.Errorf("%s: no data for %s %s", v.Name, test.method, test.status)
+				continue
+			}
+			if got := data.(*view.DistributionData).Count; got != test.want {
+				t.Errorf("%s: %s %s count = %d, want %d", v.Name, test.method, test.status, got, test.want)
+			}
+		}
+	}
+
+	rows := viewData(t, RowsPerReadView, tagsOf("", ""))
+	cells := viewData(t, CellsPerReadView, tagsOf("", ""))
+	if rows == nil || cells == nil {
+		t.Fatal("no rows or cells per read recorded")
+	}
+	if got := rows.(*view.DistributionData); got.Count != 2 || got.Max != 3 || got.Min != 0 {
+		t.Errorf("rows per read: count %d, min %v, max %v; want 2, 0, 3", got.Count, got.Min, got.Max)
+	}
+	if got := cells.(*view.DistributionData); got.Max != 6 {
+		t.Errorf("cells per read: max %v, want 6", got.Max)
+	}
+	for _, v := range []*view.View{SentBytesView, ReceivedBytesView} {
+		data := viewData(t, v, tagsOf("ReadRows", ""))
+		if data == nil || data.(*view.SumData).Value <= 0 {
+			t.Errorf("%s: got %v, want a positive sum", v.Name, data)
+		}
+	}
+	if data := viewData(t, RetryCountView, tagsOf("ReadRows", "")); data != nil {
+		t.Errorf("ReadRows recorded retries: %v", data)
+	}
+}
+
+func TestStatsRetries(t *testing.T) {
+	if err := view.Register(DefaultViews...); err != nil {
+		t.Fatal(err)
+	}
+	defer view.Unregister(DefaultViews...)
+
+	ctx := context.Background()
+	attempt := 0
+	errInjector := func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		if !strings.HasSuffix(info.FullMethod, "MutateRows") {
+			return handler(srv, ss)
+		}
+		attempt++
+		req := new(btpb.MutateRowsRequest)
+		must(ss.RecvMsg(req))
+		switch attempt {
+		case 1:
+			return status.Errorf(codes.Unavailable, "")
+		case 2:
+			// The first mutation fails and is retried.
+			return writeMutateRowsResponse(ss, codes.Aborted, codes.OK)
+		default:
+			return writeMutateRowsResponse(ss, codes.OK)
+		}
+	}
+	tbl, cleanup, err := setupFakeServer(grpc.StreamInterceptor(errInjector))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+
+	mut := NewMutation()
+	mut.Set("cf", "q", 1000, []byte("v"))
+	errs, err := tbl.ApplyBulk(ctx, []string{"a", "b"}, []*Mutation{mut, mut})
+	if err != nil || errs != nil {
+		t.Fatalf("ApplyBulk: %v, %v", errs, err)
+	}
+
+	if data := viewData(t, RetryCountView, tagsOf("ApplyBulk", "")); data == nil || data.(*view.SumData).Value != 2 {
+		t.Errorf("retries: got %v, want 2", data)
+	}
+	if data := viewData(t, AttemptLatencyView, tagsOf("ApplyBulk", "Unavailable")); data == nil || data.(*view.DistributionData).Count != 1 {
+		t.Errorf("Unavailable attempts: got %v, want 1", data)
+	}
+	if data := viewData(t, AttemptLatencyView, tagsOf("ApplyBulk", "OK")); data == nil || data.(*view.DistributionData).Count != 1 {
+		t.Errorf("OK attempts: got %v, want 1", data)
+	}
+	if data := viewData(t, OperationLatencyView, tagsOf("ApplyBulk", "OK")); data == nil || data.(*view.DistributionData).Count != 1 {
+		t.Errorf("operations: got %v, want 1", data)
+	}
+	if data := viewData(t, MutationFailureCountView, tagsOf("ApplyBulk", "Aborted")); data == nil || data.(*view.SumData).Value != 1 {
+		t.Errorf("mutation failures: got %v, want 1", data)
+	}
+}
+
+func TestStatsRetriesGroups(t *testing.T) {
+	if err := view.Register(DefaultViews...); err != nil {
+		t.Fatal(err)
+	}
+	defer view.Unregister(DefaultViews...)
+
+	ctx := context.Background()
+	tbl, cleanup, err := setupFakeServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+
+	// Two entries too large to be sent in one request. The first attempt of
+	// each request is not a retry.
+	mut := NewMutation()
+	for i := 0; i < maxMutations/2+1; i++ {
+		mut.DeleteRow()
+	}
+	errs, err := tbl.ApplyBulk(ctx, []string{"a", "b"}, []*Mutation{mut, mut})
+	if err != nil || errs != nil {
+		t.Fatalf("ApplyBulk: %v, %v", errs, err)
+	}
+
+	if data := viewData(t, RetryCountView, tagsOf("ApplyBulk", "")); data != nil {
+		t.Errorf("retries: got %v, want none", data)
+	}
+	if data := viewData(t, AttemptLatencyView, tagsOf("ApplyBulk", "OK")); data == nil || data.(*view.DistributionData).Count != 2 {
+		t.Errorf("OK attempts: got %v, want 2", data)
+	}
+}
@@ -56,6 +56,8 @@ type Client struct {
 	connPool gtransport.ConnPool
 	client   pb.DatastoreClient
 	dataset  string // Called dataset by the datastore API, synonym for project ID.
+
+	namespace string // If set, all keys and queries must be in this namespace.
 }
 
 // NewClient creates a new Client for a given dataset.  If the project ID is
@@ -374,6 +376,10 @@ func (c *Client) get(ctx context.Context, keys []*Key, dst interface{}, opts *pb
 	if len(keys) == 0 {
 		return nil
 	}
+	keys, err := c.scopeKeys(keys)
+	if err != nil {
+		return err
+	}
 
 	// Go through keys, validate them, serialize then, and create a dict mapping them to their indices.
 	// Equal keys are deduped.
@@ -494,6 +500,10 @@ func (c *Client) PutMulti(ctx context.Context, keys []*Key, src interface{}) (re
 	ctx = trace.StartSpan(ctx, "cloud.google.com/go/datastore.PutMulti")
 	defer func() { trace.EndSpan(ctx, err) }()
 
+	keys, err = c.scopeKeys(keys)
+	if err != nil {
+		return nil, err
+	}
 	mutations, err := putMutations(keys, src)
 	if err != nil {
 		return nil, err
@@ -588,6 +598,10 @@ func (c *Client) DeleteMulti(ctx context.Context, keys []*Key) (err error) {
 	ctx = trace.StartSpan(ctx, "cloud.google.com/go/datastore.DeleteMulti")
 	defer func() { trace.EndSpan(ctx, err) }()
 
+	keys, err = c.scopeKeys(keys)
+	if err != nil {
+		return err
+	}
 	mutations, err := deleteMutations(keys)
 	if err != nil {
 		return err
@@ -641,6 +655,7 @@ func (c *Client) Mutate(ctx context.Context, muts ...*Mutation) (ret []*Key, err
 	ctx = trace.StartSpan(ctx, "cloud.google.com/go/datastore.Mutate")
 	defer func() { trace.EndSpan(ctx, err) }()
 
+	muts = c.scopeMutations(muts)
 	pmuts, err := mutationProtos(muts)
 	if err != nil {
 		return nil, err
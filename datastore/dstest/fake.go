@@ -0,0 +1,604 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package dstest provides a fake Cloud Datastore service for testing. It
+// implements a simplified form of the service, suitable for unit tests. It
+// keeps all data in memory, does not require composite indexes, and is always
+// strongly consistent. It may behave differently from the actual service in
+// ways in which the service is non-deterministic or unspecified: the values
+// of allocated IDs, the contents of cursors, etc.
+//
+// To use it, connect a datastore.Client to the server's address:
+//
+//	srv := dstest.NewServer()
+//	defer srv.Close()
+//	conn, err := grpc.Dial(srv.Addr, grpc.WithInsecure())
+//	...
+//	client, err := datastore.NewClient(ctx, "project", option.WithGRPCConn(conn))
+//
+// This package is EXPERIMENTAL and is subject to change without notice.
+package dstest
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+
+	"cloud.google.com/go/internal/testutil"
+	"github.com/golang/protobuf/proto"
+	pb "google.golang.org/genproto/googleapis/datastore/v1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// maxBatchSize is the maximum number of results returned by a single
+// RunQuery call.
+const maxBatchSize = 300
+
+// Server is a fake Datastore server.
+type Server struct {
+	srv     *testutil.Server
+	Addr    string  // The address that the server is listening on.
+	GServer GServer // Not intended to be used directly.
+}
+
+// GServer is the underlying service implementor. It is not intended to be used
+// directly.
+type GServer struct {
+	pb.DatastoreServer
+
+	mu sync.Mutex
+	// version is the version of the most recent commit. Every commit gets a
+	// new version, which all the entities it writes share.
+	version  int64
+	entities map[string]*record // keyed by keyString
+	// usedIDs records every numeric ID that has been allocated, reserved or
+	// written, so that AllocateIds never hands one out again.
+	usedIDs   map[int64]bool
+	nextID    int64
+	txns      map[string]*transaction
+	nextTxn   int
+	batchSize int
+}
+
+// record holds the history of a single entity.
+type record struct {
+	key *pb.Key
+	// revisions are in increasing version order. A revision with a nil
+	// entity marks a deletion.
+	revisions []revision
+}
+
+type revision struct {
+	version int64
+	entity  *pb.Entity
+}
+
+// at returns the entity as of the given version, or nil if it did not exist
+// then, along with the version at which that state was written.
+func (r *record) at(version int64) (*pb.Entity, int64) {
+	for i := len(r.revisions) - 1; i >= 0; i-- {
+		if rev := r.revisions[i]; rev.version <= version {
+			return rev.entity, rev.version
+		}
+	}
+	return nil, 0
+}
+
+// lastChange returns the version of the most recent write to the entity.
+func (r *record) lastChange() int64 {
+	return r.revisions[len(r.revisions)-1].version
+}
+
+// transaction is an open transaction. Reads in a transaction see the data as
+// of readVersion. A read-write transaction fails to commit if any entity it
+// read or writes, or any entity in an entity group it queried, changed after
+// readVersion.
+type transaction struct {
+	readOnly    bool
+	readVersion int64
+	reads       map[string]bool // keyStrings of entities looked up
+	groups      map[string]bool // root keyStrings of ancestor queries
+}
+
+// NewServer creates a new fake server running in the current process.
+func NewServer() *Server {
+	srv, err := testutil.NewServer()
+	if err != nil {
+		panic(fmt.Sprintf("dstest.NewServer: %v", err))
+	}
+	s := &Server{
+		srv:  srv,
+		Addr: srv.Addr,
+		GServer: GServer{
+			entities:  map[string]*record{},
+			usedIDs:   map[int64]bool{},
+			txns:      map[string]*transaction{},
+			batchSize: maxBatchSize,
+		},
+	}
+	pb.RegisterDatastoreServer(srv.Gsrv, &s.GServer)
+	srv.Start()
+	return s
+}
+
+// Close shuts down the server and releases all resources.
+func (s *Server) Close() error {
+	s.srv.Close()
+	return nil
+}
+
+// Lookup looks up entities by key.
+func (s *GServer) Lookup(_ context.Context, req *pb.LookupRequest) (*pb.LookupResponse, error) {
+	if err := checkProject(req.ProjectId); err != nil {
+		return nil, err
+	}
+	if len(req.Keys) > 1000 {
+		return nil, status.Errorf(codes.InvalidArgument, "cannot get more than 1000 keys in a single call")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	version, tx, err := s.readVersion(req.ReadOptions)
+	if err != nil {
+		return nil, err
+	}
+	res := &pb.LookupResponse{}
+	for _, k := range req.Keys {
+		k, err := normalizeKey(req.ProjectId, k)
+		if err != nil {
+			return nil, err
+		}
+		if err := checkCompleteKey(k); err != nil {
+			return nil, err
+		}
+		ks := keyString(k)
+		if tx != nil {
+			tx.reads[ks] = true
+		}
+		var e *pb.Entity
+		var v int64
+		if r := s.entities[ks]; r != nil {
+			e, v = r.at(version)
+		}
+		if e == nil {
+			res.Missing = append(res.Missing, &pb.EntityResult{Entity: &pb.Entity{Key: k}, Version: version})
+			continue
+		}
+		res.Found = append(res.Found, &pb.EntityResult{Entity: proto.Clone(e).(*pb.Entity), Version: v})
+	}
+	return res, nil
+}
+
+// readVersion returns the version of the data that a read with the given
+// options should see. If the read is part of a transaction, that transaction
+// is returned as well.
+func (s *GServer) readVersion(opts *pb.ReadOptions) (int64, *transaction, error) {
+	id := opts.GetTransaction()
+	if id == nil {
+		return s.version, nil, nil
+	}
+	tx, err := s.transaction(id)
+	if err != nil {
+		return 0, nil, err
+	}
+	return tx.readVersion, tx, nil
+}
+
+func (s *GServer) transaction(id []byte) (*transaction, error) {
+	tx := s.txns[string(id)]
+	if tx == nil {
+		return nil, status.Errorf(codes.InvalidArgument, "The referenced transaction has expired or is no longer valid.")
+	}
+	return tx, nil
+}
+
+// BeginTransaction begins a new transaction.
+func (s *GServer) BeginTransaction(_ context.Context, req *pb.BeginTransactionRequest) (*pb.BeginTransactionResponse, error) {
+	if err := checkProject(req.ProjectId); err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.nextTxn++
+	id := fmt.Sprintf("txn-%d", s.nextTxn)
+	s.txns[id] = &transaction{
+		readOnly:    req.TransactionOptions.GetReadOnly() != nil,
+		readVersion: s.version,
+		reads:       map[string]bool{},
+		groups:      map[string]bool{},
+	}
+	return &pb.BeginTransactionResponse{Transaction: []byte(id)}, nil
+}
+
+// Rollback rolls back a transaction.
+func (s *GServer) Rollback(_ context.Context, req *pb.RollbackRequest) (*pb.RollbackResponse, error) {
+	if err := checkProject(req.ProjectId); err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, err := s.transaction(req.Transaction); err != nil {
+		return nil, err
+	}
+	delete(s.txns, string(req.Transaction))
+	return &pb.RollbackResponse{}, nil
+}
+
+// Commit applies the mutations in the request atomically. Either all of them
+// are applied, or none are and an error is returned.
+func (s *GServer) Commit(_ context.Context, req *pb.CommitRequest) (*pb.CommitResponse, error) {
+	if err := checkProject(req.ProjectId); err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var tx *transaction
+	switch req.Mode {
+	case pb.CommitRequest_TRANSACTIONAL:
+		if req.GetTransaction() == nil {
+			return nil, status.Errorf(codes.InvalidArgument, "a transactional commit must specify a transaction")
+		}
+		var err error
+		if tx, err = s.transaction(req.GetTransaction()); err != nil {
+			return nil, err
+		}
+		// The transaction is finished whether or not the commit succeeds.
+		delete(s.txns, string(req.GetTransaction()))
+		if tx.readOnly && len(req.Mutations) > 0 {
+			return nil, status.Errorf(codes.InvalidArgument, "cannot modify entities in a read-only transaction")
+		}
+	case pb.CommitRequest_NON_TRANSACTIONAL:
+		if req.GetTransaction() != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "a non-transactional commit must not specify a transaction")
+		}
+	default:
+		return nil, status.Errorf(codes.InvalidArgument, "unspecified commit mode")
+	}
+
+	// Stage the mutations so that nothing is written if any of them fails.
+	version := s.version + 1
+	staged := map[string]*pb.Entity{} // nil means deleted
+	var order []string                // keys of staged, in the order first written
+	current := func(ks string) (*pb.Entity, int64) {
+		if e, ok := staged[ks]; ok {
+			return e, version
+		}
+		if r := s.entities[ks]; r != nil {
+			return r.at(s.version)
+		}
+		return nil, 0
+	}
+	var allocated []int64
+	res := &pb.CommitResponse{}
+	for _, m := range req.Mutations {
+		k, e, err := mutationTarget(m)
+		if err != nil {
+			return nil, err
+		}
+		if k, err = normalizeKey(req.ProjectId, k); err != nil {
+			return nil, err
+		}
+		mr := &pb.MutationResult{Version: version}
+		if incomplete(k) {
+			if _, ok := m.Operation.(*pb.Mutation_Delete); ok {
+				return nil, status.Errorf(codes.InvalidArgument, "a key for a delete must be complete")
+			}
+			if _, ok := m.Operation.(*pb.Mutation_Update); ok {
+				return nil, status.Errorf(codes.InvalidArgument, "a key for an update must be complete")
+			}
+			if err := checkKey(k); err != nil {
+				return nil, err
+			}
+			id := s.allocateID()
+			allocated = append(allocated, id)
+			k.Path[len(k.Path)-1].IdType = &pb.Key_PathElement_Id{Id: id}
+			mr.Key = k
+		} else if err := checkCompleteKey(k); err != nil {
+			return nil, err
+		}
+		ks := keyString(k)
+		if _, ok := staged[ks]; ok && req.Mode == pb.CommitRequest_NON_TRANSACTIONAL {
+			return nil, status.Errorf(codes.InvalidArgument, "a non-transactional commit may not contain multiple mutations affecting the same entity")
+		}
+		old, oldVersion := current(ks)
+		if bv, ok := m.ConflictDetectionStrategy.(*pb.Mutation_BaseVersion); ok && bv.BaseVersion != oldVersion {
+			mr.ConflictDetected = true
+			mr.Version = oldVersion
+			res.MutationResults = append(res.MutationResults, mr)
+			continue
+		}
+		switch m.Operation.(type) {
+		case *pb.Mutation_Insert:
+			if old != nil {
+				return nil, status.Errorf(codes.AlreadyExists, "entity already exists: %v", k)
+			}
+		case *pb.Mutation_Update:
+			if old == nil {
+				return nil, status.Errorf(codes.NotFound, "no entity to update: %v", k)
+			}
+		}
+		if e != nil {
+			if err := checkEntity(e); err != nil {
+				return nil, err
+			}
+			e = proto.Clone(e).(*pb.Entity)
+			e.Key = k
+		}
+		if _, ok := staged[ks]; !ok {
+			order = append(order, ks)
+		}
+		staged[ks] = e
+		res.MutationResults = append(res.MutationResults, mr)
+	}
+
+	if tx != nil && s.conflicts(tx, staged) {
+		return nil, status.Errorf(codes.Aborted, "too much contention on these datastore entities. please try again.")
+	}
+
+	for _, id := range allocated {
+		s.usedIDs[id] = true
+	}
+	if len(order) == 0 {
+		return res, nil
+	}
+	s.version = version
+	for _, ks := range order {
+		e := staged[ks]
+		r := s.entities[ks]
+		if r == nil {
+			if e == nil {
+				continue // Deleting an entity that never existed.
+			}
+			r = &record{key: e.Key}
+			s.entities[ks] = r
+		}
+		r.revisions = append(r.revisions, revision{version: version, entity: e})
+		if e != nil {
+			if id := e.Key.Path[len(e.Key.Path)-1].GetId(); id != 0 {
+				s.usedIDs[id] = true
+			}
+			res.IndexUpdates += int32(len(e.Properties))
+		}
+	}
+	return res, nil
+}
+
+// conflicts reports whether any entity that tx read or is about to write, or
+// any entity in a group that it queried, changed after tx began.
+func (s *GServer) conflicts(tx *transaction, writes map[string]*pb.Entity) bool {
+	changed := func(ks string) bool {
+		r := s.entities[ks]
+		return r != nil && r.lastChange() > tx.readVersion
+	}
+	for ks := range tx.reads {
+		if changed(ks) {
+			return true
+		}
+	}
+	for ks := range writes {
+		if changed(ks) {
+			return true
+		}
+	}
+	if len(tx.groups) > 0 {
+		for _, r := range s.entities {
+			if tx.groups[rootKeyString(r.key)] && r.lastChange() > tx.readVersion {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func mutationTarget(m *pb.Mutation) (*pb.Key, *pb.Entity, error) {
+	var e *pb.Entity
+	switch op := m.Operation.(type) {
+	case *pb.Mutation_Insert:
+		e = op.Insert
+	case *pb.Mutation_Update:
+		e = op.Update
+	case *pb.Mutation_Upsert:
+		e = op.Upsert
+	case *pb.Mutation_Delete:
+		if op.Delete == nil {
+			return nil, nil, status.Errorf(codes.InvalidArgument, "a delete mutation must have a key")
+		}
+		return op.Delete, nil, nil
+	default:
+		return nil, nil, status.Errorf(codes.InvalidArgument, "a mutation must have an operation")
+	}
+	if e == nil || e.Key == nil {
+		return nil, nil, status.Errorf(codes.InvalidArgument, "an entity in a mutation must have a key")
+	}
+	return e.Key, e, nil
+}
+
+// AllocateIds allocates IDs for the given incomplete keys.
+func (s *GServer) AllocateIds(_ context.Context, req *pb.AllocateIdsRequest) (*pb.AllocateIdsResponse, error) {
+	if err := checkProject(req.ProjectId); err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	res := &pb.AllocateIdsResponse{}
+	for _, k := range req.Keys {
+		k, err := normalizeKey(req.ProjectId, k)
+		if err != nil {
+			return nil, err
+		}
+		if !incomplete(k) {
+			return nil, status.Errorf(codes.InvalidArgument, "a key for allocating IDs must be incomplete: %v", k)
+		}
+		if err := checkKey(k); err != nil {
+			return nil, err
+		}
+		id := s.allocateID()
+		s.usedIDs[id] = true
+		k.Path[len(k.Path)-1].IdType = &pb.Key_PathElement_Id{Id: id}
+		res.Keys = append(res.Keys, k)
+	}
+	return res, nil
+}
+
+// ReserveIds prevents the IDs of the given complete keys from being allocated.
+func (s *GServer) ReserveIds(_ context.Context, req *pb.ReserveIdsRequest) (*pb.ReserveIdsResponse, error) {
+	if err := checkProject(req.ProjectId); err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var ids []int64
+	for _, k := range req.Keys {
+		k, err := normalizeKey(req.ProjectId, k)
+		if err != nil {
+			return nil, err
+		}
+		if err := checkCompleteKey(k); err != nil {
+			return nil, err
+		}
+		id := k.Path[len(k.Path)-1].GetId()
+		if id == 0 {
+			return nil, status.Errorf(codes.InvalidArgument, "a key for reserving IDs must have a numeric ID: %v", k)
+		}
+		ids = append(ids, id)
+	}
+	for _, id := range ids {
+		s.usedIDs[id] = true
+	}
+	return &pb.ReserveIdsResponse{}, nil
+}
+
+// allocateID returns the next unused ID. The caller must mark it as used once
+// it is certain to be handed out.
+func (s *GServer) allocateID() int64 {
+	for {
+		s.nextID++
+		if !s.usedIDs[s.nextID] {
+			return s.nextID
+		}
+	}
+}
+
+func checkProject(projectID string) error {
+	if projectID == "" {
+		return status.Errorf(codes.InvalidArgument, "the project ID must be specified")
+	}
+	return nil
+}
+
+// normalizeKey returns a copy of k whose partition ID names projectID. It is
+// an error for k to name a different project.
+func normalizeKey(projectID string, k *pb.Key) (*pb.Key, error) {
+	if k == nil {
+		return nil, status.Errorf(codes.InvalidArgument, "missing key")
+	}
+	if p := k.GetPartitionId().GetProjectId(); p != "" && p != projectID {
+		return nil, status.Errorf(codes.InvalidArgument, "mismatched databases within request: %q vs. %q", p, projectID)
+	}
+	k = proto.Clone(k).(*pb.Key)
+	k.PartitionId = &pb.PartitionId{ProjectId: projectID, NamespaceId: k.GetPartitionId().GetNamespaceId()}
+	return k, nil
+}
+
+// checkKey validates every element of k's path except the ID or name of the
+// last.
+func checkKey(k *pb.Key) error {
+	if len(k.Path) == 0 {
+		return status.Errorf(codes.InvalidArgument, "a key must have at least one path element")
+	}
+	for i, e := range k.Path {
+		if e.Kind == "" {
+			return status.Errorf(codes.InvalidArgument, "a key path element must have a kind: %v", k)
+		}
+		if isReserved(e.Kind) {
+			return status.Errorf(codes.InvalidArgument, "the key path element kind %q is reserved", e.Kind)
+		}
+		if i < len(k.Path)-1 && e.GetId() == 0 && e.GetName() == "" {
+			return status.Errorf(codes.InvalidArgument, "a key path element must not be incomplete: %v", k)
+		}
+	}
+	return nil
+}
+
+func checkCompleteKey(k *pb.Key) error {
+	if err := checkKey(k); err != nil {
+		return err
+	}
+	if incomplete(k) {
+		return status.Errorf(codes.InvalidArgument, "a key path element must not be incomplete: %v", k)
+	}
+	return nil
+}
+
+// maxIndexedStringLen is the maximum length in bytes of an indexed string or
+// blob value.
+const maxIndexedStringLen = 1500
+
+func checkEntity(e *pb.Entity) error {
+	for name, v := range e.Properties {
+		if name == "" {
+			return status.Errorf(codes.InvalidArgument, "a property name must not be empty")
+		}
+		if isReserved(name) {
+			return status.Errorf(codes.InvalidArgument, "the property name %q is reserved", name)
+		}
+		if err := checkValue(name, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func checkValue(name string, v *pb.Value) error {
+	switch x := v.ValueType.(type) {
+	case *pb.Value_ArrayValue:
+		if v.ExcludeFromIndexes {
+			return status.Errorf(codes.InvalidArgument, "property %q: a Value containing an ArrayValue cannot have exclude_from_indexes set", name)
+		}
+		for _, e := range x.ArrayValue.GetValues() {
+			if _, ok := e.ValueType.(*pb.Value_ArrayValue); ok {
+				return status.Errorf(codes.InvalidArgument, "property %q: an ArrayValue cannot contain another ArrayValue", name)
+			}
+			if err := checkValue(name, e); err != nil {
+				return err
+			}
+		}
+	case *pb.Value_EntityValue:
+		return checkEntity(x.EntityValue)
+	case *pb.Value_StringValue:
+		if !v.ExcludeFromIndexes && len(x.StringValue) > maxIndexedStringLen {
+			return status.Errorf(codes.InvalidArgument, "The value of property %q is longer than %d bytes.", name, maxIndexedStringLen)
+		}
+	case *pb.Value_BlobValue:
+		if !v.ExcludeFromIndexes && len(x.BlobValue) > maxIndexedStringLen {
+			return status.Errorf(codes.InvalidArgument, "The value of property %q is longer than %d bytes.", name, maxIndexedStringLen)
+		}
+	case nil:
+		return status.Errorf(codes.InvalidArgument, "property %q has no value", name)
+	}
+	return nil
+}
+
+// isReserved reports whether name matches the pattern __.*__, which is
+// reserved for the service.
+func isReserved(name string) bool {
+	return len(name) >= 4 && strings.HasPrefix(name, "__") && strings.HasSuffix(name, "__")
+}
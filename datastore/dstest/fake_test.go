@@ -0,0 +1,401 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dstest
+
+import (
+	"context"
+	"testing"
+
+	"cloud.google.com/go/datastore"
+	"cloud.google.com/go/internal/testutil"
+	"google.golang.org/api/iterator"
+	"google.golang.org/api/option"
+	pb "google.golang.org/genproto/googleapis/datastore/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+type Item struct {
+	Name  string
+	Price int
+	Tags  []string
+}
+
+func newFake(t *testing.T) (*datastore.Client, *Server, func()) {
+	srv := NewServer()
+	conn, err := grpc.Dial(srv.Addr, grpc.WithInsecure())
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := datastore.NewClient(context.Background(), "P", option.WithGRPCConn(conn))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client, srv, func() {
+		client.Close()
+		conn.Close()
+		srv.Close()
+	}
+}
+
+func putItems(t *testing.T, client *datastore.Client, parent *datastore.Key, items ...*Item) []*datastore.Key {
+	var keys []*datastore.Key
+	for _, it := range items {
+		keys = append(keys, datastore.NameKey("Item", it.Name, parent))
+	}
+	keys, err := client.PutMulti(context.Background(), keys, items)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return keys
+}
+
+func TestGetPutDelete(t *testing.T) {
+	ctx := context.Background()
+	client, _, cleanup := newFake(t)
+	defer cleanup()
+
+	k, err := client.Put(ctx, datastore.IncompleteKey("Item", nil), &Item{Name: "a", Price: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if k.Incomplete() {
+		t.Fatalf("got incomplete key %v", k)
+	}
+	var got Item
+	if err := client.Get(ctx, k, &got); err != nil {
+		t.Fatal(err)
+	}
+	if want := (Item{Name: "a", Price: 1}); !testutil.Equal(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+
+	missing := datastore.NameKey("Item", "missing", nil)
+	items := make([]Item, 2)
+	err = client.GetMulti(ctx, []*datastore.Key{k, missing}, items)
+	if me, ok := err.(datastore.MultiError); !ok || me[0] != nil || me[1] != datastore.ErrNoSuchEntity {
+		t.Errorf("GetMulti: got %v, want [nil, ErrNoSuchEntity]", err)
+	}
+
+	if err := client.Delete(ctx, k); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Get(ctx, k, &got); err != datastore.ErrNoSuchEntity {
+		t.Errorf("after delete: got %v, want ErrNoSuchEntity", err)
+	}
+}
+
+func TestMutate(t *testing.T) {
+	ctx := context.Background()
+	client, _, cleanup := newFake(t)
+	defer cleanup()
+
+	k := datastore.NameKey("Item", "x", nil)
+	if _, err := client.Mutate(ctx, datastore.NewInsert(k, &Item{Name: "x"})); err != nil {
+		t.Fatal(err)
+	}
+	_, err := client.Mutate(ctx, datastore.NewInsert(k, &Item{Name: "x"}))
+	if status.Code(err) != codes.AlreadyExists {
+		t.Errorf("second insert: got %v, want AlreadyExists", err)
+	}
+	_, err = client.Mutate(ctx, datastore.NewUpdate(datastore.NameKey("Item", "y", nil), &Item{Name: "y"}))
+	if status.Code(err) != codes.NotFound {
+		t.Errorf("update of missing entity: got %v, want NotFound", err)
+	}
+	// A failed commit writes nothing.
+	_, err = client.Mutate(ctx,
+		datastore.NewUpsert(datastore.NameKey("Item", "z", nil), &Item{Name: "z"}),
+		datastore.NewInsert(k, &Item{Name: "x"}))
+	if err == nil {
+		t.Fatal("got nil, want error")
+	}
+	if err := client.Get(ctx, datastore.NameKey("Item", "z", nil), &Item{}); err != datastore.ErrNoSuchEntity {
+		t.Errorf("got %v, want ErrNoSuchEntity", err)
+	}
+}
+
+func TestQuery(t *testing.T) {
+	ctx := context.Background()
+	client, _, cleanup := newFake(t)
+	defer cleanup()
+
+	parent := datastore.NameKey("Store", "s", nil)
+	putItems(t, client, parent,
+		&Item{Name: "apple", Price: 3, Tags: []string{"fruit", "red"}},
+		&Item{Name: "banana", Price: 1, Tags: []string{"fruit", "yellow"}},
+		&Item{Name: "carrot", Price: 2, Tags: []string{"vegetable"}},
+		&Item{Name: "date", Price: 5, Tags: []string{"fruit"}},
+	)
+	putItems(t, client, nil, &Item{Name: "eggplant", Price: 4, Tags: []string{"vegetable"}})
+
+	names := func(q *datastore.Query) []string {
+		t.Helper()
+		var items []*Item
+		if _, err := client.GetAll(ctx, q, &items); err != nil {
+			t.Fatal(err)
+		}
+		var ns []string
+		for _, it := range items {
+			ns = append(ns, it.Name)
+		}
+		return ns
+	}
+	for _, test := range []struct {
+		q    *datastore.Query
+		want []string
+	}{
+		// Keys sort by their first path element, so the root entity comes first.
+		{datastore.NewQuery("Item"), []string{"eggplant", "apple", "banana", "carrot", "date"}},
+		{datastore.NewQuery("Item").Order("-Price"), []string{"date", "eggplant", "apple", "carrot", "banana"}},
+		{datastore.NewQuery("Item").Filter("Price >", 2), []string{"apple", "eggplant", "date"}},
+		{datastore.NewQuery("Item").Filter("Price >=", 2).Filter("Price <", 5).Order("-Price"), []string{"eggplant", "apple", "carrot"}},
+		{datastore.NewQuery("Item").Filter("Tags =", "fruit").Order("Price"), []string{"banana", "apple", "date"}},
+		{datastore.NewQuery("Item").Filter("Tags =", "fruit").Filter("Tags =", "red"), []string{"apple"}},
+		{datastore.NewQuery("Item").Ancestor(parent).Filter("Tags =", "vegetable"), []string{"carrot"}},
+		{datastore.NewQuery("Item").Order("Price").Offset(1).Limit(2), []string{"carrot", "apple"}},
+		{datastore.NewQuery("Item").Filter("__key__ >", datastore.NameKey("Item", "c", parent)).Ancestor(parent), []string{"carrot", "date"}},
+	} {
+		if got := names(test.q); !testutil.Equal(got, test.want) {
+			t.Errorf("%v: got %v, want %v", test.q, got, test.want)
+		}
+	}
+
+	// Projection returns one result per value of a multi-valued property.
+	var projected []*Item
+	q := datastore.NewQuery("Item").Ancestor(parent).Project("Tags").Order("Tags")
+	if _, err := client.GetAll(ctx, q, &projected); err != nil {
+		t.Fatal(err)
+	}
+	var tags []string
+	for _, it := range projected {
+		tags = append(tags, it.Tags...)
+	}
+	if want := []string{"fruit", "fruit", "fruit", "red", "vegetable", "yellow"}; !testutil.Equal(tags, want) {
+		t.Errorf("projection: got %v, want %v", tags, want)
+	}
+	projected = nil
+	q = datastore.NewQuery("Item").Project("Tags").DistinctOn("Tags").Order("Tags")
+	if _, err := client.GetAll(ctx, q, &projected); err != nil {
+		t.Fatal(err)
+	}
+	if len(projected) != 4 {
+		t.Errorf("distinct on: got %d results, want 4", len(projected))
+	}
+
+	n, err := client.Count(ctx, datastore.NewQuery("Item").KeysOnly())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 5 {
+		t.Errorf("count: got %d, want 5", n)
+	}
+
+	_, err = client.GetAll(ctx, datastore.NewQuery("Item").Filter("Price >", 1).Filter("Name >", "a"), &[]*Item{})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("inequalities on two properties: got %v, want InvalidArgument", err)
+	}
+}
+
+func TestQueryCursorsAndBatches(t *testing.T) {
+	ctx := context.Background()
+	client, srv, cleanup := newFake(t)
+	defer cleanup()
+	srv.GServer.batchSize = 2
+
+	var items []*Item
+	for i := 0; i < 7; i++ {
+		items = append(items, &Item{Name: string(rune('a' + i)), Price: i})
+	}
+	putItems(t, client, nil, items...)
+
+	// The iterator fetches several batches.
+	q := datastore.NewQuery("Item").Order("Price")
+	var all []*Item
+	if _, err := client.GetAll(ctx, q, &all); err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != 7 {
+		t.Fatalf("got %d items, want 7", len(all))
+	}
+
+	// Page through with cursors.
+	var pages [][]string
+	var cursor datastore.Cursor
+	for {
+		it := client.Run(ctx, q.Limit(3).Start(cursor))
+		var page []string
+		for {
+			var item Item
+			_, err := it.Next(&item)
+			if err == iterator.Done {
+				break
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			page = append(page, item.Name)
+		}
+		if len(page) == 0 {
+			break
+		}
+		pages = append(pages, page)
+		var err error
+		if cursor, err = it.Cursor(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want := [][]string{{"a", "b", "c"}, {"d", "e", "f"}, {"g"}}
+	if !testutil.Equal(pages, want) {
+		t.Errorf("got pages %v, want %v", pages, want)
+	}
+
+	// An end cursor stops the query.
+	it := client.Run(ctx, q)
+	for i := 0; i < 2; i++ {
+		if _, err := it.Next(nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	end, err := it.Cursor()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var head []*Item
+	if _, err := client.GetAll(ctx, q.End(end), &head); err != nil {
+		t.Fatal(err)
+	}
+	if len(head) != 2 || head[1].Name != "b" {
+		t.Errorf("end cursor: got %d items", len(head))
+	}
+}
+
+func TestTransactions(t *testing.T) {
+	ctx := context.Background()
+	client, _, cleanup := newFake(t)
+	defer cleanup()
+
+	k := putItems(t, client, nil, &Item{Name: "counter", Price: 1})[0]
+
+	// A transaction that read an entity modified after it began fails.
+	tx, err := client.NewTransaction(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var item Item
+	if err := tx.Get(k, &item); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Put(ctx, k, &Item{Name: "counter", Price: 10}); err != nil {
+		t.Fatal(err)
+	}
+	// Reads in the transaction see the data as of its start.
+	if err := tx.Get(k, &item); err != nil {
+		t.Fatal(err)
+	}
+	if item.Price != 1 {
+		t.Errorf("transactional read: got price %d, want 1", item.Price)
+	}
+	item.Price++
+	if _, err := tx.Put(k, &item); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tx.Commit(); err != datastore.ErrConcurrentTransaction {
+		t.Errorf("got %v, want ErrConcurrentTransaction", err)
+	}
+
+	// RunInTransaction retries and succeeds.
+	attempts := 0
+	_, err = client.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+		attempts++
+		var item Item
+		if err := tx.Get(k, &item); err != nil {
+			return err
+		}
+		if attempts == 1 {
+			if _, err := client.Put(ctx, k, &Item{Name: "counter", Price: 20}); err != nil {
+				return err
+			}
+		}
+		item.Price++
+		_, err := tx.Put(k, &item)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if attempts != 2 {
+		t.Errorf("got %d attempts, want 2", attempts)
+	}
+	if err := client.Get(ctx, k, &item); err != nil {
+		t.Fatal(err)
+	}
+	if item.Price != 21 {
+		t.Errorf("got price %d, want 21", item.Price)
+	}
+
+	// Read-only transactions cannot write.
+	tx, err = client.NewTransaction(ctx, datastore.ReadOnly)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tx.Put(k, &item); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tx.Commit(); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("read-only commit: got %v, want InvalidArgument", err)
+	}
+
+	// Queries in transactions must be ancestor queries.
+	tx, err = client.NewTransaction(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+	_, err = client.GetAll(ctx, datastore.NewQuery("Item").Transaction(tx), &[]*Item{})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("non-ancestor query in transaction: got %v, want InvalidArgument", err)
+	}
+}
+
+func TestAllocateAndReserveIDs(t *testing.T) {
+	ctx := context.Background()
+	client, srv, cleanup := newFake(t)
+	defer cleanup()
+
+	keys, err := client.AllocateIDs(ctx, []*datastore.Key{datastore.IncompleteKey("Item", nil), datastore.IncompleteKey("Item", nil)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keys[0].ID == 0 || keys[0].ID == keys[1].ID {
+		t.Errorf("got IDs %d and %d, want distinct non-zero IDs", keys[0].ID, keys[1].ID)
+	}
+
+	next := keys[1].ID + 1
+	_, err = srv.GServer.ReserveIds(ctx, &pb.ReserveIdsRequest{
+		ProjectId: "P",
+		Keys:      []*pb.Key{{Path: []*pb.Key_PathElement{{Kind: "Item", IdType: &pb.Key_PathElement_Id{Id: next}}}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys, err = client.AllocateIDs(ctx, []*datastore.Key{datastore.IncompleteKey("Item", nil)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keys[0].ID == next {
+		t.Errorf("allocated reserved ID %d", next)
+	}
+}
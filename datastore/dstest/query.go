@@ -0,0 +1,579 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dstest
+
+import (
+	"context"
+	"sort"
+	"strings"
+
+	"cloud.google.com/go/datastore/internal/valueorder"
+	"github.com/golang/protobuf/proto"
+	pb "google.golang.org/genproto/googleapis/datastore/v1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// RunQuery runs a query and returns a batch of results.
+func (s *GServer) RunQuery(_ context.Context, req *pb.RunQueryRequest) (*pb.RunQueryResponse, error) {
+	if err := checkProject(req.ProjectId); err != nil {
+		return nil, err
+	}
+	q := req.GetQuery()
+	if q == nil {
+		if req.GetGqlQuery() != nil {
+			return nil, status.Errorf(codes.Unimplemented, "GQL queries are not supported by the fake")
+		}
+		return nil, status.Errorf(codes.InvalidArgument, "missing query")
+	}
+	ns := req.PartitionId.GetNamespaceId()
+	if p := req.PartitionId.GetProjectId(); p != "" && p != req.ProjectId {
+		return nil, status.Errorf(codes.InvalidArgument, "mismatched databases within request: %q vs. %q", p, req.ProjectId)
+	}
+	pq, err := compileQuery(req.ProjectId, ns, q)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	version, tx, err := s.readVersion(req.ReadOptions)
+	if err != nil {
+		return nil, err
+	}
+	if tx != nil {
+		if pq.ancestor == nil {
+			return nil, status.Errorf(codes.InvalidArgument, "only ancestor queries are allowed inside transactions")
+		}
+		tx.groups[rootKeyString(pq.ancestor)] = true
+	}
+
+	var rows []*row
+	for _, r := range s.entities {
+		e, v := r.at(version)
+		if e == nil || !pq.matchesPartition(e.Key) {
+			continue
+		}
+		rows = append(rows, pq.rows(e, v)...)
+	}
+	sort.Slice(rows, func(i, j int) bool { return pq.compare(rows[i].pos, rows[j].pos) < 0 })
+	rows = pq.distinct(rows)
+	batch, err := pq.batch(rows, s.batchSize)
+	if err != nil {
+		return nil, err
+	}
+	batch.SnapshotVersion = version
+	return &pb.RunQueryResponse{Batch: batch, Query: q}, nil
+}
+
+// A compiledQuery is a validated query, ready to be run.
+type compiledQuery struct {
+	q         *pb.Query
+	project   string
+	namespace string
+	kind      string
+	ancestor  *pb.Key
+	// equality and inequality filters, grouped by property name.
+	eq, ineq map[string][]*pb.PropertyFilter
+	// orders always end with __key__, so that every result has a unique
+	// position.
+	orders     []*pb.PropertyOrder
+	projection []string
+	keysOnly   bool
+}
+
+func compileQuery(project, ns string, q *pb.Query) (*compiledQuery, error) {
+	pq := &compiledQuery{
+		q:         q,
+		project:   project,
+		namespace: ns,
+		eq:        map[string][]*pb.PropertyFilter{},
+		ineq:      map[string][]*pb.PropertyFilter{},
+	}
+	switch len(q.Kind) {
+	case 0:
+	case 1:
+		pq.kind = q.Kind[0].Name
+		if pq.kind == "" {
+			return nil, status.Errorf(codes.InvalidArgument, "the kind must not be empty")
+		}
+	default:
+		return nil, status.Errorf(codes.InvalidArgument, "only a single kind may be specified")
+	}
+	if err := pq.addFilter(q.Filter); err != nil {
+		return nil, err
+	}
+	var ineqProp string
+	for name := range pq.ineq {
+		if ineqProp != "" {
+			return nil, status.Errorf(codes.InvalidArgument, "cannot have inequality filters on multiple properties: [%s, %s]", ineqProp, name)
+		}
+		ineqProp = name
+	}
+
+	hasKeyOrder := false
+	for i, o := range q.Order {
+		name := o.Property.GetName()
+		if name == "" {
+			return nil, status.Errorf(codes.InvalidArgument, "an order must specify a property name")
+		}
+		if i == 0 && ineqProp != "" && name != ineqProp {
+			return nil, status.Errorf(codes.InvalidArgument, "the first sort property must be the same as the property to which the inequality filter is applied. In your query the first sort property is %s but the inequality filter is on %s", name, ineqProp)
+		}
+		if len(pq.eq[name]) > 0 {
+			// Ordering on a property with an equality filter has no effect.
+			continue
+		}
+		pq.orders = append(pq.orders, o)
+		hasKeyOrder = hasKeyOrder || name == keyFieldName
+	}
+	if len(q.Order) == 0 && ineqProp != "" {
+		pq.orders = append(pq.orders, &pb.PropertyOrder{Property: &pb.PropertyReference{Name: ineqProp}})
+		hasKeyOrder = ineqProp == keyFieldName
+	}
+	if !hasKeyOrder {
+		pq.orders = append(pq.orders, &pb.PropertyOrder{Property: &pb.PropertyReference{Name: keyFieldName}})
+	}
+
+	for _, p := range q.Projection {
+		name := p.Property.GetName()
+		if name == "" {
+			return nil, status.Errorf(codes.InvalidArgument, "a projection must specify a property name")
+		}
+		if len(pq.eq[name]) > 0 {
+			return nil, status.Errorf(codes.InvalidArgument, "cannot use projection on a property with an equality filter")
+		}
+		pq.projection = append(pq.projection, name)
+	}
+	pq.keysOnly = len(pq.projection) == 1 && pq.projection[0] == keyFieldName
+	for _, d := range q.DistinctOn {
+		if d.GetName() == "" {
+			return nil, status.Errorf(codes.InvalidArgument, "a distinct_on must specify a property name")
+		}
+	}
+	if q.Offset < 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "the offset must not be negative")
+	}
+	if q.Limit != nil && q.Limit.Value < 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "the limit must not be negative")
+	}
+	return pq, nil
+}
+
+func (pq *compiledQuery) addFilter(f *pb.Filter) error {
+	switch x := f.GetFilterType().(type) {
+	case nil:
+		return nil
+	case *pb.Filter_CompositeFilter:
+		if x.CompositeFilter.Op != pb.CompositeFilter_AND {
+			return status.Errorf(codes.InvalidArgument, "unsupported composite filter operator %v", x.CompositeFilter.Op)
+		}
+		for _, sub := range x.CompositeFilter.Filters {
+			if err := pq.addFilter(sub); err != nil {
+				return err
+			}
+		}
+		return nil
+	case *pb.Filter_PropertyFilter:
+		pf := x.PropertyFilter
+		name := pf.Property.GetName()
+		if name == "" {
+			return status.Errorf(codes.InvalidArgument, "a filter must specify a property name")
+		}
+		if pf.Value == nil || valueorder.TypeRank(pf.Value) < 0 {
+			return status.Errorf(codes.InvalidArgument, "a filter on %q must have an indexable value", name)
+		}
+		if name == keyFieldName && pf.Value.GetKeyValue() == nil {
+			return status.Errorf(codes.InvalidArgument, "a filter on __key__ must have a key value")
+		}
+		if kv := pf.Value.GetKeyValue(); kv != nil {
+			k, err := normalizeKey(pq.project, kv)
+			if err != nil {
+				return err
+			}
+			pf = &pb.PropertyFilter{Property: pf.Property, Op: pf.Op, Value: &pb.Value{ValueType: &pb.Value_KeyValue{KeyValue: k}}}
+		}
+		switch pf.Op {
+		case pb.PropertyFilter_EQUAL:
+			pq.eq[name] = append(pq.eq[name], pf)
+		case pb.PropertyFilter_LESS_THAN, pb.PropertyFilter_LESS_THAN_OR_EQUAL,
+			pb.PropertyFilter_GREATER_THAN, pb.PropertyFilter_GREATER_THAN_OR_EQUAL:
+			pq.ineq[name] = append(pq.ineq[name], pf)
+		case pb.PropertyFilter_HAS_ANCESTOR:
+			if name != keyFieldName {
+				return status.Errorf(codes.InvalidArgument, "an ancestor filter must be on __key__")
+			}
+			if pq.ancestor != nil {
+				return status.Errorf(codes.InvalidArgument, "a query may have at most one ancestor filter")
+			}
+			anc := pf.Value.GetKeyValue()
+			if err := checkCompleteKey(anc); err != nil {
+				return err
+			}
+			if anc.PartitionId.NamespaceId != pq.namespace {
+				return status.Errorf(codes.InvalidArgument, "the query namespace is %q but ancestor namespace is %q", pq.namespace, anc.PartitionId.NamespaceId)
+			}
+			pq.ancestor = anc
+		default:
+			return status.Errorf(codes.InvalidArgument, "unsupported property filter operator %v", pf.Op)
+		}
+		return nil
+	}
+	return status.Errorf(codes.InvalidArgument, "unknown filter type")
+}
+
+func (pq *compiledQuery) matchesPartition(k *pb.Key) bool {
+	p := k.GetPartitionId()
+	if p.GetProjectId() != pq.project || p.GetNamespaceId() != pq.namespace {
+		return false
+	}
+	kind := k.Path[len(k.Path)-1].Kind
+	if pq.kind == "" {
+		return !isReserved(kind)
+	}
+	return kind == pq.kind
+}
+
+// satisfies reports whether v satisfies every filter in fs.
+func satisfies(v *pb.Value, fs []*pb.PropertyFilter) bool {
+	for _, f := range fs {
+		c := valueorder.CompareValues(v, f.Value)
+		var ok bool
+		switch f.Op {
+		case pb.PropertyFilter_EQUAL:
+			ok = c == 0
+		case pb.PropertyFilter_LESS_THAN:
+			ok = c < 0
+		case pb.PropertyFilter_LESS_THAN_OR_EQUAL:
+			ok = c <= 0
+		case pb.PropertyFilter_GREATER_THAN:
+			ok = c > 0
+		case pb.PropertyFilter_GREATER_THAN_OR_EQUAL:
+			ok = c >= 0
+		}
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// candidates returns the indexed values of the named property of e that
+// satisfy the query's inequality filters on that property.
+func (pq *compiledQuery) candidates(e *pb.Entity, name string) []*pb.Value {
+	var vals []*pb.Value
+	for _, v := range indexValues(e, name) {
+		if satisfies(v, pq.ineq[name]) {
+			vals = append(vals, v)
+		}
+	}
+	return vals
+}
+
+// A row is a single query result.
+type row struct {
+	entity  *pb.Entity
+	version int64
+	// proj holds the projected values, for projection queries.
+	proj map[string]*pb.Value
+	// pos is the row's position in the result order: one value per order,
+	// then a disambiguating integer for rows of the same entity.
+	pos []*pb.Value
+}
+
+// rows returns the results of the query for e, which is in the query's
+// partition. An entity produces no rows if it does not match the filters, or
+// if it lacks an indexed value for a property that is ordered or projected.
+// For projection queries, an entity produces one row for each combination of
+// the values of its projected properties.
+func (pq *compiledQuery) rows(e *pb.Entity, version int64) []*row {
+	if pq.ancestor != nil && !hasAncestor(e.Key, pq.ancestor) {
+		return nil
+	}
+	for name, fs := range pq.eq {
+		for _, f := range fs {
+			found := false
+			for _, v := range indexValues(e, name) {
+				if satisfies(v, []*pb.PropertyFilter{f}) {
+					found = true
+					break
+				}
+			}
+			if !found {
+				return nil
+			}
+		}
+	}
+	for name := range pq.ineq {
+		if len(pq.candidates(e, name)) == 0 {
+			return nil
+		}
+	}
+
+	combos := []map[string]*pb.Value{nil}
+	if len(pq.projection) > 0 && !pq.keysOnly {
+		combos = []map[string]*pb.Value{{}}
+		for _, name := range pq.projection {
+			var vals []*pb.Value
+			if name == keyFieldName {
+				vals = indexValues(e, name)
+			} else {
+				vals = dedupe(pq.candidates(e, name))
+			}
+			if len(vals) == 0 {
+				return nil
+			}
+			var next []map[string]*pb.Value
+			for _, c := range combos {
+				for _, v := range vals {
+					m := map[string]*pb.Value{name: v}
+					for k, x := range c {
+						m[k] = x
+					}
+					next = append(next, m)
+				}
+			}
+			combos = next
+		}
+	}
+
+	var rows []*row
+	for i, proj := range combos {
+		r := &row{entity: e, version: version, proj: proj}
+		for _, o := range pq.orders {
+			name := o.Property.GetName()
+			v, ok := proj[name]
+			if !ok {
+				vals := pq.candidates(e, name)
+				if len(vals) == 0 {
+					return nil
+				}
+				// A multi-valued property sorts by its smallest value in
+				// ascending order, and by its largest in descending order.
+				v = vals[0]
+				for _, x := range vals[1:] {
+					c := valueorder.CompareValues(x, v)
+					if (o.Direction == pb.PropertyOrder_DESCENDING) == (c > 0) && c != 0 {
+						v = x
+					}
+				}
+			}
+			r.pos = append(r.pos, v)
+		}
+		r.pos = append(r.pos, &pb.Value{ValueType: &pb.Value_IntegerValue{IntegerValue: int64(i)}})
+		rows = append(rows, r)
+	}
+	return rows
+}
+
+func dedupe(vals []*pb.Value) []*pb.Value {
+	var out []*pb.Value
+	for _, v := range vals {
+		dup := false
+		for _, o := range out {
+			if valueorder.CompareValues(v, o) == 0 {
+				dup = true
+				break
+			}
+		}
+		if !dup {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+// compare orders two positions according to the query's orders.
+func (pq *compiledQuery) compare(a, b []*pb.Value) int {
+	for i, o := range pq.orders {
+		c := valueorder.CompareValues(a[i], b[i])
+		if o.Direction == pb.PropertyOrder_DESCENDING {
+			c = -c
+		}
+		if c != 0 {
+			return c
+		}
+	}
+	n := len(pq.orders)
+	return valueorder.CompareValues(a[n], b[n])
+}
+
+// distinct drops every row that has the same values for the query's
+// distinct_on properties as an earlier row.
+func (pq *compiledQuery) distinct(rows []*row) []*row {
+	if len(pq.q.DistinctOn) == 0 {
+		return rows
+	}
+	seen := map[string]bool{}
+	var out []*row
+	for _, r := range rows {
+		var parts []string
+		for _, d := range pq.q.DistinctOn {
+			v, ok := r.proj[d.Name]
+			if !ok {
+				if vals := indexValues(r.entity, d.Name); len(vals) > 0 {
+					v = vals[0]
+				}
+			}
+			b, _ := proto.Marshal(v)
+			parts = append(parts, string(b))
+		}
+		k := strings.Join(parts, "\x00")
+		if !seen[k] {
+			seen[k] = true
+			out = append(out, r)
+		}
+	}
+	return out
+}
+
+// batch applies the query's cursors, offset and limit to the sorted rows, and
+// returns the first batch of results.
+func (pq *compiledQuery) batch(rows []*row, batchSize int) (*pb.QueryResultBatch, error) {
+	q := pq.q
+	b := &pb.QueryResultBatch{EndCursor: beginCursor}
+	switch {
+	case pq.keysOnly:
+		b.EntityResultType = pb.EntityResult_KEY_ONLY
+	case len(pq.projection) > 0:
+		b.EntityResultType = pb.EntityResult_PROJECTION
+	default:
+		b.EntityResultType = pb.EntityResult_FULL
+	}
+
+	if len(q.StartCursor) > 0 {
+		start, err := pq.decodeCursor(q.StartCursor)
+		if err != nil {
+			return nil, err
+		}
+		b.EndCursor = q.StartCursor
+		if start != nil {
+			i := sort.Search(len(rows), func(i int) bool { return pq.compare(rows[i].pos, start) > 0 })
+			rows = rows[i:]
+		}
+	}
+	afterCursor := false
+	if len(q.EndCursor) > 0 {
+		end, err := pq.decodeCursor(q.EndCursor)
+		if err != nil {
+			return nil, err
+		}
+		i := len(rows)
+		if end == nil {
+			i = 0
+		} else {
+			i = sort.Search(len(rows), func(i int) bool { return pq.compare(rows[i].pos, end) > 0 })
+		}
+		afterCursor = i < len(rows)
+		rows = rows[:i]
+	}
+
+	if skip := int(q.Offset); skip > 0 {
+		if skip > len(rows) {
+			skip = len(rows)
+		}
+		if skip > 0 {
+			b.SkippedResults = int32(skip)
+			b.SkippedCursor = encodeCursor(rows[skip-1].pos)
+			b.EndCursor = b.SkippedCursor
+			rows = rows[skip:]
+		}
+	}
+
+	n := len(rows)
+	limited := false
+	if q.Limit != nil && int(q.Limit.Value) < n {
+		n = int(q.Limit.Value)
+		limited = true
+	}
+	truncated := false
+	if n > batchSize {
+		n = batchSize
+		truncated = true
+	}
+	for _, r := range rows[:n] {
+		cursor := encodeCursor(r.pos)
+		b.EntityResults = append(b.EntityResults, &pb.EntityResult{
+			Entity:  pq.result(r),
+			Version: r.version,
+			Cursor:  cursor,
+		})
+		b.EndCursor = cursor
+	}
+
+	switch {
+	case truncated:
+		b.MoreResults = pb.QueryResultBatch_NOT_FINISHED
+	case limited:
+		b.MoreResults = pb.QueryResultBatch_MORE_RESULTS_AFTER_LIMIT
+	case afterCursor:
+		b.MoreResults = pb.QueryResultBatch_MORE_RESULTS_AFTER_CURSOR
+	default:
+		b.MoreResults = pb.QueryResultBatch_NO_MORE_RESULTS
+	}
+	return b, nil
+}
+
+// result returns the entity to return for r.
+func (pq *compiledQuery) result(r *row) *pb.Entity {
+	switch {
+	case pq.keysOnly:
+		return &pb.Entity{Key: r.entity.Key}
+	case len(pq.projection) > 0:
+		e := &pb.Entity{Key: r.entity.Key, Properties: map[string]*pb.Value{}}
+		for name, v := range r.proj {
+			if name == keyFieldName {
+				continue
+			}
+			e.Properties[name] = &pb.Value{ValueType: v.ValueType, Meaning: v.Meaning}
+		}
+		return e
+	}
+	return proto.Clone(r.entity).(*pb.Entity)
+}
+
+// Cursors encode a row position as a serialized ArrayValue, after a version
+// byte. A cursor holding only the version byte is positioned before all
+// results.
+const cursorVersion = 1
+
+var beginCursor = []byte{cursorVersion}
+
+func encodeCursor(pos []*pb.Value) []byte {
+	b, err := proto.Marshal(&pb.ArrayValue{Values: pos})
+	if err != nil {
+		panic(err)
+	}
+	return append([]byte{cursorVersion}, b...)
+}
+
+// decodeCursor returns the position encoded by c, or nil if c is positioned
+// before all results.
+func (pq *compiledQuery) decodeCursor(c []byte) ([]*pb.Value, error) {
+	if len(c) == 0 || c[0] != cursorVersion {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid query cursor")
+	}
+	if len(c) == 1 {
+		return nil, nil
+	}
+	var av pb.ArrayValue
+	if err := proto.Unmarshal(c[1:], &av); err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid query cursor: %v", err)
+	}
+	if len(av.Values) != len(pq.orders)+1 {
+		return nil, status.Errorf(codes.InvalidArgument, "cursor position is outside the range of the original query")
+	}
+	return av.Values, nil
+}
@@ -0,0 +1,130 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dstest
+
+import (
+	"fmt"
+	"strings"
+
+	"cloud.google.com/go/datastore/internal/valueorder"
+	pb "google.golang.org/genproto/googleapis/datastore/v1"
+)
+
+// keyFieldName is the special property name that refers to an entity's key.
+const keyFieldName = "__key__"
+
+// keyString returns a string that uniquely identifies a complete key within
+// the fake. It is used to index entities.
+func keyString(k *pb.Key) string {
+	var b strings.Builder
+	p := k.GetPartitionId()
+	fmt.Fprintf(&b, "%q/%q", p.GetProjectId(), p.GetNamespaceId())
+	for _, e := range k.Path {
+		if e.GetName() != "" {
+			fmt.Fprintf(&b, "/%q,n%q", e.Kind, e.GetName())
+		} else {
+			fmt.Fprintf(&b, "/%q,i%d", e.Kind, e.GetId())
+		}
+	}
+	return b.String()
+}
+
+// rootKeyString returns the keyString of the root of k's entity group.
+func rootKeyString(k *pb.Key) string {
+	return keyString(&pb.Key{PartitionId: k.PartitionId, Path: k.Path[:1]})
+}
+
+// incomplete reports whether the last element of k's path has neither an ID
+// nor a name.
+func incomplete(k *pb.Key) bool {
+	if len(k.Path) == 0 {
+		return true
+	}
+	last := k.Path[len(k.Path)-1]
+	return last.GetId() == 0 && last.GetName() == ""
+}
+
+// hasAncestor reports whether anc is an ancestor of k, or k itself.
+func hasAncestor(k, anc *pb.Key) bool {
+	if k.GetPartitionId().GetNamespaceId() != anc.GetPartitionId().GetNamespaceId() {
+		return false
+	}
+	if len(anc.Path) > len(k.Path) {
+		return false
+	}
+	for i, e := range anc.Path {
+		if valueorder.ComparePathElements(e, k.Path[i]) != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// indexValues returns the indexed values of the named property of e. Array
+// values contribute each of their indexed elements. Names containing dots
+// may refer to properties of embedded entities. The special name __key__
+// yields e's key.
+func indexValues(e *pb.Entity, name string) []*pb.Value {
+	if name == keyFieldName {
+		return []*pb.Value{{ValueType: &pb.Value_KeyValue{KeyValue: e.Key}}}
+	}
+	if v, ok := e.Properties[name]; ok {
+		return indexable(v)
+	}
+	var vals []*pb.Value
+	for i := strings.IndexByte(name, '.'); i >= 0; {
+		if v, ok := e.Properties[name[:i]]; ok {
+			for _, sub := range embedded(v) {
+				vals = append(vals, indexValues(sub, name[i+1:])...)
+			}
+		}
+		j := strings.IndexByte(name[i+1:], '.')
+		if j < 0 {
+			break
+		}
+		i += j + 1
+	}
+	return vals
+}
+
+func indexable(v *pb.Value) []*pb.Value {
+	if arr, ok := v.ValueType.(*pb.Value_ArrayValue); ok {
+		var vals []*pb.Value
+		for _, e := range arr.ArrayValue.GetValues() {
+			vals = append(vals, indexable(e)...)
+		}
+		return vals
+	}
+	if v.ExcludeFromIndexes || valueorder.TypeRank(v) < 0 {
+		return nil
+	}
+	return []*pb.Value{v}
+}
+
+// embedded returns the entities held by v, which may be an entity value or an
+// array of them.
+func embedded(v *pb.Value) []*pb.Entity {
+	switch x := v.ValueType.(type) {
+	case *pb.Value_EntityValue:
+		return []*pb.Entity{x.EntityValue}
+	case *pb.Value_ArrayValue:
+		var es []*pb.Entity
+		for _, e := range x.ArrayValue.GetValues() {
+			es = append(es, embedded(e)...)
+		}
+		return es
+	}
+	return nil
+}
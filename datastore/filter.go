@@ -0,0 +1,214 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package datastore
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+
+	"cloud.google.com/go/datastore/internal/valueorder"
+	pb "google.golang.org/genproto/googleapis/datastore/v1"
+)
+
+// maxDisjunctions is the maximum number of sub-queries a query with OR, IN,
+// NOT_IN or != filters may expand to.
+const maxDisjunctions = 30
+
+// EntityFilter is a filter on query results. It is implemented by
+// PropertyFilter, AndFilter and OrFilter, and is passed to Query.FilterEntity.
+//
+// The service can only evaluate conjunctions of filters with the operators
+// "=", "<", "<=", ">" and ">=". Other filters are rewritten as a disjunction
+// of such conjunctions; each disjunct is run as a separate query and the
+// results are merged by the client. See Query.FilterEntity for the
+// consequences.
+type EntityFilter interface {
+	// dnf returns the filter in disjunctive normal form: a list of
+	// conjunctions of simple filters.
+	dnf() ([][]filter, error)
+}
+
+// PropertyFilter is a filter on a single property.
+type PropertyFilter struct {
+	// FieldName is the name of the property. The special name "__key__"
+	// refers to the entity's key.
+	FieldName string
+	// Operator is one of "=", "!=", "<", "<=", ">", ">=", "in" or "not-in".
+	// For "in" and "not-in", Value must be a slice of values.
+	Operator string
+	Value    interface{}
+}
+
+// AndFilter is satisfied when all of its filters are.
+type AndFilter struct {
+	Filters []EntityFilter
+}
+
+// OrFilter is satisfied when any of its filters is.
+type OrFilter struct {
+	Filters []EntityFilter
+}
+
+var stringToOperator = map[string]operator{
+	"=":      equal,
+	"!=":     notEqual,
+	"<":      lessThan,
+	"<=":     lessEq,
+	">":      greaterThan,
+	">=":     greaterEq,
+	"in":     in,
+	"not-in": notIn,
+}
+
+func (pf PropertyFilter) toFilter() (filter, error) {
+	if pf.FieldName == "" {
+		return filter{}, errors.New("datastore: empty query filter field name")
+	}
+	op, ok := stringToOperator[pf.Operator]
+	if !ok {
+		return filter{}, fmt.Errorf("datastore: invalid operator %q in filter on %q", pf.Operator, pf.FieldName)
+	}
+	return filter{FieldName: pf.FieldName, Op: op, Value: pf.Value}, nil
+}
+
+func (pf PropertyFilter) dnf() ([][]filter, error) {
+	f, err := pf.toFilter()
+	if err != nil {
+		return nil, err
+	}
+	return f.dnf()
+}
+
+func (af AndFilter) dnf() ([][]filter, error) {
+	conjs := [][]filter{nil}
+	for _, sub := range af.Filters {
+		d, err := sub.dnf()
+		if err != nil {
+			return nil, err
+		}
+		var next [][]filter
+		for _, c := range conjs {
+			for _, e := range d {
+				n := make([]filter, 0, len(c)+len(e))
+				n = append(append(n, c...), e...)
+				next = append(next, n)
+			}
+		}
+		if len(next) > maxDisjunctions {
+			return nil, errTooManyDisjunctions
+		}
+		conjs = next
+	}
+	return conjs, nil
+}
+
+func (of OrFilter) dnf() ([][]filter, error) {
+	var conjs [][]filter
+	for _, sub := range of.Filters {
+		d, err := sub.dnf()
+		if err != nil {
+			return nil, err
+		}
+		conjs = append(conjs, d...)
+		if len(conjs) > maxDisjunctions {
+			return nil, errTooManyDisjunctions
+		}
+	}
+	return conjs, nil
+}
+
+var errTooManyDisjunctions = fmt.Errorf("datastore: query filter expands to more than %d sub-queries", maxDisjunctions)
+
+// dnf rewrites a filter whose operator the service does not support as a
+// disjunction of filters that it does.
+func (f filter) dnf() ([][]filter, error) {
+	switch f.Op {
+	case in:
+		vals, err := filterValues(f)
+		if err != nil {
+			return nil, err
+		}
+		if len(vals) > maxDisjunctions {
+			return nil, errTooManyDisjunctions
+		}
+		var conjs [][]filter
+		for _, v := range vals {
+			conjs = append(conjs, []filter{{FieldName: f.FieldName, Op: equal, Value: v}})
+		}
+		return conjs, nil
+	case notEqual:
+		return notInRanges(f.FieldName, []interface{}{f.Value})
+	case notIn:
+		vals, err := filterValues(f)
+		if err != nil {
+			return nil, err
+		}
+		return notInRanges(f.FieldName, vals)
+	}
+	return [][]filter{{f}}, nil
+}
+
+// filterValues returns the elements of the slice value of an "in" or "not-in"
+// filter.
+func filterValues(f filter) ([]interface{}, error) {
+	v := reflect.ValueOf(f.Value)
+	if v.Kind() != reflect.Slice && v.Kind() != reflect.Array || v.Type().Elem().Kind() == reflect.Uint8 {
+		return nil, fmt.Errorf("datastore: the value of an %q filter on %q must be a slice, got %T", operatorToString[f.Op], f.FieldName, f.Value)
+	}
+	vals := make([]interface{}, v.Len())
+	for i := range vals {
+		vals[i] = v.Index(i).Interface()
+	}
+	return vals, nil
+}
+
+// notInRanges returns the disjunction of ranges that excludes exactly the
+// given values: below the smallest, between each pair of adjacent values, and
+// above the largest. Values are ordered as the service orders them.
+func notInRanges(fieldName string, vals []interface{}) ([][]filter, error) {
+	type pv struct {
+		v interface{}
+		p *pb.Value
+	}
+	var sorted []pv
+	for _, v := range vals {
+		p, err := interfaceToProto(v, false)
+		if err != nil {
+			return nil, fmt.Errorf("datastore: bad query filter value type: %v", err)
+		}
+		sorted = append(sorted, pv{v, p})
+	}
+	sort.Slice(sorted, func(i, j int) bool { return valueorder.CompareValues(sorted[i].p, sorted[j].p) < 0 })
+	if len(sorted) >= maxDisjunctions {
+		return nil, errTooManyDisjunctions
+	}
+	if len(sorted) == 0 {
+		return [][]filter{nil}, nil
+	}
+	conjs := [][]filter{{{FieldName: fieldName, Op: lessThan, Value: sorted[0].v}}}
+	for i := 1; i < len(sorted); i++ {
+		if valueorder.CompareValues(sorted[i-1].p, sorted[i].p) == 0 {
+			continue
+		}
+		conjs = append(conjs, []filter{
+			{FieldName: fieldName, Op: greaterThan, Value: sorted[i-1].v},
+			{FieldName: fieldName, Op: lessThan, Value: sorted[i].v},
+		})
+	}
+	conjs = append(conjs, []filter{{FieldName: fieldName, Op: greaterThan, Value: sorted[len(sorted)-1].v}})
+	return conjs, nil
+}
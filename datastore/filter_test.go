@@ -0,0 +1,324 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package datastore
+
+import (
+	"context"
+	"testing"
+
+	"cloud.google.com/go/datastore/dstest"
+	"cloud.google.com/go/internal/testutil"
+	"google.golang.org/api/iterator"
+	"google.golang.org/api/option"
+	"google.golang.org/grpc"
+)
+
+func TestFilterDNF(t *testing.T) {
+	for _, test := range []struct {
+		desc string
+		f    EntityFilter
+		want [][]filter
+	}{
+		{
+			desc: "simple",
+			f:    PropertyFilter{FieldName: "A", Operator: "<", Value: 1},
+			want: [][]filter{{{FieldName: "A", Op: lessThan, Value: 1}}},
+		},
+		{
+			desc: "in",
+			f:    PropertyFilter{FieldName: "A", Operator: "in", Value: []string{"x", "y"}},
+			want: [][]filter{
+				{{FieldName: "A", Op: equal, Value: "x"}},
+				{{FieldName: "A", Op: equal, Value: "y"}},
+			},
+		},
+		{
+			desc: "not equal",
+			f:    PropertyFilter{FieldName: "A", Operator: "!=", Value: 3},
+			want: [][]filter{
+				{{FieldName: "A", Op: lessThan, Value: 3}},
+				{{FieldName: "A", Op: greaterThan, Value: 3}},
+			},
+		},
+		{
+			desc: "not in sorts and dedupes values",
+			f:    PropertyFilter{FieldName: "A", Operator: "not-in", Value: []int{5, 1, 5}},
+			want: [][]filter{
+				{{FieldName: "A", Op: lessThan, Value: 1}},
+				{{FieldName: "A", Op: greaterThan, Value: 1}, {FieldName: "A", Op: lessThan, Value: 5}},
+				{{FieldName: "A", Op: greaterThan, Value: 5}},
+			},
+		},
+		{
+			desc: "and of ors",
+			f: AndFilter{Filters: []EntityFilter{
+				OrFilter{Filters: []EntityFilter{
+					PropertyFilter{FieldName: "A", Operator: "=", Value: 1},
+					PropertyFilter{FieldName: "A", Operator: "=", Value: 2},
+				}},
+				PropertyFilter{FieldName: "B", Operator: "=", Value: true},
+			}},
+			want: [][]filter{
+				{{FieldName: "A", Op: equal, Value: 1}, {FieldName: "B", Op: equal, Value: true}},
+				{{FieldName: "A", Op: equal, Value: 2}, {FieldName: "B", Op: equal, Value: true}},
+			},
+		},
+	} {
+		got, err := test.f.dnf()
+		if err != nil {
+			t.Errorf("%s: %v", test.desc, err)
+			continue
+		}
+		if !testutil.Equal(got, test.want) {
+			t.Errorf("%s: got %v, want %v", test.desc, got, test.want)
+		}
+	}
+}
+
+func TestFilterDNFErrors(t *testing.T) {
+	many := make([]int, maxDisjunctions+1)
+	for i := range many {
+		many[i] = i
+	}
+	for _, f := range []EntityFilter{
+		PropertyFilter{FieldName: "", Operator: "=", Value: 1},
+		PropertyFilter{FieldName: "A", Operator: "~", Value: 1},
+		PropertyFilter{FieldName: "A", Operator: "in", Value: 1},
+		PropertyFilter{FieldName: "A", Operator: "in", Value: []byte("x")},
+		PropertyFilter{FieldName: "A", Operator: "in", Value: many},
+		PropertyFilter{FieldName: "A", Operator: "not-in", Value: many},
+	} {
+		if _, err := f.dnf(); err == nil {
+			t.Errorf("%+v: got nil, want error", f)
+		}
+	}
+}
+
+func TestMultiCursor(t *testing.T) {
+	cs := [][]byte{[]byte("abc"), nil, {1, 2}}
+	enc := encodeMultiCursor(cs)
+	got, err := decodeMultiCursor(enc, len(cs))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !testutil.Equal(got, cs) {
+		t.Errorf("got %v, want %v", got, cs)
+	}
+	if _, err := decodeMultiCursor(enc, 2); err != errCursorMismatch {
+		t.Errorf("wrong count: got %v, want errCursorMismatch", err)
+	}
+	if _, err := decodeMultiCursor([]byte("abc"), 3); err != errCursorMismatch {
+		t.Errorf("service cursor: got %v, want errCursorMismatch", err)
+	}
+	if _, err := decodeMultiCursor(enc[:len(enc)-1], 3); err != errCursorMismatch {
+		t.Errorf("truncated: got %v, want errCursorMismatch", err)
+	}
+}
+
+// The following tests run composite filters against the dstest fake, which
+// evaluates each of the queries that the client sends.
+
+type fakeItem struct {
+	Name  string
+	Price int
+	Tags  []string
+}
+
+// newFakeClient returns a client of a dstest fake, and a function that closes
+// them.
+func newFakeClient(t *testing.T) (*Client, func()) {
+	srv := dstest.NewServer()
+	conn, err := grpc.Dial(srv.Addr, grpc.WithInsecure())
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := NewClient(context.Background(), "P", option.WithGRPCConn(conn))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client, func() {
+		client.Close()
+		conn.Close()
+		srv.Close()
+	}
+}
+
+func putFakeItems(t *testing.T, client *Client, items ...*fakeItem) {
+	var keys []*Key
+	for _, it := range items {
+		keys = append(keys, NameKey("Item", it.Name, nil))
+	}
+	if _, err := client.PutMulti(context.Background(), keys, items); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCompositeFilters(t *testing.T) {
+	ctx := context.Background()
+	client, cleanup := newFakeClient(t)
+	defer cleanup()
+
+	putFakeItems(t, client,
+		&fakeItem{Name: "a", Price: 1, Tags: []string{"red"}},
+		&fakeItem{Name: "b", Price: 2, Tags: []string{"red", "blue"}},
+		&fakeItem{Name: "c", Price: 3, Tags: []string{"green"}},
+		&fakeItem{Name: "d", Price: 4, Tags: []string{"blue"}},
+		&fakeItem{Name: "e", Price: 5},
+	)
+	names := func(q *Query) []string {
+		t.Helper()
+		var items []*fakeItem
+		if _, err := client.GetAll(ctx, q, &items); err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, it := range items {
+			got = append(got, it.Name)
+		}
+		return got
+	}
+	base := NewQuery("Item")
+	for _, test := range []struct {
+		desc string
+		q    *Query
+		want []string
+	}{
+		{
+			desc: "in",
+			q:    base.FilterField("Price", "in", []int{4, 1, 9}),
+			want: []string{"a", "d"},
+		},
+		{
+			desc: "in with order",
+			q:    base.FilterField("Price", "in", []int{4, 1}).Order("-Price"),
+			want: []string{"d", "a"},
+		},
+		{
+			desc: "empty in",
+			q:    base.FilterField("Price", "in", []int{}),
+			want: nil,
+		},
+		{
+			desc: "not equal",
+			q:    base.FilterField("Price", "!=", 3),
+			want: []string{"a", "b", "d", "e"},
+		},
+		{
+			desc: "not in",
+			q:    base.FilterField("Price", "not-in", []int{2, 4}).Order("-Price"),
+			want: []string{"e", "c", "a"},
+		},
+		{
+			desc: "or with duplicates",
+			q: base.FilterEntity(OrFilter{Filters: []EntityFilter{
+				PropertyFilter{FieldName: "Tags", Operator: "=", Value: "red"},
+				PropertyFilter{FieldName: "Tags", Operator: "=", Value: "blue"},
+			}}),
+			want: []string{"a", "b", "d"},
+		},
+		{
+			desc: "or and",
+			q: base.Filter("Price >", 1).FilterEntity(OrFilter{Filters: []EntityFilter{
+				PropertyFilter{FieldName: "Tags", Operator: "=", Value: "red"},
+				PropertyFilter{FieldName: "Name", Operator: "=", Value: "e"},
+			}}),
+			want: []string{"b", "e"},
+		},
+		{
+			desc: "offset and limit",
+			q:    base.FilterField("Price", "!=", 3).Offset(1).Limit(2),
+			want: []string{"b", "d"},
+		},
+	} {
+		if got := names(test.q); !testutil.Equal(got, test.want) {
+			t.Errorf("%s: got %v, want %v", test.desc, got, test.want)
+		}
+	}
+
+	n, err := client.Count(ctx, base.FilterEntity(OrFilter{Filters: []EntityFilter{
+		PropertyFilter{FieldName: "Tags", Operator: "=", Value: "red"},
+		PropertyFilter{FieldName: "Tags", Operator: "=", Value: "blue"},
+	}}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 3 {
+		t.Errorf("Count: got %d, want 3", n)
+	}
+
+	if _, err := client.GetAll(ctx, base.FilterField("Price", "!=", 1).FilterField("Name", ">", "a"), &[]*fakeItem{}); err == nil {
+		t.Error("inequalities on two properties: got nil, want error")
+	}
+}
+
+func TestCompositeFilterCursors(t *testing.T) {
+	ctx := context.Background()
+	client, cleanup := newFakeClient(t)
+	defer cleanup()
+
+	putFakeItems(t, client,
+		&fakeItem{Name: "a", Price: 1},
+		&fakeItem{Name: "b", Price: 2},
+		&fakeItem{Name: "c", Price: 3},
+		&fakeItem{Name: "d", Price: 4},
+		&fakeItem{Name: "e", Price: 5},
+	)
+	q := NewQuery("Item").FilterField("Price", "not-in", []int{3}).Order("Price")
+	var got []string
+	var cursor Cursor
+	for {
+		pq := q.Limit(2)
+		if cursor.String() != "" {
+			pq = pq.Start(cursor)
+		}
+		it := client.Run(ctx, pq)
+		n := 0
+		for {
+			var item fakeItem
+			_, err := it.Next(&item)
+			if err == iterator.Done {
+				break
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			got = append(got, item.Name)
+			n++
+		}
+		if n == 0 {
+			break
+		}
+		var err error
+		if cursor, err = it.Cursor(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if want := []string{"a", "b", "d", "e"}; !testutil.Equal(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	// A cursor from a simple query cannot be used with a merged one.
+	it := client.Run(ctx, NewQuery("Item"))
+	if _, err := it.Next(&fakeItem{}); err != nil {
+		t.Fatal(err)
+	}
+	c, err := it.Cursor()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.GetAll(ctx, q.Start(c), &[]*fakeItem{}); err == nil {
+		t.Error("mismatched cursor: got nil, want error")
+	}
+}
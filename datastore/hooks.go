@@ -0,0 +1,193 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package datastore
+
+import (
+	"context"
+
+	pb "google.golang.org/genproto/googleapis/datastore/v1"
+	"google.golang.org/grpc"
+)
+
+// Hooks are functions that a Client calls around the requests it sends to
+// read and write entities, for example to audit or measure them. Any of the
+// functions may be nil.
+//
+// The Before functions are called before a request is sent. If one returns an
+// error, the request is not sent, the After function is not called, and the
+// error is returned to the caller. The After functions are called with the
+// outcome of the request, after any retries.
+//
+// A call such as GetMulti may send several Lookup requests, for instance when
+// the service defers the lookup of some keys; the hooks are called for each
+// request.
+//
+// The hooks may be called concurrently from multiple goroutines, and must not
+// modify the info they are passed.
+type Hooks struct {
+	BeforeLookup func(ctx context.Context, info *LookupInfo) error
+	AfterLookup  func(ctx context.Context, info *LookupInfo, err error)
+	BeforeCommit func(ctx context.Context, info *CommitInfo) error
+	AfterCommit  func(ctx context.Context, info *CommitInfo, err error)
+}
+
+// LookupInfo describes a request to read entities by key.
+type LookupInfo struct {
+	// Keys are the keys being looked up.
+	Keys []*Key
+	// InTransaction reports whether the lookup is part of a transaction.
+	InTransaction bool
+
+	// Found and Missing are the keys of the entities that were and were not
+	// found. They are only set for AfterLookup, when the request succeeds.
+	Found, Missing []*Key
+}
+
+// CommitInfo describes a request to write entities.
+type CommitInfo struct {
+	// Mutations are the changes being committed.
+	Mutations []MutationInfo
+	// InTransaction reports whether the changes are committed as a
+	// transaction.
+	InTransaction bool
+
+	// Keys are the keys of the written entities, including those allocated
+	// for incomplete keys, in the order of Mutations. IndexUpdates is the
+	// number of index entries updated. They are only set for AfterCommit,
+	// when the request succeeds.
+	Keys         []*Key
+	IndexUpdates int
+}
+
+// MutationInfo describes a change to an entity.
+type MutationInfo struct {
+	// Op is one of "insert", "update", "upsert" or "delete".
+	Op string
+	// Key is the key of the entity. It is incomplete for inserts and
+	// upserts of entities with a key to be allocated.
+	Key *Key
+}
+
+// WithHooks returns a derivative client that calls the given hooks, including
+// for the Get and Commit calls of its transactions.
+//
+// Hooks may be added to a client that already has some. The hooks added last
+// are the outermost: their Before functions are called first and their After
+// functions last.
+//
+// The returned client shares its connection with c. Closing either of them
+// closes both.
+func (c *Client) WithHooks(h Hooks) *Client {
+	nc := *c
+	nc.client = &hookClient{DatastoreClient: c.client, hooks: h}
+	return &nc
+}
+
+// hookClient calls hooks around the Lookup and Commit requests of a
+// pb.DatastoreClient.
+type hookClient struct {
+	pb.DatastoreClient
+	hooks Hooks
+}
+
+func (hc *hookClient) Lookup(ctx context.Context, in *pb.LookupRequest, opts ...grpc.CallOption) (*pb.LookupResponse, error) {
+	h := hc.hooks
+	if h.BeforeLookup == nil && h.AfterLookup == nil {
+		return hc.DatastoreClient.Lookup(ctx, in, opts...)
+	}
+	info := &LookupInfo{
+		Keys:          protoKeys(in.Keys),
+		InTransaction: in.ReadOptions.GetTransaction() != nil,
+	}
+	if h.BeforeLookup != nil {
+		if err := h.BeforeLookup(ctx, info); err != nil {
+			return nil, err
+		}
+	}
+	resp, err := hc.DatastoreClient.Lookup(ctx, in, opts...)
+	if h.AfterLookup != nil {
+		if err == nil {
+			for _, r := range resp.Found {
+				info.Found = append(info.Found, protoKeys([]*pb.Key{r.Entity.GetKey()})...)
+			}
+			for _, r := range resp.Missing {
+				info.Missing = append(info.Missing, protoKeys([]*pb.Key{r.Entity.GetKey()})...)
+			}
+		}
+		h.AfterLookup(ctx, info, err)
+	}
+	return resp, err
+}
+
+func (hc *hookClient) Commit(ctx context.Context, in *pb.CommitRequest, opts ...grpc.CallOption) (*pb.CommitResponse, error) {
+	h := hc.hooks
+	if h.BeforeCommit == nil && h.AfterCommit == nil {
+		return hc.DatastoreClient.Commit(ctx, in, opts...)
+	}
+	info := &CommitInfo{InTransaction: in.Mode == pb.CommitRequest_TRANSACTIONAL}
+	for _, m := range in.Mutations {
+		var mi MutationInfo
+		var k *pb.Key
+		switch op := m.Operation.(type) {
+		case *pb.Mutation_Insert:
+			mi.Op, k = "insert", op.Insert.GetKey()
+		case *pb.Mutation_Update:
+			mi.Op, k = "update", op.Update.GetKey()
+		case *pb.Mutation_Upsert:
+			mi.Op, k = "upsert", op.Upsert.GetKey()
+		case *pb.Mutation_Delete:
+			mi.Op, k = "delete", op.Delete
+		}
+		if k != nil {
+			mi.Key, _ = protoToKey(k)
+		}
+		info.Mutations = append(info.Mutations, mi)
+	}
+	if h.BeforeCommit != nil {
+		if err := h.BeforeCommit(ctx, info); err != nil {
+			return nil, err
+		}
+	}
+	resp, err := hc.DatastoreClient.Commit(ctx, in, opts...)
+	if h.AfterCommit != nil {
+		if err == nil {
+			info.IndexUpdates = int(resp.IndexUpdates)
+			for i, mi := range info.Mutations {
+				k := mi.Key
+				if i < len(resp.MutationResults) && resp.MutationResults[i].Key != nil {
+					k, _ = protoToKey(resp.MutationResults[i].Key)
+				}
+				info.Keys = append(info.Keys, k)
+			}
+		}
+		h.AfterCommit(ctx, info, err)
+	}
+	return resp, err
+}
+
+// protoKeys converts keys from their protocol buffer representation,
+// skipping missing and invalid ones.
+func protoKeys(pks []*pb.Key) []*Key {
+	var keys []*Key
+	for _, pk := range pks {
+		if pk == nil {
+			continue
+		}
+		if k, err := protoToKey(pk); err == nil {
+			keys = append(keys, k)
+		}
+	}
+	return keys
+}
@@ -0,0 +1,111 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package datastore
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"cloud.google.com/go/internal/testutil"
+	pb "google.golang.org/genproto/googleapis/datastore/v1"
+)
+
+func TestHooks(t *testing.T) {
+	ctx := context.Background()
+	fake := &fakeDatastoreClient{
+		commit: func(req *pb.CommitRequest) (*pb.CommitResponse, error) {
+			return &pb.CommitResponse{
+				MutationResults: []*pb.MutationResult{
+					{Key: keyToProto(IDKey("Kind", 7, nil))},
+					{},
+				},
+				IndexUpdates: 3,
+			}, nil
+		},
+		lookup: func(req *pb.LookupRequest) (*pb.LookupResponse, error) {
+			return &pb.LookupResponse{
+				Missing: []*pb.EntityResult{{Entity: &pb.Entity{Key: req.Keys[0]}}},
+			}, nil
+		},
+	}
+	var calls []string
+	hooks := func(name string) Hooks {
+		return Hooks{
+			BeforeLookup: func(_ context.Context, info *LookupInfo) error {
+				calls = append(calls, name+" before lookup "+info.Keys[0].String())
+				return nil
+			},
+			AfterLookup: func(_ context.Context, info *LookupInfo, err error) {
+				calls = append(calls, name+" after lookup "+info.Missing[0].String())
+			},
+			BeforeCommit: func(_ context.Context, info *CommitInfo) error {
+				for _, m := range info.Mutations {
+					calls = append(calls, name+" before "+m.Op+" "+m.Key.String())
+				}
+				return nil
+			},
+			AfterCommit: func(_ context.Context, info *CommitInfo, err error) {
+				if info.IndexUpdates != 3 {
+					t.Errorf("got %d index updates, want 3", info.IndexUpdates)
+				}
+				for _, k := range info.Keys {
+					calls = append(calls, name+" after commit "+k.String())
+				}
+			},
+		}
+	}
+	client := (&Client{client: fake}).WithHooks(hooks("inner")).WithHooks(hooks("outer"))
+
+	if err := client.Get(ctx, NameKey("Kind", "a", nil), &struct{}{}); err != ErrNoSuchEntity {
+		t.Fatalf("got %v, want ErrNoSuchEntity", err)
+	}
+	_, err := client.Mutate(ctx,
+		NewInsert(IncompleteKey("Kind", nil), &struct{}{}),
+		NewDelete(NameKey("Kind", "b", nil)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"outer before lookup /Kind,a",
+		"inner before lookup /Kind,a",
+		"inner after lookup /Kind,a",
+		"outer after lookup /Kind,a",
+		"outer before insert /Kind,0",
+		"outer before delete /Kind,b",
+		"inner before insert /Kind,0",
+		"inner before delete /Kind,b",
+		"inner after commit /Kind,7",
+		"inner after commit /Kind,b",
+		"outer after commit /Kind,7",
+		"outer after commit /Kind,b",
+	}
+	if !testutil.Equal(calls, want) {
+		t.Errorf("got calls\n%q\nwant\n%q", calls, want)
+	}
+
+	// An error from a Before hook stops the request.
+	errDenied := errors.New("denied")
+	fake.commit = func(*pb.CommitRequest) (*pb.CommitResponse, error) {
+		t.Fatal("commit was not stopped")
+		return nil, nil
+	}
+	client = client.WithHooks(Hooks{
+		BeforeCommit: func(context.Context, *CommitInfo) error { return errDenied },
+	})
+	if _, err := client.Put(ctx, NameKey("Kind", "a", nil), &struct{}{}); err != errDenied {
+		t.Errorf("got %v, want %v", err, errDenied)
+	}
+}
@@ -0,0 +1,159 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package valueorder orders Datastore values and keys as the service does in its
+// indexes. It is shared by the datastore package, which merges the results of
+// several queries, and by the dstest fake, which evaluates queries.
+package valueorder
+
+import (
+	"bytes"
+	"math"
+	"strings"
+
+	pb "google.golang.org/genproto/googleapis/datastore/v1"
+)
+
+// CompareKeys orders keys the way the service does: by partition, then
+// element by element along the path. Within an element, kinds are compared
+// first, and numeric IDs sort before names.
+func CompareKeys(a, b *pb.Key) int {
+	ap, bp := a.GetPartitionId(), b.GetPartitionId()
+	if c := strings.Compare(ap.GetProjectId(), bp.GetProjectId()); c != 0 {
+		return c
+	}
+	if c := strings.Compare(ap.GetNamespaceId(), bp.GetNamespaceId()); c != 0 {
+		return c
+	}
+	for i := 0; i < len(a.Path) && i < len(b.Path); i++ {
+		if c := ComparePathElements(a.Path[i], b.Path[i]); c != 0 {
+			return c
+		}
+	}
+	return compareInts(int64(len(a.Path)), int64(len(b.Path)))
+}
+
+// ComparePathElements orders two elements of key paths, as CompareKeys does.
+func ComparePathElements(a, b *pb.Key_PathElement) int {
+	if c := strings.Compare(a.Kind, b.Kind); c != 0 {
+		return c
+	}
+	aName, bName := a.GetName() != "", b.GetName() != ""
+	switch {
+	case aName && bName:
+		return strings.Compare(a.GetName(), b.GetName())
+	case aName:
+		return 1
+	case bName:
+		return -1
+	}
+	return compareInts(a.GetId(), b.GetId())
+}
+
+func compareInts(a, b int64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+// TypeRank gives the position of a value's type in the service's mixed-type
+// ordering. Values of types that are never indexed have rank -1.
+func TypeRank(v *pb.Value) int {
+	switch v.ValueType.(type) {
+	case *pb.Value_NullValue:
+		return 0
+	case *pb.Value_IntegerValue:
+		return 1
+	case *pb.Value_TimestampValue:
+		return 2
+	case *pb.Value_BooleanValue:
+		return 3
+	case *pb.Value_BlobValue:
+		return 4
+	case *pb.Value_StringValue:
+		return 5
+	case *pb.Value_DoubleValue:
+		return 6
+	case *pb.Value_GeoPointValue:
+		return 7
+	case *pb.Value_KeyValue:
+		return 8
+	}
+	return -1
+}
+
+// CompareValues orders two indexable values. Values of different types are
+// ordered by type; values of the same type are ordered naturally.
+func CompareValues(a, b *pb.Value) int {
+	ra, rb := TypeRank(a), TypeRank(b)
+	if ra != rb {
+		return compareInts(int64(ra), int64(rb))
+	}
+	switch av := a.ValueType.(type) {
+	case *pb.Value_IntegerValue:
+		return compareInts(av.IntegerValue, b.GetIntegerValue())
+	case *pb.Value_TimestampValue:
+		at, bt := av.TimestampValue, b.GetTimestampValue()
+		if c := compareInts(at.GetSeconds(), bt.GetSeconds()); c != 0 {
+			return c
+		}
+		return compareInts(int64(at.GetNanos()), int64(bt.GetNanos()))
+	case *pb.Value_BooleanValue:
+		x, y := av.BooleanValue, b.GetBooleanValue()
+		switch {
+		case x == y:
+			return 0
+		case !x:
+			return -1
+		}
+		return 1
+	case *pb.Value_BlobValue:
+		return bytes.Compare(av.BlobValue, b.GetBlobValue())
+	case *pb.Value_StringValue:
+		return strings.Compare(av.StringValue, b.GetStringValue())
+	case *pb.Value_DoubleValue:
+		return compareFloats(av.DoubleValue, b.GetDoubleValue())
+	case *pb.Value_GeoPointValue:
+		ag, bg := av.GeoPointValue, b.GetGeoPointValue()
+		if c := compareFloats(ag.GetLatitude(), bg.GetLatitude()); c != 0 {
+			return c
+		}
+		return compareFloats(ag.GetLongitude(), bg.GetLongitude())
+	case *pb.Value_KeyValue:
+		return CompareKeys(av.KeyValue, b.GetKeyValue())
+	}
+	return 0
+}
+
+// compareFloats orders NaN before all other numbers.
+func compareFloats(a, b float64) int {
+	an, bn := math.IsNaN(a), math.IsNaN(b)
+	switch {
+	case an && bn:
+		return 0
+	case an:
+		return -1
+	case bn:
+		return 1
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
@@ -245,6 +245,10 @@ func (c *Client) AllocateIDs(ctx context.Context, keys []*Key) ([]*Key, error) {
 	if keys == nil {
 		return nil, nil
 	}
+	keys, err := c.scopeKeys(keys)
+	if err != nil {
+		return nil, err
+	}
 
 	req := &pb.AllocateIdsRequest{
 		ProjectId: c.dataset,
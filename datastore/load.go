@@ -468,6 +468,16 @@ func (s structPLS) Load(props []Property) error {
 	var fieldName, errReason string
 	var l propertyLoader
 
+	if m := migrationFor(s.v.Type()); m != nil {
+		props, fieldName, errReason = m.apply(props)
+		if errReason != "" {
+			return &ErrFieldMismatch{
+				StructType: s.v.Type(),
+				FieldName:  fieldName,
+				Reason:     errReason,
+			}
+		}
+	}
 	prev := make(map[string]struct{})
 	for _, p := range props {
 		if errStr := l.load(s.codec, s.v, p, prev); errStr != "" {
@@ -0,0 +1,394 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package datastore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+
+	"cloud.google.com/go/internal/trace"
+	"google.golang.org/api/iterator"
+)
+
+// A Migration describes how the properties of entities saved with an older
+// version of a struct are converted when they are loaded into the current
+// version. Migrations are registered with RegisterMigration, and apply to
+// every load into the struct type, including by Get, GetAll, Iterator.Next
+// and LoadStruct, and to nested structs.
+type Migration struct {
+	// Renames maps old property names to new ones. A property whose name
+	// is, or starts with, an old name followed by a dot is loaded as if it
+	// had the new name instead. If an entity has properties with both the
+	// old and the new name, the old one is ignored.
+	Renames map[string]string
+
+	// Coercions maps property names, after renaming, to functions that
+	// convert their values. A coercion is called for each value of the
+	// property, including each element of a slice, and for nil values. It
+	// should return values that already have the new type unchanged.
+	Coercions map[string]Coercion
+}
+
+// A Coercion converts a property value to a type that can be loaded into a
+// struct field. See Property.Value for the types of v.
+type Coercion func(v interface{}) (interface{}, error)
+
+var (
+	migrationsMu sync.RWMutex
+	migrations   = map[reflect.Type]*Migration{}
+)
+
+// RegisterMigration registers m as the migration for the struct type of
+// dst, which must be a struct or a struct pointer. It replaces any migration
+// previously registered for the type. RegisterMigration is typically called
+// from an init function.
+//
+// RegisterMigration panics if dst is not a struct or a struct pointer.
+func RegisterMigration(dst interface{}, m Migration) {
+	t := reflect.TypeOf(dst)
+	if t != nil && t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t == nil || t.Kind() != reflect.Struct {
+		panic(fmt.Sprintf("datastore: RegisterMigration of non-struct type %T", dst))
+	}
+	migrationsMu.Lock()
+	defer migrationsMu.Unlock()
+	migrations[t] = &m
+}
+
+// migrationFor returns the migration registered for t, or nil.
+func migrationFor(t reflect.Type) *Migration {
+	migrationsMu.RLock()
+	defer migrationsMu.RUnlock()
+	return migrations[t]
+}
+
+// apply returns props migrated by m. If a coercion fails, apply returns the
+// name of the property and the reason.
+func (m *Migration) apply(props []Property) (out []Property, fieldName, errReason string) {
+	have := make(map[string]bool, len(props))
+	for _, p := range props {
+		have[p.Name] = true
+	}
+	out = make([]Property, 0, len(props))
+	for _, p := range props {
+		if name, ok := m.rename(p.Name); ok {
+			if have[name] {
+				continue
+			}
+			p.Name = name
+		}
+		if c := m.Coercions[p.Name]; c != nil {
+			v, err := coerceValue(c, p.Value)
+			if err != nil {
+				return nil, p.Name, err.Error()
+			}
+			p.Value = v
+		}
+		out = append(out, p)
+	}
+	return out, "", ""
+}
+
+// rename returns the new name of a property, if it was renamed.
+func (m *Migration) rename(name string) (string, bool) {
+	if n, ok := m.Renames[name]; ok {
+		return n, true
+	}
+	for i := strings.LastIndexByte(name, '.'); i > 0; i = strings.LastIndexByte(name[:i], '.') {
+		if n, ok := m.Renames[name[:i]]; ok {
+			return n + name[i:], true
+		}
+	}
+	return "", false
+}
+
+func coerceValue(c Coercion, v interface{}) (interface{}, error) {
+	vs, ok := v.([]interface{})
+	if !ok {
+		return c(v)
+	}
+	out := make([]interface{}, len(vs))
+	for i, e := range vs {
+		var err error
+		if out[i], err = c(e); err != nil {
+			return nil, err
+		}
+	}
+	return out, nil
+}
+
+// CoerceToString is a Coercion that converts integers, floats and booleans to
+// their decimal or "true"/"false" representations.
+func CoerceToString(v interface{}) (interface{}, error) {
+	switch x := v.(type) {
+	case nil, string:
+		return v, nil
+	case int64:
+		return strconv.FormatInt(x, 10), nil
+	case float64:
+		return strconv.FormatFloat(x, 'g', -1, 64), nil
+	case bool:
+		return strconv.FormatBool(x), nil
+	}
+	return nil, coercionError(v, "string")
+}
+
+// CoerceToInt is a Coercion that converts strings holding decimal integers,
+// floats with no fractional part, and booleans (as 0 or 1) to integers.
+func CoerceToInt(v interface{}) (interface{}, error) {
+	switch x := v.(type) {
+	case nil, int64:
+		return v, nil
+	case string:
+		n, err := strconv.ParseInt(strings.TrimSpace(x), 10, 64)
+		if err != nil {
+			return nil, coercionError(v, "int")
+		}
+		return n, nil
+	case float64:
+		if x != math.Trunc(x) || x < math.MinInt64 || x >= math.MaxInt64 {
+			return nil, coercionError(v, "int")
+		}
+		return int64(x), nil
+	case bool:
+		if x {
+			return int64(1), nil
+		}
+		return int64(0), nil
+	}
+	return nil, coercionError(v, "int")
+}
+
+// CoerceToFloat is a Coercion that converts integers and strings holding
+// numbers to floats.
+func CoerceToFloat(v interface{}) (interface{}, error) {
+	switch x := v.(type) {
+	case nil, float64:
+		return v, nil
+	case int64:
+		return float64(x), nil
+	case string:
+		f, err := strconv.ParseFloat(strings.TrimSpace(x), 64)
+		if err != nil {
+			return nil, coercionError(v, "float")
+		}
+		return f, nil
+	}
+	return nil, coercionError(v, "float")
+}
+
+// CoerceToBool is a Coercion that converts integers (non-zero is true) and
+// strings accepted by strconv.ParseBool to booleans.
+func CoerceToBool(v interface{}) (interface{}, error) {
+	switch x := v.(type) {
+	case nil, bool:
+		return v, nil
+	case int64:
+		return x != 0, nil
+	case string:
+		b, err := strconv.ParseBool(strings.TrimSpace(x))
+		if err != nil {
+			return nil, coercionError(v, "bool")
+		}
+		return b, nil
+	}
+	return nil, coercionError(v, "bool")
+}
+
+func coercionError(v interface{}, to string) error {
+	return fmt.Errorf("cannot coerce %T value %v to %s", v, v, to)
+}
+
+// MigrateOptions configure Client.Migrate.
+type MigrateOptions struct {
+	// BatchSize is the number of entities rewritten in each transaction.
+	// The default is 100, and the maximum 500.
+	BatchSize int
+
+	// ResumeToken, if set, is the ResumeToken of a MigrateProgress reported
+	// by an earlier call to Migrate for the same kind. Migration resumes
+	// after the last batch of that call.
+	ResumeToken string
+
+	// Transform, if non-nil, is called with each entity after it is loaded,
+	// and may modify it. If it returns false, the entity is not rewritten.
+	// It is called within a transaction, and may be called more than once
+	// for the same entity if the transaction is retried.
+	Transform func(k *Key, dst interface{}) (write bool, err error)
+
+	// DropUnknownProperties causes properties that have no corresponding
+	// struct field to be dropped from the rewritten entities. Otherwise,
+	// Migrate fails with an *ErrFieldMismatch if it encounters one.
+	DropUnknownProperties bool
+
+	// Progress, if non-nil, is called after each batch is committed.
+	Progress func(MigrateProgress)
+}
+
+// MigrateProgress reports how far a call to Client.Migrate has got.
+type MigrateProgress struct {
+	// Scanned is the number of entities read, and Written the number
+	// rewritten, by this call to Migrate.
+	Scanned, Written int
+	// ResumeToken can be passed in MigrateOptions to resume migration
+	// after the last committed batch.
+	ResumeToken string
+	// Done reports whether all the entities of the kind have been migrated.
+	Done bool
+}
+
+const (
+	defaultMigrateBatchSize = 100
+	// maxMigrateBatchSize is the maximum number of mutations in a commit.
+	maxMigrateBatchSize = 500
+)
+
+var errBadResumeToken = errors.New("datastore: invalid migration resume token")
+
+// Migrate rewrites all the entities of the given kind, in the client's
+// namespace, so that they are stored as they would be saved from the current
+// version of their struct type. newDst is called to create a struct pointer
+// to load each entity into; it typically returns a pointer to a zero value of
+// a struct type with a registered Migration.
+//
+// Migrate walks the keys of the kind in order with a cursor, and rewrites
+// each batch of entities in a transaction, retrying batches that conflict
+// with concurrent transactions. Entities deleted after they are scanned are
+// skipped, and entities created in the already-scanned range are not seen.
+//
+// If Migrate fails, the returned progress holds a ResumeToken that can be
+// used to continue after the last committed batch.
+//
+// Migrate returns after migrating all the entities, or when ctx is done.
+func (c *Client) Migrate(ctx context.Context, kind string, newDst func() interface{}, opts *MigrateOptions) (prog MigrateProgress, err error) {
+	ctx = trace.StartSpan(ctx, "cloud.google.com/go/datastore.Migrate")
+	defer func() { trace.EndSpan(ctx, err) }()
+
+	if opts == nil {
+		opts = &MigrateOptions{}
+	}
+	batchSize := opts.BatchSize
+	switch {
+	case batchSize <= 0:
+		batchSize = defaultMigrateBatchSize
+	case batchSize > maxMigrateBatchSize:
+		return prog, fmt.Errorf("datastore: migration batch size %d is larger than %d", batchSize, maxMigrateBatchSize)
+	}
+	prog.ResumeToken = opts.ResumeToken
+	q := NewQuery(kind).KeysOnly().Limit(batchSize)
+	for {
+		bq := q
+		if prog.ResumeToken != "" {
+			cursor, err := DecodeCursor(prog.ResumeToken)
+			if err != nil {
+				return prog, errBadResumeToken
+			}
+			bq = bq.Start(cursor)
+		}
+		it := c.Run(ctx, bq)
+		var keys []*Key
+		for {
+			k, err := it.Next(nil)
+			if err == iterator.Done {
+				break
+			}
+			if err != nil {
+				return prog, err
+			}
+			keys = append(keys, k)
+		}
+		if len(keys) == 0 {
+			prog.Done = true
+			return prog, nil
+		}
+		cursor, err := it.Cursor()
+		if err != nil {
+			return prog, err
+		}
+		written, err := c.migrateBatch(ctx, keys, newDst, opts)
+		if err != nil {
+			return prog, err
+		}
+		prog.Scanned += len(keys)
+		prog.Written += written
+		prog.ResumeToken = cursor.String()
+		prog.Done = len(keys) < batchSize
+		if opts.Progress != nil {
+			opts.Progress(prog)
+		}
+		if prog.Done {
+			return prog, nil
+		}
+	}
+}
+
+// migrateBatch rewrites the entities with the given keys in a transaction,
+// and returns the number written.
+func (c *Client) migrateBatch(ctx context.Context, keys []*Key, newDst func() interface{}, opts *MigrateOptions) (int, error) {
+	var written int
+	_, err := c.RunInTransaction(ctx, func(tx *Transaction) error {
+		written = 0
+		dsts := make([]interface{}, len(keys))
+		for i := range dsts {
+			dsts[i] = newDst()
+		}
+		err := tx.GetMulti(keys, dsts)
+		merr, _ := err.(MultiError)
+		if err != nil && merr == nil {
+			return err
+		}
+		var wkeys []*Key
+		var wdsts []interface{}
+		for i, k := range keys {
+			if merr != nil && merr[i] != nil {
+				if merr[i] == ErrNoSuchEntity {
+					continue
+				}
+				fm, ok := merr[i].(*ErrFieldMismatch)
+				if !ok || !opts.DropUnknownProperties || fm.Reason != "no such struct field" {
+					return merr[i]
+				}
+			}
+			if opts.Transform != nil {
+				write, err := opts.Transform(k, dsts[i])
+				if err != nil {
+					return err
+				}
+				if !write {
+					continue
+				}
+			}
+			wkeys = append(wkeys, k)
+			wdsts = append(wdsts, dsts[i])
+		}
+		if len(wkeys) == 0 {
+			return nil
+		}
+		if _, err := tx.PutMulti(wkeys, wdsts); err != nil {
+			return err
+		}
+		written = len(wkeys)
+		return nil
+	})
+	return written, err
+}
@@ -0,0 +1,243 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package datastore
+
+import (
+	"context"
+	"sort"
+	"testing"
+
+	"cloud.google.com/go/internal/testutil"
+)
+
+type migrated struct {
+	Title  string
+	Count  int
+	Tags   []string
+	Inner  migratedInner
+	Ratio  float64
+	Active bool
+}
+
+type migratedInner struct {
+	Code string
+}
+
+type migratedProduct struct {
+	Title string
+	Price int
+}
+
+func init() {
+	RegisterMigration(&migrated{}, Migration{
+		Renames: map[string]string{
+			"Name":  "Title",
+			"Outer": "Inner",
+		},
+		Coercions: map[string]Coercion{
+			"Count":  CoerceToInt,
+			"Tags":   CoerceToString,
+			"Ratio":  CoerceToFloat,
+			"Active": CoerceToBool,
+		},
+	})
+	RegisterMigration(migratedInner{}, Migration{
+		Coercions: map[string]Coercion{"Code": CoerceToString},
+	})
+	RegisterMigration(&migratedProduct{}, Migration{
+		Renames:   map[string]string{"Name": "Title"},
+		Coercions: map[string]Coercion{"Price": CoerceToInt},
+	})
+}
+
+func TestMigrationLoad(t *testing.T) {
+	for _, test := range []struct {
+		desc  string
+		props []Property
+		want  migrated
+	}{
+		{
+			desc: "current",
+			props: []Property{
+				{Name: "Title", Value: "t"},
+				{Name: "Count", Value: int64(2)},
+			},
+			want: migrated{Title: "t", Count: 2},
+		},
+		{
+			desc: "rename and coerce",
+			props: []Property{
+				{Name: "Name", Value: "n"},
+				{Name: "Count", Value: "7"},
+				{Name: "Tags", Value: []interface{}{int64(1), true}},
+				{Name: "Ratio", Value: int64(3)},
+				{Name: "Active", Value: "true"},
+			},
+			want: migrated{Title: "n", Count: 7, Tags: []string{"1", "true"}, Ratio: 3, Active: true},
+		},
+		{
+			desc: "new name wins",
+			props: []Property{
+				{Name: "Name", Value: "old"},
+				{Name: "Title", Value: "new"},
+			},
+			want: migrated{Title: "new"},
+		},
+		{
+			desc: "flattened nested rename",
+			props: []Property{
+				{Name: "Outer.Code", Value: "c"},
+			},
+			want: migrated{Inner: migratedInner{Code: "c"}},
+		},
+		{
+			desc: "nested entity migration",
+			props: []Property{
+				{Name: "Inner", Value: &Entity{Properties: []Property{{Name: "Code", Value: int64(5)}}}},
+			},
+			want: migrated{Inner: migratedInner{Code: "5"}},
+		},
+	} {
+		var got migrated
+		if err := LoadStruct(&got, test.props); err != nil {
+			t.Errorf("%s: %v", test.desc, err)
+			continue
+		}
+		if !testutil.Equal(got, test.want) {
+			t.Errorf("%s: got %+v, want %+v", test.desc, got, test.want)
+		}
+	}
+
+	err := LoadStruct(&migrated{}, []Property{{Name: "Count", Value: "seven"}})
+	if fm, ok := err.(*ErrFieldMismatch); !ok || fm.FieldName != "Count" {
+		t.Errorf("bad coercion: got %v, want ErrFieldMismatch for Count", err)
+	}
+}
+
+func TestCoercions(t *testing.T) {
+	for _, test := range []struct {
+		c       Coercion
+		in      interface{}
+		want    interface{}
+		wantErr bool
+	}{
+		{CoerceToString, int64(-3), "-3", false},
+		{CoerceToString, 1.5, "1.5", false},
+		{CoerceToString, nil, nil, false},
+		{CoerceToString, []byte("x"), nil, true},
+		{CoerceToInt, " 12 ", int64(12), false},
+		{CoerceToInt, 4.0, int64(4), false},
+		{CoerceToInt, 4.5, nil, true},
+		{CoerceToInt, false, int64(0), false},
+		{CoerceToFloat, "2.5", 2.5, false},
+		{CoerceToFloat, true, nil, true},
+		{CoerceToBool, int64(2), true, false},
+		{CoerceToBool, "F", false, false},
+		{CoerceToBool, "maybe", nil, true},
+	} {
+		got, err := test.c(test.in)
+		if (err != nil) != test.wantErr {
+			t.Errorf("%v: got error %v, want error %t", test.in, err, test.wantErr)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("%v: got %#v, want %#v", test.in, got, test.want)
+		}
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	ctx := context.Background()
+	client, cleanup := newFakeClient(t)
+	defer cleanup()
+
+	var keys []*Key
+	var olds []PropertyList
+	for _, name := range []string{"a", "b", "c", "d", "e"} {
+		keys = append(keys, NameKey("Product", name, nil))
+		olds = append(olds, PropertyList{
+			{Name: "Name", Value: name},
+			{Name: "Price", Value: "10"},
+			{Name: "Obsolete", Value: true},
+		})
+	}
+	if _, err := client.PutMulti(ctx, keys, olds); err != nil {
+		t.Fatal(err)
+	}
+	newDst := func() interface{} { return &migratedProduct{} }
+
+	// Unknown properties stop the migration unless they may be dropped.
+	if _, err := client.Migrate(ctx, "Product", newDst, nil); err == nil {
+		t.Fatal("got nil, want ErrFieldMismatch")
+	}
+
+	// Stop after the first batch, then resume.
+	cctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var progress []MigrateProgress
+	opts := &MigrateOptions{
+		BatchSize:             2,
+		DropUnknownProperties: true,
+		Transform: func(k *Key, dst interface{}) (bool, error) {
+			if k.Name == "c" {
+				return false, nil
+			}
+			dst.(*migratedProduct).Price++
+			return true, nil
+		},
+		Progress: func(p MigrateProgress) {
+			progress = append(progress, p)
+			cancel()
+		},
+	}
+	prog, err := client.Migrate(cctx, "Product", newDst, opts)
+	if err == nil {
+		t.Fatal("got nil, want context error")
+	}
+	if prog.Scanned != 2 || prog.Written != 2 || prog.Done || prog.ResumeToken == "" {
+		t.Fatalf("after cancel: got %+v", prog)
+	}
+
+	opts.ResumeToken = prog.ResumeToken
+	opts.Progress = func(p MigrateProgress) { progress = append(progress, p) }
+	prog, err = client.Migrate(ctx, "Product", newDst, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if prog.Scanned != 3 || prog.Written != 2 || !prog.Done {
+		t.Errorf("after resume: got %+v", prog)
+	}
+	if len(progress) != 3 {
+		t.Errorf("got %d progress reports, want 3", len(progress))
+	}
+
+	var got PropertyList
+	if err := client.Get(ctx, keys[0], &got); err != nil {
+		t.Fatal(err)
+	}
+	want := PropertyList{{Name: "Price", Value: int64(11)}, {Name: "Title", Value: "a"}}
+	sort.Slice(got, func(i, j int) bool { return got[i].Name < got[j].Name })
+	if !testutil.Equal(got, want) {
+		t.Errorf("migrated entity: got %v, want %v", got, want)
+	}
+	// Entities skipped by Transform are left as they were.
+	got = nil
+	if err := client.Get(ctx, keys[2], &got); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 3 {
+		t.Errorf("skipped entity: got %v, want it unchanged", got)
+	}
+}
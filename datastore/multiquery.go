@@ -0,0 +1,480 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package datastore
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+
+	"cloud.google.com/go/datastore/internal/valueorder"
+	"github.com/golang/protobuf/proto"
+	"google.golang.org/api/iterator"
+	pb "google.golang.org/genproto/googleapis/datastore/v1"
+)
+
+// split returns the queries whose merged results are the results of q. If the
+// service can run q directly, split returns a single query with only simple
+// filters.
+func (q *Query) split() ([]*Query, error) {
+	simple := len(q.entityFilter) == 0
+	for _, f := range q.filter {
+		if _, ok := operatorToProto[f.Op]; !ok {
+			simple = false
+		}
+	}
+	if simple {
+		return []*Query{q}, nil
+	}
+
+	var all []EntityFilter
+	for _, f := range q.filter {
+		all = append(all, f)
+	}
+	all = append(all, q.entityFilter...)
+	conjs, err := AndFilter{Filters: all}.dnf()
+	if err != nil {
+		return nil, err
+	}
+
+	// All the sub-queries must be sorted the same way for their results to be
+	// merged. A query with an inequality filter is implicitly ordered by the
+	// filtered property, so make that order explicit for all of them.
+	var ineqField string
+	for _, c := range conjs {
+		for _, f := range c {
+			if f.Op == equal {
+				continue
+			}
+			if ineqField != "" && f.FieldName != ineqField {
+				return nil, fmt.Errorf("datastore: inequality filters on multiple properties are not supported: %q and %q", ineqField, f.FieldName)
+			}
+			ineqField = f.FieldName
+		}
+	}
+	var subs []*Query
+	for _, c := range conjs {
+		sq := q.clone()
+		sq.filter = c
+		sq.entityFilter = nil
+		if len(conjs) > 1 && len(q.order) == 0 && ineqField != "" {
+			sq.order = []order{{FieldName: ineqField, Direction: ascending}}
+		}
+		subs = append(subs, sq)
+	}
+	return subs, nil
+}
+
+// A multiIterator merges the results of several sub-queries, which are sorted
+// the same way, into a single sorted stream without duplicates.
+type multiIterator struct {
+	subs   []*subIterator
+	orders []order
+	// seen records the identities of the results returned so far.
+	seen map[string]bool
+	// projection and distinct are the projected and distinct-on properties
+	// of the original query.
+	projection []string
+	distinct   []string
+	// extra holds properties that are projected only so that results can be
+	// ordered. They are removed from results.
+	extra []string
+	// offset is the number of results still to be skipped, and limit the
+	// number still to be returned. A negative limit means unlimited.
+	offset int32
+	limit  int32
+}
+
+// A subIterator is a sub-query of a multiIterator, along with the result at
+// its head, if any.
+type subIterator struct {
+	it *Iterator
+	// filters are the sub-query's filters, grouped by property.
+	filters map[string][]*pb.PropertyFilter
+	// cursor is the position after the last result taken from the
+	// sub-query, or nil if none has been.
+	cursor []byte
+
+	done       bool
+	head       *pb.Entity
+	headKey    *Key
+	headPos    []*pb.Value
+	headCursor []byte
+}
+
+func newMultiIterator(ctx context.Context, c *Client, q *Query, subs []*Query) (*multiIterator, error) {
+	m := &multiIterator{
+		orders:     subs[0].order,
+		seen:       map[string]bool{},
+		projection: q.projection,
+		distinct:   q.distinctOn,
+		offset:     q.offset,
+		limit:      q.limit,
+	}
+	if q.distinct {
+		m.distinct = q.projection
+	}
+	starts, err := decodeMultiCursor(q.start, len(subs))
+	if err != nil {
+		return nil, err
+	}
+	ends, err := decodeMultiCursor(q.end, len(subs))
+	if err != nil {
+		return nil, err
+	}
+	if len(q.projection) > 0 {
+		projected := map[string]bool{}
+		for _, p := range q.projection {
+			projected[p] = true
+		}
+		for _, o := range m.orders {
+			if !projected[o.FieldName] && o.FieldName != keyFieldName {
+				m.extra = append(m.extra, o.FieldName)
+				projected[o.FieldName] = true
+			}
+		}
+	}
+	needValues := false
+	for _, o := range m.orders {
+		needValues = needValues || o.FieldName != keyFieldName
+	}
+
+	for i, sq := range subs {
+		sq = sq.clone()
+		sq.offset = 0
+		sq.start = nil
+		sq.end = nil
+		if q.limit >= 0 {
+			sq.limit = int32(math.Min(float64(q.offset)+float64(q.limit), math.MaxInt32))
+		}
+		if q.keysOnly && needValues {
+			sq.keysOnly = false
+		}
+		if len(m.extra) > 0 {
+			sq.projection = append(append([]string(nil), q.projection...), m.extra...)
+		}
+		if q.distinct {
+			sq.distinct = false
+			sq.distinctOn = q.projection
+		}
+		if starts != nil {
+			sq.start = starts[i]
+		}
+		s := &subIterator{cursor: sq.start, filters: map[string][]*pb.PropertyFilter{}}
+		for _, f := range sq.filter {
+			v, err := interfaceToProto(f.Value, false)
+			if err != nil {
+				return nil, fmt.Errorf("datastore: bad query filter value type: %v", err)
+			}
+			s.filters[f.FieldName] = append(s.filters[f.FieldName], &pb.PropertyFilter{Op: operatorToProto[f.Op], Value: v})
+		}
+		if ends != nil {
+			if ends[i] == nil {
+				// The sub-query had not returned anything at the end position.
+				s.done = true
+			}
+			sq.end = ends[i]
+		}
+		if !s.done {
+			s.it = c.Run(ctx, sq)
+			if s.it.err != nil {
+				return nil, s.it.err
+			}
+		}
+		m.subs = append(m.subs, s)
+	}
+	return m, nil
+}
+
+// fill fetches the next result of s into its head, unless it already has one.
+func (m *multiIterator) fill(s *subIterator) error {
+	if s.done || s.head != nil {
+		return nil
+	}
+	k, e, err := s.it.next()
+	if err == iterator.Done {
+		s.done = true
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	s.head, s.headKey, s.headCursor = e, k, s.it.entityCursor
+	s.headPos = m.position(s, e)
+	return nil
+}
+
+// take removes the head of s.
+func (s *subIterator) take() {
+	s.cursor = s.headCursor
+	s.head, s.headKey, s.headPos, s.headCursor = nil, nil, nil, nil
+}
+
+// position returns the values that determine where e sorts in the results of
+// s: one value per order, followed by e's key. For a property with several
+// values, the position uses the smallest value that satisfies the
+// sub-query's filters for ascending orders, and the largest for descending
+// orders, as the service does.
+func (m *multiIterator) position(s *subIterator, e *pb.Entity) []*pb.Value {
+	var pos []*pb.Value
+	for _, o := range m.orders {
+		var best *pb.Value
+		for _, v := range propertyIndexValues(e, o.FieldName) {
+			if !satisfiesFilters(v, s.filters[o.FieldName]) {
+				continue
+			}
+			if best == nil {
+				best = v
+				continue
+			}
+			c := valueorder.CompareValues(v, best)
+			if (o.Direction == descending && c > 0) || (o.Direction == ascending && c < 0) {
+				best = v
+			}
+		}
+		if best == nil {
+			best = &pb.Value{ValueType: &pb.Value_NullValue{}}
+		}
+		pos = append(pos, best)
+	}
+	return append(pos, &pb.Value{ValueType: &pb.Value_KeyValue{KeyValue: e.Key}})
+}
+
+// compare orders two positions.
+func (m *multiIterator) compare(a, b []*pb.Value) int {
+	for i, o := range m.orders {
+		c := valueorder.CompareValues(a[i], b[i])
+		if o.Direction == descending {
+			c = -c
+		}
+		if c != 0 {
+			return c
+		}
+	}
+	n := len(m.orders)
+	return valueorder.CompareValues(a[n], b[n])
+}
+
+// identity returns a string that is the same for results that are duplicates
+// of each other.
+func (m *multiIterator) identity(k *Key, e *pb.Entity) string {
+	names := m.distinct
+	if len(names) == 0 {
+		if len(m.projection) == 0 {
+			return k.Encode()
+		}
+		names = append([]string{keyFieldName}, m.projection...)
+	}
+	var b strings.Builder
+	for _, name := range names {
+		var enc []byte
+		if name == keyFieldName {
+			enc, _ = proto.Marshal(e.Key)
+		} else if v, ok := e.Properties[name]; ok {
+			enc, _ = proto.Marshal(v)
+		}
+		b.Write(enc)
+		b.WriteByte(0)
+	}
+	return b.String()
+}
+
+// step returns the next result in merged order that has not been returned
+// before, ignoring the offset and limit.
+func (m *multiIterator) step() (*Key, *pb.Entity, error) {
+	for {
+		var best *subIterator
+		for _, s := range m.subs {
+			if err := m.fill(s); err != nil {
+				return nil, nil, err
+			}
+			if s.head != nil && (best == nil || m.compare(s.headPos, best.headPos) < 0) {
+				best = s
+			}
+		}
+		if best == nil {
+			return nil, nil, iterator.Done
+		}
+		k, e, pos := best.headKey, best.head, best.headPos
+		id := m.identity(k, e)
+		// Take the same result from every sub-query that has it at the same
+		// position, so that cursors move past it in all of them.
+		for _, s := range m.subs {
+			if s.head != nil && m.compare(s.headPos, pos) == 0 && m.identity(s.headKey, s.head) == id {
+				s.take()
+			}
+		}
+		if m.seen[id] {
+			continue
+		}
+		m.seen[id] = true
+		for _, name := range m.extra {
+			delete(e.Properties, name)
+		}
+		return k, e, nil
+	}
+}
+
+func (m *multiIterator) next() (*Key, *pb.Entity, error) {
+	for {
+		if m.limit == 0 {
+			return nil, nil, iterator.Done
+		}
+		k, e, err := m.step()
+		if err != nil {
+			return nil, nil, err
+		}
+		if m.offset > 0 {
+			m.offset--
+			continue
+		}
+		if m.limit > 0 {
+			m.limit--
+		}
+		return k, e, nil
+	}
+}
+
+// cursor returns a cursor holding the position in each sub-query.
+func (m *multiIterator) cursor() (Cursor, error) {
+	for m.offset > 0 {
+		if _, _, err := m.step(); err == iterator.Done {
+			break
+		} else if err != nil {
+			return Cursor{}, err
+		}
+		m.offset--
+	}
+	var cs [][]byte
+	for _, s := range m.subs {
+		cs = append(cs, s.cursor)
+	}
+	return Cursor{encodeMultiCursor(cs)}, nil
+}
+
+// multiCursorPrefix starts the cursors of merged queries. Cursors returned by
+// the service never start with a zero byte.
+var multiCursorPrefix = []byte("\x00dsmq")
+
+var errCursorMismatch = errors.New("datastore: cursor does not match the query")
+
+func encodeMultiCursor(cs [][]byte) []byte {
+	b := append([]byte(nil), multiCursorPrefix...)
+	var buf [binary.MaxVarintLen64]byte
+	b = append(b, buf[:binary.PutUvarint(buf[:], uint64(len(cs)))]...)
+	for _, c := range cs {
+		b = append(b, buf[:binary.PutUvarint(buf[:], uint64(len(c)))]...)
+		b = append(b, c...)
+	}
+	return b
+}
+
+// decodeMultiCursor returns the sub-query positions in c, which must be a
+// cursor for a merged query with n sub-queries. It returns nil if c is empty.
+func decodeMultiCursor(c []byte, n int) ([][]byte, error) {
+	if len(c) == 0 {
+		return nil, nil
+	}
+	if !bytes.HasPrefix(c, multiCursorPrefix) {
+		return nil, errCursorMismatch
+	}
+	r := bytes.NewReader(c[len(multiCursorPrefix):])
+	count, err := binary.ReadUvarint(r)
+	if err != nil || count != uint64(n) {
+		return nil, errCursorMismatch
+	}
+	cs := make([][]byte, n)
+	for i := range cs {
+		l, err := binary.ReadUvarint(r)
+		if err != nil || l > uint64(r.Len()) {
+			return nil, errCursorMismatch
+		}
+		if l > 0 {
+			cs[i] = make([]byte, l)
+			r.Read(cs[i])
+		}
+	}
+	return cs, nil
+}
+
+// satisfiesFilters reports whether v satisfies all of fs.
+func satisfiesFilters(v *pb.Value, fs []*pb.PropertyFilter) bool {
+	for _, f := range fs {
+		c := valueorder.CompareValues(v, f.Value)
+		var ok bool
+		switch f.Op {
+		case pb.PropertyFilter_EQUAL:
+			ok = c == 0
+		case pb.PropertyFilter_LESS_THAN:
+			ok = c < 0
+		case pb.PropertyFilter_LESS_THAN_OR_EQUAL:
+			ok = c <= 0
+		case pb.PropertyFilter_GREATER_THAN:
+			ok = c > 0
+		case pb.PropertyFilter_GREATER_THAN_OR_EQUAL:
+			ok = c >= 0
+		}
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// propertyIndexValues returns the indexed values of the named property of e.
+// The elements of array values are returned individually, and names with dots
+// may refer to properties of embedded entities.
+func propertyIndexValues(e *pb.Entity, name string) []*pb.Value {
+	if name == keyFieldName {
+		return []*pb.Value{{ValueType: &pb.Value_KeyValue{KeyValue: e.Key}}}
+	}
+	if v, ok := e.Properties[name]; ok {
+		return indexedValues(v)
+	}
+	var vals []*pb.Value
+	for i, c := range name {
+		if c != '.' {
+			continue
+		}
+		v, ok := e.Properties[name[:i]]
+		if !ok {
+			continue
+		}
+		for _, sub := range indexedValues(v) {
+			if ev := sub.GetEntityValue(); ev != nil {
+				vals = append(vals, propertyIndexValues(ev, name[i+1:])...)
+			}
+		}
+	}
+	return vals
+}
+
+func indexedValues(v *pb.Value) []*pb.Value {
+	if av := v.GetArrayValue(); av != nil {
+		var vals []*pb.Value
+		for _, e := range av.Values {
+			vals = append(vals, indexedValues(e)...)
+		}
+		return vals
+	}
+	if v.ExcludeFromIndexes && v.GetEntityValue() == nil {
+		return nil
+	}
+	return []*pb.Value{v}
+}
@@ -0,0 +1,237 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package datastore
+
+import (
+	"fmt"
+
+	"github.com/golang/protobuf/proto"
+	pb "google.golang.org/genproto/googleapis/datastore/v1"
+)
+
+// Namespace returns a derivative client that is bound to the given namespace.
+//
+// Keys and queries with an empty namespace that are passed to the methods of
+// the returned client, or of its transactions, are treated as if they were in
+// ns. Keys and queries in any other namespace are rejected with an error, so
+// the client cannot read or write data outside of ns. Keys returned by the
+// client are in ns. Values of type *Key stored in entities are not changed.
+//
+// If ns is empty, the returned client is not bound to a namespace.
+//
+// The returned client shares its connection with c. Closing either of them
+// closes both.
+func (c *Client) Namespace(ns string) *Client {
+	nc := *c
+	nc.namespace = ns
+	return &nc
+}
+
+// namespaceError returns the error for a key in the wrong namespace.
+func (c *Client) namespaceError(ns string) error {
+	return fmt.Errorf("datastore: namespace %q does not match the client's namespace %q", ns, c.namespace)
+}
+
+// scopeKey returns k in the client's namespace. Invalid keys are returned
+// unchanged, to be reported by the caller.
+func (c *Client) scopeKey(k *Key) (*Key, error) {
+	if c.namespace == "" || !k.valid() || k.Namespace == c.namespace {
+		return k, nil
+	}
+	if k.Namespace != "" {
+		return nil, c.namespaceError(k.Namespace)
+	}
+	sk := *k
+	sk.Namespace = c.namespace
+	if k.Parent != nil {
+		// Parents of a valid key are in the same namespace.
+		sk.Parent, _ = c.scopeKey(k.Parent)
+	}
+	return &sk, nil
+}
+
+// scopeKeys returns keys in the client's namespace. The returned error, if
+// any, is a MultiError.
+func (c *Client) scopeKeys(keys []*Key) ([]*Key, error) {
+	if c.namespace == "" {
+		return keys, nil
+	}
+	scoped := make([]*Key, len(keys))
+	var merr MultiError
+	for i, k := range keys {
+		sk, err := c.scopeKey(k)
+		if err != nil {
+			if merr == nil {
+				merr = make(MultiError, len(keys))
+			}
+			merr[i] = err
+		}
+		scoped[i] = sk
+	}
+	if merr != nil {
+		return nil, merr
+	}
+	return scoped, nil
+}
+
+// scopeMutations returns muts with their keys in the client's namespace.
+// Mutations with keys in another namespace are replaced by invalid ones.
+func (c *Client) scopeMutations(muts []*Mutation) []*Mutation {
+	if c.namespace == "" {
+		return muts
+	}
+	scoped := make([]*Mutation, len(muts))
+	for i, m := range muts {
+		scoped[i] = m
+		if m.err != nil {
+			continue
+		}
+		k, err := c.scopeKey(m.key)
+		if err != nil {
+			scoped[i] = &Mutation{err: err}
+			continue
+		}
+		if k == m.key {
+			continue
+		}
+		pm := proto.Clone(m.mut).(*pb.Mutation)
+		switch op := pm.Operation.(type) {
+		case *pb.Mutation_Insert:
+			op.Insert.Key = keyToProto(k)
+		case *pb.Mutation_Update:
+			op.Update.Key = keyToProto(k)
+		case *pb.Mutation_Upsert:
+			op.Upsert.Key = keyToProto(k)
+		case *pb.Mutation_Delete:
+			op.Delete = keyToProto(k)
+		}
+		scoped[i] = &Mutation{key: k, mut: pm}
+	}
+	return scoped
+}
+
+// scopeQuery returns q in the client's namespace, along with its ancestor and
+// the keys in its filters.
+func (c *Client) scopeQuery(q *Query) *Query {
+	if c.namespace == "" || q.err != nil {
+		return q
+	}
+	q = q.clone()
+	if q.namespace != "" && q.namespace != c.namespace {
+		q.err = c.namespaceError(q.namespace)
+		return q
+	}
+	q.namespace = c.namespace
+	var err error
+	if q.ancestor, err = c.scopeKey(q.ancestor); err != nil {
+		q.err = err
+		return q
+	}
+	for i, f := range q.filter {
+		if q.filter[i].Value, err = c.scopeFilterValue(f.Value); err != nil {
+			q.err = err
+			return q
+		}
+	}
+	for i, ef := range q.entityFilter {
+		if q.entityFilter[i], err = c.scopeEntityFilter(ef); err != nil {
+			q.err = err
+			return q
+		}
+	}
+	return q
+}
+
+// scopeEntityFilter returns ef with the keys in its property filters in the
+// client's namespace.
+func (c *Client) scopeEntityFilter(ef EntityFilter) (EntityFilter, error) {
+	switch f := ef.(type) {
+	case PropertyFilter:
+		v, err := c.scopeFilterValue(f.Value)
+		if err != nil {
+			return nil, err
+		}
+		f.Value = v
+		return f, nil
+	case *PropertyFilter:
+		if f == nil {
+			return ef, nil
+		}
+		return c.scopeEntityFilter(*f)
+	case AndFilter:
+		fs, err := c.scopeEntityFilters(f.Filters)
+		if err != nil {
+			return nil, err
+		}
+		return AndFilter{Filters: fs}, nil
+	case *AndFilter:
+		if f == nil {
+			return ef, nil
+		}
+		return c.scopeEntityFilter(*f)
+	case OrFilter:
+		fs, err := c.scopeEntityFilters(f.Filters)
+		if err != nil {
+			return nil, err
+		}
+		return OrFilter{Filters: fs}, nil
+	case *OrFilter:
+		if f == nil {
+			return ef, nil
+		}
+		return c.scopeEntityFilter(*f)
+	}
+	return ef, nil
+}
+
+func (c *Client) scopeEntityFilters(efs []EntityFilter) ([]EntityFilter, error) {
+	scoped := make([]EntityFilter, len(efs))
+	for i, ef := range efs {
+		var err error
+		if scoped[i], err = c.scopeEntityFilter(ef); err != nil {
+			return nil, err
+		}
+	}
+	return scoped, nil
+}
+
+// scopeFilterValue returns the value of a filter with its keys in the
+// client's namespace. The value may be a key, or a slice of values of an "in"
+// or "not-in" filter.
+func (c *Client) scopeFilterValue(v interface{}) (interface{}, error) {
+	switch v := v.(type) {
+	case *Key:
+		return c.scopeKey(v)
+	case []*Key:
+		scoped := make([]*Key, len(v))
+		for i, k := range v {
+			var err error
+			if scoped[i], err = c.scopeKey(k); err != nil {
+				return nil, err
+			}
+		}
+		return scoped, nil
+	case []interface{}:
+		scoped := make([]interface{}, len(v))
+		for i, e := range v {
+			var err error
+			if scoped[i], err = c.scopeFilterValue(e); err != nil {
+				return nil, err
+			}
+		}
+		return scoped, nil
+	}
+	return v, nil
+}
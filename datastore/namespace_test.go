@@ -0,0 +1,213 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package datastore
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	pb "google.golang.org/genproto/googleapis/datastore/v1"
+)
+
+func TestClientNamespace(t *testing.T) {
+	ctx := context.Background()
+	var commits []*pb.CommitRequest
+	var lookups []*pb.LookupRequest
+	var queries []*pb.RunQueryRequest
+	fake := &fakeDatastoreClient{
+		commit: func(req *pb.CommitRequest) (*pb.CommitResponse, error) {
+			commits = append(commits, req)
+			resp := &pb.CommitResponse{}
+			for _, m := range req.Mutations {
+				var k *pb.Key
+				if e := m.GetUpsert(); e != nil {
+					k = e.Key
+				} else if e := m.GetInsert(); e != nil {
+					k = e.Key
+				}
+				resp.MutationResults = append(resp.MutationResults, &pb.MutationResult{Key: k})
+			}
+			return resp, nil
+		},
+		lookup: func(req *pb.LookupRequest) (*pb.LookupResponse, error) {
+			lookups = append(lookups, req)
+			resp := &pb.LookupResponse{}
+			for _, k := range req.Keys {
+				resp.Missing = append(resp.Missing, &pb.EntityResult{Entity: &pb.Entity{Key: k}})
+			}
+			return resp, nil
+		},
+		runQuery: func(req *pb.RunQueryRequest) (*pb.RunQueryResponse, error) {
+			queries = append(queries, req)
+			return &pb.RunQueryResponse{Batch: &pb.QueryResultBatch{
+				MoreResults: pb.QueryResultBatch_NO_MORE_RESULTS,
+			}}, nil
+		},
+		beginTransaction: func(*pb.BeginTransactionRequest) (*pb.BeginTransactionResponse, error) {
+			return &pb.BeginTransactionResponse{Transaction: []byte("tx")}, nil
+		},
+	}
+	client := (&Client{client: fake}).Namespace("tenant")
+
+	parent := NameKey("Parent", "p", nil)
+	k := NameKey("Kind", "a", parent)
+	got, err := client.Put(ctx, k, &struct{ A int }{1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Namespace != "tenant" || got.Parent.Namespace != "tenant" {
+		t.Errorf("Put returned key %+v, want namespace %q", got, "tenant")
+	}
+	if k.Namespace != "" {
+		t.Error("Put modified its argument")
+	}
+	if ns := commits[0].Mutations[0].GetUpsert().Key.PartitionId.GetNamespaceId(); ns != "tenant" {
+		t.Errorf("Put: got namespace %q, want %q", ns, "tenant")
+	}
+
+	if err := client.Get(ctx, k, &struct{ A int }{}); err != ErrNoSuchEntity {
+		t.Errorf("Get: got %v, want ErrNoSuchEntity", err)
+	}
+	if ns := lookups[0].Keys[0].PartitionId.GetNamespaceId(); ns != "tenant" {
+		t.Errorf("Get: got namespace %q, want %q", ns, "tenant")
+	}
+
+	if _, err := client.Mutate(ctx, NewDelete(k)); err != nil {
+		t.Fatal(err)
+	}
+	if ns := commits[1].Mutations[0].GetDelete().PartitionId.GetNamespaceId(); ns != "tenant" {
+		t.Errorf("Mutate: got namespace %q, want %q", ns, "tenant")
+	}
+
+	if _, err := client.GetAll(ctx, NewQuery("Kind").Ancestor(parent).KeysOnly(), nil); err != nil {
+		t.Fatal(err)
+	}
+	if ns := queries[0].PartitionId.GetNamespaceId(); ns != "tenant" {
+		t.Errorf("query: got namespace %q, want %q", ns, "tenant")
+	}
+
+	// Keys in composite filters and in the values of "in" filters are
+	// scoped too.
+	queries = nil
+	k2 := NameKey("Kind", "b", nil)
+	for _, q := range []*Query{
+		NewQuery("Kind").FilterEntity(OrFilter{Filters: []EntityFilter{
+			PropertyFilter{FieldName: "__key__", Operator: "=", Value: k},
+			AndFilter{Filters: []EntityFilter{&PropertyFilter{FieldName: "__key__", Operator: "=", Value: k2}}},
+		}}).KeysOnly(),
+		NewQuery("Kind").FilterEntity(AndFilter{Filters: []EntityFilter{
+			PropertyFilter{FieldName: "__key__", Operator: "=", Value: k},
+		}}).KeysOnly(),
+		NewQuery("Kind").FilterField("__key__", "in", []*Key{k, k2}).KeysOnly(),
+		NewQuery("Kind").FilterField("__key__", "in", []*Key{k2}).KeysOnly(),
+		NewQuery("Kind").FilterEntity(PropertyFilter{FieldName: "Ref", Operator: "in", Value: []interface{}{k, k2}}).KeysOnly(),
+	} {
+		if _, err := client.GetAll(ctx, q, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(queries) != 8 {
+		t.Fatalf("got %d queries, want 8", len(queries))
+	}
+	for i, req := range queries {
+		keys := filterKeys(req.GetQuery().GetFilter())
+		if len(keys) != 1 {
+			t.Errorf("query %d: got %d keys in the filter, want 1", i, len(keys))
+		}
+		for _, fk := range keys {
+			if ns := fk.GetPartitionId().GetNamespaceId(); ns != "tenant" {
+				t.Errorf("query %d: got filter key namespace %q, want %q", i, ns, "tenant")
+			}
+		}
+	}
+
+	_, err = client.RunInTransaction(ctx, func(tx *Transaction) error {
+		_, err := tx.Put(k, &struct{ A int }{2})
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ns := commits[2].Mutations[0].GetUpsert().Key.PartitionId.GetNamespaceId(); ns != "tenant" {
+		t.Errorf("transaction: got namespace %q, want %q", ns, "tenant")
+	}
+
+	// Keys and queries in other namespaces are rejected without a request.
+	other := NameKey("Kind", "a", nil)
+	other.Namespace = "other"
+	n := len(commits) + len(lookups) + len(queries)
+	if _, err := client.Put(ctx, other, &struct{ A int }{1}); err == nil {
+		t.Error("Put: got nil, want error")
+	}
+	if err := client.Get(ctx, other, &struct{ A int }{}); err == nil {
+		t.Error("Get: got nil, want error")
+	}
+	if err := client.Delete(ctx, other); err == nil {
+		t.Error("Delete: got nil, want error")
+	}
+	if _, err := client.Mutate(ctx, NewUpsert(other, &struct{ A int }{1})); err == nil {
+		t.Error("Mutate: got nil, want error")
+	}
+	if _, err := client.GetAll(ctx, NewQuery("Kind").Namespace("other").KeysOnly(), nil); err == nil {
+		t.Error("query namespace: got nil, want error")
+	}
+	if _, err := client.GetAll(ctx, NewQuery("Kind").Ancestor(other).KeysOnly(), nil); err == nil {
+		t.Error("query ancestor: got nil, want error")
+	}
+	if _, err := client.GetAll(ctx, NewQuery("Kind").Filter("__key__ =", other).KeysOnly(), nil); err == nil {
+		t.Error("query key filter: got nil, want error")
+	}
+	if _, err := client.GetAll(ctx, NewQuery("Kind").FilterEntity(OrFilter{Filters: []EntityFilter{
+		PropertyFilter{FieldName: "A", Operator: "=", Value: 1},
+		PropertyFilter{FieldName: "__key__", Operator: "=", Value: other},
+	}}).KeysOnly(), nil); err == nil {
+		t.Error("query composite key filter: got nil, want error")
+	}
+	if _, err := client.GetAll(ctx, NewQuery("Kind").FilterField("__key__", "in", []*Key{k, other}).KeysOnly(), nil); err == nil {
+		t.Error("query key slice filter: got nil, want error")
+	}
+	errTx := errors.New("tx")
+	_, err = client.RunInTransaction(ctx, func(tx *Transaction) error {
+		if _, err := tx.Put(other, &struct{ A int }{1}); err == nil {
+			t.Error("tx.Put: got nil, want error")
+		}
+		if err := tx.Delete(other); err == nil {
+			t.Error("tx.Delete: got nil, want error")
+		}
+		return errTx
+	})
+	if err != errTx {
+		t.Fatalf("got %v, want %v", err, errTx)
+	}
+	if got := len(commits) + len(lookups) + len(queries); got != n {
+		t.Errorf("got %d requests for mismatched namespaces, want none", got-n)
+	}
+}
+
+// filterKeys returns the key values in the property filters of f.
+func filterKeys(f *pb.Filter) []*pb.Key {
+	if cf := f.GetCompositeFilter(); cf != nil {
+		var keys []*pb.Key
+		for _, sub := range cf.Filters {
+			keys = append(keys, filterKeys(sub)...)
+		}
+		return keys
+	}
+	if k := f.GetPropertyFilter().GetValue().GetKeyValue(); k != nil {
+		return []*pb.Key{k}
+	}
+	return nil
+}
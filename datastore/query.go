@@ -38,6 +38,9 @@ const (
 	equal
 	greaterEq
 	greaterThan
+	notEqual
+	in
+	notIn
 
 	keyFieldName = "__key__"
 )
@@ -50,6 +53,17 @@ var operatorToProto = map[operator]pb.PropertyFilter_Operator{
 	greaterThan: pb.PropertyFilter_GREATER_THAN,
 }
 
+var operatorToString = map[operator]string{
+	lessThan:    "<",
+	lessEq:      "<=",
+	equal:       "=",
+	greaterEq:   ">=",
+	greaterThan: ">",
+	notEqual:    "!=",
+	in:          "in",
+	notIn:       "not-in",
+}
+
 // filter is a conditional filter on query results.
 type filter struct {
 	FieldName string
@@ -89,11 +103,12 @@ func NewQuery(kind string) *Query {
 
 // Query represents a datastore query.
 type Query struct {
-	kind       string
-	ancestor   *Key
-	filter     []filter
-	order      []order
-	projection []string
+	kind         string
+	ancestor     *Key
+	filter       []filter
+	entityFilter []EntityFilter // AND'ed with filter
+	order        []order
+	projection   []string
 
 	distinct   bool
 	distinctOn []string
@@ -118,6 +133,10 @@ func (q *Query) clone() *Query {
 		x.filter = make([]filter, len(q.filter))
 		copy(x.filter, q.filter)
 	}
+	if len(q.entityFilter) > 0 {
+		x.entityFilter = make([]EntityFilter, len(q.entityFilter))
+		copy(x.entityFilter, q.entityFilter)
+	}
 	if len(q.order) > 0 {
 		x.order = make([]order, len(q.order))
 		copy(x.order, q.order)
@@ -214,6 +233,53 @@ func (q *Query) Filter(filterStr string, value interface{}) *Query {
 	return q
 }
 
+// FilterField returns a derivative query with a field-based filter.
+// The operator must be one of "=", "!=", "<", "<=", ">", ">=", "in" or
+// "not-in". For "in" and "not-in", value must be a slice holding the values
+// to match or exclude. Multiple filters are AND'ed together.
+//
+// Filters with the "!=", "in" and "not-in" operators are not evaluated by the
+// service; see FilterEntity.
+func (q *Query) FilterField(fieldName, operator string, value interface{}) *Query {
+	q = q.clone()
+	f, err := PropertyFilter{FieldName: fieldName, Operator: operator, Value: value}.toFilter()
+	if err != nil {
+		q.err = err
+		return q
+	}
+	q.filter = append(q.filter, f)
+	return q
+}
+
+// FilterEntity returns a derivative query with a filter, which may combine
+// several filters with AndFilter and OrFilter. Multiple filters are AND'ed
+// together.
+//
+// The service only supports conjunctions of "=", "<", "<=", ">" and ">="
+// filters. A query with other filters is rewritten as a disjunction of at
+// most 30 such conjunctions: "in" becomes one equality per value, and "!="
+// and "not-in" become the ranges between the excluded values. Each
+// conjunction is run as a separate query, and the results are merged in the
+// query's order and de-duplicated by the client.
+//
+// Such a query may have inequality filters, including those derived from "!="
+// and "not-in", on at most one property. If it has no sort order, its results
+// are ordered by that property. Its offset and limit are applied to the merged
+// results, so each sub-query may fetch up to offset+limit results. Its
+// cursors record a position in every sub-query, so they can only be used with
+// the same query. An entity with several values for a filtered property may be
+// returned more than once if results are fetched in separate runs using
+// cursors.
+func (q *Query) FilterEntity(ef EntityFilter) *Query {
+	q = q.clone()
+	if ef == nil {
+		q.err = errors.New("datastore: nil query filter")
+		return q
+	}
+	q.entityFilter = append(q.entityFilter, ef)
+	return q
+}
+
 // Order returns a derivative query with a field-based sort order. Orders are
 // applied in the order they are added. The default order is ascending; to sort
 // in descending order prefix the fieldName with a minus sign (-).
@@ -463,6 +529,20 @@ func (c *Client) Count(ctx context.Context, q *Query) (n int, err error) {
 	// Create an iterator and use it to walk through the batches of results
 	// directly.
 	it := c.Run(ctx, newQ)
+	if it.multi != nil {
+		// Merged results must be counted one by one, since the same entity may
+		// be returned by several sub-queries.
+		for {
+			_, _, err := it.next()
+			if err == iterator.Done {
+				return n, nil
+			}
+			if err != nil {
+				return 0, err
+			}
+			n++
+		}
+	}
 	for {
 		err := it.nextBatch()
 		if err == iterator.Done {
@@ -565,9 +645,25 @@ func (c *Client) GetAll(ctx context.Context, q *Query, dst interface{}) (keys []
 
 // Run runs the given query in the given context.
 func (c *Client) Run(ctx context.Context, q *Query) *Iterator {
+	q = c.scopeQuery(q)
 	if q.err != nil {
 		return &Iterator{err: q.err}
 	}
+	subs, err := q.split()
+	if err != nil {
+		return &Iterator{err: err}
+	}
+	switch len(subs) {
+	case 0:
+		// The filter cannot match anything, e.g. "in" with no values.
+		return &Iterator{ctx: ctx, client: c, err: iterator.Done}
+	case 1:
+		q = subs[0]
+	default:
+		t := &Iterator{ctx: ctx, client: c, keysOnly: q.keysOnly}
+		t.multi, t.err = newMultiIterator(ctx, c, q, subs)
+		return t
+	}
 	t := &Iterator{
 		ctx:          ctx,
 		client:       c,
@@ -622,6 +718,11 @@ type Iterator struct {
 	pageCursor []byte
 	// entityCursor is the compiled cursor of the next result.
 	entityCursor []byte
+
+	// multi merges the results of sub-queries, for queries with filters
+	// that the service cannot evaluate. If it is set, the fields above
+	// related to batches and cursors are unused.
+	multi *multiIterator
 }
 
 // Next returns the key of the next result. When there are no more results,
@@ -642,6 +743,13 @@ func (t *Iterator) Next(dst interface{}) (k *Key, err error) {
 }
 
 func (t *Iterator) next() (*Key, *pb.Entity, error) {
+	if t.multi != nil && t.err == nil {
+		k, e, err := t.multi.next()
+		if err != nil {
+			t.err = err
+		}
+		return k, e, err
+	}
 	// Fetch additional batches while there are no more results.
 	for t.err == nil && len(t.results) == 0 {
 		t.err = t.nextBatch()
@@ -741,6 +849,13 @@ func (t *Iterator) Cursor() (c Cursor, err error) {
 	t.ctx = trace.StartSpan(t.ctx, "cloud.google.com/go/datastore.Query.Cursor")
 	defer func() { trace.EndSpan(t.ctx, err) }()
 
+	if t.multi != nil {
+		if t.err != nil && t.err != iterator.Done {
+			return Cursor{}, t.err
+		}
+		return t.multi.cursor()
+	}
+
 	// If there is still an offset, we need to the skip those results first.
 	for t.err == nil && t.offset > 0 {
 		t.err = t.nextBatch()
@@ -297,6 +297,10 @@ func (t *Transaction) PutMulti(keys []*Key, src interface{}) (ret []*PendingKey,
 	if t.id == nil {
 		return nil, errExpiredTransaction
 	}
+	keys, err = t.client.scopeKeys(keys)
+	if err != nil {
+		return nil, err
+	}
 	mutations, err := putMutations(keys, src)
 	if err != nil {
 		return nil, err
@@ -337,6 +341,10 @@ func (t *Transaction) DeleteMulti(keys []*Key) (err error) {
 	if t.id == nil {
 		return errExpiredTransaction
 	}
+	keys, err = t.client.scopeKeys(keys)
+	if err != nil {
+		return err
+	}
 	mutations, err := deleteMutations(keys)
 	if err != nil {
 		return err
@@ -357,6 +365,7 @@ func (t *Transaction) Mutate(muts ...*Mutation) ([]*PendingKey, error) {
 	if t.id == nil {
 		return nil, errExpiredTransaction
 	}
+	muts = t.client.scopeMutations(muts)
 	pmuts, err := mutationProtos(muts)
 	if err != nil {
 		return nil, err
@@ -0,0 +1,347 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package firestore
+
+import (
+	"context"
+	"errors"
+	"math"
+	"sync"
+	"time"
+
+	gax "github.com/googleapis/gax-go/v2"
+	pb "google.golang.org/genproto/googleapis/firestore/v1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// The 500/50/5 rule: start at 500 operations per second, and increase
+	// the rate by 50% every 5 minutes.
+	bulkWriterInitialOpsPerSecond = 500
+	bulkWriterMaxOpsPerSecond     = 10000
+	bulkWriterRampMultiplier      = 1.5
+	bulkWriterRampInterval        = 5 * time.Minute
+
+	// maxBulkWriterConcurrency is the maximum number of commits in flight.
+	maxBulkWriterConcurrency = 100
+
+	// maxBulkWriterAttempts is the number of times a write is tried before
+	// its error is reported.
+	maxBulkWriterAttempts = 10
+)
+
+// The backoff between attempts of a failed write.
+// Variable for testing.
+var bulkWriterBackoff = gax.Backoff{
+	Initial:    1 * time.Second,
+	Max:        60 * time.Second,
+	Multiplier: 1.5,
+}
+
+var errBulkWriterEnded = errors.New("firestore: BulkWriter has ended")
+
+// A BulkWriter applies a large number of independent writes, as fast as the
+// database allows. Unlike a WriteBatch, a BulkWriter accepts any number of
+// writes, and they are not atomic: each write is committed on its own, so
+// the failure of one does not affect the others.
+//
+// A BulkWriter limits the rate of its writes following the 500/50/5 rule:
+// it starts at 500 writes per second, and increases the rate by 50% every 5
+// minutes. Writes that fail with a transient error, such as contention or
+// the service being overloaded, are retried with exponential backoff.
+//
+// Writes are not necessarily applied in the order they are added. Do not
+// write the same document more than once between calls to Flush.
+//
+// A BulkWriter is safe for use by multiple goroutines. Call End when done
+// with it.
+type BulkWriter struct {
+	c       *Client
+	ctx     context.Context
+	cancel  func()
+	limiter *rampLimiter
+	sem     chan struct{} // limits the number of commits in flight
+
+	mu      sync.Mutex
+	ended   bool
+	stopped bool             // the sending goroutine has exited
+	queue   []*BulkWriterJob // jobs waiting to be sent
+	ready   chan struct{}    // signaled when the queue becomes non-empty
+	pending map[*BulkWriterJob]bool
+	done    chan struct{} // closed when the sending goroutine exits
+}
+
+// A BulkWriterJob is the pending result of a write added to a BulkWriter.
+type BulkWriterJob struct {
+	writes   []*pb.Write
+	attempts int
+	backoff  gax.Backoff
+
+	done   chan struct{}
+	result *WriteResult
+	err    error
+}
+
+// Results blocks until the write has been applied or has failed, and returns
+// its result.
+func (j *BulkWriterJob) Results() (*WriteResult, error) {
+	<-j.done
+	return j.result, j.err
+}
+
+// BulkWriter returns a BulkWriter that sends its writes using ctx. The
+// writes of a BulkWriter whose context is done fail with the context's error.
+func (c *Client) BulkWriter(ctx context.Context) *BulkWriter {
+	ctx, cancel := context.WithCancel(ctx)
+	bw := &BulkWriter{
+		c:       c,
+		ctx:     ctx,
+		cancel:  cancel,
+		limiter: newRampLimiter(time.Now),
+		sem:     make(chan struct{}, maxBulkWriterConcurrency),
+		ready:   make(chan struct{}, 1),
+		pending: map[*BulkWriterJob]bool{},
+		done:    make(chan struct{}),
+	}
+	go bw.send()
+	return bw
+}
+
+// Create adds a write that creates a document.
+// See DocumentRef.Create for details.
+func (bw *BulkWriter) Create(dr *DocumentRef, data interface{}) (*BulkWriterJob, error) {
+	return bw.add(dr.newCreateWrites(data))
+}
+
+// Set adds a write that sets the contents of a document.
+// See DocumentRef.Set for details.
+func (bw *BulkWriter) Set(dr *DocumentRef, data interface{}, opts ...SetOption) (*BulkWriterJob, error) {
+	return bw.add(dr.newSetWrites(data, opts))
+}
+
+// Update adds a write that updates a document.
+// See DocumentRef.Update for details.
+func (bw *BulkWriter) Update(dr *DocumentRef, data []Update, opts ...Precondition) (*BulkWriterJob, error) {
+	return bw.add(dr.newUpdatePathWrites(data, opts))
+}
+
+// Delete adds a write that deletes a document.
+// See DocumentRef.Delete for details.
+func (bw *BulkWriter) Delete(dr *DocumentRef, opts ...Precondition) (*BulkWriterJob, error) {
+	return bw.add(dr.newDeleteWrites(opts))
+}
+
+func (bw *BulkWriter) add(ws []*pb.Write, err error) (*BulkWriterJob, error) {
+	if err != nil {
+		return nil, err
+	}
+	bw.mu.Lock()
+	defer bw.mu.Unlock()
+	if bw.ended {
+		return nil, errBulkWriterEnded
+	}
+	if bw.stopped {
+		return nil, bw.ctx.Err()
+	}
+	j := &BulkWriterJob{writes: ws, backoff: bulkWriterBackoff, done: make(chan struct{})}
+	bw.pending[j] = true
+	bw.enqueue(j)
+	return j, nil
+}
+
+// enqueue adds j to the queue of jobs to send.
+// Must hold the lock.
+func (bw *BulkWriter) enqueue(j *BulkWriterJob) {
+	bw.queue = append(bw.queue, j)
+	select {
+	case bw.ready <- struct{}{}:
+	default:
+	}
+}
+
+// Flush blocks until all the writes added before the call have been applied
+// or have failed.
+func (bw *BulkWriter) Flush() {
+	bw.mu.Lock()
+	jobs := make([]*BulkWriterJob, 0, len(bw.pending))
+	for j := range bw.pending {
+		jobs = append(jobs, j)
+	}
+	bw.mu.Unlock()
+	for _, j := range jobs {
+		<-j.done
+	}
+}
+
+// End flushes the BulkWriter and releases its resources. Writes cannot be
+// added after End has been called.
+func (bw *BulkWriter) End() {
+	bw.mu.Lock()
+	bw.ended = true
+	bw.mu.Unlock()
+	bw.Flush()
+	bw.cancel()
+	<-bw.done
+}
+
+// send sends queued jobs, in order, as fast as the rate limit allows.
+func (bw *BulkWriter) send() {
+	defer close(bw.done)
+	for {
+		bw.mu.Lock()
+		var j *BulkWriterJob
+		if len(bw.queue) > 0 {
+			j = bw.queue[0]
+			bw.queue[0] = nil
+			bw.queue = bw.queue[1:]
+		}
+		bw.mu.Unlock()
+		if j == nil {
+			select {
+			case <-bw.ready:
+				continue
+			case <-bw.ctx.Done():
+				bw.failQueued(bw.ctx.Err())
+				return
+			}
+		}
+		if err := bw.limiter.wait(bw.ctx); err != nil {
+			bw.finish(j, nil, err)
+			continue
+		}
+		select {
+		case bw.sem <- struct{}{}:
+		case <-bw.ctx.Done():
+			bw.finish(j, nil, bw.ctx.Err())
+			continue
+		}
+		go func() {
+			defer func() { <-bw.sem }()
+			bw.commit(j)
+		}()
+	}
+}
+
+// commit tries j once, and either finishes it or schedules a retry.
+func (bw *BulkWriter) commit(j *BulkWriterJob) {
+	j.attempts++
+	wr, err := bw.c.commit1(bw.ctx, j.writes)
+	if err == nil || j.attempts >= maxBulkWriterAttempts || !isRetryableBulkWriterError(err) {
+		bw.finish(j, wr, err)
+		return
+	}
+	delay := j.backoff.Pause()
+	if status.Code(err) == codes.ResourceExhausted {
+		delay = j.backoff.Max
+	}
+	go func() {
+		if err := sleep(bw.ctx, delay); err != nil {
+			bw.finish(j, nil, err)
+			return
+		}
+		bw.mu.Lock()
+		stopped := bw.stopped
+		if !stopped {
+			bw.enqueue(j)
+		}
+		bw.mu.Unlock()
+		if stopped {
+			bw.finish(j, nil, bw.ctx.Err())
+		}
+	}()
+}
+
+func (bw *BulkWriter) finish(j *BulkWriterJob, wr *WriteResult, err error) {
+	j.result, j.err = wr, err
+	close(j.done)
+	bw.mu.Lock()
+	defer bw.mu.Unlock()
+	delete(bw.pending, j)
+}
+
+// failQueued stops the BulkWriter from accepting jobs, and fails all the
+// jobs waiting to be sent.
+func (bw *BulkWriter) failQueued(err error) {
+	bw.mu.Lock()
+	queue := bw.queue
+	bw.queue = nil
+	bw.stopped = true
+	bw.mu.Unlock()
+	for _, j := range queue {
+		bw.finish(j, nil, err)
+	}
+}
+
+func isRetryableBulkWriterError(err error) bool {
+	switch status.Code(err) {
+	case codes.Aborted, codes.Unavailable, codes.ResourceExhausted, codes.Internal:
+		return true
+	}
+	return false
+}
+
+// rampLimiter is a token bucket whose rate starts at
+// bulkWriterInitialOpsPerSecond, and increases by bulkWriterRampMultiplier
+// every bulkWriterRampInterval, up to bulkWriterMaxOpsPerSecond. The bucket
+// holds at most one second's worth of tokens.
+type rampLimiter struct {
+	now func() time.Time
+
+	mu     sync.Mutex
+	start  time.Time
+	last   time.Time
+	tokens float64
+}
+
+func newRampLimiter(now func() time.Time) *rampLimiter {
+	t := now()
+	return &rampLimiter{now: now, start: t, last: t, tokens: bulkWriterInitialOpsPerSecond}
+}
+
+// rate returns the number of operations per second allowed at t.
+func (l *rampLimiter) rate(t time.Time) float64 {
+	steps := float64(t.Sub(l.start) / bulkWriterRampInterval)
+	return math.Min(bulkWriterInitialOpsPerSecond*math.Pow(bulkWriterRampMultiplier, steps), bulkWriterMaxOpsPerSecond)
+}
+
+// reserve takes a token if one is available, and otherwise returns how long
+// to wait for one.
+func (l *rampLimiter) reserve() (time.Duration, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	t := l.now()
+	rate := l.rate(t)
+	l.tokens = math.Min(l.tokens+t.Sub(l.last).Seconds()*rate, rate)
+	l.last = t
+	if l.tokens >= 1 {
+		l.tokens--
+		return 0, true
+	}
+	return time.Duration((1 - l.tokens) / rate * float64(time.Second)), false
+}
+
+// wait blocks until a token is available and takes it.
+func (l *rampLimiter) wait(ctx context.Context) error {
+	for {
+		d, ok := l.reserve()
+		if ok {
+			return nil
+		}
+		if err := sleep(ctx, d); err != nil {
+			return err
+		}
+	}
+}
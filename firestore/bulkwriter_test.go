@@ -0,0 +1,268 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package firestore
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/firestore/fstest"
+	"cloud.google.com/go/internal/testutil"
+	"google.golang.org/api/option"
+	pb "google.golang.org/genproto/googleapis/firestore/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// flakyServer fails the first failures commits of each document with code.
+type flakyServer struct {
+	*fstest.GServer
+	code     codes.Code
+	failures int
+
+	mu       sync.Mutex
+	attempts map[string]int
+}
+
+func (s *flakyServer) Commit(ctx context.Context, req *pb.CommitRequest) (*pb.CommitResponse, error) {
+	s.mu.Lock()
+	name := req.Writes[0].GetUpdate().GetName() + req.Writes[0].GetDelete()
+	s.attempts[name]++
+	n := s.attempts[name]
+	s.mu.Unlock()
+	if n <= s.failures {
+		return nil, status.Errorf(s.code, "attempt %d", n)
+	}
+	return s.GServer.Commit(ctx, req)
+}
+
+// newFakeClient returns a client of an fstest server. If flaky is non-nil,
+// it is served in front of the fake.
+func newFakeClient(t *testing.T, flaky *flakyServer) (*Client, func()) {
+	fake := fstest.NewServer()
+	addr := fake.Addr
+	var srv *testutil.Server
+	if flaky != nil {
+		var err error
+		srv, err = testutil.NewServer()
+		if err != nil {
+			t.Fatal(err)
+		}
+		flaky.GServer = &fake.GServer
+		flaky.attempts = map[string]int{}
+		pb.RegisterFirestoreServer(srv.Gsrv, flaky)
+		srv.Start()
+		addr = srv.Addr
+	}
+	conn, err := grpc.Dial(addr, grpc.WithInsecure())
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := NewClient(context.Background(), "P", option.WithGRPCConn(conn))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client, func() {
+		client.Close()
+		conn.Close()
+		if srv != nil {
+			srv.Close()
+		}
+		fake.Close()
+	}
+}
+
+func TestBulkWriter(t *testing.T) {
+	ctx := context.Background()
+	client, cleanup := newFakeClient(t, nil)
+	defer cleanup()
+
+	if _, err := client.Doc("C/existing").Set(ctx, map[string]interface{}{"n": 0}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Doc("C/gone").Set(ctx, map[string]interface{}{}); err != nil {
+		t.Fatal(err)
+	}
+
+	bw := client.BulkWriter(ctx)
+	// More writes than the initial rate allows in a second.
+	const n = 600
+	var jobs []*BulkWriterJob
+	for i := 0; i < n; i++ {
+		j, err := bw.Set(client.Doc(fmt.Sprintf("C/d%d", i)), map[string]interface{}{"i": i})
+		if err != nil {
+			t.Fatal(err)
+		}
+		jobs = append(jobs, j)
+	}
+	upd, err := bw.Update(client.Doc("C/existing"), []Update{{Path: "n", Value: Increment(1)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	del, err := bw.Delete(client.Doc("C/gone"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A write that fails does not affect the others.
+	dup, err := bw.Create(client.Doc("C/existing"), map[string]interface{}{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bw.Set(client.Doc("C/bad"), 7); err == nil {
+		t.Error("got nil, want error for invalid data")
+	}
+	bw.Flush()
+	for i, j := range jobs {
+		wr, err := j.Results()
+		if err != nil {
+			t.Fatalf("job %d: %v", i, err)
+		}
+		if wr.UpdateTime.IsZero() {
+			t.Fatalf("job %d: zero update time", i)
+		}
+	}
+	if _, err := upd.Results(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := del.Results(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dup.Results(); status.Code(err) != codes.AlreadyExists {
+		t.Errorf("got %v, want AlreadyExists", err)
+	}
+
+	bw.End()
+	if _, err := bw.Delete(client.Doc("C/d0")); err != errBulkWriterEnded {
+		t.Errorf("after End: got %v, want %v", err, errBulkWriterEnded)
+	}
+
+	docs, err := client.Collection("C").Documents(ctx).GetAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(docs), n+1; got != want {
+		t.Errorf("got %d documents, want %d", got, want)
+	}
+	snap, err := client.Doc("C/existing").Get(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := snap.Data()["n"]; got != int64(1) {
+		t.Errorf("got %v, want 1", got)
+	}
+}
+
+func TestBulkWriterRetry(t *testing.T) {
+	saved := bulkWriterBackoff
+	defer func() { bulkWriterBackoff = saved }()
+	bulkWriterBackoff.Initial = time.Millisecond
+	bulkWriterBackoff.Max = 10 * time.Millisecond
+
+	ctx := context.Background()
+	for _, test := range []struct {
+		code     codes.Code
+		failures int
+		wantCode codes.Code
+	}{
+		{codes.Unavailable, 2, codes.OK},
+		{codes.Aborted, maxBulkWriterAttempts - 1, codes.OK},
+		{codes.Unavailable, maxBulkWriterAttempts, codes.Unavailable},
+		{codes.PermissionDenied, 1, codes.PermissionDenied},
+	} {
+		flaky := &flakyServer{code: test.code, failures: test.failures}
+		client, cleanup := newFakeClient(t, flaky)
+		bw := client.BulkWriter(ctx)
+		var jobs []*BulkWriterJob
+		for i := 0; i < 10; i++ {
+			j, err := bw.Create(client.Doc(fmt.Sprintf("C/d%d", i)), map[string]interface{}{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			jobs = append(jobs, j)
+		}
+		bw.End()
+		for _, j := range jobs {
+			if _, err := j.Results(); status.Code(err) != test.wantCode {
+				t.Errorf("%v x %d: got %v, want code %v", test.code, test.failures, err, test.wantCode)
+			}
+		}
+		cleanup()
+	}
+}
+
+func TestBulkWriterCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	client, cleanup := newFakeClient(t, nil)
+	defer cleanup()
+
+	bw := client.BulkWriter(ctx)
+	cancel()
+	j, err := bw.Create(client.Doc("C/a"), map[string]interface{}{})
+	if err == nil {
+		if _, err = j.Results(); err == nil {
+			t.Error("got nil, want error")
+		}
+	}
+	bw.End()
+}
+
+func TestRampLimiter(t *testing.T) {
+	now := time.Unix(0, 0)
+	l := newRampLimiter(func() time.Time { return now })
+	for i := 0; i < bulkWriterInitialOpsPerSecond; i++ {
+		if _, ok := l.reserve(); !ok {
+			t.Fatalf("reserve %d failed", i)
+		}
+	}
+	d, ok := l.reserve()
+	if ok {
+		t.Fatal("reserve succeeded with an empty bucket")
+	}
+	if want := time.Second / bulkWriterInitialOpsPerSecond; d != want {
+		t.Errorf("got wait %v, want %v", d, want)
+	}
+
+	for _, test := range []struct {
+		elapsed time.Duration
+		want    float64
+	}{
+		{0, 500},
+		{bulkWriterRampInterval - time.Second, 500},
+		{bulkWriterRampInterval, 750},
+		{2 * bulkWriterRampInterval, 1125},
+		{time.Hour, bulkWriterMaxOpsPerSecond},
+	} {
+		if got := l.rate(now.Add(test.elapsed)); got != test.want {
+			t.Errorf("rate after %v: got %v, want %v", test.elapsed, got, test.want)
+		}
+	}
+
+	// The bucket refills at the ramped rate, but holds at most a second's
+	// worth of tokens.
+	now = now.Add(bulkWriterRampInterval)
+	n := 0
+	for ; n < 1000; n++ {
+		if _, ok := l.reserve(); !ok {
+			break
+		}
+	}
+	if n != 750 {
+		t.Errorf("got %d tokens, want 750", n)
+	}
+}
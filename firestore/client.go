@@ -56,6 +56,10 @@ type Client struct {
 	c          *vkit.Client
 	projectID  string
 	databaseID string // A client is tied to a single database.
+
+	// readSettings are the default settings of reads outside
+	// transactions. May be nil.
+	readSettings *readSettings
 }
 
 // NewClient creates a new Firestore client that uses the given project.
@@ -202,6 +206,10 @@ func (c *Client) getAll(ctx context.Context, docRefs []*DocumentRef, tid []byte)
 	}
 	if tid != nil {
 		req.ConsistencySelector = &pb.BatchGetDocumentsRequest_Transaction{tid}
+	} else if rt, err := c.readSettings.readTimeProto(); err != nil {
+		return nil, err
+	} else if rt != nil {
+		req.ConsistencySelector = &pb.BatchGetDocumentsRequest_ReadTime{ReadTime: rt}
 	}
 	streamClient, err := c.c.BatchGetDocuments(withResourceHeader(ctx, req.Database), req)
 	if err != nil {
@@ -267,6 +275,19 @@ func (c *Client) Collections(ctx context.Context) *CollectionIterator {
 	return it
 }
 
+// WithReadOptions returns a derivative client whose reads outside
+// transactions use the given options, in addition to those of c. They apply
+// to GetAll, DocumentRef.Get and Query.Documents, for documents and queries
+// created from the returned client, but not to Snapshots.
+//
+// The returned client shares its connection with c. Closing either of them
+// closes both.
+func (c *Client) WithReadOptions(opts ...ReadOption) *Client {
+	nc := *c
+	nc.readSettings = newReadSettings(c.readSettings, opts)
+	return &nc
+}
+
 // Batch returns a WriteBatch.
 func (c *Client) Batch() *WriteBatch {
 	return &WriteBatch{c: c}
@@ -14,6 +14,35 @@
 
 package firestore
 
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"time"
+
+	"cloud.google.com/go/internal/version"
+	gax "github.com/googleapis/gax-go/v2"
+	pb "google.golang.org/genproto/googleapis/firestore/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+)
+
+// partitionQueryRetry retries the PartitionQuery RPC on the codes, and with
+// the backoff, of the other reads of the apiv1 client.
+var partitionQueryRetry = gax.WithRetry(func() gax.Retryer {
+	return gax.OnCodes([]codes.Code{
+		codes.Unavailable,
+		codes.Internal,
+		codes.DeadlineExceeded,
+	}, gax.Backoff{
+		Initial:    100 * time.Millisecond,
+		Max:        60 * time.Second,
+		Multiplier: 1.3,
+	})
+})
+
 // A CollectionGroupRef is a reference to a group of collections sharing the
 // same ID.
 type CollectionGroupRef struct {
@@ -36,3 +65,98 @@ func newCollectionGroupRef(c *Client, dbPath, collectionID string) *CollectionGr
 		},
 	}
 }
+
+// GetPartitionedQueries returns a slice of Query objects, each containing a
+// partition of a collection group. partitionCount must be a positive value
+// and the number of returned partitions may be less than the requested
+// number if providing the desired number would result in partitions with
+// very few documents.
+//
+// The queries are ordered by DocumentID, and together they return all the
+// documents of the collection group. They can be run in parallel, in this
+// process or, after Query.Serialize, in others.
+//
+// The filters, orders and cursors of cgr.Query are not used.
+func (cgr CollectionGroupRef) GetPartitionedQueries(ctx context.Context, partitionCount int) ([]Query, error) {
+	if partitionCount <= 0 {
+		return nil, errors.New("firestore: a positive partitionCount is required")
+	}
+	q := newCollectionGroupRef(cgr.c, cgr.c.path(), cgr.collectionID).OrderBy(DocumentID, Asc)
+	if partitionCount == 1 {
+		return []Query{q}, nil
+	}
+	sq, err := q.toProto()
+	if err != nil {
+		return nil, err
+	}
+	req := &pb.PartitionQueryRequest{
+		Parent:         q.parentPath,
+		QueryType:      &pb.PartitionQueryRequest_StructuredQuery{StructuredQuery: sq},
+		PartitionCount: int64(partitionCount - 1), // the number of split points
+	}
+	cursors, err := cgr.c.partitionQuery(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	var queries []Query
+	var start *DocumentRef
+	for _, cursor := range cursors {
+		vals, err := cursorFromProto(cursor, cgr.c)
+		if err != nil {
+			return nil, err
+		}
+		if len(vals) != 1 {
+			return nil, fmt.Errorf("firestore: bad partition cursor %v", cursor)
+		}
+		end, ok := vals[0].(*DocumentRef)
+		if !ok {
+			return nil, fmt.Errorf("firestore: bad partition cursor %v", cursor)
+		}
+		queries = append(queries, partition(q, start, end))
+		start = end
+	}
+	return append(queries, partition(q, start, nil)), nil
+}
+
+// partitionQuery returns the cursors of all the pages of the response to req.
+// The apiv1 client does not have the PartitionQuery RPC, so it is called on
+// the connection of the client, with the headers the apiv1 client sends.
+func (c *Client) partitionQuery(ctx context.Context, req *pb.PartitionQueryRequest) ([]*pb.Cursor, error) {
+	ctx = withResourceHeader(ctx, c.path())
+	md, _ := metadata.FromOutgoingContext(ctx)
+	md = metadata.Join(md, metadata.Pairs(
+		"x-goog-api-client", gax.XGoogHeader("gl-go", version.Go(), "gccl", version.Repo, "gax", gax.Version, "grpc", grpc.Version),
+		"x-goog-request-params", "parent="+url.QueryEscape(req.Parent),
+	))
+	ctx = metadata.NewOutgoingContext(ctx, md)
+	client := pb.NewFirestoreClient(c.c.Connection())
+	var cursors []*pb.Cursor
+	for {
+		var resp *pb.PartitionQueryResponse
+		err := gax.Invoke(ctx, func(ctx context.Context, settings gax.CallSettings) error {
+			var err error
+			resp, err = client.PartitionQuery(ctx, req, settings.GRPC...)
+			return err
+		}, partitionQueryRetry)
+		if err != nil {
+			return nil, err
+		}
+		cursors = append(cursors, resp.Partitions...)
+		if resp.NextPageToken == "" {
+			return cursors, nil
+		}
+		req.PageToken = resp.NextPageToken
+	}
+}
+
+// partition returns the part of q from start up to end. A nil start or end
+// leaves that side of the query open.
+func partition(q Query, start, end *DocumentRef) Query {
+	if start != nil {
+		q = q.StartAt(start)
+	}
+	if end != nil {
+		q = q.EndBefore(end)
+	}
+	return q
+}
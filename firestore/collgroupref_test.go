@@ -0,0 +1,89 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package firestore
+
+import (
+	"context"
+	"fmt"
+	"testing"
+)
+
+func TestGetPartitionedQueries(t *testing.T) {
+	ctx := context.Background()
+	client, cleanup := newFakeClient(t, nil)
+	defer cleanup()
+
+	var want []string
+	for i := 0; i < 10; i++ {
+		p := fmt.Sprintf("A/a%d/G/g%d", i%3, i)
+		if _, err := client.Doc(p).Set(ctx, map[string]interface{}{"i": i}); err != nil {
+			t.Fatal(err)
+		}
+		want = append(want, p)
+	}
+	// Not in the group.
+	if _, err := client.Doc("A/a0/H/h").Set(ctx, map[string]interface{}{}); err != nil {
+		t.Fatal(err)
+	}
+
+	cgr := client.CollectionGroup("G")
+	for _, count := range []int{1, 3, 20} {
+		queries, err := cgr.GetPartitionedQueries(ctx, count)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(queries) > count || count > 1 && len(queries) < 2 {
+			t.Errorf("count %d: got %d partitions", count, len(queries))
+		}
+		// Run each partition as another process would.
+		got := map[string]bool{}
+		for _, q := range queries {
+			b, err := q.Serialize()
+			if err != nil {
+				t.Fatal(err)
+			}
+			q, err = client.Collection("X").Deserialize(b)
+			if err != nil {
+				t.Fatal(err)
+			}
+			docs, err := q.Documents(ctx).GetAll()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(docs) == 0 {
+				t.Errorf("count %d: empty partition", count)
+			}
+			for _, d := range docs {
+				p := d.Ref.shortPath
+				if got[p] {
+					t.Errorf("count %d: %s is in two partitions", count, p)
+				}
+				got[p] = true
+			}
+		}
+		if len(got) != len(want) {
+			t.Errorf("count %d: got %d documents, want %d", count, len(got), len(want))
+		}
+		for _, p := range want {
+			if !got[p] {
+				t.Errorf("count %d: missing %s", count, p)
+			}
+		}
+	}
+
+	if _, err := cgr.GetPartitionedQueries(ctx, 0); err == nil {
+		t.Error("got nil, want error for partition count 0")
+	}
+}
@@ -115,6 +115,9 @@ func (d *DocumentRef) Get(ctx context.Context) (_ *DocumentSnapshot, err error)
 // Pointers and interface{} are also permitted, and their elements processed
 // recursively.
 //
+// A value whose type implements ValueMarshaler, or an addressable value whose
+// pointer type does, converts itself. Its struct fields, if any, are ignored.
+//
 // Struct fields can have tags like those used by the encoding/json package. Tags
 // begin with "firestore:" and are followed by "-", meaning "ignore this field," or
 // an alternative name for the field. Following the name, these comma-separated
@@ -122,7 +125,11 @@ func (d *DocumentRef) Get(ctx context.Context) (_ *DocumentSnapshot, err error)
 //
 //   - omitempty: Do not encode this field if it is empty. A value is empty
 //     if it is a zero value, or an array, slice or map of length zero.
-//   - serverTimestamp: The field must be of type time.Time. serverTimestamp
+//   - omitzero: Do not encode this field if it is the zero value of its type,
+//     or if it has an IsZero() bool method that returns true. Unlike omitempty,
+//     omitzero encodes empty but non-nil slices and maps, and omits zero structs.
+//   - serverTimestamp: The field must be of type time.Time, *time.Time or
+//     *ts.Timestamp; a nil pointer counts as the zero value. serverTimestamp
 //     is a sentinel token that tells Firestore to substitute the server time
 //     into that field. When writing, if the field has the zero value, the
 //     server will populate the stored document with the time that the request
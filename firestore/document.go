@@ -101,6 +101,9 @@ func (d *DocumentSnapshot) Data() map[string]interface{} {
 //     recursively.
 //   - References are converted to *firestore.DocumentRefs.
 //
+// A value whose type implements ValueUnmarshaler, or whose pointer type does,
+// populates itself instead.
+//
 // Field names given by struct field tags are observed, as described in
 // DocumentRef.Create.
 //
@@ -198,6 +201,12 @@ func toProtoDocument(x interface{}) (*pb.Document, []*pb.DocumentTransform_Field
 }
 
 func extractTransforms(v reflect.Value, prefix FieldPath) ([]*pb.DocumentTransform_FieldTransform, error) {
+	if v.IsValid() {
+		// Values that convert themselves have no transforms.
+		if _, ok := valueMarshaler(v); ok {
+			return nil, nil
+		}
+	}
 	switch v.Kind() {
 	case reflect.Map:
 		return extractTransformsFromMap(v, prefix)
@@ -272,8 +281,10 @@ func extractTransformsFromStruct(v reflect.Value, prefix FieldPath) ([]*pb.Docum
 				isZero = fv.Interface().(time.Time).IsZero()
 			case reflect.PtrTo(typeOfGoTime):
 				isZero = fv.IsNil() || fv.Elem().Interface().(time.Time).IsZero()
+			case typeOfProtoTimestamp:
+				isZero = fv.IsNil()
 			default:
-				return nil, fmt.Errorf("firestore: field %s of struct %s with serverTimestamp tag must be of type time.Time or *time.Time",
+				return nil, fmt.Errorf("firestore: field %s of struct %s with serverTimestamp tag must be of type time.Time, *time.Time or *timestamp.Timestamp",
 					f.Name, v.Type())
 			}
 			if isZero {
@@ -117,6 +117,31 @@ func ExampleWriteBatch_Commit() {
 	fmt.Println(writeResults)
 }
 
+func ExampleBulkWriter() {
+	ctx := context.Background()
+	client, err := firestore.NewClient(ctx, "project-id")
+	if err != nil {
+		// TODO: Handle error.
+	}
+	defer client.Close()
+
+	bw := client.BulkWriter(ctx)
+	var jobs []*firestore.BulkWriterJob
+	for i := 0; i < 10000; i++ {
+		job, err := bw.Set(client.Doc(fmt.Sprintf("Items/item%d", i)), map[string]interface{}{"n": i})
+		if err != nil {
+			// TODO: Handle error.
+		}
+		jobs = append(jobs, job)
+	}
+	bw.End()
+	for _, job := range jobs {
+		if _, err := job.Results(); err != nil {
+			// TODO: Handle error.
+		}
+	}
+}
+
 func ExampleCollectionRef_Add() {
 	ctx := context.Background()
 	client, err := firestore.NewClient(ctx, "project-id")
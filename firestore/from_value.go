@@ -40,6 +40,11 @@ func setReflectFromProtoValue(v reflect.Value, vproto *pb.Value, c *Client) erro
 	}
 
 	val := vproto.ValueType
+	if _, ok := val.(*pb.Value_NullValue); !ok || v.Kind() != reflect.Ptr {
+		if u, ok := valueUnmarshaler(v); ok {
+			return u.UnmarshalFirestoreValue(vproto)
+		}
+	}
 	// A Null value sets anything nullable to nil, and has no effect
 	// on anything else.
 	if _, ok := val.(*pb.Value_NullValue); ok {
@@ -225,7 +230,6 @@ func setReflectFromProtoValue(v reflect.Value, vproto *pb.Value, c *Client) erro
 	case reflect.Struct:
 		x, ok := val.(*pb.Value_MapValue)
 		if !ok {
-			fmt.Printf("couldn't coerce val to MapValue (%v -> %v)\n", val, pb.Value_MapValue)
 			return typeErr()
 		}
 		return populateStruct(v, x.MapValue.Fields, c)
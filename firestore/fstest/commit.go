@@ -0,0 +1,287 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fstest
+
+import (
+	"context"
+	"math"
+
+	"cloud.google.com/go/firestore/internal/fieldpath"
+	"github.com/golang/protobuf/proto"
+	tspb "github.com/golang/protobuf/ptypes/timestamp"
+	pb "google.golang.org/genproto/googleapis/firestore/v1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Commit applies writes atomically, optionally committing a transaction.
+func (s *GServer) Commit(_ context.Context, req *pb.CommitRequest) (*pb.CommitResponse, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if req.Transaction != nil {
+		txn, err := s.findTxn(req.Transaction)
+		if err != nil {
+			return nil, err
+		}
+		delete(s.txns, string(req.Transaction))
+		if txn.readOnly && len(req.Writes) > 0 {
+			return nil, status.Error(codes.InvalidArgument, "cannot write in a read-only transaction")
+		}
+		for name, t := range txn.reads {
+			if !s.lastChange(name).Equal(t) {
+				return nil, status.Errorf(codes.Aborted, "transaction contention on %q", name)
+			}
+		}
+	}
+
+	// Stage the writes, so that the commit has no effect if one of them
+	// fails.
+	prev := s.now
+	commitTime := s.nextTime()
+	ct := timestamp(commitTime)
+	staged := map[string]*pb.Document{}
+	var order []string
+	current := func(name string) *pb.Document {
+		if d, ok := staged[name]; ok {
+			return d
+		}
+		return s.docAt(name, prev)
+	}
+	resp := &pb.CommitResponse{CommitTime: ct}
+	for _, w := range req.Writes {
+		name, err := writeDocName(w)
+		if err != nil {
+			return nil, err
+		}
+		doc := current(name)
+		if err := checkPrecondition(w.CurrentDocument, name, doc); err != nil {
+			return nil, err
+		}
+		wr := &pb.WriteResult{UpdateTime: ct}
+		var transforms []*pb.DocumentTransform_FieldTransform
+		switch op := w.Operation.(type) {
+		case *pb.Write_Update:
+			if doc, err = applyUpdate(doc, op.Update, w.UpdateMask, ct); err != nil {
+				return nil, err
+			}
+			transforms = w.UpdateTransforms
+		case *pb.Write_Delete:
+			doc = nil
+		case *pb.Write_Transform:
+			if doc == nil {
+				doc = &pb.Document{Name: name, CreateTime: ct}
+			} else {
+				doc = cloneDoc(doc)
+			}
+			transforms = op.Transform.FieldTransforms
+		default:
+			return nil, status.Errorf(codes.InvalidArgument, "bad write %v", w)
+		}
+		if len(transforms) > 0 {
+			if wr.TransformResults, err = applyTransforms(doc, transforms, ct); err != nil {
+				return nil, err
+			}
+		}
+		if doc != nil {
+			doc.UpdateTime = ct
+		}
+		if _, ok := staged[name]; !ok {
+			order = append(order, name)
+		}
+		staged[name] = doc
+		resp.WriteResults = append(resp.WriteResults, wr)
+	}
+
+	// All the writes are staged, so the commit succeeds.
+	s.now = commitTime
+	if len(order) == 0 {
+		return resp, nil
+	}
+	for _, name := range order {
+		r := s.docs[name]
+		if r == nil {
+			r = &record{}
+			s.docs[name] = r
+		}
+		r.revisions = append(r.revisions, revision{time: commitTime, doc: staged[name]})
+	}
+	close(s.changed)
+	s.changed = make(chan struct{})
+	return resp, nil
+}
+
+// writeDocName returns the name of the document a write changes.
+func writeDocName(w *pb.Write) (string, error) {
+	var name string
+	switch op := w.Operation.(type) {
+	case *pb.Write_Update:
+		name = op.Update.GetName()
+	case *pb.Write_Delete:
+		name = op.Delete
+	case *pb.Write_Transform:
+		name = op.Transform.GetDocument()
+	}
+	if _, _, err := splitDocName(name); err != nil {
+		return "", err
+	}
+	return name, nil
+}
+
+func checkPrecondition(pc *pb.Precondition, name string, doc *pb.Document) error {
+	switch c := pc.GetConditionType().(type) {
+	case *pb.Precondition_Exists:
+		if c.Exists && doc == nil {
+			return status.Errorf(codes.NotFound, "document %q does not exist", name)
+		}
+		if !c.Exists && doc != nil {
+			return status.Errorf(codes.AlreadyExists, "document %q already exists", name)
+		}
+	case *pb.Precondition_UpdateTime:
+		if doc == nil || !proto.Equal(doc.UpdateTime, c.UpdateTime) {
+			return status.Errorf(codes.FailedPrecondition, "document %q was not last updated at %v", name, c.UpdateTime)
+		}
+	}
+	return nil
+}
+
+// applyUpdate returns the result of writing u over doc, which may be nil.
+// Without a mask, u replaces all of doc's fields. With a mask, only the
+// fields in the mask are set, or deleted if they are not in u.
+func applyUpdate(doc, u *pb.Document, mask *pb.DocumentMask, ct *tspb.Timestamp) (*pb.Document, error) {
+	var nd *pb.Document
+	if doc == nil {
+		nd = &pb.Document{Name: u.Name, CreateTime: ct}
+	} else {
+		nd = cloneDoc(doc)
+	}
+	if mask == nil {
+		nd.Fields = cloneDoc(u).Fields
+		return nd, nil
+	}
+	paths, err := parseFieldPaths(mask.FieldPaths)
+	if err != nil {
+		return nil, err
+	}
+	if nd.Fields == nil {
+		nd.Fields = map[string]*pb.Value{}
+	}
+	for _, path := range paths {
+		v := getField(u.Fields, path)
+		if v != nil {
+			v = proto.Clone(v).(*pb.Value)
+		}
+		setField(nd.Fields, path, v)
+	}
+	return nd, nil
+}
+
+// applyTransforms applies transforms to doc in place, and returns their
+// results.
+func applyTransforms(doc *pb.Document, fts []*pb.DocumentTransform_FieldTransform, ct *tspb.Timestamp) ([]*pb.Value, error) {
+	if doc.Fields == nil {
+		doc.Fields = map[string]*pb.Value{}
+	}
+	var results []*pb.Value
+	for _, ft := range fts {
+		path, err := fieldpath.Parse(ft.FieldPath)
+		if err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+		old := getField(doc.Fields, path)
+		var v *pb.Value
+		switch t := ft.TransformType.(type) {
+		case *pb.DocumentTransform_FieldTransform_SetToServerValue:
+			if t.SetToServerValue != pb.DocumentTransform_FieldTransform_REQUEST_TIME {
+				return nil, status.Errorf(codes.InvalidArgument, "bad server value %v", t.SetToServerValue)
+			}
+			v = &pb.Value{ValueType: &pb.Value_TimestampValue{TimestampValue: ct}}
+		case *pb.DocumentTransform_FieldTransform_Increment:
+			if !isNumber(t.Increment) {
+				return nil, status.Error(codes.InvalidArgument, "increment by a non-number")
+			}
+			v = increment(old, t.Increment)
+		case *pb.DocumentTransform_FieldTransform_Maximum:
+			v = extremum(old, t.Maximum, 1)
+		case *pb.DocumentTransform_FieldTransform_Minimum:
+			v = extremum(old, t.Minimum, -1)
+		case *pb.DocumentTransform_FieldTransform_AppendMissingElements:
+			elems := append([]*pb.Value(nil), old.GetArrayValue().GetValues()...)
+			for _, e := range t.AppendMissingElements.GetValues() {
+				if indexOf(elems, e) < 0 {
+					elems = append(elems, e)
+				}
+			}
+			v = &pb.Value{ValueType: &pb.Value_ArrayValue{ArrayValue: &pb.ArrayValue{Values: elems}}}
+		case *pb.DocumentTransform_FieldTransform_RemoveAllFromArray:
+			var elems []*pb.Value
+			for _, e := range old.GetArrayValue().GetValues() {
+				if indexOf(t.RemoveAllFromArray.GetValues(), e) < 0 {
+					elems = append(elems, e)
+				}
+			}
+			v = &pb.Value{ValueType: &pb.Value_ArrayValue{ArrayValue: &pb.ArrayValue{Values: elems}}}
+		default:
+			return nil, status.Errorf(codes.InvalidArgument, "bad transform %v", ft)
+		}
+		setField(doc.Fields, path, v)
+		results = append(results, v)
+	}
+	return results, nil
+}
+
+// increment returns old + inc. If old is not a number, it returns inc.
+// Integer sums saturate rather than overflow.
+func increment(old, inc *pb.Value) *pb.Value {
+	if old == nil || !isNumber(old) {
+		return inc
+	}
+	oi, oIsInt := old.ValueType.(*pb.Value_IntegerValue)
+	ii, iIsInt := inc.ValueType.(*pb.Value_IntegerValue)
+	if oIsInt && iIsInt {
+		a, b := oi.IntegerValue, ii.IntegerValue
+		sum := a + b
+		switch {
+		case a > 0 && b > 0 && sum < 0:
+			sum = math.MaxInt64
+		case a < 0 && b < 0 && sum >= 0:
+			sum = math.MinInt64
+		}
+		return &pb.Value{ValueType: &pb.Value_IntegerValue{IntegerValue: sum}}
+	}
+	return &pb.Value{ValueType: &pb.Value_DoubleValue{DoubleValue: toFloat(old) + toFloat(inc)}}
+}
+
+// extremum returns the larger (sign 1) or smaller (sign -1) of old and v. If
+// old is not a number, it returns v.
+func extremum(old, v *pb.Value, sign int) *pb.Value {
+	if old == nil || !isNumber(old) {
+		return v
+	}
+	if compareNumbers(toFloat(v), toFloat(old))*sign > 0 {
+		return v
+	}
+	return old
+}
+
+// indexOf returns the index of the first element of vs equal to v, or -1.
+func indexOf(vs []*pb.Value, v *pb.Value) int {
+	for i, e := range vs {
+		if typeOrder(e) == typeOrder(v) && compareValues(e, v) == 0 {
+			return i
+		}
+	}
+	return -1
+}
@@ -0,0 +1,505 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package fstest provides a fake Cloud Firestore service for testing. It
+// implements a simplified form of the service, suitable for unit tests. It
+// keeps all data in memory, does not require composite indexes, and is always
+// strongly consistent.
+//
+// Read-write transactions are optimistic: a transaction fails to commit with
+// codes.Aborted if a document it read was changed after it was read, and the
+// client retries it. Queries in a read-write transaction count as reads of
+// the documents they return.
+//
+// To use it, connect a firestore.Client to the server's address:
+//
+//	srv := fstest.NewServer()
+//	defer srv.Close()
+//	conn, err := grpc.Dial(srv.Addr, grpc.WithInsecure())
+//	...
+//	client, err := firestore.NewClient(ctx, "project", option.WithGRPCConn(conn))
+//
+// This package is EXPERIMENTAL and is subject to change without notice.
+package fstest
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/firestore/internal/fieldpath"
+	"cloud.google.com/go/internal/testutil"
+	"github.com/golang/protobuf/ptypes"
+	emptypb "github.com/golang/protobuf/ptypes/empty"
+	tspb "github.com/golang/protobuf/ptypes/timestamp"
+	pb "google.golang.org/genproto/googleapis/firestore/v1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// defaultPageSize is the page size of ListDocuments and ListCollectionIds
+// when the request does not specify one.
+const defaultPageSize = 300
+
+// Server is a fake Firestore server.
+type Server struct {
+	srv     *testutil.Server
+	Addr    string  // The address that the server is listening on.
+	GServer GServer // Not intended to be used directly.
+}
+
+// GServer is the underlying service implementor. It is not intended to be used
+// directly.
+type GServer struct {
+	pb.FirestoreServer
+
+	mu sync.Mutex
+	// now is the time of the most recent commit. Every commit gets a later
+	// time, which all the documents it writes share as their update time.
+	// Reads that do not specify a time see the data as of now.
+	now     time.Time
+	docs    map[string]*record // keyed by document name
+	txns    map[string]*transaction
+	nextTxn int
+	// changed is closed and replaced after every commit, to wake listeners.
+	changed chan struct{}
+}
+
+// record holds the history of a single document.
+type record struct {
+	// revisions are in increasing time order. A revision with a nil
+	// document marks a deletion.
+	revisions []revision
+}
+
+type revision struct {
+	time time.Time
+	doc  *pb.Document
+}
+
+// at returns the document as of t, or nil if it did not exist then.
+func (r *record) at(t time.Time) *pb.Document {
+	for i := len(r.revisions) - 1; i >= 0; i-- {
+		if rev := r.revisions[i]; !rev.time.After(t) {
+			return rev.doc
+		}
+	}
+	return nil
+}
+
+// lastChange returns the time of the most recent write to the document.
+func (r *record) lastChange() time.Time {
+	return r.revisions[len(r.revisions)-1].time
+}
+
+// transaction is an open transaction. Reads in a read-only transaction see
+// the data as of readTime. Reads in a read-write transaction see the latest
+// data, and record the time it last changed.
+type transaction struct {
+	readOnly bool
+	readTime time.Time
+	reads    map[string]time.Time // document name to time of last change
+}
+
+// NewServer creates a new fake server running in the current process.
+func NewServer() *Server {
+	srv, err := testutil.NewServer()
+	if err != nil {
+		panic(fmt.Sprintf("fstest.NewServer: %v", err))
+	}
+	s := &Server{
+		srv:  srv,
+		Addr: srv.Addr,
+		GServer: GServer{
+			now:     time.Now().Truncate(time.Microsecond),
+			docs:    map[string]*record{},
+			txns:    map[string]*transaction{},
+			changed: make(chan struct{}),
+		},
+	}
+	pb.RegisterFirestoreServer(srv.Gsrv, &s.GServer)
+	srv.Start()
+	return s
+}
+
+// Close shuts down the server and releases all resources.
+func (s *Server) Close() error {
+	s.srv.Close()
+	return nil
+}
+
+// nextTime returns the next time of the server's clock, after all the times
+// it has used. It does not advance the clock; callers set s.now once the time
+// is used. Times have microsecond precision, like those of the service.
+// Must hold the lock.
+func (s *GServer) nextTime() time.Time {
+	t := time.Now().Truncate(time.Microsecond)
+	if !t.After(s.now) {
+		t = s.now.Add(time.Microsecond)
+	}
+	return t
+}
+
+// docAt returns the document with the given name as of t, or nil.
+// Must hold the lock.
+func (s *GServer) docAt(name string, t time.Time) *pb.Document {
+	r := s.docs[name]
+	if r == nil {
+		return nil
+	}
+	return r.at(t)
+}
+
+// lastChange returns the time of the last write to the named document, or the
+// zero time if it has never been written.
+// Must hold the lock.
+func (s *GServer) lastChange(name string) time.Time {
+	if r := s.docs[name]; r != nil {
+		return r.lastChange()
+	}
+	return time.Time{}
+}
+
+// consistency describes how a request reads: at a point in time, or in a
+// transaction.
+type consistency struct {
+	readTime time.Time
+	txn      *transaction
+	// newTxn is the ID of a transaction begun by the request, if any.
+	newTxn []byte
+}
+
+// resolveConsistency interprets the consistency selector of a read request.
+// At most one of its arguments may be set.
+// Must hold the lock.
+func (s *GServer) resolveConsistency(txnID []byte, newTxn *pb.TransactionOptions, readTime *tspb.Timestamp) (*consistency, error) {
+	c := &consistency{readTime: s.now}
+	switch {
+	case txnID != nil:
+		txn, err := s.findTxn(txnID)
+		if err != nil {
+			return nil, err
+		}
+		c.txn = txn
+		if txn.readOnly {
+			c.readTime = txn.readTime
+		}
+	case newTxn != nil:
+		var err error
+		if c.newTxn, c.txn, err = s.beginTxn(newTxn); err != nil {
+			return nil, err
+		}
+		if c.txn.readOnly {
+			c.readTime = c.txn.readTime
+		}
+	case readTime != nil:
+		t, err := ptypes.Timestamp(readTime)
+		if err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "bad read time: %v", err)
+		}
+		if t.After(s.now) {
+			t = s.now
+		}
+		c.readTime = t
+	}
+	return c, nil
+}
+
+// read returns the named document as of the consistency's read time, recording
+// the read in a read-write transaction.
+// Must hold the lock.
+func (s *GServer) read(c *consistency, name string) *pb.Document {
+	if c.txn != nil && !c.txn.readOnly {
+		c.txn.reads[name] = s.lastChange(name)
+	}
+	return s.docAt(name, c.readTime)
+}
+
+func (s *GServer) findTxn(id []byte) (*transaction, error) {
+	txn := s.txns[string(id)]
+	if txn == nil {
+		return nil, status.Errorf(codes.InvalidArgument, "transaction %q is not active", id)
+	}
+	return txn, nil
+}
+
+// Must hold the lock.
+func (s *GServer) beginTxn(opts *pb.TransactionOptions) ([]byte, *transaction, error) {
+	txn := &transaction{reads: map[string]time.Time{}}
+	if ro := opts.GetReadOnly(); ro != nil {
+		txn.readOnly = true
+		txn.readTime = s.now
+		if rt := ro.GetReadTime(); rt != nil {
+			t, err := ptypes.Timestamp(rt)
+			if err != nil {
+				return nil, nil, status.Errorf(codes.InvalidArgument, "bad read time: %v", err)
+			}
+			txn.readTime = t
+		}
+	}
+	s.nextTxn++
+	id := strconv.Itoa(s.nextTxn)
+	s.txns[id] = txn
+	return []byte(id), txn, nil
+}
+
+// BeginTransaction starts a transaction.
+func (s *GServer) BeginTransaction(_ context.Context, req *pb.BeginTransactionRequest) (*pb.BeginTransactionResponse, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	opts := req.Options
+	if opts == nil {
+		opts = &pb.TransactionOptions{}
+	}
+	id, _, err := s.beginTxn(opts)
+	if err != nil {
+		return nil, err
+	}
+	return &pb.BeginTransactionResponse{Transaction: id}, nil
+}
+
+// Rollback abandons a transaction.
+func (s *GServer) Rollback(_ context.Context, req *pb.RollbackRequest) (*emptypb.Empty, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, err := s.findTxn(req.Transaction); err != nil {
+		return nil, err
+	}
+	delete(s.txns, string(req.Transaction))
+	return &emptypb.Empty{}, nil
+}
+
+// BatchGetDocuments returns the requested documents. Each document is
+// returned once, even if it is requested several times.
+func (s *GServer) BatchGetDocuments(req *pb.BatchGetDocumentsRequest, stream pb.Firestore_BatchGetDocumentsServer) error {
+	s.mu.Lock()
+	c, err := s.resolveConsistency(req.GetTransaction(), req.GetNewTransaction(), req.GetReadTime())
+	if err != nil {
+		s.mu.Unlock()
+		return err
+	}
+	var paths [][]string
+	if req.Mask != nil {
+		if paths, err = parseFieldPaths(req.Mask.FieldPaths); err != nil {
+			s.mu.Unlock()
+			return err
+		}
+	}
+	var resps []*pb.BatchGetDocumentsResponse
+	seen := map[string]bool{}
+	readTime := timestamp(c.readTime)
+	for _, name := range req.Documents {
+		if _, _, err := splitDocName(name); err != nil {
+			s.mu.Unlock()
+			return err
+		}
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+		resp := &pb.BatchGetDocumentsResponse{ReadTime: readTime}
+		if doc := s.read(c, name); doc != nil {
+			if req.Mask != nil {
+				doc = project(doc, paths)
+			}
+			resp.Result = &pb.BatchGetDocumentsResponse_Found{Found: cloneDoc(doc)}
+		} else {
+			resp.Result = &pb.BatchGetDocumentsResponse_Missing{Missing: name}
+		}
+		resps = append(resps, resp)
+	}
+	if len(resps) > 0 {
+		resps[0].Transaction = c.newTxn
+	}
+	s.mu.Unlock()
+	for _, resp := range resps {
+		if err := stream.Send(resp); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ListCollectionIds lists the IDs of the collections directly under a
+// document, or at the root of the database. A collection exists if any
+// document exists anywhere beneath it.
+func (s *GServer) ListCollectionIds(_ context.Context, req *pb.ListCollectionIdsRequest) (*pb.ListCollectionIdsResponse, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	prefix := req.Parent + "/"
+	ids := map[string]bool{}
+	for name, r := range s.docs {
+		if r.at(s.now) == nil || !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		rest := name[len(prefix):]
+		ids[strings.SplitN(rest, "/", 2)[0]] = true
+	}
+	var all []string
+	for id := range ids {
+		all = append(all, id)
+	}
+	sort.Strings(all)
+	from, to, next, err := page(len(all), req.PageSize, req.PageToken)
+	if err != nil {
+		return nil, err
+	}
+	return &pb.ListCollectionIdsResponse{CollectionIds: all[from:to], NextPageToken: next}, nil
+}
+
+// ListDocuments lists the documents in a collection. With ShowMissing, it
+// includes documents that do not exist but have documents beneath them; they
+// are returned with only a name.
+func (s *GServer) ListDocuments(_ context.Context, req *pb.ListDocumentsRequest) (*pb.ListDocumentsResponse, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c, err := s.resolveConsistency(req.GetTransaction(), nil, req.GetReadTime())
+	if err != nil {
+		return nil, err
+	}
+	var paths [][]string
+	if req.Mask != nil {
+		if paths, err = parseFieldPaths(req.Mask.FieldPaths); err != nil {
+			return nil, err
+		}
+	}
+	prefix := req.Parent + "/" + req.CollectionId + "/"
+	docs := map[string]*pb.Document{}
+	for name, r := range s.docs {
+		if !strings.HasPrefix(name, prefix) || r.at(c.readTime) == nil {
+			continue
+		}
+		rest := name[len(prefix):]
+		if i := strings.IndexByte(rest, '/'); i >= 0 {
+			// A document beneath a child document, which may be missing.
+			if req.ShowMissing {
+				child := prefix + rest[:i]
+				if docs[child] == nil {
+					docs[child] = &pb.Document{Name: child}
+				}
+			}
+			continue
+		}
+		doc := s.read(c, name)
+		if req.Mask != nil {
+			doc = project(doc, paths)
+		}
+		docs[name] = cloneDoc(doc)
+	}
+	var names []string
+	for name := range docs {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool { return compareNames(names[i], names[j]) < 0 })
+	from, to, next, err := page(len(names), req.PageSize, req.PageToken)
+	if err != nil {
+		return nil, err
+	}
+	resp := &pb.ListDocumentsResponse{NextPageToken: next}
+	for _, name := range names[from:to] {
+		resp.Documents = append(resp.Documents, docs[name])
+	}
+	return resp, nil
+}
+
+// page returns the range of n items in the page with the given size and
+// token, and the token of the next page.
+func page(n int, size int32, token string) (from, to int, next string, err error) {
+	if token != "" {
+		if from, err = strconv.Atoi(token); err != nil || from < 0 || from > n {
+			return 0, 0, "", status.Errorf(codes.InvalidArgument, "bad page token %q", token)
+		}
+	}
+	if size <= 0 {
+		size = defaultPageSize
+	}
+	to = from + int(size)
+	if to >= n {
+		return from, n, "", nil
+	}
+	return from, to, strconv.Itoa(to), nil
+}
+
+// splitDocName returns the database and document path of a document name,
+// which has the form "projects/P/databases/D/documents/C/ID...".
+func splitDocName(name string) (db, path string, err error) {
+	parts := strings.Split(name, "/")
+	if len(parts) < 7 || len(parts)%2 == 0 || parts[0] != "projects" || parts[2] != "databases" || parts[4] != "documents" {
+		return "", "", status.Errorf(codes.InvalidArgument, "bad document name %q", name)
+	}
+	for _, p := range parts {
+		if p == "" {
+			return "", "", status.Errorf(codes.InvalidArgument, "bad document name %q", name)
+		}
+	}
+	return strings.Join(parts[:5], "/"), strings.Join(parts[5:], "/"), nil
+}
+
+// project returns a copy of doc with only the fields at paths.
+func project(doc *pb.Document, paths [][]string) *pb.Document {
+	p := &pb.Document{
+		Name:       doc.Name,
+		CreateTime: doc.CreateTime,
+		UpdateTime: doc.UpdateTime,
+	}
+	for _, path := range paths {
+		if v := getField(doc.Fields, path); v != nil {
+			if p.Fields == nil {
+				p.Fields = map[string]*pb.Value{}
+			}
+			setField(p.Fields, path, v)
+		}
+	}
+	return p
+}
+
+func parseFieldPaths(fps []string) ([][]string, error) {
+	var paths [][]string
+	for _, fp := range fps {
+		path, err := fieldpath.Parse(fp)
+		if err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+		paths = append(paths, path)
+	}
+	return paths, nil
+}
+
+func timestamp(t time.Time) *tspb.Timestamp {
+	ts, err := ptypes.TimestampProto(t)
+	if err != nil {
+		panic(err)
+	}
+	return ts
+}
+
+// resumeToken encodes a time as a resume token for the Listen stream.
+func resumeToken(t time.Time) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, uint64(t.UnixNano()))
+	return b
+}
+
+// parseResumeToken decodes a resume token made by resumeToken.
+func parseResumeToken(b []byte) (time.Time, bool) {
+	if len(b) != 8 {
+		return time.Time{}, false
+	}
+	return time.Unix(0, int64(binary.BigEndian.Uint64(b))), true
+}
@@ -0,0 +1,528 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fstest
+
+import (
+	"context"
+	"math"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"cloud.google.com/go/internal/testutil"
+	"google.golang.org/api/option"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func newFake(t *testing.T) (*firestore.Client, *Server, func()) {
+	srv := NewServer()
+	conn, err := grpc.Dial(srv.Addr, grpc.WithInsecure())
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := firestore.NewClient(context.Background(), "P", option.WithGRPCConn(conn))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client, srv, func() {
+		client.Close()
+		conn.Close()
+		srv.Close()
+	}
+}
+
+// ids returns the IDs of the documents returned by q.
+func ids(t *testing.T, q firestore.Query) []string {
+	t.Helper()
+	docs, err := q.Documents(context.Background()).GetAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var res []string
+	for _, d := range docs {
+		res = append(res, d.Ref.ID)
+	}
+	return res
+}
+
+func TestGetSetUpdateDelete(t *testing.T) {
+	ctx := context.Background()
+	client, _, cleanup := newFake(t)
+	defer cleanup()
+
+	doc := client.Doc("C/a")
+	if _, err := doc.Get(ctx); status.Code(err) != codes.NotFound {
+		t.Fatalf("got %v, want NotFound", err)
+	}
+	wr, err := doc.Create(ctx, map[string]interface{}{"x": 1, "m": map[string]interface{}{"y": "z"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := doc.Create(ctx, map[string]interface{}{"x": 2}); status.Code(err) != codes.AlreadyExists {
+		t.Fatalf("got %v, want AlreadyExists", err)
+	}
+	snap, err := doc.Get(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !snap.UpdateTime.Equal(wr.UpdateTime) || !snap.CreateTime.Equal(wr.UpdateTime) {
+		t.Errorf("got times %v, %v; want %v", snap.CreateTime, snap.UpdateTime, wr.UpdateTime)
+	}
+
+	_, err = doc.Update(ctx, []firestore.Update{{Path: "m.y", Value: firestore.Delete}, {Path: "w", Value: true}},
+		firestore.LastUpdateTime(wr.UpdateTime))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = doc.Update(ctx, []firestore.Update{{Path: "x", Value: 3}}, firestore.LastUpdateTime(wr.UpdateTime))
+	if status.Code(err) != codes.FailedPrecondition {
+		t.Fatalf("got %v, want FailedPrecondition", err)
+	}
+	if _, err := client.Doc("C/b").Update(ctx, []firestore.Update{{Path: "x", Value: 1}}); status.Code(err) != codes.NotFound {
+		t.Fatalf("got %v, want NotFound", err)
+	}
+	snap, err = doc.Get(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]interface{}{"x": int64(1), "m": map[string]interface{}{}, "w": true}
+	if got := snap.Data(); !testutil.Equal(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	if _, err := doc.Set(ctx, map[string]interface{}{"n": 5}, firestore.MergeAll); err != nil {
+		t.Fatal(err)
+	}
+	snap, err = doc.Get(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := snap.Data()["n"]; got != int64(5) || len(snap.Data()) != 4 {
+		t.Errorf("after merge got %v", snap.Data())
+	}
+
+	if _, err := doc.Delete(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := doc.Delete(ctx, firestore.Exists); status.Code(err) != codes.NotFound {
+		t.Fatalf("got %v, want NotFound", err)
+	}
+	if _, err := doc.Get(ctx); status.Code(err) != codes.NotFound {
+		t.Fatalf("got %v, want NotFound", err)
+	}
+	snaps, err := client.GetAll(ctx, []*firestore.DocumentRef{doc, doc, client.Doc("C/b")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range snaps {
+		if s.Exists() {
+			t.Errorf("%s exists", s.Ref.Path)
+		}
+	}
+}
+
+func TestRejectedCommitKeepsClock(t *testing.T) {
+	ctx := context.Background()
+	client, srv, cleanup := newFake(t)
+	defer cleanup()
+
+	now := func() time.Time {
+		srv.GServer.mu.Lock()
+		defer srv.GServer.mu.Unlock()
+		return srv.GServer.now
+	}
+	doc := client.Doc("C/a")
+	wr, err := doc.Create(ctx, map[string]interface{}{"x": 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := now(); !got.Equal(wr.UpdateTime) {
+		t.Fatalf("after commit: got clock %v, want %v", got, wr.UpdateTime)
+	}
+	if _, err := doc.Create(ctx, map[string]interface{}{"x": 2}); status.Code(err) != codes.AlreadyExists {
+		t.Fatalf("got %v, want AlreadyExists", err)
+	}
+	if got := now(); !got.Equal(wr.UpdateTime) {
+		t.Errorf("after rejected commit: got clock %v, want %v", got, wr.UpdateTime)
+	}
+}
+
+func TestTransforms(t *testing.T) {
+	ctx := context.Background()
+	client, _, cleanup := newFake(t)
+	defer cleanup()
+
+	doc := client.Doc("C/a")
+	if _, err := doc.Set(ctx, map[string]interface{}{"n": 1, "f": 1.5, "big": int64(math.MaxInt64), "a": []interface{}{1, 2}}); err != nil {
+		t.Fatal(err)
+	}
+	wr, err := doc.Update(ctx, []firestore.Update{
+		{Path: "t", Value: firestore.ServerTimestamp},
+		{Path: "n", Value: firestore.Increment(2)},
+		{Path: "f", Value: firestore.Increment(1)},
+		{Path: "big", Value: firestore.Increment(1)},
+		{Path: "new", Value: firestore.Increment(7)},
+		{Path: "a", Value: firestore.ArrayUnion(2, 3)},
+		{Path: "b", Value: firestore.ArrayRemove(1)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	snap, err := doc.Get(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]interface{}{
+		"t":   wr.UpdateTime,
+		"n":   int64(3),
+		"f":   2.5,
+		"big": int64(math.MaxInt64),
+		"new": int64(7),
+		"a":   []interface{}{int64(1), int64(2), int64(3)},
+		"b":   []interface{}{},
+	}
+	if got := snap.Data(); !testutil.Equal(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if _, err := doc.Update(ctx, []firestore.Update{{Path: "a", Value: firestore.ArrayRemove(1, 3)}}); err != nil {
+		t.Fatal(err)
+	}
+	snap, err = doc.Get(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := snap.Data()["a"], []interface{}{int64(2)}; !testutil.Equal(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestQuery(t *testing.T) {
+	ctx := context.Background()
+	client, _, cleanup := newFake(t)
+	defer cleanup()
+
+	coll := client.Collection("C")
+	data := map[string]map[string]interface{}{
+		"a": {"n": 1, "s": "x", "tags": []interface{}{"red", "blue"}, "m": map[string]interface{}{"k": 1}},
+		"b": {"n": 2, "s": "y", "tags": []interface{}{"green"}, "m": map[string]interface{}{"k": 2}},
+		"c": {"n": 3, "s": "x", "tags": []interface{}{}, "nan": math.NaN()},
+		"d": {"n": 2.5, "s": nil},
+		"e": {"s": "z"},
+	}
+	for id, d := range data {
+		if _, err := coll.Doc(id).Set(ctx, d); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Documents in other collections must not be returned.
+	if _, err := client.Doc("C/a/C/x").Set(ctx, map[string]interface{}{"n": 1}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Doc("D/a").Set(ctx, map[string]interface{}{"n": 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		desc string
+		q    firestore.Query
+		want []string
+	}{
+		{"all", coll.Query, []string{"a", "b", "c", "d", "e"}},
+		{"==", coll.Where("s", "==", "x"), []string{"a", "c"}},
+		{"== nested", coll.Where("m.k", "==", 2), []string{"b"}},
+		{"<", coll.Where("n", "<", 2.5), []string{"a", "b"}},
+		{"<=", coll.Where("n", "<=", 2.5), []string{"a", "b", "d"}},
+		{">", coll.Where("n", ">", 2), []string{"d", "c"}},
+		{">= desc", coll.Where("n", ">=", 2).OrderBy("n", firestore.Desc), []string{"c", "d", "b"}},
+		{"inequality on strings", coll.Where("s", ">", "x"), []string{"b", "e"}},
+		{"array-contains", coll.Where("tags", "array-contains", "green"), []string{"b"}},
+		{"array-contains-any", coll.Where("tags", "array-contains-any", []interface{}{"red", "green"}), []string{"a", "b"}},
+		{"in", coll.Where("n", "in", []interface{}{1, 3}), []string{"a", "c"}},
+		{"is null", coll.Where("s", "==", nil), []string{"d"}},
+		{"is nan", coll.Where("nan", "==", math.NaN()), []string{"c"}},
+		{"order, missing fields excluded", coll.OrderBy("s", firestore.Asc).OrderBy("n", firestore.Desc), []string{"d", "c", "a", "b"}},
+		{"order by ID", coll.OrderBy(firestore.DocumentID, firestore.Desc), []string{"e", "d", "c", "b", "a"}},
+		{"limit offset", coll.OrderBy("n", firestore.Asc).Offset(1).Limit(2), []string{"b", "d"}},
+		{"start at", coll.OrderBy("n", firestore.Asc).StartAt(2), []string{"b", "d", "c"}},
+		{"start after", coll.OrderBy("n", firestore.Asc).StartAfter(2), []string{"d", "c"}},
+		{"end at", coll.OrderBy("n", firestore.Asc).EndAt(2.5), []string{"a", "b", "d"}},
+		{"end before", coll.OrderBy("n", firestore.Asc).EndBefore(2.5), []string{"a", "b"}},
+		{"cursor on ID", coll.OrderBy("s", firestore.Asc).OrderBy(firestore.DocumentID, firestore.Asc).StartAfter("x", "a"), []string{"c", "b", "e"}},
+	} {
+		if got := ids(t, test.q); !testutil.Equal(got, test.want) {
+			t.Errorf("%s: got %v, want %v", test.desc, got, test.want)
+		}
+	}
+
+	// Cursor from a snapshot.
+	snap, err := coll.Doc("b").Get(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := ids(t, coll.OrderBy("n", firestore.Asc).StartAfter(snap)), []string{"d", "c"}; !testutil.Equal(got, want) {
+		t.Errorf("snapshot cursor: got %v, want %v", got, want)
+	}
+
+	// Collection group.
+	if got, want := ids(t, client.CollectionGroup("C").Where("n", "==", 1)), []string{"a", "x"}; !testutil.Equal(got, want) {
+		t.Errorf("collection group: got %v, want %v", got, want)
+	}
+
+	// Select.
+	docs, err := coll.Select("n").Where("s", "==", "y").Documents(ctx).GetAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(docs) != 1 || !testutil.Equal(docs[0].Data(), map[string]interface{}{"n": int64(2)}) {
+		t.Errorf("select: got %v", docs)
+	}
+}
+
+func TestTransactions(t *testing.T) {
+	ctx := context.Background()
+	client, _, cleanup := newFake(t)
+	defer cleanup()
+
+	doc := client.Doc("C/counter")
+	if _, err := doc.Set(ctx, map[string]interface{}{"n": 0}); err != nil {
+		t.Fatal(err)
+	}
+	const N = 10
+	var wg sync.WaitGroup
+	errc := make(chan error, N)
+	for i := 0; i < N; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errc <- client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+				snap, err := tx.Get(doc)
+				if err != nil {
+					return err
+				}
+				n, err := snap.DataAt("n")
+				if err != nil {
+					return err
+				}
+				return tx.Set(doc, map[string]interface{}{"n": n.(int64) + 1})
+			}, firestore.MaxAttempts(100))
+		}()
+	}
+	wg.Wait()
+	close(errc)
+	for err := range errc {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	snap, err := doc.Get(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := snap.Data()["n"]; got != int64(N) {
+		t.Errorf("got %v, want %d", got, N)
+	}
+
+	// A read-only transaction sees the data as of its start.
+	err = client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		if _, err := tx.Get(doc); err != nil {
+			return err
+		}
+		if _, err := doc.Set(ctx, map[string]interface{}{"n": -1}); err != nil {
+			return err
+		}
+		docs, err := tx.Documents(client.Collection("C")).GetAll()
+		if err != nil {
+			return err
+		}
+		if got := docs[0].Data()["n"]; got != int64(N) {
+			t.Errorf("read-only transaction: got %v, want %d", got, N)
+		}
+		return nil
+	}, firestore.ReadOnly)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Queries in read-write transactions count as reads.
+	attempts := 0
+	err = client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		attempts++
+		if _, err := tx.Documents(client.Collection("C")).GetAll(); err != nil {
+			return err
+		}
+		if attempts == 1 {
+			if _, err := doc.Set(ctx, map[string]interface{}{"n": -2}); err != nil {
+				return err
+			}
+		}
+		return tx.Set(client.Doc("C/other"), map[string]interface{}{})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if attempts != 2 {
+		t.Errorf("got %d attempts, want 2", attempts)
+	}
+}
+
+func TestCollectionsAndDocumentRefs(t *testing.T) {
+	ctx := context.Background()
+	client, _, cleanup := newFake(t)
+	defer cleanup()
+
+	for _, path := range []string{"A/a", "B/b", "A/a/S/x", "A/m/T/y"} {
+		if _, err := client.Doc(path).Set(ctx, map[string]interface{}{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	colls, err := client.Collections(ctx).GetAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, c := range colls {
+		got = append(got, c.ID)
+	}
+	if want := []string{"A", "B"}; !testutil.Equal(got, want) {
+		t.Errorf("collections: got %v, want %v", got, want)
+	}
+
+	// DocumentRefs includes missing documents with subcollections.
+	refs, err := client.Collection("A").DocumentRefs(ctx).GetAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got = nil
+	for _, r := range refs {
+		got = append(got, r.ID)
+	}
+	sort.Strings(got)
+	if want := []string{"a", "m"}; !testutil.Equal(got, want) {
+		t.Errorf("document refs: got %v, want %v", got, want)
+	}
+}
+
+func TestDocumentSnapshots(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	client, _, cleanup := newFake(t)
+	defer cleanup()
+
+	doc := client.Doc("C/a")
+	it := doc.Snapshots(ctx)
+	defer it.Stop()
+	snap, err := it.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if snap.Exists() {
+		t.Fatal("got existing document, want missing")
+	}
+	if _, err := client.Doc("C/b").Set(ctx, map[string]interface{}{"x": 0}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := doc.Set(ctx, map[string]interface{}{"x": 1}); err != nil {
+		t.Fatal(err)
+	}
+	snap, err = it.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := snap.Data()["x"]; got != int64(1) {
+		t.Fatalf("got %v, want 1", got)
+	}
+	if _, err := doc.Delete(ctx); err != nil {
+		t.Fatal(err)
+	}
+	snap, err = it.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if snap.Exists() {
+		t.Fatal("got existing document after delete")
+	}
+}
+
+func TestQuerySnapshots(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	client, _, cleanup := newFake(t)
+	defer cleanup()
+
+	coll := client.Collection("C")
+	if _, err := coll.Doc("a").Set(ctx, map[string]interface{}{"n": 1}); err != nil {
+		t.Fatal(err)
+	}
+	it := coll.Where("n", ">", 0).Snapshots(ctx)
+	defer it.Stop()
+	next := func() ([]string, []firestore.DocumentChangeKind) {
+		t.Helper()
+		qs, err := it.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		docs, err := qs.Documents.GetAll()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var ids []string
+		for _, d := range docs {
+			ids = append(ids, d.Ref.ID)
+		}
+		var kinds []firestore.DocumentChangeKind
+		for _, c := range qs.Changes {
+			kinds = append(kinds, c.Kind)
+		}
+		return ids, kinds
+	}
+
+	if got, kinds := next(); !testutil.Equal(got, []string{"a"}) || !testutil.Equal(kinds, []firestore.DocumentChangeKind{firestore.DocumentAdded}) {
+		t.Fatalf("got %v %v", got, kinds)
+	}
+	if _, err := coll.Doc("b").Set(ctx, map[string]interface{}{"n": 2}); err != nil {
+		t.Fatal(err)
+	}
+	if got, kinds := next(); !testutil.Equal(got, []string{"a", "b"}) || !testutil.Equal(kinds, []firestore.DocumentChangeKind{firestore.DocumentAdded}) {
+		t.Fatalf("got %v %v", got, kinds)
+	}
+	// Changing a document so that it no longer matches removes it.
+	if _, err := coll.Doc("a").Set(ctx, map[string]interface{}{"n": 0}); err != nil {
+		t.Fatal(err)
+	}
+	if got, kinds := next(); !testutil.Equal(got, []string{"b"}) || !testutil.Equal(kinds, []firestore.DocumentChangeKind{firestore.DocumentRemoved}) {
+		t.Fatalf("got %v %v", got, kinds)
+	}
+	if _, err := coll.Doc("b").Update(ctx, []firestore.Update{{Path: "n", Value: 3}}); err != nil {
+		t.Fatal(err)
+	}
+	if got, kinds := next(); !testutil.Equal(got, []string{"b"}) || !testutil.Equal(kinds, []firestore.DocumentChangeKind{firestore.DocumentModified}) {
+		t.Fatalf("got %v %v", got, kinds)
+	}
+}
+
+func TestResumeToken(t *testing.T) {
+	now := time.Now().Truncate(time.Microsecond)
+	got, ok := parseResumeToken(resumeToken(now))
+	if !ok || !got.Equal(now) {
+		t.Errorf("got %v, %t; want %v", got, ok, now)
+	}
+	if _, ok := parseResumeToken([]byte("x")); ok {
+		t.Error("parsed bad token")
+	}
+}
@@ -0,0 +1,252 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fstest
+
+import (
+	"io"
+	"sort"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
+	tspb "github.com/golang/protobuf/ptypes/timestamp"
+	pb "google.golang.org/genproto/googleapis/firestore/v1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// A listenTarget is a target added to a Listen stream.
+type listenTarget struct {
+	// Exactly one of docs and query is set.
+	docs  []string
+	query *query
+	// seen maps the names of the documents the client has been sent to their
+	// update times.
+	seen map[string]*tspb.Timestamp
+	// added is true until the target's ADD and CURRENT changes are sent.
+	added bool
+}
+
+// Listen streams changes to documents and query results. After each commit
+// that affects one of the stream's targets, it sends the changed documents
+// followed by a global NO_CHANGE target change holding the commit time as
+// the read time and a resume token. A target added with a resume token or a
+// read time gets only the changes since then.
+func (s *GServer) Listen(stream pb.Firestore_ListenServer) error {
+	ctx := stream.Context()
+	reqc := make(chan *pb.ListenRequest)
+	errc := make(chan error, 1)
+	go func() {
+		for {
+			req, err := stream.Recv()
+			if err != nil {
+				errc <- err
+				return
+			}
+			select {
+			case reqc <- req:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	targets := map[int32]*listenTarget{}
+	for {
+		s.mu.Lock()
+		changed := s.changed
+		resps := s.listenResponses(targets, s.now)
+		s.mu.Unlock()
+		for _, r := range resps {
+			if err := stream.Send(r); err != nil {
+				return err
+			}
+		}
+
+		select {
+		case <-changed:
+		case req := <-reqc:
+			switch tc := req.TargetChange.(type) {
+			case *pb.ListenRequest_AddTarget:
+				id := tc.AddTarget.TargetId
+				if _, ok := targets[id]; ok {
+					return status.Errorf(codes.InvalidArgument, "duplicate target ID %d", id)
+				}
+				t, err := s.newListenTarget(tc.AddTarget)
+				if err != nil {
+					return err
+				}
+				targets[id] = t
+			case *pb.ListenRequest_RemoveTarget:
+				id := tc.RemoveTarget
+				if _, ok := targets[id]; !ok {
+					return status.Errorf(codes.InvalidArgument, "unknown target ID %d", id)
+				}
+				delete(targets, id)
+				err := stream.Send(&pb.ListenResponse{ResponseType: &pb.ListenResponse_TargetChange{
+					TargetChange: &pb.TargetChange{
+						TargetChangeType: pb.TargetChange_REMOVE,
+						TargetIds:        []int32{id},
+					},
+				}})
+				if err != nil {
+					return err
+				}
+			default:
+				return status.Error(codes.InvalidArgument, "missing target change")
+			}
+		case err := <-errc:
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// newListenTarget compiles a target. If the target resumes from an earlier
+// time, the documents it matched then are taken as already seen.
+func (s *GServer) newListenTarget(pt *pb.Target) (*listenTarget, error) {
+	t := &listenTarget{seen: map[string]*tspb.Timestamp{}, added: true}
+	switch tt := pt.TargetType.(type) {
+	case *pb.Target_Documents:
+		for _, name := range tt.Documents.GetDocuments() {
+			if _, _, err := splitDocName(name); err != nil {
+				return nil, err
+			}
+		}
+		t.docs = tt.Documents.GetDocuments()
+	case *pb.Target_Query:
+		q, err := compileQuery(tt.Query.GetParent(), tt.Query.GetStructuredQuery())
+		if err != nil {
+			return nil, err
+		}
+		t.query = q
+	default:
+		return nil, status.Error(codes.InvalidArgument, "missing target")
+	}
+
+	var from time.Time
+	switch rt := pt.ResumeType.(type) {
+	case *pb.Target_ResumeToken:
+		var ok bool
+		if from, ok = parseResumeToken(rt.ResumeToken); !ok {
+			return nil, status.Error(codes.InvalidArgument, "bad resume token")
+		}
+	case *pb.Target_ReadTime:
+		var err error
+		if from, err = ptypes.Timestamp(rt.ReadTime); err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+	default:
+		return t, nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for name, d := range s.targetResults(t, from) {
+		t.seen[name] = d.UpdateTime
+	}
+	return t, nil
+}
+
+// targetResults returns the documents that match t as of rt, keyed by name.
+// Must hold the lock.
+func (s *GServer) targetResults(t *listenTarget, rt time.Time) map[string]*pb.Document {
+	res := map[string]*pb.Document{}
+	if t.query != nil {
+		for _, d := range s.runQuery(t.query, rt) {
+			res[d.Name] = d
+		}
+		return res
+	}
+	for _, name := range t.docs {
+		if d := s.docAt(name, rt); d != nil {
+			res[name] = cloneDoc(d)
+		}
+	}
+	return res
+}
+
+// listenResponses returns the responses that bring the client's view of
+// targets up to date as of rt, and records that they have been sent.
+// Must hold the lock.
+func (s *GServer) listenResponses(targets map[int32]*listenTarget, rt time.Time) []*pb.ListenResponse {
+	var ids []int32
+	for id := range targets {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	readTime := timestamp(rt)
+	targetChange := func(typ pb.TargetChange_TargetChangeType, id int32) *pb.ListenResponse {
+		return &pb.ListenResponse{ResponseType: &pb.ListenResponse_TargetChange{
+			TargetChange: &pb.TargetChange{TargetChangeType: typ, TargetIds: []int32{id}},
+		}}
+	}
+	var resps []*pb.ListenResponse
+	for _, id := range ids {
+		t := targets[id]
+		if t.added {
+			resps = append(resps, targetChange(pb.TargetChange_ADD, id))
+		}
+		results := s.targetResults(t, rt)
+		var names []string
+		for name := range results {
+			names = append(names, name)
+		}
+		for name := range t.seen {
+			if results[name] == nil {
+				names = append(names, name)
+			}
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			d := results[name]
+			switch {
+			case d == nil && s.docAt(name, rt) == nil:
+				resps = append(resps, &pb.ListenResponse{ResponseType: &pb.ListenResponse_DocumentDelete{
+					DocumentDelete: &pb.DocumentDelete{Document: name, RemovedTargetIds: []int32{id}, ReadTime: readTime},
+				}})
+				delete(t.seen, name)
+			case d == nil:
+				resps = append(resps, &pb.ListenResponse{ResponseType: &pb.ListenResponse_DocumentRemove{
+					DocumentRemove: &pb.DocumentRemove{Document: name, RemovedTargetIds: []int32{id}, ReadTime: readTime},
+				}})
+				delete(t.seen, name)
+			case !proto.Equal(d.UpdateTime, t.seen[name]):
+				resps = append(resps, &pb.ListenResponse{ResponseType: &pb.ListenResponse_DocumentChange{
+					DocumentChange: &pb.DocumentChange{Document: d, TargetIds: []int32{id}},
+				}})
+				t.seen[name] = d.UpdateTime
+			}
+		}
+		if t.added {
+			resps = append(resps, targetChange(pb.TargetChange_CURRENT, id))
+			t.added = false
+		}
+	}
+	if len(resps) == 0 {
+		return nil
+	}
+	return append(resps, &pb.ListenResponse{ResponseType: &pb.ListenResponse_TargetChange{
+		TargetChange: &pb.TargetChange{
+			TargetChangeType: pb.TargetChange_NO_CHANGE,
+			ReadTime:         readTime,
+			ResumeToken:      resumeToken(rt),
+		},
+	}})
+}
@@ -0,0 +1,465 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fstest
+
+import (
+	"context"
+	"math"
+	"sort"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/firestore/internal/fieldpath"
+	pb "google.golang.org/genproto/googleapis/firestore/v1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// nameField is the field path that refers to a document's name.
+const nameField = "__name__"
+
+// RunQuery runs a structured query.
+func (s *GServer) RunQuery(req *pb.RunQueryRequest, stream pb.Firestore_RunQueryServer) error {
+	q, err := compileQuery(req.Parent, req.GetStructuredQuery())
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	c, err := s.resolveConsistency(req.GetTransaction(), req.GetNewTransaction(), req.GetReadTime())
+	if err != nil {
+		s.mu.Unlock()
+		return err
+	}
+	docs := s.runQuery(q, c.readTime)
+	if c.txn != nil && !c.txn.readOnly {
+		for _, d := range docs {
+			s.read(c, d.Name)
+		}
+	}
+	s.mu.Unlock()
+
+	readTime := timestamp(c.readTime)
+	if len(docs) == 0 {
+		// Report the read time, and any new transaction, even if there are
+		// no results.
+		return stream.Send(&pb.RunQueryResponse{Transaction: c.newTxn, ReadTime: readTime})
+	}
+	for i, d := range docs {
+		resp := &pb.RunQueryResponse{Document: d, ReadTime: readTime}
+		if i == 0 {
+			resp.Transaction = c.newTxn
+		}
+		if err := stream.Send(resp); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// PartitionQuery splits the results of a collection group query, ordered by
+// name, into at most PartitionCount+1 ranges of about the same size, and
+// returns the document references that separate them.
+func (s *GServer) PartitionQuery(_ context.Context, req *pb.PartitionQueryRequest) (*pb.PartitionQueryResponse, error) {
+	q, err := compileQuery(req.Parent, req.GetStructuredQuery())
+	if err != nil {
+		return nil, err
+	}
+	if !q.allDescendants || len(q.filters) > 0 || q.start != nil || q.end != nil || q.offset > 0 || q.limit >= 0 {
+		return nil, status.Error(codes.InvalidArgument, "partitioned queries must be unfiltered collection group queries")
+	}
+	if len(q.orders) != 1 || q.orders[0].desc {
+		return nil, status.Error(codes.InvalidArgument, "partitioned queries must be ordered by name ascending")
+	}
+	if req.PartitionCount <= 0 {
+		return nil, status.Error(codes.InvalidArgument, "partition count must be positive")
+	}
+	s.mu.Lock()
+	docs := s.runQuery(q, s.now)
+	s.mu.Unlock()
+
+	n := int(req.PartitionCount) + 1
+	if n > len(docs) {
+		n = len(docs)
+	}
+	var cursors []*pb.Cursor
+	for i := 1; i < n; i++ {
+		name := docs[i*len(docs)/n].Name
+		cursors = append(cursors, &pb.Cursor{Values: []*pb.Value{{ValueType: &pb.Value_ReferenceValue{ReferenceValue: name}}}})
+	}
+	from, to, next, err := page(len(cursors), req.PageSize, req.PageToken)
+	if err != nil {
+		return nil, err
+	}
+	return &pb.PartitionQueryResponse{Partitions: cursors[from:to], NextPageToken: next}, nil
+}
+
+// A query is a compiled structured query.
+type query struct {
+	parent         string
+	collectionID   string
+	allDescendants bool
+	filters        []fieldFilter
+	orders         []fieldOrder
+	start, end     *pb.Cursor
+	offset         int
+	limit          int // negative for no limit
+	// projection is nil for no projection.
+	projection [][]string
+}
+
+type fieldFilter struct {
+	path []string
+	// Exactly one of op and unary is set.
+	op    pb.StructuredQuery_FieldFilter_Operator
+	unary pb.StructuredQuery_UnaryFilter_Operator
+	value *pb.Value
+}
+
+type fieldOrder struct {
+	path []string
+	desc bool
+}
+
+func compileQuery(parent string, sq *pb.StructuredQuery) (*query, error) {
+	if sq == nil {
+		return nil, status.Error(codes.InvalidArgument, "missing structured query")
+	}
+	if len(sq.From) != 1 {
+		return nil, status.Error(codes.InvalidArgument, "query must have exactly one collection selector")
+	}
+	q := &query{
+		parent:         parent,
+		collectionID:   sq.From[0].CollectionId,
+		allDescendants: sq.From[0].AllDescendants,
+		start:          sq.StartAt,
+		end:            sq.EndAt,
+		offset:         int(sq.Offset),
+		limit:          -1,
+	}
+	if q.collectionID == "" && !q.allDescendants {
+		return nil, status.Error(codes.InvalidArgument, "missing collection ID")
+	}
+	if sq.Limit != nil {
+		q.limit = int(sq.Limit.Value)
+	}
+	if sq.Select != nil {
+		q.projection = [][]string{}
+		for _, f := range sq.Select.Fields {
+			path, err := fieldRefPath(f)
+			if err != nil {
+				return nil, err
+			}
+			q.projection = append(q.projection, path)
+		}
+	}
+	if err := q.addFilter(sq.Where); err != nil {
+		return nil, err
+	}
+
+	// Add the implicit orders: first by the inequality field if there are no
+	// explicit orders, then by name, in the direction of the last order.
+	var ineq []string
+	for _, f := range q.filters {
+		switch f.op {
+		case pb.StructuredQuery_FieldFilter_LESS_THAN, pb.StructuredQuery_FieldFilter_LESS_THAN_OR_EQUAL,
+			pb.StructuredQuery_FieldFilter_GREATER_THAN, pb.StructuredQuery_FieldFilter_GREATER_THAN_OR_EQUAL:
+			if ineq != nil && !equalPaths(ineq, f.path) {
+				return nil, status.Error(codes.InvalidArgument, "inequality filters on multiple fields")
+			}
+			ineq = f.path
+		}
+	}
+	for _, o := range sq.OrderBy {
+		path, err := fieldRefPath(o.Field)
+		if err != nil {
+			return nil, err
+		}
+		q.orders = append(q.orders, fieldOrder{path: path, desc: o.Direction == pb.StructuredQuery_DESCENDING})
+	}
+	if len(q.orders) == 0 && ineq != nil {
+		q.orders = append(q.orders, fieldOrder{path: ineq})
+	} else if ineq != nil && !equalPaths(q.orders[0].path, ineq) {
+		return nil, status.Error(codes.InvalidArgument, "the first order must be on the inequality field")
+	}
+	hasName := false
+	for _, o := range q.orders {
+		hasName = hasName || isNamePath(o.path)
+	}
+	if !hasName {
+		desc := len(q.orders) > 0 && q.orders[len(q.orders)-1].desc
+		q.orders = append(q.orders, fieldOrder{path: []string{nameField}, desc: desc})
+	}
+	for _, c := range []*pb.Cursor{q.start, q.end} {
+		if c != nil && len(c.Values) > len(q.orders) {
+			return nil, status.Error(codes.InvalidArgument, "too many cursor values")
+		}
+	}
+	return q, nil
+}
+
+func (q *query) addFilter(f *pb.StructuredQuery_Filter) error {
+	if f == nil {
+		return nil
+	}
+	switch ft := f.FilterType.(type) {
+	case *pb.StructuredQuery_Filter_CompositeFilter:
+		if ft.CompositeFilter.Op != pb.StructuredQuery_CompositeFilter_AND {
+			return status.Errorf(codes.InvalidArgument, "bad composite filter operator %v", ft.CompositeFilter.Op)
+		}
+		for _, sub := range ft.CompositeFilter.Filters {
+			if err := q.addFilter(sub); err != nil {
+				return err
+			}
+		}
+	case *pb.StructuredQuery_Filter_FieldFilter:
+		path, err := fieldRefPath(ft.FieldFilter.Field)
+		if err != nil {
+			return err
+		}
+		op := ft.FieldFilter.Op
+		if op == pb.StructuredQuery_FieldFilter_OPERATOR_UNSPECIFIED {
+			return status.Error(codes.InvalidArgument, "missing filter operator")
+		}
+		v := ft.FieldFilter.Value
+		if v == nil {
+			return status.Error(codes.InvalidArgument, "missing filter value")
+		}
+		if op == pb.StructuredQuery_FieldFilter_IN || op == pb.StructuredQuery_FieldFilter_ARRAY_CONTAINS_ANY {
+			if v.GetArrayValue() == nil || len(v.GetArrayValue().Values) == 0 {
+				return status.Errorf(codes.InvalidArgument, "%v filter needs a non-empty array", op)
+			}
+		}
+		q.filters = append(q.filters, fieldFilter{path: path, op: op, value: v})
+	case *pb.StructuredQuery_Filter_UnaryFilter:
+		path, err := fieldRefPath(ft.UnaryFilter.GetField())
+		if err != nil {
+			return err
+		}
+		q.filters = append(q.filters, fieldFilter{path: path, unary: ft.UnaryFilter.Op})
+	default:
+		return status.Error(codes.InvalidArgument, "bad filter")
+	}
+	return nil
+}
+
+func fieldRefPath(f *pb.StructuredQuery_FieldReference) ([]string, error) {
+	if f == nil {
+		return nil, status.Error(codes.InvalidArgument, "missing field reference")
+	}
+	path, err := fieldpath.Parse(f.FieldPath)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	return path, nil
+}
+
+func equalPaths(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func isNamePath(path []string) bool {
+	return len(path) == 1 && path[0] == nameField
+}
+
+// inCollection reports whether the named document is in the query's
+// collection, or one of its collection group. A collection group query
+// without a collection ID matches all the descendants of the parent.
+func (q *query) inCollection(name string) bool {
+	prefix := q.parent + "/"
+	if !strings.HasPrefix(name, prefix) {
+		return false
+	}
+	rest := strings.Split(name[len(prefix):], "/")
+	if !q.allDescendants {
+		return len(rest) == 2 && rest[0] == q.collectionID
+	}
+	return q.collectionID == "" || rest[len(rest)-2] == q.collectionID
+}
+
+// runQuery returns the results of q as of t.
+// Must hold the lock.
+func (s *GServer) runQuery(q *query, t time.Time) []*pb.Document {
+	var docs []*pb.Document
+	for name, r := range s.docs {
+		if !q.inCollection(name) {
+			continue
+		}
+		if d := r.at(t); d != nil && q.matches(d) {
+			docs = append(docs, d)
+		}
+	}
+	sort.Slice(docs, func(i, j int) bool { return q.compare(docs[i], docs[j]) < 0 })
+	var res []*pb.Document
+	skipped := 0
+	for _, d := range docs {
+		if q.start != nil && !q.afterStart(d) || q.end != nil && !q.beforeEnd(d) {
+			continue
+		}
+		if skipped < q.offset {
+			skipped++
+			continue
+		}
+		if q.limit >= 0 && len(res) == q.limit {
+			break
+		}
+		if q.projection != nil {
+			d = project(d, q.projection)
+		}
+		res = append(res, cloneDoc(d))
+	}
+	return res
+}
+
+// fieldValue returns the value of a field of d, or nil.
+func fieldValue(d *pb.Document, path []string) *pb.Value {
+	if isNamePath(path) {
+		return &pb.Value{ValueType: &pb.Value_ReferenceValue{ReferenceValue: d.Name}}
+	}
+	return getField(d.Fields, path)
+}
+
+// matches reports whether d satisfies the query's filters and has all its
+// order fields.
+func (q *query) matches(d *pb.Document) bool {
+	for _, o := range q.orders {
+		if fieldValue(d, o.path) == nil {
+			return false
+		}
+	}
+	for _, f := range q.filters {
+		if !f.matches(fieldValue(d, f.path)) {
+			return false
+		}
+	}
+	return true
+}
+
+func (f *fieldFilter) matches(v *pb.Value) bool {
+	if v == nil {
+		return false
+	}
+	switch f.unary {
+	case pb.StructuredQuery_UnaryFilter_IS_NAN:
+		return isNumber(v) && math.IsNaN(toFloat(v))
+	case pb.StructuredQuery_UnaryFilter_IS_NULL:
+		return v.GetNullValue() == 0 && typeOrder(v) == 0
+	}
+	switch f.op {
+	case pb.StructuredQuery_FieldFilter_EQUAL:
+		return equalValues(v, f.value)
+	case pb.StructuredQuery_FieldFilter_ARRAY_CONTAINS:
+		return arrayContains(v, f.value)
+	case pb.StructuredQuery_FieldFilter_IN:
+		for _, e := range f.value.GetArrayValue().GetValues() {
+			if equalValues(v, e) {
+				return true
+			}
+		}
+		return false
+	case pb.StructuredQuery_FieldFilter_ARRAY_CONTAINS_ANY:
+		for _, e := range f.value.GetArrayValue().GetValues() {
+			if arrayContains(v, e) {
+				return true
+			}
+		}
+		return false
+	}
+	// Inequalities only match values of the same type, and never NaN.
+	if typeOrder(v) != typeOrder(f.value) {
+		return false
+	}
+	if isNumber(v) && (math.IsNaN(toFloat(v)) || math.IsNaN(toFloat(f.value))) {
+		return false
+	}
+	c := compareValues(v, f.value)
+	switch f.op {
+	case pb.StructuredQuery_FieldFilter_LESS_THAN:
+		return c < 0
+	case pb.StructuredQuery_FieldFilter_LESS_THAN_OR_EQUAL:
+		return c <= 0
+	case pb.StructuredQuery_FieldFilter_GREATER_THAN:
+		return c > 0
+	case pb.StructuredQuery_FieldFilter_GREATER_THAN_OR_EQUAL:
+		return c >= 0
+	}
+	return false
+}
+
+func arrayContains(arr, v *pb.Value) bool {
+	for _, e := range arr.GetArrayValue().GetValues() {
+		if equalValues(e, v) {
+			return true
+		}
+	}
+	return false
+}
+
+// compare orders two documents by the query's orders.
+func (q *query) compare(a, b *pb.Document) int {
+	for _, o := range q.orders {
+		c := compareValues(fieldValue(a, o.path), fieldValue(b, o.path))
+		if o.desc {
+			c = -c
+		}
+		if c != 0 {
+			return c
+		}
+	}
+	return 0
+}
+
+// compareCursor compares d with the position of a cursor, considering only as
+// many orders as the cursor has values.
+func (q *query) compareCursor(d *pb.Document, c *pb.Cursor) int {
+	for i, cv := range c.Values {
+		o := q.orders[i]
+		v := fieldValue(d, o.path)
+		var r int
+		if isNamePath(o.path) && cv.GetReferenceValue() != "" && !strings.Contains(cv.GetReferenceValue(), "/documents/") {
+			// A relative document name.
+			r = compareNames(d.Name, q.parent+"/"+cv.GetReferenceValue())
+		} else {
+			r = compareValues(v, cv)
+		}
+		if o.desc {
+			r = -r
+		}
+		if r != 0 {
+			return r
+		}
+	}
+	return 0
+}
+
+// afterStart reports whether d is at or after the start cursor. A cursor
+// with Before set is positioned before the documents equal to its values.
+func (q *query) afterStart(d *pb.Document) bool {
+	c := q.compareCursor(d, q.start)
+	return c > 0 || c == 0 && q.start.Before
+}
+
+// beforeEnd reports whether d is before the end cursor.
+func (q *query) beforeEnd(d *pb.Document) bool {
+	c := q.compareCursor(d, q.end)
+	return c < 0 || c == 0 && !q.end.Before
+}
@@ -0,0 +1,266 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fstest
+
+import (
+	"bytes"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/golang/protobuf/proto"
+	pb "google.golang.org/genproto/googleapis/firestore/v1"
+)
+
+// compareValues orders values as Firestore does: first by type, then by
+// value. Integers and doubles are compared as numbers, with NaN first.
+func compareValues(a, b *pb.Value) int {
+	ta, tb := typeOrder(a), typeOrder(b)
+	if ta != tb {
+		return compareInt64s(int64(ta), int64(tb))
+	}
+	switch av := a.ValueType.(type) {
+	case *pb.Value_BooleanValue:
+		x, y := av.BooleanValue, b.GetBooleanValue()
+		switch {
+		case x == y:
+			return 0
+		case !x:
+			return -1
+		}
+		return 1
+	case *pb.Value_IntegerValue:
+		if bv, ok := b.ValueType.(*pb.Value_IntegerValue); ok {
+			return compareInt64s(av.IntegerValue, bv.IntegerValue)
+		}
+		return compareNumbers(float64(av.IntegerValue), toFloat(b))
+	case *pb.Value_DoubleValue:
+		return compareNumbers(av.DoubleValue, toFloat(b))
+	case *pb.Value_TimestampValue:
+		at, bt := av.TimestampValue, b.GetTimestampValue()
+		if c := compareInt64s(at.GetSeconds(), bt.GetSeconds()); c != 0 {
+			return c
+		}
+		return compareInt64s(int64(at.GetNanos()), int64(bt.GetNanos()))
+	case *pb.Value_StringValue:
+		return strings.Compare(av.StringValue, b.GetStringValue())
+	case *pb.Value_BytesValue:
+		return bytes.Compare(av.BytesValue, b.GetBytesValue())
+	case *pb.Value_ReferenceValue:
+		return compareNames(av.ReferenceValue, b.GetReferenceValue())
+	case *pb.Value_GeoPointValue:
+		ag, bg := av.GeoPointValue, b.GetGeoPointValue()
+		if c := compareNumbers(ag.GetLatitude(), bg.GetLatitude()); c != 0 {
+			return c
+		}
+		return compareNumbers(ag.GetLongitude(), bg.GetLongitude())
+	case *pb.Value_ArrayValue:
+		x, y := av.ArrayValue.GetValues(), b.GetArrayValue().GetValues()
+		for i := 0; i < len(x) && i < len(y); i++ {
+			if c := compareValues(x[i], y[i]); c != 0 {
+				return c
+			}
+		}
+		return compareInt64s(int64(len(x)), int64(len(y)))
+	case *pb.Value_MapValue:
+		x, y := av.MapValue.GetFields(), b.GetMapValue().GetFields()
+		xk, yk := sortedKeys(x), sortedKeys(y)
+		for i := 0; i < len(xk) && i < len(yk); i++ {
+			if c := strings.Compare(xk[i], yk[i]); c != 0 {
+				return c
+			}
+			if c := compareValues(x[xk[i]], y[yk[i]]); c != 0 {
+				return c
+			}
+		}
+		return compareInt64s(int64(len(xk)), int64(len(yk)))
+	}
+	return 0
+}
+
+// typeOrder gives the position of a value's type in Firestore's ordering.
+func typeOrder(v *pb.Value) int {
+	switch v.ValueType.(type) {
+	case *pb.Value_NullValue:
+		return 0
+	case *pb.Value_BooleanValue:
+		return 1
+	case *pb.Value_IntegerValue, *pb.Value_DoubleValue:
+		return 2
+	case *pb.Value_TimestampValue:
+		return 3
+	case *pb.Value_StringValue:
+		return 4
+	case *pb.Value_BytesValue:
+		return 5
+	case *pb.Value_ReferenceValue:
+		return 6
+	case *pb.Value_GeoPointValue:
+		return 7
+	case *pb.Value_ArrayValue:
+		return 8
+	case *pb.Value_MapValue:
+		return 9
+	}
+	return 10
+}
+
+func isNumber(v *pb.Value) bool {
+	switch v.ValueType.(type) {
+	case *pb.Value_IntegerValue, *pb.Value_DoubleValue:
+		return true
+	}
+	return false
+}
+
+func toFloat(v *pb.Value) float64 {
+	if x, ok := v.ValueType.(*pb.Value_IntegerValue); ok {
+		return float64(x.IntegerValue)
+	}
+	return v.GetDoubleValue()
+}
+
+// compareNumbers orders NaN before all other numbers.
+func compareNumbers(a, b float64) int {
+	an, bn := math.IsNaN(a), math.IsNaN(b)
+	switch {
+	case an && bn:
+		return 0
+	case an:
+		return -1
+	case bn:
+		return 1
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+func compareInt64s(a, b int64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+// compareNames orders document names segment by segment.
+func compareNames(a, b string) int {
+	as, bs := strings.Split(a, "/"), strings.Split(b, "/")
+	for i := 0; i < len(as) && i < len(bs); i++ {
+		if c := compareIDs(as[i], bs[i]); c != 0 {
+			return c
+		}
+	}
+	return compareInt64s(int64(len(as)), int64(len(bs)))
+}
+
+// compareIDs orders the segments of document names. Numeric IDs, of the form
+// __id<n>__, sort by number before string IDs.
+func compareIDs(a, b string) int {
+	an, aNum := numericID(a)
+	bn, bNum := numericID(b)
+	switch {
+	case aNum && bNum:
+		return compareInt64s(an, bn)
+	case aNum:
+		return -1
+	case bNum:
+		return 1
+	}
+	return strings.Compare(a, b)
+}
+
+func numericID(id string) (int64, bool) {
+	if !strings.HasPrefix(id, "__id") || !strings.HasSuffix(id, "__") || len(id) < len("__id__") {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(id[len("__id"):len(id)-len("__")], 10, 64)
+	return n, err == nil
+}
+
+func sortedKeys(m map[string]*pb.Value) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// equalValues reports whether two values are equal, as for an EQUAL filter.
+// Unlike compareValues, NaN is not equal to itself.
+func equalValues(a, b *pb.Value) bool {
+	if isNumber(a) && math.IsNaN(toFloat(a)) {
+		return false
+	}
+	return compareValues(a, b) == 0
+}
+
+// getField returns the value at path in fields, or nil.
+func getField(fields map[string]*pb.Value, path []string) *pb.Value {
+	for i, seg := range path {
+		v, ok := fields[seg]
+		if !ok {
+			return nil
+		}
+		if i == len(path)-1 {
+			return v
+		}
+		fields = v.GetMapValue().GetFields()
+		if fields == nil {
+			return nil
+		}
+	}
+	return nil
+}
+
+// setField sets the value at path in fields, creating or replacing
+// intermediate maps as needed. A nil value deletes the field.
+func setField(fields map[string]*pb.Value, path []string, v *pb.Value) {
+	for _, seg := range path[:len(path)-1] {
+		m := fields[seg].GetMapValue()
+		if m == nil {
+			if v == nil {
+				return
+			}
+			m = &pb.MapValue{}
+			fields[seg] = &pb.Value{ValueType: &pb.Value_MapValue{MapValue: m}}
+		}
+		if m.Fields == nil {
+			m.Fields = map[string]*pb.Value{}
+		}
+		fields = m.Fields
+	}
+	last := path[len(path)-1]
+	if v == nil {
+		delete(fields, last)
+	} else {
+		fields[last] = v
+	}
+}
+
+// cloneDoc returns a deep copy of d.
+func cloneDoc(d *pb.Document) *pb.Document {
+	if d == nil {
+		return nil
+	}
+	return proto.Clone(d).(*pb.Document)
+}
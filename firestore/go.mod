@@ -5,12 +5,12 @@ go 1.11
 require (
 	cloud.google.com/go v0.53.0
 	cloud.google.com/go/storage v1.6.0 // indirect
-	github.com/golang/protobuf v1.3.4
+	github.com/golang/protobuf v1.4.1
 	github.com/google/go-cmp v0.4.0
 	github.com/googleapis/gax-go/v2 v2.0.5
 	golang.org/x/net v0.0.0-20200226121028-0de0cce0169b // indirect
 	golang.org/x/tools v0.0.0-20200227222343-706bc42d1f0d // indirect
 	google.golang.org/api v0.19.0
-	google.golang.org/genproto v0.0.0-20200228133532-8c2c7df3a383
+	google.golang.org/genproto v0.0.0-20201110150050-8816d57aaa9a
 	google.golang.org/grpc v1.27.1
 )
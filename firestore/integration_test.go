@@ -1429,6 +1429,36 @@ func TestIntegration_CollectionGroupQueries(t *testing.T) {
 	}
 }
 
+// TestIntegration_RecursiveDelete runs the name bounds of a recursive delete
+// of a collection against the service, whose ordering of document names the
+// fake only imitates.
+func TestIntegration_RecursiveDelete(t *testing.T) {
+	ctx := context.Background()
+	h := testHelper{t}
+	client := integrationClient(t)
+	collID := collectionIDs.New()
+	coll := client.Collection(collID)
+	// IDs that sort before and after the other IDs of the collection, and a
+	// collection whose ID extends that of coll.
+	docs := []*DocumentRef{coll.Doc("0"), coll.Doc("A"), coll.Doc("a"), coll.Doc("a").Collection("sub").Doc("x"), coll.Doc("~")}
+	for _, d := range docs {
+		h.mustCreate(d, map[string]interface{}{})
+	}
+	sibling := client.Collection(collID + "0").Doc("a")
+	h.mustCreate(sibling, map[string]interface{}{})
+	defer h.mustDelete(sibling)
+
+	if err := coll.RecursiveDelete(ctx, nil); err != nil {
+		t.Fatal(err)
+	}
+	for _, d := range docs {
+		if _, err := d.Get(ctx); status.Code(err) != codes.NotFound {
+			t.Errorf("%s: got %v, want NotFound", d.Path, err)
+		}
+	}
+	h.mustGet(sibling)
+}
+
 func codeEq(t *testing.T, msg string, code codes.Code, err error) {
 	if status.Code(err) != code {
 		t.Fatalf("%s:\ngot <%v>\nwant code %s", msg, err, code)
@@ -0,0 +1,66 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package fieldpath parses the field paths of the Firestore service.
+package fieldpath
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Parse splits a field path into its segments. Segments are
+// separated by dots, and may be quoted with backticks, within which a
+// backslash escapes the next character.
+func Parse(s string) ([]string, error) {
+	if s == "" {
+		return nil, errors.New("empty field path")
+	}
+	var segs []string
+	for len(s) > 0 {
+		var seg strings.Builder
+		if s[0] == '`' {
+			i := 1
+			for ; i < len(s) && s[i] != '`'; i++ {
+				if s[i] == '\\' && i+1 < len(s) {
+					i++
+				}
+				seg.WriteByte(s[i])
+			}
+			if i == len(s) {
+				return nil, fmt.Errorf("unterminated quote in field path %q", s)
+			}
+			s = s[i+1:]
+		} else {
+			i := strings.IndexByte(s, '.')
+			if i < 0 {
+				i = len(s)
+			}
+			seg.WriteString(s[:i])
+			s = s[i:]
+		}
+		if seg.Len() == 0 {
+			return nil, fmt.Errorf("empty segment in field path")
+		}
+		segs = append(segs, seg.String())
+		if len(s) > 0 {
+			if s[0] != '.' || len(s) == 1 {
+				return nil, fmt.Errorf("bad field path %q", s)
+			}
+			s = s[1:]
+		}
+	}
+	return segs, nil
+}
@@ -20,6 +20,7 @@ import (
 	"time"
 
 	"github.com/golang/protobuf/ptypes"
+	tspb "github.com/golang/protobuf/ptypes/timestamp"
 	pb "google.golang.org/genproto/googleapis/firestore/v1"
 )
 
@@ -173,3 +174,48 @@ func processSetOptions(opts []SetOption) (fps []FieldPath, all bool, err error)
 		return nil, false, fmt.Errorf("conflicting options: %+v", opts)
 	}
 }
+
+// A ReadOption configures how documents are read. See Client.WithReadOptions,
+// Query.WithReadOptions and WithReadOptions.
+type ReadOption interface {
+	applyRead(*readSettings)
+}
+
+// ReadTime returns a ReadOption that reads documents as they were at the
+// given time, rather than the latest versions. The time must be recent
+// enough that the service still has the versions of that time; typically,
+// within the past hour.
+func ReadTime(t time.Time) ReadOption { return readTime(t) }
+
+type readTime time.Time
+
+func (rt readTime) applyRead(rs *readSettings) { rs.readTime = time.Time(rt) }
+
+func (rt readTime) String() string { return fmt.Sprintf("ReadTime(%s)", time.Time(rt)) }
+
+// readSettings hold the effect of ReadOptions.
+type readSettings struct {
+	readTime time.Time // zero for the latest versions
+}
+
+// newReadSettings returns the settings of base, which may be nil, modified
+// by opts.
+func newReadSettings(base *readSettings, opts []ReadOption) *readSettings {
+	rs := &readSettings{}
+	if base != nil {
+		*rs = *base
+	}
+	for _, o := range opts {
+		o.applyRead(rs)
+	}
+	return rs
+}
+
+// readTimeProto returns the read time of rs, which may be nil, or nil to read
+// the latest versions.
+func (rs *readSettings) readTimeProto() (*tspb.Timestamp, error) {
+	if rs == nil || rs.readTime.IsZero() {
+		return nil, nil
+	}
+	return ptypes.TimestampProto(rs.readTime)
+}
@@ -15,7 +15,9 @@
 package firestore
 
 import (
+	"context"
 	"testing"
+	"time"
 
 	pb "google.golang.org/genproto/googleapis/firestore/v1"
 )
@@ -149,3 +151,86 @@ func TestProcessPreconditionsForUpdate(t *testing.T) {
 		}
 	}
 }
+
+func TestReadTime(t *testing.T) {
+	ctx := context.Background()
+	client, cleanup := newFakeClient(t, nil)
+	defer cleanup()
+
+	doc := client.Doc("C/a")
+	wr, err := doc.Set(ctx, map[string]interface{}{"n": 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := doc.Set(ctx, map[string]interface{}{"n": 2}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Doc("C/b").Set(ctx, map[string]interface{}{"n": 3}); err != nil {
+		t.Fatal(err)
+	}
+	past := ReadTime(wr.UpdateTime)
+
+	check := func(desc string, docs []*DocumentSnapshot, want ...int64) {
+		t.Helper()
+		var got []int64
+		for _, d := range docs {
+			if d.Exists() {
+				got = append(got, d.Data()["n"].(int64))
+			}
+		}
+		if len(got) != len(want) {
+			t.Errorf("%s: got %v, want %v", desc, got, want)
+			return
+		}
+		for i := range got {
+			if got[i] != want[i] {
+				t.Errorf("%s: got %v, want %v", desc, got, want)
+				return
+			}
+		}
+	}
+
+	pastClient := client.WithReadOptions(past)
+	docs, err := pastClient.GetAll(ctx, []*DocumentRef{pastClient.Doc("C/a"), pastClient.Doc("C/b")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	check("GetAll", docs, 1)
+	docs, err = pastClient.Collection("C").Documents(ctx).GetAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	check("client Documents", docs, 1)
+	docs, err = client.Collection("C").WithReadOptions(past).Documents(ctx).GetAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	check("query Documents", docs, 1)
+	// The query's options override the client's.
+	docs, err = pastClient.Collection("C").WithReadOptions(ReadTime(time.Time{})).Documents(ctx).GetAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	check("latest Documents", docs, 2, 3)
+
+	err = client.RunTransaction(ctx, func(ctx context.Context, tx *Transaction) error {
+		docs, err := tx.GetAll([]*DocumentRef{doc})
+		if err != nil {
+			return err
+		}
+		check("transaction GetAll", docs, 1)
+		docs, err = tx.Documents(client.Collection("C")).GetAll()
+		if err != nil {
+			return err
+		}
+		check("transaction Documents", docs, 1)
+		return nil
+	}, ReadOnly, WithReadOptions(past))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = client.RunTransaction(ctx, func(context.Context, *Transaction) error { return nil }, WithReadOptions(past))
+	if err != errReadOptionsWrite {
+		t.Errorf("got %v, want %v", err, errReadOptionsWrite)
+	}
+}
@@ -21,9 +21,13 @@ import (
 	"io"
 	"math"
 	"reflect"
+	"strings"
 	"time"
 
+	"cloud.google.com/go/firestore/internal/fieldpath"
 	"cloud.google.com/go/internal/btree"
+	"github.com/golang/protobuf/proto"
+	tspb "github.com/golang/protobuf/ptypes/timestamp"
 	"github.com/golang/protobuf/ptypes/wrappers"
 	"google.golang.org/api/iterator"
 	pb "google.golang.org/genproto/googleapis/firestore/v1"
@@ -46,6 +50,8 @@ type Query struct {
 	startVals, endVals     []interface{}
 	startDoc, endDoc       *DocumentSnapshot
 	startBefore, endBefore bool
+	limitToLast            bool
+	readSettings           *readSettings
 	err                    error
 
 	// allDescendants indicates whether this query is for all collections
@@ -164,8 +170,36 @@ func (q Query) Offset(n int) Query {
 
 // Limit returns a new Query that specifies the maximum number of results to return.
 // It must not be negative.
+//
+// Calling Limit overrides a previous call to Limit or LimitToLast.
 func (q Query) Limit(n int) Query {
 	q.limit = &wrappers.Int32Value{Value: trunc32(n)}
+	q.limitToLast = false
+	return q
+}
+
+// LimitToLast returns a new Query that specifies the maximum number of results
+// to return, counting from the end of the results rather than the start. For
+// example, ordering by time and limiting to last 10 returns the 10 latest
+// documents, from oldest to latest. It must not be negative.
+//
+// A query with LimitToLast must have at least one OrderBy clause. The query
+// sent to the service has its orders and cursors reversed, and the results
+// are returned in the order of the original query; so the query's Documents
+// iterator returns no results until all of them have been received.
+//
+// Calling LimitToLast overrides a previous call to Limit or LimitToLast.
+func (q Query) LimitToLast(n int) Query {
+	q.limit = &wrappers.Int32Value{Value: trunc32(n)}
+	q.limitToLast = true
+	return q
+}
+
+// WithReadOptions returns a new Query that reads with the given options,
+// overriding those of the client. The options are ignored within a
+// transaction, and by Snapshots.
+func (q Query) WithReadOptions(opts ...ReadOption) Query {
+	q.readSettings = newReadSettings(q.readSettings, opts)
 	return q
 }
 
@@ -188,6 +222,10 @@ func (q Query) Limit(n int) Query {
 //
 //   client.Collection("States").OrderBy(DocumentID, firestore.Asc).StartAt("NewYork")
 //
+// The value for DocumentID may also be a *DocumentRef. This is the only way to
+// specify a document in a collection group query, where the documents are in
+// different collections.
+//
 // Calling StartAt overrides a previous call to StartAt or StartAfter.
 func (q Query) StartAt(docSnapshotOrFieldValues ...interface{}) Query {
 	q.startBefore = true
@@ -246,6 +284,9 @@ func (q Query) toProto() (*pb.StructuredQuery, error) {
 	if q.collectionID == "" {
 		return nil, errors.New("firestore: query created without CollectionRef")
 	}
+	if q.limitToLast && len(q.orders) == 0 {
+		return nil, errors.New("firestore: LimitToLast requires at least one OrderBy clause")
+	}
 	if q.startBefore {
 		if len(q.startVals) == 0 && q.startDoc == nil {
 			return nil, errors.New("firestore: StartAt/StartAfter must be called with at least one value")
@@ -318,9 +359,201 @@ func (q Query) toProto() (*pb.StructuredQuery, error) {
 		return nil, err
 	}
 	p.EndAt = cursor
+	if q.limitToLast {
+		// Reverse the query, so that the service returns the last results.
+		// The implicit order on the document name follows the last order,
+		// so it is reversed as well.
+		for _, o := range p.OrderBy {
+			if o.Direction == pb.StructuredQuery_DESCENDING {
+				o.Direction = pb.StructuredQuery_ASCENDING
+			} else {
+				o.Direction = pb.StructuredQuery_DESCENDING
+			}
+		}
+		// Swap the cursors. A cursor positioned before some documents in one
+		// direction is positioned after them in the other.
+		p.StartAt, p.EndAt = p.EndAt, p.StartAt
+		for _, c := range []*pb.Cursor{p.StartAt, p.EndAt} {
+			if c != nil {
+				c.Before = !c.Before
+			}
+		}
+	}
 	return p, nil
 }
 
+// Serialize returns the query in a form that can be sent to another process,
+// which turns it back into a Query with Deserialize. The read settings of the
+// query, such as the time it reads at, are not included.
+//
+// Queries with LimitToLast cannot be serialized.
+func (q Query) Serialize() ([]byte, error) {
+	if q.limitToLast {
+		return nil, errors.New("firestore: cannot serialize a LimitToLast query")
+	}
+	sq, err := q.toProto()
+	if err != nil {
+		return nil, err
+	}
+	return proto.Marshal(&pb.RunQueryRequest{
+		Parent:    q.parentPath,
+		QueryType: &pb.RunQueryRequest_StructuredQuery{StructuredQuery: sq},
+	})
+}
+
+// Deserialize returns the query serialized by Query.Serialize, using the
+// client of q. It is typically called on a query or collection reference of
+// a client, as in
+//
+//   q, err := client.Collection("C").Deserialize(b)
+func (q Query) Deserialize(bytes []byte) (Query, error) {
+	var req pb.RunQueryRequest
+	if err := proto.Unmarshal(bytes, &req); err != nil {
+		return Query{}, err
+	}
+	return q.c.queryFromProto(req.Parent, req.GetStructuredQuery())
+}
+
+// queryFromProto is the inverse of Query.toProto.
+func (c *Client) queryFromProto(parent string, sq *pb.StructuredQuery) (Query, error) {
+	if sq == nil || len(sq.From) != 1 {
+		return Query{}, errors.New("firestore: serialized query must have one collection selector")
+	}
+	q := Query{
+		c:              c,
+		parentPath:     parent,
+		collectionID:   sq.From[0].CollectionId,
+		allDescendants: sq.From[0].AllDescendants,
+		offset:         sq.Offset,
+		limit:          sq.Limit,
+	}
+	if q.allDescendants {
+		i := strings.Index(parent, "/documents")
+		if i < 0 {
+			return Query{}, fmt.Errorf("firestore: bad query parent %q", parent)
+		}
+		q.path = parent[:i]
+	} else {
+		q.path = parent + "/" + q.collectionID
+	}
+	if sq.Select != nil {
+		q.selection = []FieldPath{}
+		for _, f := range sq.Select.Fields {
+			fp, err := fieldpath.Parse(f.FieldPath)
+			if err != nil {
+				return Query{}, err
+			}
+			q.selection = append(q.selection, fp)
+		}
+	}
+	if err := q.addProtoFilter(sq.Where); err != nil {
+		return Query{}, err
+	}
+	for _, o := range sq.OrderBy {
+		fp, err := fieldpath.Parse(o.Field.GetFieldPath())
+		if err != nil {
+			return Query{}, err
+		}
+		q.orders = append(q.orders, order{fieldPath: fp, dir: Direction(o.Direction)})
+	}
+	var err error
+	if sq.StartAt != nil {
+		q.startBefore = sq.StartAt.Before
+		if q.startVals, err = cursorFromProto(sq.StartAt, c); err != nil {
+			return Query{}, err
+		}
+	}
+	if sq.EndAt != nil {
+		q.endBefore = sq.EndAt.Before
+		if q.endVals, err = cursorFromProto(sq.EndAt, c); err != nil {
+			return Query{}, err
+		}
+	}
+	return q, nil
+}
+
+// addProtoFilter adds the filters of f, which must be a field or unary filter
+// or a conjunction of them, to q.
+func (q *Query) addProtoFilter(f *pb.StructuredQuery_Filter) error {
+	switch ft := f.GetFilterType().(type) {
+	case nil:
+		return nil
+	case *pb.StructuredQuery_Filter_CompositeFilter:
+		if ft.CompositeFilter.Op != pb.StructuredQuery_CompositeFilter_AND {
+			return fmt.Errorf("firestore: bad composite filter operator %v", ft.CompositeFilter.Op)
+		}
+		for _, f := range ft.CompositeFilter.Filters {
+			if err := q.addProtoFilter(f); err != nil {
+				return err
+			}
+		}
+		return nil
+	case *pb.StructuredQuery_Filter_UnaryFilter:
+		fp, err := fieldpath.Parse(ft.UnaryFilter.GetField().GetFieldPath())
+		if err != nil {
+			return err
+		}
+		var v interface{}
+		switch ft.UnaryFilter.Op {
+		case pb.StructuredQuery_UnaryFilter_IS_NULL:
+			v = nil
+		case pb.StructuredQuery_UnaryFilter_IS_NAN:
+			v = math.NaN()
+		default:
+			return fmt.Errorf("firestore: bad unary filter operator %v", ft.UnaryFilter.Op)
+		}
+		q.filters = append(q.filters, filter{fieldPath: fp, op: "==", value: v})
+		return nil
+	case *pb.StructuredQuery_Filter_FieldFilter:
+		fp, err := fieldpath.Parse(ft.FieldFilter.GetField().GetFieldPath())
+		if err != nil {
+			return err
+		}
+		var op string
+		switch ft.FieldFilter.Op {
+		case pb.StructuredQuery_FieldFilter_LESS_THAN:
+			op = "<"
+		case pb.StructuredQuery_FieldFilter_LESS_THAN_OR_EQUAL:
+			op = "<="
+		case pb.StructuredQuery_FieldFilter_GREATER_THAN:
+			op = ">"
+		case pb.StructuredQuery_FieldFilter_GREATER_THAN_OR_EQUAL:
+			op = ">="
+		case pb.StructuredQuery_FieldFilter_EQUAL:
+			op = "=="
+		case pb.StructuredQuery_FieldFilter_IN:
+			op = "in"
+		case pb.StructuredQuery_FieldFilter_ARRAY_CONTAINS:
+			op = "array-contains"
+		case pb.StructuredQuery_FieldFilter_ARRAY_CONTAINS_ANY:
+			op = "array-contains-any"
+		default:
+			return fmt.Errorf("firestore: bad field filter operator %v", ft.FieldFilter.Op)
+		}
+		v, err := createFromProtoValue(ft.FieldFilter.Value, q.c)
+		if err != nil {
+			return err
+		}
+		q.filters = append(q.filters, filter{fieldPath: fp, op: op, value: v})
+		return nil
+	default:
+		return fmt.Errorf("firestore: bad filter type %T", ft)
+	}
+}
+
+// cursorFromProto returns the values of a cursor. References to documents,
+// such as those of DocumentID orders, are returned as *DocumentRefs.
+func cursorFromProto(cur *pb.Cursor, c *Client) ([]interface{}, error) {
+	vals := make([]interface{}, len(cur.Values))
+	for i, v := range cur.Values {
+		var err error
+		if vals[i], err = createFromProtoValue(v, c); err != nil {
+			return nil, err
+		}
+	}
+	return vals, nil
+}
+
 // If there is a start/end that uses a Document Snapshot, we may need to adjust the OrderBy
 // clauses that the user provided: we add OrderBy(__name__) if it isn't already present, and
 // we make sure we don't invalidate the original query by adding an OrderBy for inequality filters.
@@ -377,13 +610,18 @@ func (q *Query) fieldValuesToCursorValues(fieldValues []interface{}) ([]*pb.Valu
 	for i, ord := range q.orders {
 		fval := fieldValues[i]
 		if ord.isDocumentID() {
-			// TODO(jba): support DocumentRefs as well as strings.
 			// TODO(jba): error if document ref does not belong to the right collection.
-			docID, ok := fval.(string)
-			if !ok {
-				return nil, fmt.Errorf("firestore: expected doc ID for DocumentID field, got %T", fval)
+			switch v := fval.(type) {
+			case string:
+				vals[i] = &pb.Value{ValueType: &pb.Value_ReferenceValue{q.path + "/" + v}}
+			case *DocumentRef:
+				if v == nil {
+					return nil, errNilDocRef
+				}
+				vals[i] = &pb.Value{ValueType: &pb.Value_ReferenceValue{ReferenceValue: v.Path}}
+			default:
+				return nil, fmt.Errorf("firestore: expected doc ID or *DocumentRef for DocumentID field, got %T", fval)
 			}
-			vals[i] = &pb.Value{ValueType: &pb.Value_ReferenceValue{q.path + "/" + docID}}
 		} else {
 			var sawTransform bool
 			vals[i], sawTransform, err = toProtoValue(reflect.ValueOf(fval))
@@ -558,6 +796,16 @@ func (r order) toProto() (*pb.StructuredQuery_Order, error) {
 	}, nil
 }
 
+// readTime returns the time the query reads at, or nil to read the latest
+// versions.
+func (q *Query) readTime() (*tspb.Timestamp, error) {
+	rs := q.readSettings
+	if rs == nil {
+		rs = q.c.readSettings
+	}
+	return rs.readTimeProto()
+}
+
 func fref(fp FieldPath) *pb.StructuredQuery_FieldReference {
 	return &pb.StructuredQuery_FieldReference{FieldPath: fp.toServiceFieldPath()}
 }
@@ -642,6 +890,10 @@ type queryDocumentIterator struct {
 	q            *Query
 	tid          []byte // transaction ID, if any
 	streamClient pb.Firestore_RunQueryClient
+
+	// For LimitToLast queries, all the results in the query's order.
+	reversed       []*DocumentSnapshot
+	reversedLoaded bool
 }
 
 func newQueryDocumentIterator(ctx context.Context, q *Query, tid []byte) *queryDocumentIterator {
@@ -655,6 +907,35 @@ func newQueryDocumentIterator(ctx context.Context, q *Query, tid []byte) *queryD
 }
 
 func (it *queryDocumentIterator) next() (*DocumentSnapshot, error) {
+	if !it.q.limitToLast {
+		return it.recv()
+	}
+	if !it.reversedLoaded {
+		for {
+			ds, err := it.recv()
+			if err == iterator.Done {
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+			it.reversed = append(it.reversed, ds)
+		}
+		for i, j := 0, len(it.reversed)-1; i < j; i, j = i+1, j-1 {
+			it.reversed[i], it.reversed[j] = it.reversed[j], it.reversed[i]
+		}
+		it.reversedLoaded = true
+	}
+	if len(it.reversed) == 0 {
+		return nil, iterator.Done
+	}
+	ds := it.reversed[0]
+	it.reversed = it.reversed[1:]
+	return ds, nil
+}
+
+// recv returns the next result from the stream.
+func (it *queryDocumentIterator) recv() (*DocumentSnapshot, error) {
 	client := it.q.c
 	if it.streamClient == nil {
 		sq, err := it.q.toProto()
@@ -667,6 +948,10 @@ func (it *queryDocumentIterator) next() (*DocumentSnapshot, error) {
 		}
 		if it.tid != nil {
 			req.ConsistencySelector = &pb.RunQueryRequest_Transaction{it.tid}
+		} else if rt, err := it.q.readTime(); err != nil {
+			return nil, err
+		} else if rt != nil {
+			req.ConsistencySelector = &pb.RunQueryRequest_ReadTime{ReadTime: rt}
 		}
 		it.streamClient, err = client.c.RunQuery(it.ctx, req)
 		if err != nil {
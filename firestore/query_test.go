@@ -16,6 +16,7 @@ package firestore
 
 import (
 	"context"
+	"fmt"
 	"math"
 	"sort"
 	"testing"
@@ -869,3 +870,181 @@ func (b byQuery) Less(i, j int) bool {
 	}
 	return c < 0
 }
+
+func TestLimitToLastToProto(t *testing.T) {
+	c := &Client{projectID: "P", databaseID: "DB"}
+	q := c.Collection("C").OrderBy("a", Asc).OrderBy("b", Desc).StartAt(1, 2).EndBefore(3, 4).LimitToLast(2)
+	got, err := q.toProto()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &pb.StructuredQuery{
+		From: []*pb.StructuredQuery_CollectionSelector{{CollectionId: "C"}},
+		OrderBy: []*pb.StructuredQuery_Order{
+			{Field: fref1("a"), Direction: pb.StructuredQuery_DESCENDING},
+			{Field: fref1("b"), Direction: pb.StructuredQuery_ASCENDING},
+		},
+		StartAt: &pb.Cursor{Values: []*pb.Value{intval(3), intval(4)}, Before: false},
+		EndAt:   &pb.Cursor{Values: []*pb.Value{intval(1), intval(2)}, Before: false},
+		Limit:   &wrappers.Int32Value{Value: 2},
+	}
+	if !testEqual(got, want) {
+		t.Errorf("got\n%v\nwant\n%v", pretty.Value(got), pretty.Value(want))
+	}
+
+	if _, err := c.Collection("C").LimitToLast(1).toProto(); err == nil {
+		t.Error("got nil, want error for LimitToLast without OrderBy")
+	}
+	// Limit overrides LimitToLast.
+	got, err = c.Collection("C").LimitToLast(1).Limit(3).toProto()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Limit.Value != 3 || len(got.OrderBy) != 0 {
+		t.Errorf("got %v", got)
+	}
+}
+
+func TestLimitToLast(t *testing.T) {
+	ctx := context.Background()
+	client, cleanup := newFakeClient(t, nil)
+	defer cleanup()
+
+	coll := client.Collection("C")
+	for i := 1; i <= 5; i++ {
+		if _, err := coll.Doc(fmt.Sprintf("d%d", i)).Set(ctx, map[string]interface{}{"n": i}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ids := func(docs []*DocumentSnapshot) []string {
+		var res []string
+		for _, d := range docs {
+			res = append(res, d.Ref.ID)
+		}
+		return res
+	}
+	for _, test := range []struct {
+		q    Query
+		want []string
+	}{
+		{coll.OrderBy("n", Asc).LimitToLast(2), []string{"d4", "d5"}},
+		{coll.OrderBy("n", Desc).LimitToLast(2), []string{"d2", "d1"}},
+		{coll.OrderBy("n", Asc).EndBefore(5).LimitToLast(2), []string{"d3", "d4"}},
+		{coll.OrderBy("n", Asc).StartAfter(3).EndAt(5).LimitToLast(10), []string{"d4", "d5"}},
+	} {
+		docs, err := test.q.Documents(ctx).GetAll()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := ids(docs); !testEqual(got, test.want) {
+			t.Errorf("got %v, want %v", got, test.want)
+		}
+	}
+
+	it := coll.OrderBy("n", Asc).LimitToLast(2).Snapshots(ctx)
+	defer it.Stop()
+	qs, err := it.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	docs, err := qs.Documents.GetAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := ids(docs), []string{"d4", "d5"}; !testEqual(got, want) {
+		t.Errorf("snapshot: got %v, want %v", got, want)
+	}
+	if _, err := coll.Doc("d6").Set(ctx, map[string]interface{}{"n": 6}); err != nil {
+		t.Fatal(err)
+	}
+	qs, err = it.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	docs, err = qs.Documents.GetAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := ids(docs), []string{"d5", "d6"}; !testEqual(got, want) {
+		t.Errorf("snapshot: got %v, want %v", got, want)
+	}
+}
+
+func TestCollectionGroupDocumentRefCursors(t *testing.T) {
+	ctx := context.Background()
+	client, cleanup := newFakeClient(t, nil)
+	defer cleanup()
+
+	for _, p := range []string{"A/a/G/x", "A/b/G/y", "B/c/G/z", "G/w"} {
+		if _, err := client.Doc(p).Set(ctx, map[string]interface{}{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Split the collection group into two ranges at A/b/G/y.
+	q := client.CollectionGroup("G").OrderBy(DocumentID, Asc)
+	split := client.Doc("A/b/G/y")
+	var got []string
+	for _, part := range []Query{q.EndBefore(split), q.StartAt(split)} {
+		docs, err := part.Documents(ctx).GetAll()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var ids []string
+		for _, d := range docs {
+			ids = append(ids, d.Ref.ID)
+		}
+		got = append(got, fmt.Sprint(ids))
+	}
+	if want := []string{"[x]", "[y z w]"}; !testEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	if _, err := q.StartAt(3).toProto(); err == nil {
+		t.Error("got nil, want error for non-ID cursor value")
+	}
+}
+
+func TestQuerySerialize(t *testing.T) {
+	c := &Client{projectID: "P", databaseID: "DB"}
+	coll := c.Collection("C")
+	for _, q := range []Query{
+		coll.Query,
+		c.Doc("C/d").Collection("S").Select("a", "b.c"),
+		coll.Where("a", ">", 1).Where("b", "==", nil).Where("c", "==", math.NaN()),
+		coll.Where("a", "in", []int{1, 2}).Where("b", "array-contains-any", []string{"x"}),
+		coll.Where("a", "==", c.Doc("C/d")).Where("b", "array-contains", "x"),
+		coll.Where("a", "<=", "x").OrderBy("a", Desc).OrderBy(DocumentID, Desc).StartAfter("x", "d").EndAt("a", "e"),
+		coll.OrderBy("a.b", Asc).Offset(2).Limit(3),
+		c.CollectionGroup("G").OrderBy(DocumentID, Asc).StartAt(c.Doc("A/a/G/g")).EndBefore(c.Doc("B/b/G/g")),
+	} {
+		want, err := q.toProto()
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := q.Serialize()
+		if err != nil {
+			t.Fatal(err)
+		}
+		q2, err := coll.Deserialize(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if q2.path != q.path || q2.parentPath != q.parentPath {
+			t.Errorf("got paths %q, %q, want %q, %q", q2.path, q2.parentPath, q.path, q.parentPath)
+		}
+		got, err := q2.toProto()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !testEqual(got, want) {
+			t.Errorf("got  %v\nwant %v", pretty.Value(got), pretty.Value(want))
+		}
+	}
+
+	if _, err := coll.OrderBy("a", Asc).LimitToLast(1).Serialize(); err == nil {
+		t.Error("got nil, want error for LimitToLast")
+	}
+	if _, err := coll.Deserialize([]byte("junk")); err == nil {
+		t.Error("got nil, want error for bad bytes")
+	}
+}
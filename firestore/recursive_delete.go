@@ -0,0 +1,252 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package firestore
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+
+	"cloud.google.com/go/internal/trace"
+	"github.com/golang/protobuf/ptypes/wrappers"
+	pb "google.golang.org/genproto/googleapis/firestore/v1"
+)
+
+// The number of descendants read by each query of a recursive delete.
+// Variable for testing.
+var recursiveDeletePageSize = 1000
+
+// minDocumentID is the smallest document ID: the smallest numeric ID, in the
+// form the service gives to numeric IDs.
+const minDocumentID = "__id-9223372036854775808__"
+
+// RecursiveDeleteOptions configure the RecursiveDelete methods.
+type RecursiveDeleteOptions struct {
+	// BulkWriter, if non-nil, is used to delete the documents, and is not
+	// ended. Otherwise, RecursiveDelete uses a BulkWriter of its own.
+	BulkWriter *BulkWriter
+
+	// Progress, if non-nil, is called each time a batch of deletes has
+	// completed.
+	Progress func(RecursiveDeleteProgress)
+}
+
+// RecursiveDeleteProgress reports how far a recursive delete has got.
+type RecursiveDeleteProgress struct {
+	// Deleted is the number of documents deleted, and Failed the number that
+	// could not be deleted.
+	Deleted, Failed int
+}
+
+// A RecursiveDeleteError is returned by RecursiveDelete when some documents
+// could not be deleted. The other documents are deleted.
+type RecursiveDeleteError struct {
+	// Failures maps the paths of the documents that could not be deleted to
+	// the errors deleting them.
+	Failures map[string]error
+}
+
+func (e *RecursiveDeleteError) Error() string {
+	var paths []string
+	for p := range e.Failures {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	return fmt.Sprintf("firestore: failed to delete %d documents, including %s: %v", len(paths), paths[0], e.Failures[paths[0]])
+}
+
+// RecursiveDelete deletes the document, and all the documents in its
+// subcollections, at any depth. The documents are deleted in no particular
+// order, and not atomically: if RecursiveDelete fails, some of them may
+// have been deleted.
+//
+// If some documents cannot be deleted, RecursiveDelete deletes the rest and
+// returns a *RecursiveDeleteError.
+func (d *DocumentRef) RecursiveDelete(ctx context.Context, opts *RecursiveDeleteOptions) (err error) {
+	ctx = trace.StartSpan(ctx, "cloud.google.com/go/firestore.DocumentRef.RecursiveDelete")
+	defer func() { trace.EndSpan(ctx, err) }()
+
+	if d == nil {
+		return errNilDocRef
+	}
+	return d.Parent.c.recursiveDelete(ctx, d.Path, "", d, opts)
+}
+
+// RecursiveDelete deletes all the documents in the collection, and in their
+// subcollections, at any depth. It also deletes the documents in the
+// collection's subcollections whose parent documents do not exist.
+//
+// See DocumentRef.RecursiveDelete for details.
+func (c *CollectionRef) RecursiveDelete(ctx context.Context, opts *RecursiveDeleteOptions) (err error) {
+	ctx = trace.StartSpan(ctx, "cloud.google.com/go/firestore.CollectionRef.RecursiveDelete")
+	defer func() { trace.EndSpan(ctx, err) }()
+
+	return c.c.recursiveDelete(ctx, c.parentPath, c.Path, nil, opts)
+}
+
+// recursiveDelete deletes the descendants of the document or database
+// parent, restricted to those in the collection collPath if it is not
+// empty, and then deletes self if it is not nil.
+func (c *Client) recursiveDelete(ctx context.Context, parent, collPath string, self *DocumentRef, opts *RecursiveDeleteOptions) error {
+	if opts == nil {
+		opts = &RecursiveDeleteOptions{}
+	}
+	bw := opts.BulkWriter
+	if bw == nil {
+		bw = c.BulkWriter(ctx)
+		defer bw.End()
+	}
+
+	var prog RecursiveDeleteProgress
+	failures := map[string]error{}
+	type pendingDelete struct {
+		path string
+		job  *BulkWriterJob
+	}
+	var pending []pendingDelete
+	// wait waits for the pending deletes to complete.
+	wait := func() {
+		if len(pending) == 0 {
+			return
+		}
+		for _, p := range pending {
+			if _, err := p.job.Results(); err != nil {
+				failures[p.path] = err
+				prog.Failed++
+			} else {
+				prog.Deleted++
+			}
+		}
+		pending = nil
+		if opts.Progress != nil {
+			opts.Progress(prog)
+		}
+	}
+	del := func(dr *DocumentRef) error {
+		job, err := bw.Delete(dr)
+		if err != nil {
+			return err
+		}
+		pending = append(pending, pendingDelete{dr.Path, job})
+		return nil
+	}
+
+	after := ""
+	for {
+		// Read the next page while the previous one is being deleted.
+		names, err := c.descendantNames(ctx, parent, collPath, after)
+		wait()
+		if err != nil {
+			return err
+		}
+		for _, name := range names {
+			dr, err := pathToDoc(name, c)
+			if err != nil {
+				return err
+			}
+			if err := del(dr); err != nil {
+				return err
+			}
+		}
+		if len(names) < recursiveDeletePageSize {
+			break
+		}
+		after = names[len(names)-1]
+	}
+	if self != nil {
+		if err := del(self); err != nil {
+			return err
+		}
+	}
+	wait()
+	if len(failures) > 0 {
+		return &RecursiveDeleteError{Failures: failures}
+	}
+	return nil
+}
+
+// descendantNames returns the names of the first recursiveDeletePageSize
+// descendants of parent after the name after, in order. If collPath is not
+// empty, only the descendants in that collection are returned.
+//
+// It runs a query over all the collections under parent, with a range filter
+// on the document name to select a single collection.
+func (c *Client) descendantNames(ctx context.Context, parent, collPath, after string) ([]string, error) {
+	nameRef := fref(FieldPath{DocumentID})
+	sq := &pb.StructuredQuery{
+		From:    []*pb.StructuredQuery_CollectionSelector{{AllDescendants: true}},
+		Select:  &pb.StructuredQuery_Projection{Fields: []*pb.StructuredQuery_FieldReference{nameRef}},
+		OrderBy: []*pb.StructuredQuery_Order{{Field: nameRef, Direction: pb.StructuredQuery_ASCENDING}},
+		Limit:   &wrappers.Int32Value{Value: int32(recursiveDeletePageSize)},
+	}
+	if collPath != "" {
+		// Every document in the collection sorts between these names, and
+		// no other document does, because names are compared segment by
+		// segment. The lower bound names the document with the smallest
+		// ID: numeric IDs sort before string IDs.
+		nameFilter := func(op pb.StructuredQuery_FieldFilter_Operator, ref string) *pb.StructuredQuery_Filter {
+			return &pb.StructuredQuery_Filter{
+				FilterType: &pb.StructuredQuery_Filter_FieldFilter{
+					FieldFilter: &pb.StructuredQuery_FieldFilter{
+						Field: nameRef,
+						Op:    op,
+						Value: &pb.Value{ValueType: &pb.Value_ReferenceValue{ReferenceValue: ref}},
+					},
+				},
+			}
+		}
+		sq.Where = &pb.StructuredQuery_Filter{
+			FilterType: &pb.StructuredQuery_Filter_CompositeFilter{
+				CompositeFilter: &pb.StructuredQuery_CompositeFilter{
+					Op: pb.StructuredQuery_CompositeFilter_AND,
+					Filters: []*pb.StructuredQuery_Filter{
+						nameFilter(pb.StructuredQuery_FieldFilter_GREATER_THAN_OR_EQUAL, collPath+"/"+minDocumentID),
+						nameFilter(pb.StructuredQuery_FieldFilter_LESS_THAN, collPath+"\x00"),
+					},
+				},
+			},
+		}
+	}
+	if after != "" {
+		sq.StartAt = &pb.Cursor{
+			Values: []*pb.Value{{ValueType: &pb.Value_ReferenceValue{ReferenceValue: after}}},
+			Before: false,
+		}
+	}
+	req := &pb.RunQueryRequest{
+		Parent:    parent,
+		QueryType: &pb.RunQueryRequest_StructuredQuery{StructuredQuery: sq},
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stream, err := c.c.RunQuery(withResourceHeader(ctx, c.path()), req)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for {
+		res, err := stream.Recv()
+		if err == io.EOF {
+			return names, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if res.Document != nil {
+			names = append(names, res.Document.Name)
+		}
+	}
+}
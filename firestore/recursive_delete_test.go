@@ -0,0 +1,132 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package firestore
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"testing"
+
+	"cloud.google.com/go/internal/testutil"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// allDocPaths returns the short paths of all the documents in the database.
+func allDocPaths(t *testing.T, c *Client) []string {
+	t.Helper()
+	var paths []string
+	after := ""
+	for {
+		names, err := c.descendantNames(context.Background(), c.path()+"/documents", "", after)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, n := range names {
+			paths = append(paths, strings.TrimPrefix(n, c.path()+"/documents/"))
+		}
+		if len(names) < recursiveDeletePageSize {
+			break
+		}
+		after = names[len(names)-1]
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+func TestRecursiveDelete(t *testing.T) {
+	defer func(n int) { recursiveDeletePageSize = n }(recursiveDeletePageSize)
+	recursiveDeletePageSize = 3
+
+	ctx := context.Background()
+	for _, test := range []struct {
+		desc string
+		del  func(*Client, *RecursiveDeleteOptions) error
+		want []string
+	}{
+		{
+			"document",
+			func(c *Client, opts *RecursiveDeleteOptions) error { return c.Doc("C/a").RecursiveDelete(ctx, opts) },
+			[]string{"C/0", "C/b", "C/b/S/x", "C2/a", "D/a"},
+		},
+		{
+			"top-level collection",
+			func(c *Client, opts *RecursiveDeleteOptions) error { return c.Collection("C").RecursiveDelete(ctx, opts) },
+			[]string{"C2/a", "D/a"},
+		},
+		{
+			"subcollection",
+			func(c *Client, opts *RecursiveDeleteOptions) error {
+				return c.Collection("C/a/S").RecursiveDelete(ctx, opts)
+			},
+			[]string{"C/0", "C/a", "C/a/T/z", "C/b", "C/b/S/x", "C2/a", "D/a"},
+		},
+	} {
+		client, cleanup := newFakeClient(t, nil)
+		// C/a/S/x3 does not exist, but has a subcollection. C/0 sorts
+		// before "__id", the prefix of the lower bound of the collection,
+		// as a string but not as a document ID.
+		paths := []string{"C/0", "C/a", "C/a/S/x1", "C/a/S/x2", "C/a/S/x1/U/y", "C/a/S/x3/V/w", "C/a/T/z", "C/b", "C/b/S/x", "C2/a", "D/a"}
+		for _, p := range paths {
+			if _, err := client.Doc(p).Set(ctx, map[string]interface{}{}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		var progs []RecursiveDeleteProgress
+		err := test.del(client, &RecursiveDeleteOptions{
+			Progress: func(p RecursiveDeleteProgress) { progs = append(progs, p) },
+		})
+		if err != nil {
+			t.Fatalf("%s: %v", test.desc, err)
+		}
+		if got := allDocPaths(t, client); !testutil.Equal(got, test.want) {
+			t.Errorf("%s: got %v, want %v", test.desc, got, test.want)
+		}
+		if len(progs) == 0 {
+			t.Errorf("%s: no progress reported", test.desc)
+		} else if last := progs[len(progs)-1]; last.Failed != 0 || last.Deleted != len(paths)-len(test.want) {
+			t.Errorf("%s: got progress %+v, want %d deleted", test.desc, last, len(paths)-len(test.want))
+		}
+		cleanup()
+	}
+}
+
+func TestRecursiveDeleteFailures(t *testing.T) {
+	ctx := context.Background()
+	flaky := &flakyServer{code: codes.PermissionDenied}
+	client, cleanup := newFakeClient(t, flaky)
+	defer cleanup()
+
+	for _, p := range []string{"C/a", "C/a/S/x", "C/b"} {
+		if _, err := client.Doc(p).Set(ctx, map[string]interface{}{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Fail the first attempt to delete C/a/S/x.
+	flaky.failures = 1
+	flaky.attempts = map[string]int{client.Doc("C/b").Path: 1, client.Doc("C/a").Path: 1}
+	err := client.Collection("C").RecursiveDelete(ctx, nil)
+	rerr, ok := err.(*RecursiveDeleteError)
+	if !ok {
+		t.Fatalf("got %v, want a *RecursiveDeleteError", err)
+	}
+	if len(rerr.Failures) != 1 || status.Code(rerr.Failures[client.Doc("C/a/S/x").Path]) != codes.PermissionDenied {
+		t.Errorf("got failures %v", rerr.Failures)
+	}
+	if got, want := allDocPaths(t, client), []string{"C/a/S/x"}; !testutil.Equal(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
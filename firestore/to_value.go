@@ -46,6 +46,8 @@ var (
 //   an int64 to represent integral values, and those types can't be properly
 //   represented in an int64.
 // - An error is returned for the special Delete value.
+// - A value that implements ValueMarshaler, or an addressable value whose
+//   pointer does, converts itself.
 //
 // toProtoValue also reports whether it recursively encountered a transform.
 func toProtoValue(v reflect.Value) (pbv *pb.Value, sawTransform bool, err error) {
@@ -59,6 +61,16 @@ func toProtoValue(v reflect.Value) (pbv *pb.Value, sawTransform bool, err error)
 	if vi == ServerTimestamp {
 		return nil, false, errors.New("firestore: must use ServerTimestamp as a map value")
 	}
+	if m, ok := valueMarshaler(v); ok {
+		pv, err := m.MarshalFirestoreValue()
+		if err != nil {
+			return nil, false, err
+		}
+		if pv == nil {
+			return nullValue, false, nil
+		}
+		return pv, false, nil
+	}
 	switch x := vi.(type) {
 	case []byte:
 		return &pb.Value{ValueType: &pb.Value_BytesValue{x}}, false, nil
@@ -228,6 +240,9 @@ func structToProtoValue(v reflect.Value) (*pb.Value, bool, error) {
 		if opts.omitEmpty && isEmptyValue(fv) {
 			continue
 		}
+		if opts.omitZero && isZeroValue(fv) {
+			continue
+		}
 		val, sst, err := toProtoValue(fv)
 		if err != nil {
 			return nil, false, err
@@ -252,6 +267,7 @@ func structToProtoValue(v reflect.Value) (*pb.Value, bool, error) {
 
 type tagOptions struct {
 	omitEmpty       bool // do not marshal value if empty
+	omitZero        bool // do not marshal value if zero
 	serverTimestamp bool // set time.Time to server timestamp on write
 }
 
@@ -266,6 +282,8 @@ func parseTag(t reflect.StructTag) (name string, keep bool, other interface{}, e
 		switch opt {
 		case "omitempty":
 			tagOpts.omitEmpty = true
+		case "omitzero":
+			tagOpts.omitZero = true
 		case "serverTimestamp":
 			tagOpts.serverTimestamp = true
 		default:
@@ -278,7 +296,7 @@ func parseTag(t reflect.StructTag) (name string, keep bool, other interface{}, e
 // isLeafType determines whether or not a type is a 'leaf type'
 // and should not be recursed into, but considered one field.
 func isLeafType(t reflect.Type) bool {
-	return t == typeOfGoTime || t == typeOfLatLng || t == typeOfProtoTimestamp
+	return t == typeOfGoTime || t == typeOfLatLng || t == typeOfProtoTimestamp || isConverterType(t)
 }
 
 var fieldCache = fields.NewCache(parseTag, nil, isLeafType)
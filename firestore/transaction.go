@@ -34,6 +34,7 @@ type Transaction struct {
 	maxAttempts    int
 	readOnly       bool
 	readAfterWrite bool
+	readSettings   *readSettings
 }
 
 // A TransactionOption is an option passed to Client.Transaction.
@@ -60,11 +61,24 @@ type ro struct{}
 
 func (ro) config(t *Transaction) { t.readOnly = true }
 
+// WithReadOptions is a TransactionOption that configures the reads of a
+// read-only transaction. For example, with the ReadTime option, all the
+// reads of the transaction see the documents as they were at that time.
+// It is an error to use WithReadOptions without ReadOnly.
+func WithReadOptions(opts ...ReadOption) TransactionOption {
+	return readOptions(opts)
+}
+
+type readOptions []ReadOption
+
+func (ro readOptions) config(t *Transaction) { t.readSettings = newReadSettings(t.readSettings, ro) }
+
 var (
 	// Defined here for testing.
 	errReadAfterWrite    = errors.New("firestore: read after write in transaction")
 	errWriteReadOnly     = errors.New("firestore: write in read-only transaction")
 	errNestedTransaction = errors.New("firestore: nested transaction")
+	errReadOptionsWrite  = errors.New("firestore: read options in read-write transaction")
 )
 
 type transactionInProgressKey struct{}
@@ -105,10 +119,21 @@ func (c *Client) RunTransaction(ctx context.Context, f func(context.Context, *Tr
 	for _, opt := range opts {
 		opt.config(t)
 	}
+	if t.readSettings != nil && !t.readOnly {
+		return errReadOptionsWrite
+	}
 	var txOpts *pb.TransactionOptions
 	if t.readOnly {
+		ro := &pb.TransactionOptions_ReadOnly{}
+		rt, err := t.readSettings.readTimeProto()
+		if err != nil {
+			return err
+		}
+		if rt != nil {
+			ro.ConsistencySelector = &pb.TransactionOptions_ReadOnly_ReadTime{ReadTime: rt}
+		}
 		txOpts = &pb.TransactionOptions{
-			Mode: &pb.TransactionOptions_ReadOnly_{&pb.TransactionOptions_ReadOnly{}},
+			Mode: &pb.TransactionOptions_ReadOnly_{ro},
 		}
 	}
 	var backoff gax.Backoff
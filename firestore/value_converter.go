@@ -0,0 +1,129 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package firestore
+
+import (
+	"math"
+	"reflect"
+
+	pb "google.golang.org/genproto/googleapis/firestore/v1"
+)
+
+// ValueMarshaler is implemented by types that convert themselves to a
+// Firestore value. Set, Create, Update and the other write methods call
+// MarshalFirestoreValue instead of converting the value by reflection.
+//
+// A nil *pb.Value is written as a Firestore null.
+type ValueMarshaler interface {
+	MarshalFirestoreValue() (*pb.Value, error)
+}
+
+// ValueUnmarshaler is implemented by types that populate themselves from a
+// Firestore value. DataTo and DataAt call UnmarshalFirestoreValue instead of
+// populating the value by reflection. The *pb.Value must not be retained.
+//
+// UnmarshalFirestoreValue is also called with a null value, except when the
+// destination is a pointer, which is set to nil.
+type ValueUnmarshaler interface {
+	UnmarshalFirestoreValue(*pb.Value) error
+}
+
+var (
+	typeOfValueMarshaler   = reflect.TypeOf((*ValueMarshaler)(nil)).Elem()
+	typeOfValueUnmarshaler = reflect.TypeOf((*ValueUnmarshaler)(nil)).Elem()
+	typeOfZeroer           = reflect.TypeOf((*interface{ IsZero() bool })(nil)).Elem()
+)
+
+// valueMarshaler returns the ValueMarshaler for v, if v or, when it is
+// addressable, a pointer to v implements the interface.
+func valueMarshaler(v reflect.Value) (ValueMarshaler, bool) {
+	if v.Kind() == reflect.Ptr && v.IsNil() {
+		return nil, false
+	}
+	if v.Type().Implements(typeOfValueMarshaler) {
+		return v.Interface().(ValueMarshaler), true
+	}
+	if v.CanAddr() && reflect.PtrTo(v.Type()).Implements(typeOfValueMarshaler) {
+		return v.Addr().Interface().(ValueMarshaler), true
+	}
+	return nil, false
+}
+
+// valueUnmarshaler returns the ValueUnmarshaler for v, which must be
+// settable. If v is a nil pointer whose type implements the interface, a new
+// value is allocated.
+func valueUnmarshaler(v reflect.Value) (ValueUnmarshaler, bool) {
+	if v.Kind() == reflect.Ptr && v.Type().Implements(typeOfValueUnmarshaler) {
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		return v.Interface().(ValueUnmarshaler), true
+	}
+	if v.CanAddr() && reflect.PtrTo(v.Type()).Implements(typeOfValueUnmarshaler) {
+		return v.Addr().Interface().(ValueUnmarshaler), true
+	}
+	return nil, false
+}
+
+// isConverterType reports whether values of type t, or pointers to them,
+// convert themselves to or from Firestore values.
+func isConverterType(t reflect.Type) bool {
+	pt := reflect.PtrTo(t)
+	return t.Implements(typeOfValueMarshaler) || t.Implements(typeOfValueUnmarshaler) ||
+		pt.Implements(typeOfValueMarshaler) || pt.Implements(typeOfValueUnmarshaler)
+}
+
+// isZeroValue reports whether v is the zero value of its type, or has an
+// IsZero method that reports true. It is used for the omitzero tag option.
+func isZeroValue(v reflect.Value) bool {
+	if v.CanInterface() && v.Type().Implements(typeOfZeroer) {
+		if v.Kind() == reflect.Ptr && v.IsNil() {
+			return true
+		}
+		return v.Interface().(interface{ IsZero() bool }).IsZero()
+	}
+	switch v.Kind() {
+	case reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			if !isZeroValue(v.Index(i)) {
+				return false
+			}
+		}
+		return true
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			if !isZeroValue(v.Field(i)) {
+				return false
+			}
+		}
+		return true
+	case reflect.Chan, reflect.Func, reflect.Interface, reflect.Map, reflect.Ptr, reflect.Slice:
+		return v.IsNil()
+	case reflect.String:
+		return v.Len() == 0
+	case reflect.Bool:
+		return !v.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int() == 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return v.Uint() == 0
+	case reflect.Float32, reflect.Float64:
+		// Negative zero is not the zero value.
+		return v.Float() == 0 && !math.Signbit(v.Float())
+	case reflect.Complex64, reflect.Complex128:
+		return v.Complex() == 0
+	}
+	return false
+}
@@ -0,0 +1,213 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package firestore
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	ts "github.com/golang/protobuf/ptypes/timestamp"
+	pb "google.golang.org/genproto/googleapis/firestore/v1"
+)
+
+// celsius is stored as a string like "21.5C".
+type celsius float64
+
+func (c celsius) MarshalFirestoreValue() (*pb.Value, error) {
+	return strval(strconv.FormatFloat(float64(c), 'g', -1, 64) + "C"), nil
+}
+
+func (c *celsius) UnmarshalFirestoreValue(v *pb.Value) error {
+	s, ok := v.ValueType.(*pb.Value_StringValue)
+	if !ok {
+		return fmt.Errorf("celsius: got %s, want string", typeString(v))
+	}
+	f, err := strconv.ParseFloat(strings.TrimSuffix(s.StringValue, "C"), 64)
+	if err != nil {
+		return err
+	}
+	*c = celsius(f)
+	return nil
+}
+
+// point is stored as an array, and has pointer-receiver methods only.
+type point struct{ X, Y int }
+
+func (p *point) MarshalFirestoreValue() (*pb.Value, error) {
+	return arrayval(intval(p.X), intval(p.Y)), nil
+}
+
+func (p *point) UnmarshalFirestoreValue(v *pb.Value) error {
+	a := v.GetArrayValue()
+	if a == nil || len(a.Values) != 2 {
+		return fmt.Errorf("point: bad value %v", v)
+	}
+	p.X = int(a.Values[0].GetIntegerValue())
+	p.Y = int(a.Values[1].GetIntegerValue())
+	return nil
+}
+
+type converterStruct struct {
+	Temp  celsius
+	PTemp *celsius
+	Pos   point
+	PPos  *point
+	Temps []celsius
+}
+
+func TestValueConverters(t *testing.T) {
+	c := celsius(21.5)
+	in := &converterStruct{
+		Temp:  -3,
+		PTemp: &c,
+		Pos:   point{1, 2},
+		Temps: []celsius{1, 2},
+	}
+	got, _, err := toProtoValue(reflect.ValueOf(in))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := mapval(map[string]*pb.Value{
+		"Temp":  strval("-3C"),
+		"PTemp": strval("21.5C"),
+		"Pos":   arrayval(intval(1), intval(2)),
+		"PPos":  nullValue,
+		"Temps": arrayval(strval("1C"), strval("2C")),
+	})
+	if !testEqual(got, want) {
+		t.Fatalf("got %+v, want %+v", got, want)
+	}
+
+	var out converterStruct
+	if err := setFromProtoValue(&out, got, nil); err != nil {
+		t.Fatal(err)
+	}
+	if !testEqual(&out, in) {
+		t.Errorf("got %+v, want %+v", out, in)
+	}
+
+	// Null leaves non-pointer converters to decide, and sets pointers to nil.
+	out.PTemp = &c
+	err = setFromProtoValue(&out, mapval(map[string]*pb.Value{"PTemp": nullValue}), nil)
+	if err != nil || out.PTemp != nil {
+		t.Errorf("got (%v, %v), want (nil, nil)", out.PTemp, err)
+	}
+	err = setFromProtoValue(&out, mapval(map[string]*pb.Value{"Temp": nullValue}), nil)
+	if err == nil {
+		t.Error("got nil, want error from UnmarshalFirestoreValue")
+	}
+}
+
+func TestValueConvertersRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	client, cleanup := newFakeClient(t, nil)
+	defer cleanup()
+
+	type S struct {
+		Temp    celsius
+		Pos     *point
+		Created *ts.Timestamp `firestore:",serverTimestamp"`
+	}
+	doc := client.Doc("C/a")
+	if _, err := doc.Set(ctx, &S{Temp: 37, Pos: &point{3, 4}}); err != nil {
+		t.Fatal(err)
+	}
+	snap, err := doc.Get(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := snap.Data()["Temp"], "37C"; got != want {
+		t.Errorf("stored %v, want %q", got, want)
+	}
+	var got S
+	if err := snap.DataTo(&got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Temp != 37 || got.Pos == nil || *got.Pos != (point{3, 4}) {
+		t.Errorf("got %+v", got)
+	}
+	if got.Created == nil {
+		t.Error("server timestamp not set")
+	}
+}
+
+type zeroer struct{ n int }
+
+func (z zeroer) IsZero() bool { return z.n < 0 }
+
+func TestOmitZero(t *testing.T) {
+	type inner struct{ A int }
+	type S struct {
+		I  int               `firestore:",omitzero"`
+		F  float64           `firestore:",omitzero"`
+		Sl []int             `firestore:",omitzero"`
+		M  map[string]int    `firestore:",omitzero"`
+		In inner             `firestore:",omitzero"`
+		Ar [2]int            `firestore:",omitzero"`
+		T  time.Time         `firestore:",omitzero"`
+		Z  zeroer            `firestore:",omitzero"`
+		P  *inner            `firestore:",omitzero"`
+		E  map[string]string `firestore:",omitempty"`
+	}
+	got, _, err := toProtoValue(reflect.ValueOf(S{
+		Sl: []int{},
+		M:  map[string]int{},
+		Z:  zeroer{-1},
+		E:  map[string]string{},
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Empty but non-nil slices and maps are not zero.
+	want := mapval(map[string]*pb.Value{
+		"Sl": arrayval(),
+		"M":  mapval(map[string]*pb.Value{}),
+	})
+	if !testEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+
+	got, _, err = toProtoValue(reflect.ValueOf(S{In: inner{1}, Ar: [2]int{0, 1}, T: aTime, Z: zeroer{0}}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range []string{"In", "Ar", "T", "Z"} {
+		if _, ok := got.GetMapValue().Fields[k]; !ok {
+			t.Errorf("%s: omitted, want present", k)
+		}
+	}
+}
+
+func TestExtractTransformsConverters(t *testing.T) {
+	type S struct {
+		A *ts.Timestamp `firestore:",serverTimestamp"`
+		B *ts.Timestamp `firestore:",serverTimestamp"`
+		// A converter's own fields are not examined.
+		P point
+	}
+	got, err := extractTransforms(reflect.ValueOf(&S{B: &ts.Timestamp{Seconds: 1}}), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []*pb.DocumentTransform_FieldTransform{serverTimestamp("A")}
+	if !testEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
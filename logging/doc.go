@@ -94,6 +94,51 @@ You may want use a standard log.Logger in your program.
 	stdlg.Println("some info")
 
 
+Structured Logging
+
+A StructuredLogger writes entries with a message and key/value fields as a JSON
+payload. It associates each entry with the trace of its context and with the
+source location of its caller.
+
+	slg := lg.StructuredLogger(logging.Info).With("user", user)
+	slg.Warning(ctx, "quota exceeded", "used", used, "limit", limit)
+
+The trace is that of the OpenCensus span of the context, if any. In an HTTP
+handler without OpenCensus, propagate the X-Cloud-Trace-Context header of the
+request instead:
+
+	ctx := logging.ContextWithTraceHeader(r.Context(), r.Header.Get("X-Cloud-Trace-Context"))
+
+A StructuredLogger can also provide a *log.Logger that writes its lines as
+entries with the fields and trace of the logger:
+
+	stdlg := slg.StandardLogger(ctx, logging.Info)
+	stdlg.Printf("processed %d items", n)
+
+
+Writing to Standard Output
+
+On Cloud Run, Cloud Functions and other runtimes whose logging agents parse
+structured log lines from standard output, a Logger can write its entries there
+instead of calling the Stackdriver Logging API:
+
+	lg := client.Logger("my-log", logging.RedirectAsJSON(os.Stdout))
+
+
+Spooling Entries to Disk
+
+By default, a Logger drops the entries that it cannot write to the Stackdriver
+Logging API, for example during an outage of the service, once they exceed its
+BufferedByteLimit. With a spool directory, it persists them there instead, and
+writes them in order when the service is available again:
+
+	lg := client.Logger("my-log", logging.SpoolDirectory("/var/spool/my-log"))
+
+The SpoolByteLimit option caps the size of the directory. The numbers of
+spooled, replayed and dropped entries are recorded as OpenCensus measures; see
+DefaultViews.
+
+
 Log Levels
 
 An Entry may have one of a number of severity levels associated with it.
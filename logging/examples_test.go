@@ -18,6 +18,7 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"net/http"
 	"os"
 
 	"cloud.google.com/go/logging"
@@ -160,6 +161,32 @@ func ExampleLogger_StandardLogger() {
 	slg.Println("an informative message")
 }
 
+func ExampleLogger_StructuredLogger() {
+	ctx := context.Background()
+	client, err := logging.NewClient(ctx, "my-project")
+	if err != nil {
+		// TODO: Handle error.
+	}
+	lg := client.Logger("my-log")
+	slg := lg.StructuredLogger(logging.Info).With("component", "billing")
+	slg.Warning(ctx, "payment declined", "account", "a-123", "attempt", 2)
+}
+
+// This example shows how to associate the entries written while handling an
+// HTTP request with the trace of the request.
+func ExampleContextWithTraceHeader() {
+	ctx := context.Background()
+	client, err := logging.NewClient(ctx, "my-project")
+	if err != nil {
+		// TODO: Handle error.
+	}
+	slg := client.Logger("my-log").StructuredLogger(logging.Info)
+	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		ctx := logging.ContextWithTraceHeader(r.Context(), r.Header.Get("X-Cloud-Trace-Context"))
+		slg.Info(ctx, "handling request", "path", r.URL.Path)
+	})
+}
+
 func ExampleParseSeverity() {
 	sev := logging.ParseSeverity("ALERT")
 	fmt.Println(sev)
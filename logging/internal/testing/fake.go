@@ -21,7 +21,6 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"regexp"
 	"sort"
 	"strings"
 	"sync"
@@ -38,8 +37,9 @@ import (
 type loggingHandler struct {
 	logpb.LoggingServiceV2Server
 
-	mu   sync.Mutex
-	logs map[string][]*logpb.LogEntry // indexed by log name
+	mu       sync.Mutex
+	logs     map[string][]*logpb.LogEntry // indexed by log name
+	insertID int                          // the last insert ID assigned
 }
 
 type configHandler struct {
@@ -101,7 +101,6 @@ func (h *loggingHandler) WriteLogEntries(_ context.Context, req *logpb.WriteLogE
 	if !strings.HasPrefix(req.LogName, "projects/"+ValidProjectID+"/") && !strings.HasPrefix(req.LogName, "organizations/"+ValidOrgID+"/") {
 		return nil, fmt.Errorf("bad LogName: %q", req.LogName)
 	}
-	// TODO(jba): support insertId?
 	h.mu.Lock()
 	defer h.mu.Unlock()
 	for _, e := range req.Entries {
@@ -109,6 +108,11 @@ func (h *loggingHandler) WriteLogEntries(_ context.Context, req *logpb.WriteLogE
 		if e.Timestamp == nil {
 			e.Timestamp = &tspb.Timestamp{Seconds: time.Now().Unix(), Nanos: 0}
 		}
+		// Assign insert ID if missing, as the service does.
+		if e.InsertId == "" {
+			h.insertID++
+			e.InsertId = fmt.Sprintf("fake-%d", h.insertID)
+		}
 		// Fill from common fields in request.
 		if e.LogName == "" {
 			e.LogName = req.LogName
@@ -132,8 +136,8 @@ func (h *loggingHandler) WriteLogEntries(_ context.Context, req *logpb.WriteLogE
 // ListLogEntries lists log entries. Use this method to retrieve log entries
 // from Stackdriver Logging.
 //
-// This fake implementation ignores project IDs. It does not support full filtering, only
-// expressions of the form "logName = NAME".
+// This fake implementation ignores project IDs. It supports the advanced logs filter
+// language, as described in filter.go.
 func (h *loggingHandler) ListLogEntries(_ context.Context, req *logpb.ListLogEntriesRequest) (*logpb.ListLogEntriesResponse, error) {
 	h.mu.Lock()
 	defer h.mu.Unlock()
@@ -155,35 +159,29 @@ func (h *loggingHandler) ListLogEntries(_ context.Context, req *logpb.ListLogEnt
 	}, nil
 }
 
-func (h *loggingHandler) filterEntries(filter string) ([]*logpb.LogEntry, error) {
-	logName, err := parseFilter(filter)
+func (h *loggingHandler) filterEntries(filterString string) ([]*logpb.LogEntry, error) {
+	f, logName, err := parseFilter(filterString)
 	if err != nil {
 		return nil, err
 	}
-	if logName != "" {
-		return h.logs[logName], nil
-	}
 	var entries []*logpb.LogEntry
-	for _, es := range h.logs {
-		entries = append(entries, es...)
+	for name, es := range h.logs {
+		if logName != "" && name != logName {
+			continue
+		}
+		for _, e := range es {
+			fields, err := entryFields(e)
+			if err != nil {
+				return nil, err
+			}
+			if f(fields) {
+				entries = append(entries, e)
+			}
+		}
 	}
 	return entries, nil
 }
 
-var filterRegexp = regexp.MustCompile(`^logName\s*=\s*"?([-_/.%\w]+)"?`)
-
-// returns the log name, or "" for the empty filter
-func parseFilter(filter string) (string, error) {
-	if filter == "" {
-		return "", nil
-	}
-	subs := filterRegexp.FindStringSubmatch(filter)
-	if subs == nil {
-		return "", invalidArgument(fmt.Sprintf("fake.go: failed to parse filter %s", filter))
-	}
-	return subs[1], nil // cannot panic by construction of regexp
-}
-
 func sortEntries(entries []*logpb.LogEntry, orderBy string) error {
 	switch orderBy {
 	case "", "timestamp asc":
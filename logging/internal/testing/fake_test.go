@@ -44,35 +44,6 @@ func TestNewServer(t *testing.T) {
 	conn.Close()
 }
 
-func TestParseFilter(t *testing.T) {
-	for _, test := range []struct {
-		filter  string
-		want    string
-		wantErr bool
-	}{
-		{"", "", false},
-		{"logName = syslog", "syslog", false},
-		{"logname = syslog", "", true},
-		{"logName = 'syslog'", "", true},
-		{"logName == syslog", "", true},
-	} {
-		got, err := parseFilter(test.filter)
-		if err != nil {
-			if !test.wantErr {
-				t.Errorf("%q: got %v, want no error", test.filter, err)
-			}
-			continue
-		}
-		if test.wantErr {
-			t.Errorf("%q: got no error, want one", test.filter)
-			continue
-		}
-		if got != test.want {
-			t.Errorf("%q: got %q, want %q", test.filter, got, test.want)
-		}
-	}
-}
-
 func TestSortEntries(t *testing.T) {
 	entries := []*logpb.LogEntry{
 		/* 0 */ {Timestamp: &tspb.Timestamp{Seconds: 30}},
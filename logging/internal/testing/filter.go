@@ -0,0 +1,621 @@
+/*
+Copyright 2020 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package testing
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/golang/protobuf/jsonpb"
+	logtypepb "google.golang.org/genproto/googleapis/logging/type"
+	logpb "google.golang.org/genproto/googleapis/logging/v2"
+)
+
+// This file implements the advanced logs filter language, described at
+// https://cloud.google.com/logging/docs/view/advanced-queries:
+//
+//	filter      ::= conjunction
+//	conjunction ::= disjunction { ["AND"] disjunction }
+//	disjunction ::= negation { "OR" negation }
+//	negation    ::= ("NOT" | "-") negation | primary
+//	primary     ::= "(" filter ")" | path op value | value
+//	path        ::= name { "." name }
+//	op          ::= "=" | "!=" | "<" | "<=" | ">" | ">=" | ":" | "=~" | "!~"
+//	value       ::= string | word | "(" value { ["AND" | "OR"] value } ")"
+//
+// As in the service, OR binds more tightly than AND. A value alone is a global
+// restriction, which matches entries with a field containing the value.
+//
+// Entries are compared in their JSON form, so paths use the names of that
+// form, like jsonPayload and resource.labels.zone; snake_case names are also
+// accepted. Severities compare by their level, timestamps as times, and
+// numbers as numbers. The ":" operator matches substrings, ignoring case; the
+// value "*" matches any value of a field that is present.
+
+// A filter reports whether an entry, in its JSON form, matches it.
+type filter func(entry map[string]interface{}) bool
+
+// matchAll is the filter of the empty filter string.
+func matchAll(map[string]interface{}) bool { return true }
+
+// parseFilter parses a filter in the logging filter language. It also returns
+// the name of the log that the filter requires, or "".
+func parseFilter(s string) (filter, string, error) {
+	p := &filterParser{s: s}
+	if p.skipSpace(); p.eof() {
+		return matchAll, "", nil
+	}
+	f, logName, err := p.conjunction()
+	if err != nil {
+		return nil, "", invalidArgument(fmt.Sprintf("fake.go: bad filter %q: %v", s, err))
+	}
+	if p.skipSpace(); !p.eof() {
+		return nil, "", invalidArgument(fmt.Sprintf("fake.go: bad filter %q: unexpected %q at offset %d", s, p.s[p.pos:], p.pos))
+	}
+	return f, logName, nil
+}
+
+// entryFields returns e in its JSON form.
+func entryFields(e *logpb.LogEntry) (map[string]interface{}, error) {
+	var buf bytes.Buffer
+	if err := (&jsonpb.Marshaler{}).Marshal(&buf, e); err != nil {
+		return nil, err
+	}
+	var m map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+type filterParser struct {
+	s   string
+	pos int
+}
+
+func (p *filterParser) eof() bool { return p.pos >= len(p.s) }
+
+func (p *filterParser) peek() byte { return p.s[p.pos] }
+
+func (p *filterParser) skipSpace() {
+	for !p.eof() && unicode.IsSpace(rune(p.peek())) {
+		p.pos++
+	}
+}
+
+// keyword consumes the keyword kw, if it is next and followed by a delimiter.
+func (p *filterParser) keyword(kw string) bool {
+	p.skipSpace()
+	if !strings.HasPrefix(p.s[p.pos:], kw) {
+		return false
+	}
+	end := p.pos + len(kw)
+	if end < len(p.s) && !unicode.IsSpace(rune(p.s[end])) && p.s[end] != '(' {
+		return false
+	}
+	p.pos = end
+	return true
+}
+
+// atEndOfTerm reports whether no further term follows.
+func (p *filterParser) atEndOfTerm() bool {
+	p.skipSpace()
+	return p.eof() || p.peek() == ')'
+}
+
+// The parsing methods return the log name that all entries matching the
+// filter have, if the filter requires one with a comparison like
+// logName = "projects/p/logs/l". The fake uses it to avoid looking at the
+// entries of other logs.
+
+func (p *filterParser) conjunction() (filter, string, error) {
+	f, logName, err := p.disjunction()
+	if err != nil {
+		return nil, "", err
+	}
+	fs := []filter{f}
+	for !p.atEndOfTerm() {
+		p.keyword("AND")
+		f, ln, err := p.disjunction()
+		if err != nil {
+			return nil, "", err
+		}
+		fs = append(fs, f)
+		if logName == "" {
+			logName = ln
+		}
+	}
+	if len(fs) == 1 {
+		return fs[0], logName, nil
+	}
+	return func(e map[string]interface{}) bool {
+		for _, f := range fs {
+			if !f(e) {
+				return false
+			}
+		}
+		return true
+	}, logName, nil
+}
+
+func (p *filterParser) disjunction() (filter, string, error) {
+	f, logName, err := p.negation()
+	if err != nil {
+		return nil, "", err
+	}
+	fs := []filter{f}
+	for p.keyword("OR") {
+		f, _, err := p.negation()
+		if err != nil {
+			return nil, "", err
+		}
+		fs = append(fs, f)
+	}
+	if len(fs) == 1 {
+		return fs[0], logName, nil
+	}
+	return func(e map[string]interface{}) bool {
+		for _, f := range fs {
+			if f(e) {
+				return true
+			}
+		}
+		return false
+	}, "", nil
+}
+
+func (p *filterParser) negation() (filter, string, error) {
+	p.skipSpace()
+	negate := p.keyword("NOT")
+	if !negate && !p.eof() && p.peek() == '-' {
+		p.pos++
+		negate = true
+	}
+	if !negate {
+		return p.primary()
+	}
+	f, _, err := p.negation()
+	if err != nil {
+		return nil, "", err
+	}
+	return func(e map[string]interface{}) bool { return !f(e) }, "", nil
+}
+
+func (p *filterParser) primary() (filter, string, error) {
+	p.skipSpace()
+	if p.eof() {
+		return nil, "", fmt.Errorf("unexpected end of filter")
+	}
+	if p.peek() == '(' {
+		p.pos++
+		f, logName, err := p.conjunction()
+		if err != nil {
+			return nil, "", err
+		}
+		if p.skipSpace(); p.eof() || p.peek() != ')' {
+			return nil, "", fmt.Errorf("missing ) at offset %d", p.pos)
+		}
+		p.pos++
+		return f, logName, nil
+	}
+	if p.peek() == '"' {
+		v, err := p.quoted()
+		if err != nil {
+			return nil, "", err
+		}
+		return globalRestriction(v), "", nil
+	}
+	start := p.pos
+	path, err := p.path()
+	if err != nil {
+		return nil, "", err
+	}
+	p.skipSpace()
+	op := p.operator()
+	if op == "" {
+		// A global restriction, whose value is the text of the path.
+		return globalRestriction(p.s[start:p.pos]), "", nil
+	}
+	v, err := p.value()
+	if err != nil {
+		return nil, "", err
+	}
+	f, err := comparison(path, op, v)
+	if err != nil {
+		return nil, "", err
+	}
+	logName := ""
+	if len(path) == 1 && (path[0] == "logName" || path[0] == "log_name") && op == "=" && v.list == nil {
+		logName = v.s
+	}
+	return f, logName, nil
+}
+
+var operators = []string{"<=", ">=", "!=", "=~", "!~", "=", "<", ">", ":"}
+
+func (p *filterParser) operator() string {
+	for _, op := range operators {
+		if strings.HasPrefix(p.s[p.pos:], op) {
+			p.pos += len(op)
+			return op
+		}
+	}
+	return ""
+}
+
+// path parses a dotted sequence of names, each a word or a quoted string.
+func (p *filterParser) path() ([]string, error) {
+	var path []string
+	for {
+		var name string
+		if !p.eof() && p.peek() == '"' {
+			var err error
+			if name, err = p.quoted(); err != nil {
+				return nil, err
+			}
+		} else {
+			start := p.pos
+			for !p.eof() && isNameByte(p.peek()) {
+				p.pos++
+			}
+			if p.pos == start {
+				return nil, fmt.Errorf("want a field name at offset %d", p.pos)
+			}
+			name = p.s[start:p.pos]
+		}
+		path = append(path, name)
+		if p.eof() || p.peek() != '.' {
+			return path, nil
+		}
+		p.pos++
+	}
+}
+
+func isNameByte(b byte) bool {
+	return b == '_' || b == '-' || b == '/' || b == '%' || b == '*' ||
+		'a' <= b && b <= 'z' || 'A' <= b && b <= 'Z' || '0' <= b && b <= '9'
+}
+
+func (p *filterParser) quoted() (string, error) {
+	start := p.pos
+	p.pos++ // opening quote
+	for !p.eof() && p.peek() != '"' {
+		if p.peek() == '\\' {
+			p.pos++
+		}
+		p.pos++
+	}
+	if p.eof() {
+		return "", fmt.Errorf("unterminated string at offset %d", start)
+	}
+	p.pos++
+	s, err := strconv.Unquote(p.s[start:p.pos])
+	if err != nil {
+		return "", fmt.Errorf("bad string %s", p.s[start:p.pos])
+	}
+	return s, nil
+}
+
+// A filterValue is the value of a comparison: a single string, or a list of
+// values of which any (or all) must compare.
+type filterValue struct {
+	s    string
+	list []filterValue
+	all  bool // the list is joined by AND, not OR
+}
+
+func (p *filterParser) value() (filterValue, error) {
+	p.skipSpace()
+	if p.eof() {
+		return filterValue{}, fmt.Errorf("want a value at end of filter")
+	}
+	switch p.peek() {
+	case '"':
+		s, err := p.quoted()
+		return filterValue{s: s}, err
+	case '(':
+		p.pos++
+		var v filterValue
+		for {
+			elem, err := p.value()
+			if err != nil {
+				return filterValue{}, err
+			}
+			v.list = append(v.list, elem)
+			if p.skipSpace(); !p.eof() && p.peek() == ')' {
+				p.pos++
+				return v, nil
+			}
+			if p.keyword("AND") {
+				v.all = true
+			} else {
+				p.keyword("OR")
+			}
+		}
+	default:
+		start := p.pos
+		for !p.eof() && !unicode.IsSpace(rune(p.peek())) && p.peek() != ')' && p.peek() != '(' {
+			p.pos++
+		}
+		if p.pos == start {
+			return filterValue{}, fmt.Errorf("want a value at offset %d", p.pos)
+		}
+		return filterValue{s: p.s[start:p.pos]}, nil
+	}
+}
+
+func comparison(path []string, op string, v filterValue) (filter, error) {
+	negate := false
+	switch op {
+	case "!=":
+		op, negate = "=", true
+	case "!~":
+		op, negate = "=~", true
+	}
+	match, err := valueMatcher(path, op, v)
+	if err != nil {
+		return nil, err
+	}
+	return func(e map[string]interface{}) bool {
+		vals, ok := lookup(e, path)
+		if !ok && isSeverity(path) {
+			// The JSON form omits the default severity.
+			vals, ok = []interface{}{"DEFAULT"}, true
+		}
+		if op == ":" && v.s == "*" && v.list == nil {
+			return ok != negate
+		}
+		for _, val := range vals {
+			if match(val) {
+				return !negate
+			}
+		}
+		return negate
+	}, nil
+}
+
+// valueMatcher returns a function that reports whether a field value compares
+// with v.
+func valueMatcher(path []string, op string, v filterValue) (func(interface{}) bool, error) {
+	if v.list != nil {
+		var ms []func(interface{}) bool
+		for _, elem := range v.list {
+			m, err := valueMatcher(path, op, elem)
+			if err != nil {
+				return nil, err
+			}
+			ms = append(ms, m)
+		}
+		return func(x interface{}) bool {
+			for _, m := range ms {
+				if m(x) != v.all {
+					return !v.all
+				}
+			}
+			return v.all
+		}, nil
+	}
+	if op == "=~" {
+		re, err := regexp.Compile(v.s)
+		if err != nil {
+			return nil, err
+		}
+		return func(x interface{}) bool {
+			s, ok := x.(string)
+			return ok && re.MatchString(s)
+		}, nil
+	}
+	if op == ":" {
+		want := strings.ToLower(v.s)
+		return func(x interface{}) bool {
+			return strings.Contains(strings.ToLower(leafString(x)), want)
+		}, nil
+	}
+	cmp, err := comparer(path, v.s)
+	if err != nil {
+		return nil, err
+	}
+	return func(x interface{}) bool {
+		c, ok := cmp(x)
+		if !ok {
+			return false
+		}
+		switch op {
+		case "=":
+			return c == 0
+		case "<":
+			return c < 0
+		case "<=":
+			return c <= 0
+		case ">":
+			return c > 0
+		default: // ">="
+			return c >= 0
+		}
+	}, nil
+}
+
+// comparer returns a function that compares a field value with the value s,
+// returning false if they are not comparable.
+func comparer(path []string, s string) (func(interface{}) (int, bool), error) {
+	switch {
+	case isSeverity(path):
+		want, ok := severityLevel(s)
+		if !ok {
+			return nil, fmt.Errorf("bad severity %q", s)
+		}
+		return func(x interface{}) (int, bool) {
+			got, ok := severityLevel(leafString(x))
+			return compareInts(int64(got), int64(want)), ok
+		}, nil
+
+	case isTimestamp(path):
+		want, err := time.Parse(time.RFC3339Nano, s)
+		if err != nil {
+			return nil, fmt.Errorf("bad timestamp %q", s)
+		}
+		return func(x interface{}) (int, bool) {
+			got, err := time.Parse(time.RFC3339Nano, leafString(x))
+			if err != nil {
+				return 0, false
+			}
+			switch {
+			case got.Before(want):
+				return -1, true
+			case got.After(want):
+				return 1, true
+			default:
+				return 0, true
+			}
+		}, nil
+	}
+	return func(x interface{}) (int, bool) {
+		got := leafString(x)
+		if _, isMap := x.(map[string]interface{}); isMap {
+			return 0, false
+		}
+		gn, err1 := strconv.ParseFloat(got, 64)
+		wn, err2 := strconv.ParseFloat(s, 64)
+		if err1 == nil && err2 == nil {
+			switch {
+			case gn < wn:
+				return -1, true
+			case gn > wn:
+				return 1, true
+			default:
+				return 0, true
+			}
+		}
+		return strings.Compare(got, s), true
+	}, nil
+}
+
+func compareInts(a, b int64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	default:
+		return 0
+	}
+}
+
+func isSeverity(path []string) bool {
+	return len(path) == 1 && path[0] == "severity"
+}
+
+func isTimestamp(path []string) bool {
+	return len(path) == 1 && (path[0] == "timestamp" || path[0] == "receiveTimestamp" || path[0] == "receive_timestamp")
+}
+
+// severityLevel returns the level of a severity name or number.
+func severityLevel(s string) (int32, bool) {
+	if n, err := strconv.Atoi(s); err == nil {
+		return int32(n), true
+	}
+	n, ok := logtypepb.LogSeverity_value[strings.ToUpper(s)]
+	return n, ok
+}
+
+// leafString returns the text of a JSON value.
+func leafString(x interface{}) string {
+	switch x := x.(type) {
+	case string:
+		return x
+	case nil:
+		return ""
+	case float64:
+		return strconv.FormatFloat(x, 'g', -1, 64)
+	default:
+		return fmt.Sprint(x)
+	}
+}
+
+// lookup returns the values at path in m. Lists along the path contribute
+// all their elements.
+func lookup(m map[string]interface{}, path []string) ([]interface{}, bool) {
+	vals := []interface{}{m}
+	for _, name := range path {
+		var next []interface{}
+		for _, v := range vals {
+			obj, ok := v.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			x, ok := obj[name]
+			if !ok {
+				x, ok = obj[camelCase(name)]
+			}
+			if !ok {
+				continue
+			}
+			if list, ok := x.([]interface{}); ok {
+				next = append(next, list...)
+			} else {
+				next = append(next, x)
+			}
+		}
+		vals = next
+	}
+	return vals, len(vals) > 0
+}
+
+// camelCase converts a snake_case name to camelCase.
+func camelCase(s string) string {
+	parts := strings.Split(s, "_")
+	for i := 1; i < len(parts); i++ {
+		if parts[i] != "" {
+			parts[i] = strings.ToUpper(parts[i][:1]) + parts[i][1:]
+		}
+	}
+	return strings.Join(parts, "")
+}
+
+// globalRestriction returns a filter matching entries with a field whose
+// value contains s, ignoring case.
+func globalRestriction(s string) filter {
+	want := strings.ToLower(s)
+	var contains func(interface{}) bool
+	contains = func(x interface{}) bool {
+		switch x := x.(type) {
+		case map[string]interface{}:
+			for _, v := range x {
+				if contains(v) {
+					return true
+				}
+			}
+			return false
+		case []interface{}:
+			for _, v := range x {
+				if contains(v) {
+					return true
+				}
+			}
+			return false
+		default:
+			return strings.Contains(strings.ToLower(leafString(x)), want)
+		}
+	}
+	return func(e map[string]interface{}) bool { return contains(e) }
+}
@@ -0,0 +1,151 @@
+/*
+Copyright 2020 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package testing
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/ptypes"
+	structpb "github.com/golang/protobuf/ptypes/struct"
+	mrpb "google.golang.org/genproto/googleapis/api/monitoredres"
+	logtypepb "google.golang.org/genproto/googleapis/logging/type"
+	logpb "google.golang.org/genproto/googleapis/logging/v2"
+)
+
+func TestParseFilter(t *testing.T) {
+	timestamp := func(s string) *logpb.LogEntry {
+		tm, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ts, err := ptypes.TimestampProto(tm)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &logpb.LogEntry{Timestamp: ts}
+	}
+	e0 := timestamp("2020-01-01T00:00:00Z")
+	e0.LogName = "projects/P/logs/syslog"
+	e0.Severity = logtypepb.LogSeverity_ERROR
+	e0.Payload = &logpb.LogEntry_TextPayload{TextPayload: "disk full on /dev/sda"}
+	e0.Resource = &mrpb.MonitoredResource{Type: "gce_instance", Labels: map[string]string{"zone": "us-central1-a"}}
+	e0.Labels = map[string]string{"env": "prod", "k8s-pod/app": "web"}
+	e0.HttpRequest = &logtypepb.HttpRequest{Status: 500}
+
+	e1 := timestamp("2020-01-02T00:00:00Z")
+	e1.LogName = "projects/P/logs/app"
+	e1.Severity = logtypepb.LogSeverity_INFO
+	e1.Payload = &logpb.LogEntry_JsonPayload{JsonPayload: &structpb.Struct{Fields: map[string]*structpb.Value{
+		"user": {Kind: &structpb.Value_StructValue{StructValue: &structpb.Struct{Fields: map[string]*structpb.Value{
+			"name": {Kind: &structpb.Value_StringValue{StringValue: "Alice"}},
+			"age":  {Kind: &structpb.Value_NumberValue{NumberValue: 30}},
+		}}}},
+		"tags": {Kind: &structpb.Value_ListValue{ListValue: &structpb.ListValue{Values: []*structpb.Value{
+			{Kind: &structpb.Value_StringValue{StringValue: "a"}},
+			{Kind: &structpb.Value_StringValue{StringValue: "b"}},
+		}}}},
+	}}}
+	e1.Resource = &mrpb.MonitoredResource{Type: "k8s_container"}
+	e1.Labels = map[string]string{"env": "dev"}
+
+	e2 := timestamp("2020-01-03T00:00:00Z")
+	e2.LogName = "projects/P/logs/app"
+	e2.Payload = &logpb.LogEntry_TextPayload{TextPayload: "hello"}
+
+	entries := []*logpb.LogEntry{e0, e1, e2}
+	for _, test := range []struct {
+		filter  string
+		want    []int  // indexes of the matching entries
+		logName string // required by the filter
+	}{
+		{"", []int{0, 1, 2}, ""},
+		{`logName = "projects/P/logs/app"`, []int{1, 2}, "projects/P/logs/app"},
+		{`logName=projects/P/logs/syslog`, []int{0}, "projects/P/logs/syslog"},
+		{`logName = a OR logName = b`, nil, ""},
+		{`NOT logName = a`, []int{0, 1, 2}, ""},
+		{`severity >= WARNING`, []int{0}, ""},
+		{`severity < INFO`, []int{2}, ""},
+		{`severity = (ERROR OR info)`, []int{0, 1}, ""},
+		{`severity=DEFAULT`, []int{2}, ""},
+		{`severity >= 200`, []int{0, 1}, ""},
+		{`timestamp >= "2020-01-02T00:00:00Z"`, []int{1, 2}, ""},
+		{`timestamp >= 2020-01-01T12:00:00Z timestamp < "2020-01-03T00:00:00Z"`, []int{1}, ""},
+		{`resource.type = gce_instance`, []int{0}, ""},
+		{`resource.labels.zone: CENTRAL`, []int{0}, ""},
+		{`labels.env = prod OR labels.env = dev`, []int{0, 1}, ""},
+		{`labels."k8s-pod/app" = web`, []int{0}, ""},
+		{`labels.env:*`, []int{0, 1}, ""},
+		{`NOT labels.env:*`, []int{2}, ""},
+		{`-labels.env:*`, []int{2}, ""},
+		{`labels.env != prod`, []int{1, 2}, ""},
+		{`jsonPayload.user.name = Alice`, []int{1}, ""},
+		{`json_payload.user.age >= 18`, []int{1}, ""},
+		{`jsonPayload.user.age > 100`, nil, ""},
+		{`jsonPayload.tags = b`, []int{1}, ""},
+		{`textPayload =~ "^disk"`, []int{0}, ""},
+		{`textPayload !~ "^disk"`, []int{1, 2}, ""},
+		{`text_payload: FULL`, []int{0}, ""},
+		{`httpRequest.status >= 500`, []int{0}, ""},
+		{`hello`, []int{2}, ""},
+		{`"disk full"`, []int{0}, ""},
+		{`logName = "projects/P/logs/app" AND (severity = INFO OR textPayload = hello)`, []int{1, 2}, "projects/P/logs/app"},
+		// OR binds more tightly than AND.
+		{`severity = ERROR OR severity = INFO AND logName = "projects/P/logs/app"`, []int{1}, "projects/P/logs/app"},
+		{`(logName = "projects/P/logs/syslog") AND timestamp >= "2019-01-01T00:00:00Z"`, []int{0}, "projects/P/logs/syslog"},
+	} {
+		f, logName, err := parseFilter(test.filter)
+		if err != nil {
+			t.Errorf("%q: %v", test.filter, err)
+			continue
+		}
+		if logName != test.logName {
+			t.Errorf("%q: got log name %q, want %q", test.filter, logName, test.logName)
+		}
+		var got []int
+		for i, e := range entries {
+			fields, err := entryFields(e)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if f(fields) {
+				got = append(got, i)
+			}
+		}
+		if fmt.Sprint(got) != fmt.Sprint(test.want) {
+			t.Errorf("%q: got entries %v, want %v", test.filter, got, test.want)
+		}
+	}
+}
+
+func TestParseFilterErrors(t *testing.T) {
+	for _, filter := range []string{
+		`severity >= LOUD`,
+		`(logName = x`,
+		`timestamp > yesterday`,
+		`textPayload =~ "("`,
+		`logName =`,
+		`"unterminated`,
+		`logName = x)`,
+		`= x`,
+	} {
+		if _, _, err := parseFilter(filter); err == nil {
+			t.Errorf("%q: got no error, want one", filter)
+		}
+	}
+}
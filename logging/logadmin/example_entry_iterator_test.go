@@ -64,3 +64,22 @@ func ExampleEntryIterator_Next() {
 		fmt.Println(entry)
 	}
 }
+
+func ExampleClient_Tail() {
+	ctx := context.Background()
+	client, err := logadmin.NewClient(ctx, "my-project")
+	if err != nil {
+		// TODO: Handle error.
+	}
+	it := client.Tail(ctx, logadmin.Filter("severity >= ERROR"))
+	it.OnSuppressed = func(s logadmin.SuppressionInfo) {
+		fmt.Printf("%d entries suppressed: %s\n", s.Count, s.Reason)
+	}
+	for {
+		entry, err := it.Next()
+		if err != nil {
+			// TODO: Handle error.
+		}
+		fmt.Println(entry)
+	}
+}
@@ -0,0 +1,246 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logadmin
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"cloud.google.com/go/logging"
+	vkit "cloud.google.com/go/logging/apiv2"
+	"github.com/golang/protobuf/ptypes"
+	"google.golang.org/api/iterator"
+	logpb "google.golang.org/genproto/googleapis/logging/v2"
+)
+
+// Defaults for the settings of a TailIterator.
+const (
+	DefaultTailPollInterval = 2 * time.Second
+	DefaultTailLateness     = 30 * time.Second
+)
+
+// maxTailSkew is how far ahead of the time of a poll the timestamps of the
+// entries seen may move the low water mark of a TailIterator. It allows for
+// clock skew between the iterator and the writers of entries, while an entry
+// with a timestamp far in the future does not hide those that follow it.
+const maxTailSkew = 10 * time.Second
+
+// SuppressionReason is the reason that a TailIterator did not return some
+// entries.
+type SuppressionReason int
+
+const (
+	// RateLimit means that more than MaxEntriesPerPoll new entries arrived
+	// between two polls of a TailIterator.
+	RateLimit SuppressionReason = iota + 1
+)
+
+func (r SuppressionReason) String() string {
+	switch r {
+	case RateLimit:
+		return "RateLimit"
+	default:
+		return fmt.Sprintf("SuppressionReason(%d)", int(r))
+	}
+}
+
+// SuppressionInfo describes the entries that a TailIterator did not return.
+type SuppressionInfo struct {
+	// Reason is why the entries were not returned.
+	Reason SuppressionReason
+
+	// Count is the number of entries that were not returned.
+	Count int
+}
+
+// A TailIterator iterates over log entries as they arrive. See Client.Tail.
+//
+// The exported fields of a TailIterator configure it. They must be set before
+// the first call to Next.
+type TailIterator struct {
+	// PollInterval is the time between requests for new entries. If zero,
+	// DefaultTailPollInterval is used.
+	PollInterval time.Duration
+
+	// Lateness is how long after the newest entry seen the iterator keeps
+	// looking for entries with earlier timestamps, which arrive out of order
+	// because they were written or ingested late. Entries that arrive later
+	// than that are missed. Timestamps in the future count as the current
+	// time, plus a few seconds. If zero, DefaultTailLateness is used.
+	Lateness time.Duration
+
+	// MaxEntriesPerPoll limits the number of new entries returned for each
+	// request. The entries over the limit are suppressed. If zero, there is
+	// no limit.
+	MaxEntriesPerPoll int
+
+	// OnSuppressed, if non-nil, is called by Next when entries are
+	// suppressed.
+	OnSuppressed func(SuppressionInfo)
+
+	ctx     context.Context
+	client  *vkit.Client
+	req     *logpb.ListLogEntriesRequest // without the timestamp bound
+	start   time.Time                    // no entries before it are returned
+	newest  time.Time                    // of the entries seen
+	seen    map[string]time.Time         // timestamps of the entries seen, by insert ID
+	items   []*logging.Entry
+	polled  bool
+	nextReq time.Time // of the next poll
+}
+
+// Tail returns a TailIterator for the log entries that arrive after the call
+// to Tail, such as those of a running incident. Next returns each entry once,
+// in the order of arrival, which may differ from the order of timestamps. It
+// blocks until an entry is available or ctx is done.
+//
+// Tail polls for new entries with ListLogEntries. The options are those of
+// Entries, except NewestFirst, which is ignored. Requires ReadScope or
+// AdminScope.
+func (c *Client) Tail(ctx context.Context, opts ...EntriesOption) *TailIterator {
+	req := listLogEntriesRequest(c.parent, opts)
+	req.OrderBy = "timestamp asc"
+	now := time.Now()
+	return &TailIterator{
+		ctx:    ctx,
+		client: c.lClient,
+		req:    req,
+		start:  now,
+		newest: now,
+		seen:   map[string]time.Time{},
+	}
+}
+
+// Next returns the next new entry. It blocks until there is one, and returns
+// an error only if the context of the iterator is done or a request fails.
+func (it *TailIterator) Next() (*logging.Entry, error) {
+	for len(it.items) == 0 {
+		if err := it.ctx.Err(); err != nil {
+			return nil, err
+		}
+		if it.polled {
+			t := time.NewTimer(time.Until(it.nextReq))
+			select {
+			case <-it.ctx.Done():
+				t.Stop()
+				return nil, it.ctx.Err()
+			case <-t.C:
+			}
+		}
+		it.polled = true
+		it.nextReq = time.Now().Add(it.pollInterval())
+		if err := it.poll(); err != nil {
+			return nil, err
+		}
+	}
+	e := it.items[0]
+	it.items = it.items[1:]
+	return e, nil
+}
+
+func (it *TailIterator) pollInterval() time.Duration {
+	if it.PollInterval > 0 {
+		return it.PollInterval
+	}
+	return DefaultTailPollInterval
+}
+
+func (it *TailIterator) lateness() time.Duration {
+	if it.Lateness > 0 {
+		return it.Lateness
+	}
+	return DefaultTailLateness
+}
+
+// lowWater returns the earliest timestamp of the entries that the next poll
+// looks for.
+func (it *TailIterator) lowWater() time.Time {
+	t := it.newest.Add(-it.lateness())
+	if t.Before(it.start) {
+		return it.start
+	}
+	return t
+}
+
+// poll requests the entries since the low water mark, and adds those not seen
+// before to the items of the iterator.
+func (it *TailIterator) poll() error {
+	from := it.lowWater()
+	maxNewest := time.Now().Add(maxTailSkew)
+	req := *it.req
+	bound := fmt.Sprintf(`timestamp >= "%s"`, from.UTC().Format(time.RFC3339Nano))
+	if req.Filter == "" {
+		req.Filter = bound
+	} else {
+		req.Filter = fmt.Sprintf("(%s) AND %s", req.Filter, bound)
+	}
+
+	suppressed := 0
+	added := 0
+	lit := it.client.ListLogEntries(it.ctx, &req)
+	for {
+		le, err := lit.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		ts, err := ptypes.Timestamp(le.Timestamp)
+		if err != nil {
+			return err
+		}
+		// The service assigns an insert ID to every entry; fall back to the
+		// whole entry just in case.
+		id := le.InsertId
+		if id == "" {
+			id = le.String()
+		}
+		if _, ok := it.seen[id]; ok || ts.Before(from) {
+			continue
+		}
+		it.seen[id] = ts
+		if ts.After(maxNewest) {
+			ts = maxNewest
+		}
+		if ts.After(it.newest) {
+			it.newest = ts
+		}
+		if it.MaxEntriesPerPoll > 0 && added >= it.MaxEntriesPerPoll {
+			suppressed++
+			continue
+		}
+		e, err := fromLogEntry(le)
+		if err != nil {
+			return err
+		}
+		it.items = append(it.items, e)
+		added++
+	}
+
+	// Entries before the new low water mark will not be returned by the next
+	// poll, so there is no need to remember them.
+	low := it.lowWater()
+	for id, ts := range it.seen {
+		if ts.Before(low) {
+			delete(it.seen, id)
+		}
+	}
+	if suppressed > 0 && it.OnSuppressed != nil {
+		it.OnSuppressed(SuppressionInfo{Reason: RateLimit, Count: suppressed})
+	}
+	return nil
+}
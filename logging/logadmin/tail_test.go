@@ -0,0 +1,157 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logadmin
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/internal/uid"
+	"github.com/golang/protobuf/ptypes"
+	mrpb "google.golang.org/genproto/googleapis/api/monitoredres"
+	logpb "google.golang.org/genproto/googleapis/logging/v2"
+)
+
+var tailLogIDs = uid.NewSpace("GO-LOGADMIN-TAIL", nil)
+
+// writeTailEntries writes entries with the given payloads and timestamps to
+// logName.
+func writeTailEntries(t *testing.T, logName string, entries map[string]time.Time) {
+	t.Helper()
+	req := &logpb.WriteLogEntriesRequest{
+		LogName:  logName,
+		Resource: &mrpb.MonitoredResource{Type: "global"},
+	}
+	for p, ts := range entries {
+		tspb, err := ptypes.TimestampProto(ts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Entries = append(req.Entries, &logpb.LogEntry{
+			Timestamp: tspb,
+			Payload:   &logpb.LogEntry_TextPayload{TextPayload: p},
+		})
+	}
+	if _, err := client.lClient.WriteLogEntries(context.Background(), req); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// nextPayloads returns the payloads of the next n entries of it, or fails.
+func nextPayloads(t *testing.T, it *TailIterator, n int) []string {
+	t.Helper()
+	var got []string
+	for i := 0; i < n; i++ {
+		e, err := it.Next()
+		if err != nil {
+			t.Fatalf("after %v: %v", got, err)
+		}
+		got = append(got, e.Payload.(string))
+	}
+	return got
+}
+
+func TestTail(t *testing.T) {
+	if integrationTest {
+		t.Skip("integration tests write entries with the logging package")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	logName := fmt.Sprintf("projects/%s/logs/%s", testProjectID, tailLogIDs.New())
+	start := time.Now()
+	writeTailEntries(t, logName, map[string]time.Time{"old": start.Add(-time.Hour)})
+
+	it := client.Tail(ctx, Filter(fmt.Sprintf(`logName = "%s"`, logName)))
+	it.PollInterval = 10 * time.Millisecond
+	it.Lateness = time.Minute
+
+	writeTailEntries(t, logName, map[string]time.Time{
+		"b": start.Add(2 * time.Second),
+		"a": start.Add(time.Second),
+	})
+	if got, want := fmt.Sprint(nextPayloads(t, it, 2)), "[a b]"; got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+	// A late entry, earlier than those seen, arrives with a new one. The
+	// entries seen before are not returned again.
+	writeTailEntries(t, logName, map[string]time.Time{
+		"late": start.Add(1500 * time.Millisecond),
+		"c":    start.Add(3 * time.Second),
+	})
+	if got, want := fmt.Sprint(nextPayloads(t, it, 2)), "[late c]"; got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+	// An entry later than Lateness is missed.
+	writeTailEntries(t, logName, map[string]time.Time{
+		"too late": start.Add(3*time.Second - 2*time.Minute),
+		"d":        start.Add(4 * time.Second),
+	})
+	if got, want := fmt.Sprint(nextPayloads(t, it, 1)), "[d]"; got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+
+	// An entry from the future does not raise the low water mark past the
+	// entries that follow it.
+	writeTailEntries(t, logName, map[string]time.Time{"future": start.Add(time.Hour)})
+	if got, want := fmt.Sprint(nextPayloads(t, it, 1)), "[future]"; got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+	writeTailEntries(t, logName, map[string]time.Time{"e": start.Add(5 * time.Second)})
+	if got, want := fmt.Sprint(nextPayloads(t, it, 1)), "[e]"; got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+
+	cctx, ccancel := context.WithCancel(ctx)
+	it2 := client.Tail(cctx, Filter(fmt.Sprintf(`logName = "%s"`, logName)))
+	it2.PollInterval = 10 * time.Millisecond
+	ccancel()
+	if _, err := it2.Next(); err != context.Canceled {
+		t.Errorf("after cancel: got %v, want %v", err, context.Canceled)
+	}
+}
+
+func TestTailSuppression(t *testing.T) {
+	if integrationTest {
+		t.Skip("integration tests write entries with the logging package")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	logName := fmt.Sprintf("projects/%s/logs/%s", testProjectID, tailLogIDs.New())
+	start := time.Now()
+
+	it := client.Tail(ctx, Filter(fmt.Sprintf(`logName = "%s"`, logName)))
+	it.PollInterval = 10 * time.Millisecond
+	it.MaxEntriesPerPoll = 2
+	var notices []SuppressionInfo
+	it.OnSuppressed = func(s SuppressionInfo) { notices = append(notices, s) }
+
+	entries := map[string]time.Time{}
+	for i := 0; i < 5; i++ {
+		entries[fmt.Sprint(i)] = start.Add(time.Duration(i+1) * time.Millisecond)
+	}
+	writeTailEntries(t, logName, entries)
+	if got, want := fmt.Sprint(nextPayloads(t, it, 2)), "[0 1]"; got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+	writeTailEntries(t, logName, map[string]time.Time{"5": start.Add(time.Second)})
+	if got, want := fmt.Sprint(nextPayloads(t, it, 1)), "[5]"; got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+	if got, want := fmt.Sprint(notices), "[{RateLimit 3}]"; got != want {
+		t.Errorf("suppression notices: got %s, want %s", got, want)
+	}
+}
@@ -32,7 +32,6 @@ import (
 	"fmt"
 	"log"
 	"net/http"
-	"os"
 	"regexp"
 	"strconv"
 	"strings"
@@ -40,7 +39,6 @@ import (
 	"time"
 	"unicode/utf8"
 
-	"cloud.google.com/go/compute/metadata"
 	"cloud.google.com/go/internal/version"
 	vkit "cloud.google.com/go/logging/apiv2"
 	"cloud.google.com/go/logging/internal"
@@ -236,8 +234,15 @@ type Logger struct {
 
 	// Options
 	commonResource *mrpb.MonitoredResource
+	hasResource    bool                // if set, commonResource is not detected
+	resourceEnv    ResourceEnvironment // if set, commonResource is detected from it
 	commonLabels   map[string]string
 	ctxFunc        func() (context.Context, func())
+	redirect       *jsonWriter // if set, entries are written to it instead of the service
+	spoolDir       string
+	spoolByteLimit int
+	spool          *spool           // if set, failed writes are persisted in it
+	overflow       *bundler.Bundler // of the entries to spool, if spool is set
 }
 
 // A LoggerOption is a configuration option for a Logger.
@@ -247,72 +252,17 @@ type LoggerOption interface {
 
 // CommonResource sets the monitored resource associated with all log entries
 // written from a Logger. If not provided, the resource is automatically
-// detected based on the running environment (on GCE and GAE Standard only).
+// detected based on the running environment (on GCE, GKE, App Engine,
+// Cloud Run and Cloud Functions), or on the environment given with
+// DetectResourceFrom.
 // This value can be overridden per-entry by setting an Entry's Resource field.
 func CommonResource(r *mrpb.MonitoredResource) LoggerOption { return commonResource{r} }
 
 type commonResource struct{ *mrpb.MonitoredResource }
 
-func (r commonResource) set(l *Logger) { l.commonResource = r.MonitoredResource }
-
-var detectedResource struct {
-	pb   *mrpb.MonitoredResource
-	once sync.Once
-}
-
-func detectGCEResource() *mrpb.MonitoredResource {
-	projectID, err := metadata.ProjectID()
-	if err != nil {
-		return nil
-	}
-	id, err := metadata.InstanceID()
-	if err != nil {
-		return nil
-	}
-	zone, err := metadata.Zone()
-	if err != nil {
-		return nil
-	}
-	name, err := metadata.InstanceName()
-	if err != nil {
-		return nil
-	}
-	return &mrpb.MonitoredResource{
-		Type: "gce_instance",
-		Labels: map[string]string{
-			"project_id":    projectID,
-			"instance_id":   id,
-			"instance_name": name,
-			"zone":          zone,
-		},
-	}
-}
-
-func detectGAEResource() *mrpb.MonitoredResource {
-	return &mrpb.MonitoredResource{
-		Type: "gae_app",
-		Labels: map[string]string{
-			"project_id":  os.Getenv("GOOGLE_CLOUD_PROJECT"),
-			"module_id":   os.Getenv("GAE_SERVICE"),
-			"version_id":  os.Getenv("GAE_VERSION"),
-			"instance_id": os.Getenv("GAE_INSTANCE"),
-			"runtime":     os.Getenv("GAE_RUNTIME"),
-		},
-	}
-}
-
-func detectResource() *mrpb.MonitoredResource {
-	detectedResource.once.Do(func() {
-		switch {
-		// GAE needs to come first, as metadata.OnGCE() is actually true on GAE
-		// Second Gen runtimes.
-		case os.Getenv("GAE_ENV") == "standard":
-			detectedResource.pb = detectGAEResource()
-		case metadata.OnGCE():
-			detectedResource.pb = detectGCEResource()
-		}
-	})
-	return detectedResource.pb
+func (r commonResource) set(l *Logger) {
+	l.commonResource = r.MonitoredResource
+	l.hasResource = true
 }
 
 var resourceInfo = map[string]struct{ rtype, label string }{
@@ -450,15 +400,10 @@ func (c contextFunc) set(l *Logger) { l.ctxFunc = c }
 // characters: [A-Za-z0-9]; and punctuation characters: forward-slash,
 // underscore, hyphen, and period.
 func (c *Client) Logger(logID string, opts ...LoggerOption) *Logger {
-	r := detectResource()
-	if r == nil {
-		r = monitoredResource(c.parent)
-	}
 	l := &Logger{
-		client:         c,
-		logName:        internal.LogPath(c.parent, logID),
-		commonResource: r,
-		ctxFunc:        func() (context.Context, func()) { return context.Background(), nil },
+		client:  c,
+		logName: internal.LogPath(c.parent, logID),
+		ctxFunc: func() (context.Context, func()) { return context.Background(), nil },
 	}
 	l.bundler = bundler.NewBundler(&logpb.LogEntry{}, func(entries interface{}) {
 		l.writeLogEntries(entries.([]*logpb.LogEntry))
@@ -467,9 +412,44 @@ func (c *Client) Logger(logID string, opts ...LoggerOption) *Logger {
 	l.bundler.BundleCountThreshold = DefaultEntryCountThreshold
 	l.bundler.BundleByteThreshold = DefaultEntryByteThreshold
 	l.bundler.BufferedByteLimit = DefaultBufferedByteLimit
+	l.spoolByteLimit = DefaultSpoolByteLimit
 	for _, opt := range opts {
 		opt.set(l)
 	}
+	if !l.hasResource {
+		if l.resourceEnv != nil {
+			l.commonResource = resourceFromEnv(l.resourceEnv)
+		} else {
+			l.commonResource = detectResource()
+		}
+		if l.commonResource == nil {
+			l.commonResource = monitoredResource(c.parent)
+		}
+	}
+	if l.spoolDir != "" {
+		if s, err := openSpool(l.spoolDir, l.spoolByteLimit); err != nil {
+			c.error(err)
+		} else {
+			l.spool = s
+			// Entries that do not fit in the buffer are spooled in bundles
+			// like those of the buffer.
+			l.overflow = bundler.NewBundler(&logpb.LogEntry{}, func(entries interface{}) {
+				l.spoolRequest(l.writeRequest(entries.([]*logpb.LogEntry)))
+			})
+			l.overflow.DelayThreshold = l.bundler.DelayThreshold
+			l.overflow.BundleCountThreshold = l.bundler.BundleCountThreshold
+			l.overflow.BundleByteThreshold = l.bundler.BundleByteThreshold
+			l.overflow.BundleByteLimit = l.bundler.BundleByteLimit
+			// The overflow holds about a bundle in memory; the spool, not the
+			// overflow, is what outlasts an outage.
+			l.overflow.BufferedByteLimit = l.bundler.BundleByteThreshold
+			c.loggers.Add(1)
+			go func() {
+				defer c.loggers.Done()
+				l.replaySpool(c.donec)
+			}()
+		}
+	}
 	l.stdLoggers = map[Severity]*log.Logger{}
 	for s := range severityName {
 		l.stdLoggers[s] = log.New(severityWriter{l, s}, "", 0)
@@ -482,6 +462,9 @@ func (c *Client) Logger(logID string, opts ...LoggerOption) *Logger {
 		defer c.loggers.Done()
 		<-c.donec
 		l.bundler.Flush()
+		if l.overflow != nil {
+			l.overflow.Flush()
+		}
 	}()
 	return l
 }
@@ -795,6 +778,9 @@ func (l *Logger) LogSync(ctx context.Context, e Entry) error {
 	if err != nil {
 		return err
 	}
+	if l.redirect != nil {
+		return l.redirect.write(ent, l.commonLabels)
+	}
 	_, err = l.client.client.WriteLogEntries(ctx, &logpb.WriteLogEntriesRequest{
 		LogName:  l.logName,
 		Resource: l.commonResource,
@@ -804,15 +790,34 @@ func (l *Logger) LogSync(ctx context.Context, e Entry) error {
 	return err
 }
 
-// Log buffers the Entry for output to the logging service. It never blocks.
+// Log buffers the Entry for output to the logging service. It never blocks,
+// unless the Logger has a SpoolDirectory and its buffers are full, in which
+// case it writes the Entry to the spool.
 func (l *Logger) Log(e Entry) {
 	ent, err := l.toLogEntry(e)
 	if err != nil {
 		l.client.error(err)
 		return
 	}
+	if l.redirect != nil {
+		if err := l.redirect.write(ent, l.commonLabels); err != nil {
+			l.client.error(err)
+		}
+		return
+	}
 	if err := l.bundler.Add(ent, proto.Size(ent)); err != nil {
+		if err == ErrOverflow && l.overflow != nil {
+			err = l.overflow.Add(ent, proto.Size(ent))
+			if err == nil {
+				return
+			}
+			if err == ErrOverflow {
+				l.spoolRequest(l.writeRequest([]*logpb.LogEntry{ent}))
+				return
+			}
+		}
 		l.client.error(err)
+		l.recordEntries(DroppedEntries, 1)
 	}
 }
 
@@ -824,16 +829,32 @@ func (l *Logger) Log(e Entry) {
 // be actionable. For more accurate error reporting, set Client.OnError.
 func (l *Logger) Flush() error {
 	l.bundler.Flush()
+	if l.overflow != nil {
+		l.overflow.Flush()
+	}
 	return l.client.extractErrorInfo()
 }
 
-func (l *Logger) writeLogEntries(entries []*logpb.LogEntry) {
-	req := &logpb.WriteLogEntriesRequest{
+func (l *Logger) writeRequest(entries []*logpb.LogEntry) *logpb.WriteLogEntriesRequest {
+	return &logpb.WriteLogEntriesRequest{
 		LogName:  l.logName,
 		Resource: l.commonResource,
 		Labels:   l.commonLabels,
 		Entries:  entries,
 	}
+}
+
+func (l *Logger) writeLogEntries(entries []*logpb.LogEntry) {
+	req := l.writeRequest(entries)
+	var seq uint64
+	if l.spool != nil {
+		var ok bool
+		if seq, ok = l.spool.beginWrite(); !ok {
+			// Write the entries after those already spooled.
+			l.spoolRequest(req)
+			return
+		}
+	}
 	ctx, afterCall := l.ctxFunc()
 	ctx, cancel := context.WithTimeout(ctx, defaultWriteTimeout)
 	defer cancel()
@@ -841,6 +862,11 @@ func (l *Logger) writeLogEntries(entries []*logpb.LogEntry) {
 	if err != nil {
 		l.client.error(err)
 	}
+	if l.spool != nil {
+		l.endWrite(seq, req, err)
+	} else if err != nil {
+		l.recordEntries(DroppedEntries, len(entries))
+	}
 	if afterCall != nil {
 		afterCall()
 	}
@@ -17,20 +17,27 @@
 package logging
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
 	"net/url"
+	"os"
 	"testing"
 	"time"
 
 	"cloud.google.com/go/internal/testutil"
+	"cloud.google.com/go/internal/tracecontext"
 	"github.com/golang/protobuf/proto"
 	durpb "github.com/golang/protobuf/ptypes/duration"
 	structpb "github.com/golang/protobuf/ptypes/struct"
+	"go.opencensus.io/trace"
 	"google.golang.org/api/logging/v2"
 	"google.golang.org/api/support/bundler"
 	mrpb "google.golang.org/genproto/googleapis/api/monitoredres"
 	logtypepb "google.golang.org/genproto/googleapis/logging/type"
+	"google.golang.org/grpc/metadata"
 )
 
 func TestLoggerCreation(t *testing.T) {
@@ -77,6 +84,16 @@ func TestLoggerCreation(t *testing.T) {
 			wantLogger:  &Logger{commonResource: customResource},
 			wantBundler: defaultBundler,
 		},
+		{
+			options:     []LoggerOption{DetectResourceFrom(fakeResourceEnv{env: map[string]string{"GAE_ENV": "standard"}})},
+			wantLogger:  &Logger{commonResource: detectGAEResource(fakeResourceEnv{})},
+			wantBundler: defaultBundler,
+		},
+		{
+			options:     []LoggerOption{DetectResourceFrom(fakeResourceEnv{}), CommonResource(customResource)},
+			wantLogger:  &Logger{commonResource: customResource},
+			wantBundler: defaultBundler,
+		},
 		{
 			options: []LoggerOption{
 				DelayThreshold(time.Minute),
@@ -339,6 +356,65 @@ func TestToLogEntryTrace(t *testing.T) {
 	}
 }
 
+func TestStructuredLoggerEntry(t *testing.T) {
+	s := (&Logger{client: &Client{parent: "projects/P"}}).StructuredLogger(Info).With("a", 1, "b", "x")
+
+	var tid trace.TraceID
+	var sid trace.SpanID
+	copy(tid[:], "0123456789abcdef")
+	copy(sid[:], "01234567")
+	var bin [tracecontext.Len]byte
+	tracecontext.Encode(bin[:], tid[:], 0x4a, 1)
+	spanCtx, span := trace.StartSpanWithRemoteParent(context.Background(), "span",
+		trace.SpanContext{TraceID: tid, SpanID: sid}, trace.WithSampler(trace.AlwaysSample()))
+	defer span.End()
+	header := "105445aa7843bc8bf206b120001000/000000000000004a;o=1"
+
+	for _, test := range []struct {
+		name              string
+		ctx               context.Context
+		wantTrace, wantID string
+		wantSampled       bool
+	}{
+		{"none", context.Background(), "", "", false},
+		{
+			"OpenCensus span",
+			spanCtx,
+			"projects/P/traces/" + tid.String(), span.SpanContext().SpanID.String(), true,
+		},
+		{
+			"header",
+			ContextWithTraceHeader(context.Background(), header),
+			"projects/P/traces/105445aa7843bc8bf206b120001000", "000000000000004a", true,
+		},
+		{
+			"gRPC header",
+			metadata.NewIncomingContext(context.Background(), metadata.Pairs("x-cloud-trace-context", header)),
+			"projects/P/traces/105445aa7843bc8bf206b120001000", "000000000000004a", true,
+		},
+		{
+			"gRPC binary",
+			metadata.NewIncomingContext(context.Background(), metadata.Pairs("grpc-trace-bin", string(bin[:]))),
+			"projects/P/traces/" + tid.String(), "000000000000004a", true,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			e := s.entry(test.ctx, Warning, "msg", []interface{}{"b", errors.New("boom"), 3}, nil)
+			want := map[string]interface{}{"a": 1, "b": "boom", "3": nil, MessageKey: "msg"}
+			if !testutil.Equal(e.Payload, want) {
+				t.Errorf("payload: got %v, want %v", e.Payload, want)
+			}
+			if e.Severity != Warning {
+				t.Errorf("severity: got %v, want Warning", e.Severity)
+			}
+			if e.Trace != test.wantTrace || e.SpanID != test.wantID || e.TraceSampled != test.wantSampled {
+				t.Errorf("got trace %q, span %q, sampled %t; want %q, %q, %t",
+					e.Trace, e.SpanID, e.TraceSampled, test.wantTrace, test.wantID, test.wantSampled)
+			}
+		})
+	}
+}
+
 func TestFromHTTPRequest(t *testing.T) {
 	// The test URL has invalid UTF-8 runes.
 	const testURL = "http://example.com/path?q=1&name=\xfe\xff"
@@ -451,6 +527,187 @@ func TestMonitoredResource(t *testing.T) {
 	}
 }
 
+type fakeResourceEnv struct {
+	env      map[string]string
+	files    map[string]string
+	metadata map[string]string // nil if not on GCE
+}
+
+func (f fakeResourceEnv) Getenv(name string) string { return f.env[name] }
+
+func (f fakeResourceEnv) ReadFile(name string) ([]byte, error) {
+	s, ok := f.files[name]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	return []byte(s), nil
+}
+
+func (f fakeResourceEnv) OnGCE() bool { return f.metadata != nil }
+
+func (f fakeResourceEnv) Metadata(path string) (string, error) {
+	v, ok := f.metadata[path]
+	if !ok {
+		return "", fmt.Errorf("metadata: %s not defined", path)
+	}
+	return v, nil
+}
+
+func TestDetectResource(t *testing.T) {
+	gceMetadata := map[string]string{
+		"project/project-id": "proj",
+		"instance/id":        "1234",
+		"instance/name":      "vm",
+		"instance/zone":      "projects/5678/zones/us-central1-a",
+	}
+	serverlessMetadata := map[string]string{
+		"project/project-id": "proj",
+		"instance/region":    "projects/5678/regions/us-central1\n",
+	}
+	gkeMetadata := map[string]string{
+		"instance/attributes/cluster-name": "cluster",
+	}
+	for k, v := range gceMetadata {
+		gkeMetadata[k] = v
+	}
+
+	for _, test := range []struct {
+		name string
+		env  fakeResourceEnv
+		want *mrpb.MonitoredResource
+	}{
+		{"not on GCP", fakeResourceEnv{}, nil},
+		{
+			"Knative not on GCP",
+			fakeResourceEnv{env: map[string]string{"K_SERVICE": "svc", "K_REVISION": "svc-00001"}},
+			nil,
+		},
+		{
+			"GCE",
+			fakeResourceEnv{metadata: gceMetadata},
+			&mrpb.MonitoredResource{
+				Type: "gce_instance",
+				Labels: map[string]string{
+					"project_id": "proj", "instance_id": "1234", "instance_name": "vm", "zone": "us-central1-a",
+				},
+			},
+		},
+		{"GCE without metadata", fakeResourceEnv{metadata: map[string]string{}}, nil},
+		{
+			"GAE standard",
+			fakeResourceEnv{
+				env: map[string]string{
+					"GAE_ENV": "standard", "GOOGLE_CLOUD_PROJECT": "proj", "GAE_SERVICE": "default",
+					"GAE_VERSION": "v1", "GAE_INSTANCE": "i1", "GAE_RUNTIME": "go113",
+				},
+				metadata: gceMetadata,
+			},
+			&mrpb.MonitoredResource{
+				Type: "gae_app",
+				Labels: map[string]string{
+					"project_id": "proj", "module_id": "default", "version_id": "v1", "instance_id": "i1", "runtime": "go113",
+				},
+			},
+		},
+		{
+			"GAE flex",
+			fakeResourceEnv{
+				env:      map[string]string{"GAE_SERVICE": "default", "GAE_VERSION": "v1", "GAE_INSTANCE": "i1"},
+				metadata: gceMetadata,
+			},
+			&mrpb.MonitoredResource{
+				Type: "gae_app",
+				Labels: map[string]string{
+					"project_id": "proj", "module_id": "default", "version_id": "v1", "zone": "us-central1-a",
+				},
+			},
+		},
+		{
+			"Cloud Run",
+			fakeResourceEnv{
+				env:      map[string]string{"K_SERVICE": "svc", "K_REVISION": "svc-00001", "K_CONFIGURATION": "svc"},
+				metadata: serverlessMetadata,
+			},
+			&mrpb.MonitoredResource{
+				Type: "cloud_run_revision",
+				Labels: map[string]string{
+					"project_id": "proj", "service_name": "svc", "revision_name": "svc-00001",
+					"configuration_name": "svc", "location": "us-central1",
+				},
+			},
+		},
+		{
+			"Cloud Functions",
+			fakeResourceEnv{
+				env: map[string]string{
+					"K_SERVICE": "fn", "K_REVISION": "3", "FUNCTION_TARGET": "Handle", "FUNCTION_SIGNATURE_TYPE": "http",
+				},
+				metadata: serverlessMetadata,
+			},
+			&mrpb.MonitoredResource{
+				Type:   "cloud_function",
+				Labels: map[string]string{"project_id": "proj", "function_name": "fn", "region": "us-central1"},
+			},
+		},
+		{
+			"Cloud Functions, older runtime",
+			fakeResourceEnv{
+				env:      map[string]string{"FUNCTION_NAME": "fn", "FUNCTION_REGION": "europe-west1"},
+				metadata: map[string]string{"project/project-id": "proj"},
+			},
+			&mrpb.MonitoredResource{
+				Type:   "cloud_function",
+				Labels: map[string]string{"project_id": "proj", "function_name": "fn", "region": "europe-west1"},
+			},
+		},
+		{
+			"GKE with downward API",
+			fakeResourceEnv{
+				env: map[string]string{
+					"KUBERNETES_SERVICE_HOST": "10.0.0.1", "HOSTNAME": "host",
+					"NAMESPACE_NAME": "ns", "POD_NAME": "pod", "CONTAINER_NAME": "ctr",
+				},
+				metadata: gkeMetadata,
+			},
+			&mrpb.MonitoredResource{
+				Type: "k8s_container",
+				Labels: map[string]string{
+					"project_id": "proj", "location": "us-central1-a", "cluster_name": "cluster",
+					"namespace_name": "ns", "pod_name": "pod", "container_name": "ctr",
+				},
+			},
+		},
+		{
+			"GKE regional without downward API",
+			fakeResourceEnv{
+				env:   map[string]string{"KUBERNETES_SERVICE_HOST": "10.0.0.1", "HOSTNAME": "host"},
+				files: map[string]string{k8sNamespaceFile: "ns\n"},
+				metadata: func() map[string]string {
+					m := map[string]string{"instance/attributes/cluster-location": "us-central1"}
+					for k, v := range gkeMetadata {
+						m[k] = v
+					}
+					return m
+				}(),
+			},
+			&mrpb.MonitoredResource{
+				Type: "k8s_container",
+				Labels: map[string]string{
+					"project_id": "proj", "location": "us-central1", "cluster_name": "cluster",
+					"namespace_name": "ns", "pod_name": "host", "container_name": "",
+				},
+			},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			got := resourceFromEnv(test.env)
+			if !testutil.Equal(got, test.want) {
+				t.Errorf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
 // Used by the tests in logging_test.
 func SetNow(f func() time.Time) {
 	now = f
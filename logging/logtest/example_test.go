@@ -0,0 +1,67 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logtest_test
+
+import (
+	"context"
+	"fmt"
+
+	"cloud.google.com/go/logging"
+	"cloud.google.com/go/logging/logadmin"
+	"cloud.google.com/go/logging/logtest"
+	"google.golang.org/api/iterator"
+	"google.golang.org/api/option"
+	"google.golang.org/grpc"
+)
+
+func Example() {
+	ctx := context.Background()
+	addr, err := logtest.NewServer()
+	if err != nil {
+		// TODO: Handle error.
+	}
+	conn, err := grpc.Dial(addr, grpc.WithInsecure())
+	if err != nil {
+		// TODO: Handle error.
+	}
+	client, err := logging.NewClient(ctx, logtest.ProjectID, option.WithGRPCConn(conn))
+	if err != nil {
+		// TODO: Handle error.
+	}
+	adminClient, err := logadmin.NewClient(ctx, logtest.ProjectID, option.WithGRPCConn(conn))
+	if err != nil {
+		// TODO: Handle error.
+	}
+
+	lg := client.Logger("my-log")
+	lg.Log(logging.Entry{Severity: logging.Info, Payload: "started"})
+	lg.Log(logging.Entry{Severity: logging.Error, Payload: "disk full", Labels: map[string]string{"disk": "sda"}})
+	if err := lg.Flush(); err != nil {
+		// TODO: Handle error.
+	}
+
+	it := adminClient.Entries(ctx, logadmin.Filter(`severity >= WARNING AND labels.disk:*`))
+	for {
+		e, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			// TODO: Handle error.
+		}
+		fmt.Println(e.Severity, e.Payload)
+	}
+	// Output: Error disk full
+}
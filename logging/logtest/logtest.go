@@ -0,0 +1,45 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package logtest provides an in-memory fake of the Stackdriver Logging
+// service, for testing programs that use the logging and logadmin packages
+// without a project.
+//
+// The fake stores the entries written to it, and lists them with the
+// advanced logs filter language
+// (https://cloud.google.com/logging/docs/view/advanced-queries), including
+// comparisons of nested fields, severities and timestamps, the ":"
+// operator, and AND, OR and NOT. It ignores the resource names of list
+// requests. It also stores sinks and metrics.
+//
+// This package is EXPERIMENTAL and subject to change without notice.
+package logtest // import "cloud.google.com/go/logging/logtest"
+
+import (
+	ltesting "cloud.google.com/go/logging/internal/testing"
+)
+
+// The only project and organization whose logs the fake accepts entries for.
+// Clients for the fake should use them as their parent.
+const (
+	ProjectID      = ltesting.ValidProjectID
+	OrganizationID = ltesting.ValidOrgID
+)
+
+// NewServer starts a fake logging server listening on a local port, and
+// returns its address. Connect clients to it with option.WithGRPCConn and an
+// insecure connection. The server runs until the program exits.
+func NewServer() (addr string, err error) {
+	return ltesting.NewServer()
+}
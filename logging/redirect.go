@@ -0,0 +1,175 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/golang/protobuf/jsonpb"
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
+	logtypepb "google.golang.org/genproto/googleapis/logging/type"
+	logpb "google.golang.org/genproto/googleapis/logging/v2"
+)
+
+// RedirectAsJSON makes a Logger write each entry as a line of JSON to w,
+// instead of sending it to the logging service. The line is in the
+// structured logging format that the logging agents of Cloud Run, Cloud
+// Functions, App Engine and GKE parse from the standard output of a program,
+// so
+//
+//	lg := client.Logger("my-log", logging.RedirectAsJSON(os.Stdout))
+//
+// lets the same Log calls work on those runtimes without calling the API.
+//
+// The entry's Severity, Labels (merged with the common labels), InsertID,
+// HTTPRequest, Operation, Trace, SpanID, TraceSampled and SourceLocation are
+// written as the special fields of the format. A string payload is written as
+// the "message" field; the fields of any other payload are written at the top
+// level of the line. The monitored resource and the log ID are set by the
+// agent and not written.
+//
+// Log and LogSync write each line with a single call to w.Write, and never
+// concurrently. Errors writing to w are reported like the errors of the
+// logging service, and returned by LogSync.
+func RedirectAsJSON(w io.Writer) LoggerOption { return redirectAsJSON{w} }
+
+type redirectAsJSON struct{ w io.Writer }
+
+func (r redirectAsJSON) set(l *Logger) { l.redirect = &jsonWriter{w: r.w} }
+
+// jsonWriter writes entries to an io.Writer in the structured logging format.
+type jsonWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// The special fields of the structured logging format. See
+// https://cloud.google.com/logging/docs/agent/configuration#special-fields.
+const (
+	specialFieldPrefix  = "logging.googleapis.com/"
+	severityField       = "severity"
+	messageField        = "message"
+	timestampField      = "timestamp"
+	httpRequestField    = "httpRequest"
+	labelsField         = specialFieldPrefix + "labels"
+	insertIDField       = specialFieldPrefix + "insertId"
+	operationField      = specialFieldPrefix + "operation"
+	sourceLocationField = specialFieldPrefix + "sourceLocation"
+	spanIDField         = specialFieldPrefix + "spanId"
+	traceField          = specialFieldPrefix + "trace"
+	traceSampledField   = specialFieldPrefix + "trace_sampled"
+)
+
+func (w *jsonWriter) write(ent *logpb.LogEntry, commonLabels map[string]string) error {
+	line, err := toJSONLine(ent, commonLabels)
+	if err != nil {
+		return err
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	_, err = w.w.Write(line)
+	return err
+}
+
+// toJSONLine returns ent in the structured logging format, followed by a
+// newline.
+func toJSONLine(ent *logpb.LogEntry, commonLabels map[string]string) ([]byte, error) {
+	fields := map[string]interface{}{}
+	switch p := ent.Payload.(type) {
+	case *logpb.LogEntry_TextPayload:
+		fields[messageField] = p.TextPayload
+	case *logpb.LogEntry_JsonPayload:
+		b, err := marshalProto(p.JsonPayload)
+		if err != nil {
+			return nil, err
+		}
+		var m map[string]json.RawMessage
+		if err := json.Unmarshal(b, &m); err != nil {
+			return nil, err
+		}
+		for k, v := range m {
+			fields[k] = v
+		}
+	}
+	if ent.Severity != logtypepb.LogSeverity_DEFAULT {
+		fields[severityField] = ent.Severity.String()
+	}
+	if ent.Timestamp != nil {
+		t, err := ptypes.Timestamp(ent.Timestamp)
+		if err != nil {
+			return nil, err
+		}
+		fields[timestampField] = t.UTC().Format(time.RFC3339Nano)
+	}
+	if len(commonLabels) > 0 || len(ent.Labels) > 0 {
+		labels := map[string]string{}
+		for k, v := range commonLabels {
+			labels[k] = v
+		}
+		for k, v := range ent.Labels {
+			labels[k] = v
+		}
+		fields[labelsField] = labels
+	}
+	if ent.InsertId != "" {
+		fields[insertIDField] = ent.InsertId
+	}
+	if ent.Trace != "" {
+		fields[traceField] = ent.Trace
+	}
+	if ent.SpanId != "" {
+		fields[spanIDField] = ent.SpanId
+	}
+	if ent.TraceSampled {
+		fields[traceSampledField] = true
+	}
+	var err error
+	if ent.HttpRequest != nil {
+		if fields[httpRequestField], err = marshalProto(ent.HttpRequest); err != nil {
+			return nil, err
+		}
+	}
+	if ent.Operation != nil {
+		if fields[operationField], err = marshalProto(ent.Operation); err != nil {
+			return nil, err
+		}
+	}
+	if ent.SourceLocation != nil {
+		if fields[sourceLocationField], err = marshalProto(ent.SourceLocation); err != nil {
+			return nil, err
+		}
+	}
+
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(fields); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func marshalProto(m proto.Message) (json.RawMessage, error) {
+	var buf bytes.Buffer
+	if err := (&jsonpb.Marshaler{}).Marshal(&buf, m); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
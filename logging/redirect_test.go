@@ -0,0 +1,125 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logging_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/internal/testutil"
+	"cloud.google.com/go/logging"
+	logpb "google.golang.org/genproto/googleapis/logging/v2"
+)
+
+func TestRedirectAsJSON(t *testing.T) {
+	var buf bytes.Buffer
+	lg := client.Logger(testLogID,
+		logging.RedirectAsJSON(&buf),
+		logging.CommonLabels(map[string]string{"common": "c", "both": "common"}))
+
+	u, err := url.Parse("http://example.com/path?q=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lg.Log(logging.Entry{Payload: "hello <world>"})
+	lg.Log(logging.Entry{
+		Timestamp: time.Date(2020, 3, 4, 5, 6, 7, 8000, time.UTC),
+		Severity:  logging.Warning,
+		Payload:   map[string]interface{}{"count": 3, "message": "structured"},
+		Labels:    map[string]string{"both": "entry"},
+		InsertID:  "id1",
+		HTTPRequest: &logging.HTTPRequest{
+			Request: &http.Request{Method: "GET", URL: u},
+			Status:  404,
+			Latency: 1500 * time.Millisecond,
+		},
+		Operation:      &logpb.LogEntryOperation{Id: "op", Producer: "p", First: true},
+		Trace:          "projects/P/traces/t1",
+		SpanID:         "000000000000004a",
+		TraceSampled:   true,
+		SourceLocation: &logpb.LogEntrySourceLocation{File: "f.go", Line: 12, Function: "main.f"},
+	})
+	if err := lg.LogSync(context.Background(), logging.Entry{Severity: logging.Error, Payload: "sync"}); err != nil {
+		t.Fatal(err)
+	}
+
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	if !strings.Contains(lines[0], "<world>") {
+		t.Errorf("HTML characters were escaped: %s", lines[0])
+	}
+	commonLabels := map[string]interface{}{"common": "c", "both": "common"}
+	want := []map[string]interface{}{
+		{
+			"message":                       "hello <world>",
+			"timestamp":                     "1970-01-01T00:16:40Z",
+			"logging.googleapis.com/labels": commonLabels,
+		},
+		{
+			"message":   "structured",
+			"count":     3.0,
+			"severity":  "WARNING",
+			"timestamp": "2020-03-04T05:06:07.000008Z",
+			"httpRequest": map[string]interface{}{
+				"requestMethod": "GET",
+				"requestUrl":    "http://example.com/path?q=1",
+				"status":        404.0,
+				"latency":       "1.500s",
+			},
+			"logging.googleapis.com/labels":         map[string]interface{}{"common": "c", "both": "entry"},
+			"logging.googleapis.com/insertId":       "id1",
+			"logging.googleapis.com/operation":      map[string]interface{}{"id": "op", "producer": "p", "first": true},
+			"logging.googleapis.com/trace":          "projects/P/traces/t1",
+			"logging.googleapis.com/spanId":         "000000000000004a",
+			"logging.googleapis.com/trace_sampled":  true,
+			"logging.googleapis.com/sourceLocation": map[string]interface{}{"file": "f.go", "line": "12", "function": "main.f"},
+		},
+		{
+			"message":                       "sync",
+			"severity":                      "ERROR",
+			"timestamp":                     "1970-01-01T00:16:40Z",
+			"logging.googleapis.com/labels": commonLabels,
+		},
+	}
+	if len(lines) != len(want) {
+		t.Fatalf("got %d lines, want %d:\n%s", len(lines), len(want), buf.String())
+	}
+	for i, line := range lines {
+		var got map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &got); err != nil {
+			t.Fatalf("line %d: %v", i, err)
+		}
+		if diff := testutil.Diff(got, want[i]); diff != "" {
+			t.Errorf("line %d: got=-, want=+\n%s", i, diff)
+		}
+	}
+}
+
+type errWriter struct{}
+
+func (errWriter) Write([]byte) (int, error) { return 0, errors.New("write failed") }
+
+func TestRedirectAsJSONError(t *testing.T) {
+	lg := client.Logger(testLogID, logging.RedirectAsJSON(errWriter{}))
+	if err := lg.LogSync(context.Background(), logging.Entry{Payload: "p"}); err == nil || err.Error() != "write failed" {
+		t.Errorf("got %v, want the error of the writer", err)
+	}
+}
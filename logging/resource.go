@@ -0,0 +1,235 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logging
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+
+	"cloud.google.com/go/compute/metadata"
+	mrpb "google.golang.org/genproto/googleapis/api/monitoredres"
+)
+
+// A ResourceEnvironment is the environment that the monitored resource of a
+// Logger is detected from: environment variables, files and the metadata
+// server. By default it is the environment of the program. Pass an
+// implementation to DetectResourceFrom to detect the resource of a platform
+// that provides this information elsewhere, such as Knative outside Google
+// Cloud Platform.
+type ResourceEnvironment interface {
+	// Getenv returns the value of an environment variable, as os.Getenv.
+	Getenv(name string) string
+	// ReadFile returns the contents of a file, as ioutil.ReadFile.
+	ReadFile(name string) ([]byte, error)
+	// OnGCE reports whether the metadata server is available.
+	OnGCE() bool
+	// Metadata returns the value at the path of the metadata server, such
+	// as "instance/zone".
+	Metadata(path string) (string, error)
+}
+
+type osResourceEnv struct{}
+
+func (osResourceEnv) Getenv(name string) string            { return os.Getenv(name) }
+func (osResourceEnv) ReadFile(name string) ([]byte, error) { return ioutil.ReadFile(name) }
+func (osResourceEnv) OnGCE() bool                          { return metadata.OnGCE() }
+func (osResourceEnv) Metadata(path string) (string, error) { return metadata.Get(path) }
+
+var detectedResource struct {
+	pb   *mrpb.MonitoredResource
+	once sync.Once
+}
+
+// detectResource returns the monitored resource of the program, or nil if it
+// is not running on Google Cloud Platform. The result is computed once.
+func detectResource() *mrpb.MonitoredResource {
+	detectedResource.once.Do(func() {
+		detectedResource.pb = resourceFromEnv(osResourceEnv{})
+	})
+	return detectedResource.pb
+}
+
+// DetectResourceFrom returns a LoggerOption that detects the monitored
+// resource of a Logger from env, rather than from the environment of the
+// program. It has no effect if CommonResource is also given.
+func DetectResourceFrom(env ResourceEnvironment) LoggerOption { return detectResourceFrom{env} }
+
+type detectResourceFrom struct{ env ResourceEnvironment }
+
+func (d detectResourceFrom) set(l *Logger) { l.resourceEnv = d.env }
+
+// resourceFromEnv returns the monitored resource detected from env, or nil if
+// env is not on Google Cloud Platform.
+func resourceFromEnv(env ResourceEnvironment) *mrpb.MonitoredResource {
+	switch {
+	// GAE needs to come first, as metadata.OnGCE() is actually true on GAE
+	// Second Gen runtimes.
+	case env.Getenv("GAE_ENV") == "standard":
+		return detectGAEResource(env)
+	// Knative sets the variables of Cloud Run outside GCP too, and the
+	// resources below need the metadata server.
+	case !env.OnGCE():
+		return nil
+	// Cloud Functions set the variables of Cloud Run too, so they come
+	// before it.
+	case env.Getenv("FUNCTION_TARGET") != "" || env.Getenv("FUNCTION_NAME") != "":
+		return detectCloudFunctionResource(env)
+	case env.Getenv("K_SERVICE") != "" && env.Getenv("K_REVISION") != "":
+		return detectCloudRunResource(env)
+	case env.Getenv("GAE_SERVICE") != "":
+		return detectGAEFlexResource(env)
+	case env.Getenv("KUBERNETES_SERVICE_HOST") != "":
+		return detectGKEResource(env)
+	default:
+		return detectGCEResource(env)
+	}
+}
+
+// metadataValue returns the value at path of the metadata server, without
+// surrounding white space, or "" if it is unavailable.
+func metadataValue(env ResourceEnvironment, path string) string {
+	v, err := env.Metadata(path)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(v)
+}
+
+// lastComponent returns the part of a metadata value such as
+// "projects/123/zones/us-central1-a" after its last slash.
+func lastComponent(s string) string {
+	return s[strings.LastIndex(s, "/")+1:]
+}
+
+func detectGCEResource(env ResourceEnvironment) *mrpb.MonitoredResource {
+	projectID := metadataValue(env, "project/project-id")
+	id := metadataValue(env, "instance/id")
+	zone := lastComponent(metadataValue(env, "instance/zone"))
+	name := metadataValue(env, "instance/name")
+	if projectID == "" || id == "" || zone == "" || name == "" {
+		return nil
+	}
+	return &mrpb.MonitoredResource{
+		Type: "gce_instance",
+		Labels: map[string]string{
+			"project_id":    projectID,
+			"instance_id":   id,
+			"instance_name": name,
+			"zone":          zone,
+		},
+	}
+}
+
+func detectGAEResource(env ResourceEnvironment) *mrpb.MonitoredResource {
+	return &mrpb.MonitoredResource{
+		Type: "gae_app",
+		Labels: map[string]string{
+			"project_id":  env.Getenv("GOOGLE_CLOUD_PROJECT"),
+			"module_id":   env.Getenv("GAE_SERVICE"),
+			"version_id":  env.Getenv("GAE_VERSION"),
+			"instance_id": env.Getenv("GAE_INSTANCE"),
+			"runtime":     env.Getenv("GAE_RUNTIME"),
+		},
+	}
+}
+
+func detectGAEFlexResource(env ResourceEnvironment) *mrpb.MonitoredResource {
+	return &mrpb.MonitoredResource{
+		Type: "gae_app",
+		Labels: map[string]string{
+			"project_id": metadataValue(env, "project/project-id"),
+			"module_id":  env.Getenv("GAE_SERVICE"),
+			"version_id": env.Getenv("GAE_VERSION"),
+			"zone":       lastComponent(metadataValue(env, "instance/zone")),
+		},
+	}
+}
+
+func detectCloudFunctionResource(env ResourceEnvironment) *mrpb.MonitoredResource {
+	// Newer runtimes name the function with K_SERVICE, older ones with
+	// FUNCTION_NAME.
+	name := env.Getenv("K_SERVICE")
+	if name == "" {
+		name = env.Getenv("FUNCTION_NAME")
+	}
+	return &mrpb.MonitoredResource{
+		Type: "cloud_function",
+		Labels: map[string]string{
+			"project_id":    metadataValue(env, "project/project-id"),
+			"function_name": name,
+			"region":        serverlessRegion(env),
+		},
+	}
+}
+
+func detectCloudRunResource(env ResourceEnvironment) *mrpb.MonitoredResource {
+	return &mrpb.MonitoredResource{
+		Type: "cloud_run_revision",
+		Labels: map[string]string{
+			"project_id":         metadataValue(env, "project/project-id"),
+			"service_name":       env.Getenv("K_SERVICE"),
+			"revision_name":      env.Getenv("K_REVISION"),
+			"configuration_name": env.Getenv("K_CONFIGURATION"),
+			"location":           serverlessRegion(env),
+		},
+	}
+}
+
+// serverlessRegion returns the region of a Cloud Run or Cloud Functions
+// instance, falling back to the FUNCTION_REGION variable of older runtimes.
+func serverlessRegion(env ResourceEnvironment) string {
+	if r := lastComponent(metadataValue(env, "instance/region")); r != "" {
+		return r
+	}
+	return env.Getenv("FUNCTION_REGION")
+}
+
+// The file of the Kubernetes service account that holds the namespace of the
+// pod.
+const k8sNamespaceFile = "/var/run/secrets/kubernetes.io/serviceaccount/namespace"
+
+func detectGKEResource(env ResourceEnvironment) *mrpb.MonitoredResource {
+	// Regional clusters have a cluster-location attribute; the location of
+	// zonal clusters is the zone of their nodes.
+	location := metadataValue(env, "instance/attributes/cluster-location")
+	if location == "" {
+		location = lastComponent(metadataValue(env, "instance/zone"))
+	}
+	// The namespace, pod and container names are best set with the downward
+	// API, as environment variables of the container.
+	namespace := env.Getenv("NAMESPACE_NAME")
+	if namespace == "" {
+		if b, err := env.ReadFile(k8sNamespaceFile); err == nil {
+			namespace = strings.TrimSpace(string(b))
+		}
+	}
+	pod := env.Getenv("POD_NAME")
+	if pod == "" {
+		pod = env.Getenv("HOSTNAME")
+	}
+	return &mrpb.MonitoredResource{
+		Type: "k8s_container",
+		Labels: map[string]string{
+			"project_id":     metadataValue(env, "project/project-id"),
+			"location":       location,
+			"cluster_name":   metadataValue(env, "instance/attributes/cluster-name"),
+			"namespace_name": namespace,
+			"pod_name":       pod,
+			"container_name": env.Getenv("CONTAINER_NAME"),
+		},
+	}
+}
@@ -0,0 +1,414 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logging
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	gax "github.com/googleapis/gax-go/v2"
+	logpb "google.golang.org/genproto/googleapis/logging/v2"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// DefaultSpoolByteLimit is the default value for the SpoolByteLimit
+// LoggerOption.
+const DefaultSpoolByteLimit = 1 << 30 // 1GiB
+
+// SpoolDirectory makes a Logger persist the entries passed to Log that it
+// cannot write to the logging service in files of dir, instead of dropping
+// them, and write them once the service is available again. This lets a
+// program keep its logs through an outage of the service that is longer than
+// its BufferedByteLimit allows.
+//
+// A bundle of entries is spooled when its write fails with an error that may
+// go away, such as Unavailable or DeadlineExceeded, and entries that do not
+// fit in the BufferedByteLimit are spooled in bundles of their own. The
+// entries of those bundles are held in memory up to EntryByteThreshold bytes;
+// beyond that, Log spools each entry by itself before it returns. As the
+// write of a bundle is retried for up to several minutes, most entries of a
+// long outage are spooled for the latter reason. While there are spooled
+// bundles, later bundles are spooled too.
+//
+// The spooled bundles are written by a goroutine of the Logger, which backs
+// off while the writes fail. A bundle whose write fails takes the place it
+// had when the write started, and the goroutine waits for the writes in
+// flight before writing the bundles spooled after them, so bundles are
+// written in the order they left the buffer of the Logger. Entries that do
+// not fit in the buffer may be written before those already in it. The errors
+// of the writes are reported to Client.OnError.
+//
+// A spooled bundle that cannot be read is renamed with the suffix ".bad",
+// and its error reported to Client.OnError.
+//
+// Bundles that remain in dir when the Client is closed, or when the program
+// exits, are written by the next Logger that uses dir. The directory must
+// not be used by more than one Logger at a time. It is created if needed.
+//
+// Flush does not wait for the spooled entries to be written. LogSync does
+// not use the spool.
+//
+// This option is EXPERIMENTAL. It may be changed or removed.
+func SpoolDirectory(dir string) LoggerOption { return spoolDirectory(dir) }
+
+type spoolDirectory string
+
+func (d spoolDirectory) set(l *Logger) { l.spoolDir = string(d) }
+
+// SpoolByteLimit is the maximum number of bytes of the files in the spool
+// directory of a Logger. Entries that do not fit are dropped with ErrOverflow.
+// The default is DefaultSpoolByteLimit.
+//
+// This option is EXPERIMENTAL. It may be changed or removed.
+func SpoolByteLimit(n int) LoggerOption { return spoolByteLimit(n) }
+
+type spoolByteLimit int
+
+func (s spoolByteLimit) set(l *Logger) { l.spoolByteLimit = int(s) }
+
+// The suffixes of the files of a spool directory. A spooled bundle is first
+// written to a temporary file, and then renamed.
+const (
+	spoolSuffix    = ".spool"
+	spoolTmpSuffix = ".tmp"
+	spoolBadSuffix = ".bad"
+)
+
+// A spool holds the WriteLogEntriesRequests of a Logger in the files of a
+// directory, in order. The files are named by their sequence number. The
+// writes of the Logger to the service take a sequence number too, so that a
+// request whose write fails can be spooled at its place.
+type spool struct {
+	dir     string
+	limit   int64
+	backoff gax.Backoff   // of the writes of the spooled requests
+	notify  chan struct{} // signaled when a request is added or a write ends
+
+	mu      sync.Mutex
+	files   []spoolFile     // by sequence number
+	size    int64           // of the files
+	seq     uint64          // of the next file or write
+	writing map[uint64]bool // sequence numbers of the writes in flight
+}
+
+type spoolFile struct {
+	name string
+	seq  uint64
+	size int64
+}
+
+// openSpool returns the spool of dir, with the requests already in it.
+func openSpool(dir string, limit int) (*spool, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	infos, err := ioutil.ReadDir(dir) // sorted by name
+	if err != nil {
+		return nil, err
+	}
+	s := &spool{
+		dir:   dir,
+		limit: int64(limit),
+		backoff: gax.Backoff{
+			Initial:    time.Second,
+			Max:        time.Minute,
+			Multiplier: 2,
+		},
+		notify:  make(chan struct{}, 1),
+		writing: map[uint64]bool{},
+	}
+	for _, fi := range infos {
+		name := fi.Name()
+		if fi.IsDir() {
+			continue
+		}
+		if strings.HasSuffix(name, spoolTmpSuffix) {
+			// Left by a program that exited while spooling.
+			os.Remove(filepath.Join(dir, name))
+			continue
+		}
+		seq, err := strconv.ParseUint(strings.TrimSuffix(name, spoolSuffix), 10, 64)
+		if !strings.HasSuffix(name, spoolSuffix) || err != nil {
+			continue
+		}
+		s.files = append(s.files, spoolFile{name: name, seq: seq, size: fi.Size()})
+		s.size += fi.Size()
+		if seq >= s.seq {
+			s.seq = seq + 1
+		}
+	}
+	return s, nil
+}
+
+// add persists req after the requests in the spool. It returns ErrOverflow if
+// req does not fit.
+func (s *spool) add(req *logpb.WriteLogEntriesRequest) error {
+	b, err := proto.Marshal(req)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	seq := s.seq
+	s.seq++
+	return s.write(seq, b)
+}
+
+// write persists the marshaled request b with sequence number seq. s.mu must
+// be held.
+func (s *spool) write(seq uint64, b []byte) error {
+	if s.size+int64(len(b)) > s.limit {
+		return ErrOverflow
+	}
+	// The sequence numbers are padded so that the names sort in order.
+	name := fmt.Sprintf("%020d%s", seq, spoolSuffix)
+	path := filepath.Join(s.dir, name)
+	if err := ioutil.WriteFile(path+spoolTmpSuffix, b, 0600); err != nil {
+		os.Remove(path + spoolTmpSuffix)
+		return err
+	}
+	if err := os.Rename(path+spoolTmpSuffix, path); err != nil {
+		os.Remove(path + spoolTmpSuffix)
+		return err
+	}
+	i := sort.Search(len(s.files), func(i int) bool { return s.files[i].seq > seq })
+	s.files = append(s.files, spoolFile{})
+	copy(s.files[i+1:], s.files[i:])
+	s.files[i] = spoolFile{name: name, seq: seq, size: int64(len(b))}
+	s.size += int64(len(b))
+	s.signal()
+	return nil
+}
+
+// signal wakes up the goroutine that writes the spooled requests. s.mu must
+// be held.
+func (s *spool) signal() {
+	select {
+	case s.notify <- struct{}{}:
+	default:
+	}
+}
+
+// beginWrite starts a write to the service, and returns its sequence number.
+// It returns false if there are requests in the spool, which the request of
+// the write must follow.
+func (s *spool) beginWrite() (uint64, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.files) > 0 {
+		return 0, false
+	}
+	seq := s.seq
+	s.seq++
+	s.writing[seq] = true
+	return seq, true
+}
+
+// endWrite ends the write with sequence number seq. If req is not nil, the
+// write failed, and req is persisted at the place of the write. It returns
+// ErrOverflow if req does not fit.
+func (s *spool) endWrite(seq uint64, req *logpb.WriteLogEntriesRequest) error {
+	var b []byte
+	var err error
+	if req != nil {
+		b, err = proto.Marshal(req)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.writing, seq)
+	s.signal()
+	if req == nil || err != nil {
+		return err
+	}
+	return s.write(seq, b)
+}
+
+// oldest returns the oldest request in the spool and its file. It returns
+// false if the spool is empty, or if a write that the request must follow is
+// in flight, and an error with the file if the file cannot be read.
+func (s *spool) oldest() (spoolFile, *logpb.WriteLogEntriesRequest, bool, error) {
+	s.mu.Lock()
+	if len(s.files) == 0 {
+		s.mu.Unlock()
+		return spoolFile{}, nil, false, nil
+	}
+	f := s.files[0]
+	for seq := range s.writing {
+		if seq < f.seq {
+			s.mu.Unlock()
+			return spoolFile{}, nil, false, nil
+		}
+	}
+	s.mu.Unlock()
+
+	b, err := ioutil.ReadFile(filepath.Join(s.dir, f.name))
+	if err != nil {
+		return f, nil, true, err
+	}
+	req := &logpb.WriteLogEntriesRequest{}
+	if err := proto.Unmarshal(b, req); err != nil {
+		return f, nil, true, fmt.Errorf("logging: bad spool file %s: %v", f.name, err)
+	}
+	return f, req, true, nil
+}
+
+// forget removes f, the oldest file, from the list of files of the spool.
+func (s *spool) forget(f spoolFile) {
+	s.mu.Lock()
+	s.files = s.files[1:]
+	s.size -= f.size
+	s.mu.Unlock()
+}
+
+// remove removes f, the oldest file, from the spool.
+func (s *spool) remove(f spoolFile) error {
+	s.forget(f)
+	if err := os.Remove(filepath.Join(s.dir, f.name)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// setAside removes f, the oldest file, from the spool, but keeps it in the
+// directory under another name.
+func (s *spool) setAside(f spoolFile) error {
+	s.forget(f)
+	path := filepath.Join(s.dir, f.name)
+	return os.Rename(path, path+spoolBadSuffix)
+}
+
+// spoolable reports whether a request that failed with err should be
+// spooled, because the error may go away.
+func spoolable(err error) bool {
+	if err == context.DeadlineExceeded {
+		// The deadline passed while the client was backing off.
+		return true
+	}
+	switch status.Code(err) {
+	case codes.Unavailable, codes.DeadlineExceeded, codes.ResourceExhausted, codes.Aborted, codes.Internal:
+		return true
+	default:
+		return false
+	}
+}
+
+// spoolRequest adds req to the spool of the Logger, or drops it if it does
+// not fit.
+func (l *Logger) spoolRequest(req *logpb.WriteLogEntriesRequest) {
+	l.recordSpooled(req, l.spool.add(req))
+}
+
+// endWrite ends the write of req with sequence number seq, which failed if
+// err is not nil. The request is spooled at the place of the write if err
+// may go away, and dropped otherwise.
+func (l *Logger) endWrite(seq uint64, req *logpb.WriteLogEntriesRequest, err error) {
+	if err == nil || !spoolable(err) {
+		if serr := l.spool.endWrite(seq, nil); serr != nil {
+			l.client.error(serr)
+		}
+		if err != nil {
+			l.recordEntries(DroppedEntries, len(req.Entries))
+		}
+		return
+	}
+	l.recordSpooled(req, l.spool.endWrite(seq, req))
+}
+
+// recordSpooled records the entries of req as spooled, or as dropped if
+// spooling them failed with err.
+func (l *Logger) recordSpooled(req *logpb.WriteLogEntriesRequest, err error) {
+	if err != nil {
+		l.client.error(err)
+		l.recordEntries(DroppedEntries, len(req.Entries))
+		return
+	}
+	l.recordEntries(SpooledEntries, len(req.Entries))
+}
+
+// replaySpool writes the requests of the spool to the logging service in
+// order, after the writes in flight that precede them, backing off while the
+// writes fail, until donec is closed.
+func (l *Logger) replaySpool(donec <-chan struct{}) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-donec:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	s := l.spool
+	bo := s.backoff
+	for {
+		f, req, ok, err := s.oldest()
+		if !ok {
+			select {
+			case <-s.notify:
+				continue
+			case <-donec:
+				return
+			}
+		}
+		if err != nil {
+			// Keep the file, as the number of entries it held is unknown.
+			l.client.error(err)
+			if err := s.setAside(f); err != nil {
+				l.client.error(err)
+			}
+			continue
+		}
+
+		wctx, wcancel := context.WithTimeout(ctx, defaultWriteTimeout)
+		_, err = l.client.client.WriteLogEntries(wctx, req)
+		wcancel()
+		if err != nil && ctx.Err() != nil {
+			// The client is closed; the request stays in the spool.
+			return
+		}
+		if err == nil || !spoolable(err) {
+			if err == nil {
+				l.recordEntries(ReplayedEntries, len(req.Entries))
+			} else {
+				l.client.error(err)
+				l.recordEntries(DroppedEntries, len(req.Entries))
+			}
+			if err := s.remove(f); err != nil {
+				l.client.error(err)
+			}
+			bo = s.backoff
+			continue
+		}
+		l.client.error(err)
+		t := time.NewTimer(bo.Pause())
+		select {
+		case <-t.C:
+		case <-donec:
+			t.Stop()
+			return
+		}
+	}
+}
@@ -0,0 +1,341 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logging_test
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/logging"
+	ltesting "cloud.google.com/go/logging/internal/testing"
+	"cloud.google.com/go/logging/logadmin"
+	"go.opencensus.io/stats/view"
+	"google.golang.org/api/iterator"
+	"google.golang.org/api/option"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// outageServer is a fake logging service whose writes fail with Unavailable
+// while it is down.
+type outageServer struct {
+	addr string
+	down int32
+}
+
+func newOutageServer(t *testing.T) *outageServer {
+	addr, err := ltesting.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &outageServer{addr: addr, down: 1}
+}
+
+func (s *outageServer) setDown(down bool) {
+	v := int32(0)
+	if down {
+		v = 1
+	}
+	atomic.StoreInt32(&s.down, v)
+}
+
+// dial returns a connection to the server. Each client needs its own, as
+// closing the client closes it.
+func (s *outageServer) dial(t *testing.T) option.ClientOption {
+	conn, err := grpc.Dial(s.addr, grpc.WithInsecure(), grpc.WithUnaryInterceptor(
+		func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+			if atomic.LoadInt32(&s.down) == 1 && strings.HasSuffix(method, "/WriteLogEntries") {
+				return status.Error(codes.Unavailable, "outage")
+			}
+			return invoker(ctx, method, req, reply, cc, opts...)
+		}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return option.WithGRPCConn(conn)
+}
+
+func (s *outageServer) client(t *testing.T, onError func(error)) *logging.Client {
+	c, err := logging.NewClient(ctx, "projects/"+ltesting.ValidProjectID, s.dial(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.OnError = onError
+	return c
+}
+
+// shortWrites makes the writes of a Logger time out quickly, instead of
+// retrying through the outage.
+var shortWrites = logging.ContextFunc(func() (context.Context, func()) {
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	return ctx, cancel
+})
+
+func spoolFiles(t *testing.T, dir string) []string {
+	files, err := filepath.Glob(filepath.Join(dir, "*.spool"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+func TestSpool(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	srv := newOutageServer(t)
+	ignore := func(error) {}
+
+	// During the outage, each flushed bundle is spooled once its write times
+	// out.
+	c := srv.client(t, ignore)
+	lg := c.Logger("spool", logging.SpoolDirectory(dir), shortWrites)
+	for i := 0; i < 3; i++ {
+		lg.Log(logging.Entry{Payload: strconv.Itoa(i)})
+		lg.Flush()
+	}
+	if got := len(spoolFiles(t, dir)); got != 3 {
+		t.Fatalf("got %d spooled bundles, want 3", got)
+	}
+	// The bundles outlive the client.
+	c.Close()
+	if got := len(spoolFiles(t, dir)); got != 3 {
+		t.Fatalf("after Close, got %d spooled bundles, want 3", got)
+	}
+
+	// A Logger with the same directory writes them, in order, before its
+	// own entries.
+	srv.setDown(false)
+	c = srv.client(t, ignore)
+	defer c.Close()
+	lg = c.Logger("spool", logging.SpoolDirectory(dir))
+	lg.Log(logging.Entry{Payload: "3"})
+	lg.Flush()
+
+	ac, err := logadmin.NewClient(ctx, "projects/"+ltesting.ValidProjectID, srv.dial(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ac.Close()
+	var got []string
+	ok := waitFor(func() bool {
+		got = nil
+		var ids []int
+		byID := map[int]string{}
+		it := ac.Entries(ctx, logadmin.Filter(fmt.Sprintf(`logName = "projects/%s/logs/spool"`, ltesting.ValidProjectID)))
+		for {
+			e, err := it.Next()
+			if err == iterator.Done {
+				break
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			// The fake assigns increasing insert IDs in the order of writes.
+			id, err := strconv.Atoi(strings.TrimPrefix(e.InsertID, "fake-"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			ids = append(ids, id)
+			byID[id] = e.Payload.(string)
+		}
+		sort.Ints(ids)
+		for _, id := range ids {
+			got = append(got, byID[id])
+		}
+		return len(got) == 4
+	})
+	if !ok {
+		t.Fatalf("timed out; got %q", got)
+	}
+	if want := []string{"0", "1", "2", "3"}; fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if files := spoolFiles(t, dir); len(files) != 0 {
+		t.Errorf("spooled bundles remain: %q", files)
+	}
+}
+
+func TestSpoolByteLimit(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := view.Register(logging.DroppedEntriesView); err != nil {
+		t.Fatal(err)
+	}
+	defer view.Unregister(logging.DroppedEntriesView)
+
+	srv := newOutageServer(t)
+	errc := make(chan error, 10)
+	c := srv.client(t, func(err error) {
+		select {
+		case errc <- err:
+		default:
+		}
+	})
+	lg := c.Logger("spool-limit", logging.SpoolDirectory(dir), logging.SpoolByteLimit(1), shortWrites)
+	lg.Log(logging.Entry{Payload: "dropped"})
+	lg.Flush()
+	c.Close()
+
+	if files := spoolFiles(t, dir); len(files) != 0 {
+		t.Errorf("got spooled bundles %q, want none", files)
+	}
+	timeout := time.After(10 * time.Second)
+	for overflowed := false; !overflowed; {
+		select {
+		case err := <-errc:
+			overflowed = err == logging.ErrOverflow
+		case <-timeout:
+			t.Fatal("ErrOverflow was not reported")
+		}
+	}
+
+	rows, err := view.RetrieveData(logging.DroppedEntriesView.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var dropped float64
+	for _, r := range rows {
+		for _, tg := range r.Tags {
+			if strings.HasSuffix(tg.Value, "/logs/spool-limit") {
+				dropped += r.Data.(*view.SumData).Value
+			}
+		}
+	}
+	if dropped != 1 {
+		t.Errorf("got %v dropped entries, want 1", dropped)
+	}
+}
+
+func TestSpoolOverflow(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	srv := newOutageServer(t)
+
+	// No entry fits in the buffer, and the entries are spooled in one
+	// bundle.
+	c := srv.client(t, func(error) {})
+	lg := c.Logger("spool-overflow", logging.SpoolDirectory(dir), logging.BufferedByteLimit(1), shortWrites)
+	for i := 0; i < 3; i++ {
+		lg.Log(logging.Entry{Payload: strconv.Itoa(i)})
+	}
+	lg.Flush()
+	c.Close()
+	if got := len(spoolFiles(t, dir)); got != 1 {
+		t.Errorf("got %d spooled bundles, want 1", got)
+	}
+}
+
+func TestSpoolBadFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	bad := filepath.Join(dir, fmt.Sprintf("%020d.spool", 0))
+	if err := ioutil.WriteFile(bad, []byte{0xff, 0xff, 0xff}, 0600); err != nil {
+		t.Fatal(err)
+	}
+	srv := newOutageServer(t)
+	srv.setDown(false)
+
+	// The file that cannot be read is set aside, and its error reported.
+	errc := make(chan error, 1)
+	c := srv.client(t, func(err error) {
+		select {
+		case errc <- err:
+		default:
+		}
+	})
+	defer c.Close()
+	c.Logger("spool-bad", logging.SpoolDirectory(dir))
+	select {
+	case <-errc:
+	case <-time.After(10 * time.Second):
+		t.Fatal("no error was reported")
+	}
+	if !waitFor(func() bool { return len(spoolFiles(t, dir)) == 0 }) {
+		t.Fatal("the file was not removed from the spool")
+	}
+	if _, err := os.Stat(bad + ".bad"); err != nil {
+		t.Errorf("the file was not set aside: %v", err)
+	}
+}
+
+func TestSpoolFlood(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	views := []*view.View{logging.SpooledEntriesView, logging.DroppedEntriesView}
+	if err := view.Register(views...); err != nil {
+		t.Fatal(err)
+	}
+	defer view.Unregister(views...)
+	srv := newOutageServer(t)
+
+	// Far more entries than fit in memory are logged while the writes fail.
+	// Those beyond a bundle are spooled by Log, and none is dropped.
+	const n = 500
+	c := srv.client(t, func(error) {})
+	lg := c.Logger("spool-flood", logging.SpoolDirectory(dir), logging.BufferedByteLimit(1),
+		logging.EntryByteThreshold(1000), shortWrites)
+	for i := 0; i < n; i++ {
+		lg.Log(logging.Entry{Payload: strings.Repeat("x", 100)})
+	}
+	lg.Flush()
+	c.Close()
+
+	count := func(v *view.View) float64 {
+		rows, err := view.RetrieveData(v.Name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var sum float64
+		for _, r := range rows {
+			for _, tg := range r.Tags {
+				if strings.HasSuffix(tg.Value, "/logs/spool-flood") {
+					sum += r.Data.(*view.SumData).Value
+				}
+			}
+		}
+		return sum
+	}
+	if got := count(logging.SpooledEntriesView); got != n {
+		t.Errorf("got %v spooled entries, want %d", got, n)
+	}
+	if got := count(logging.DroppedEntriesView); got != 0 {
+		t.Errorf("got %v dropped entries, want 0", got)
+	}
+}
@@ -0,0 +1,99 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logging
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	logpb "google.golang.org/genproto/googleapis/logging/v2"
+)
+
+func TestSpoolWriteOrder(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	s, err := openSpool(dir, DefaultSpoolByteLimit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := func(name string) *logpb.WriteLogEntriesRequest {
+		return &logpb.WriteLogEntriesRequest{LogName: name}
+	}
+	oldest := func() string {
+		t.Helper()
+		_, r, ok, err := s.oldest()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !ok {
+			return ""
+		}
+		return r.LogName
+	}
+
+	seq, ok := s.beginWrite()
+	if !ok {
+		t.Fatal("beginWrite on an empty spool failed")
+	}
+	// A request spooled during the write waits for it.
+	if err := s.add(req("b")); err != nil {
+		t.Fatal(err)
+	}
+	if got := oldest(); got != "" {
+		t.Errorf("during the write, got oldest %q, want none", got)
+	}
+	if _, ok := s.beginWrite(); ok {
+		t.Error("beginWrite on a non-empty spool succeeded")
+	}
+	// The failed write takes its place before it.
+	if err := s.endWrite(seq, req("a")); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"a", "b", ""} {
+		f, _, _, _ := s.oldest()
+		if got := oldest(); got != want {
+			t.Fatalf("got oldest %q, want %q", got, want)
+		}
+		if want != "" {
+			if err := s.remove(f); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+}
+
+func TestSpoolOverflowLimit(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	c := &Client{parent: "projects/PROJECT_ID", donec: make(chan struct{})}
+	defer func() {
+		close(c.donec)
+		c.loggers.Wait()
+	}()
+
+	// The overflow is held in memory, and is bounded by a bundle rather
+	// than by the size of the spool.
+	l := c.Logger("log", SpoolDirectory(dir), SpoolByteLimit(1<<40), EntryByteThreshold(1000))
+	if got, want := l.overflow.BufferedByteLimit, 1000; got != want {
+		t.Errorf("got BufferedByteLimit %d, want %d", got, want)
+	}
+}
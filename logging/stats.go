@@ -0,0 +1,101 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logging
+
+import (
+	"context"
+
+	"go.opencensus.io/stats"
+	"go.opencensus.io/stats/view"
+	"go.opencensus.io/tag"
+)
+
+// keyLog tags the measures of a Logger with its log name, such as
+// "projects/my-project/logs/my-log".
+var keyLog = tag.MustNewKey("log")
+
+const statsPrefix = "cloud.google.com/go/logging/"
+
+// The following are measures recorded by the Log method of a Logger and the
+// writes of its buffered entries.
+var (
+	// SpooledEntries is a measure of the number of entries persisted to the
+	// spool directory of a Logger. See SpoolDirectory.
+	// It is EXPERIMENTAL and subject to change or removal without notice.
+	SpooledEntries = stats.Int64(statsPrefix+"spooled_entries", "Number of entries persisted to the spool directory", stats.UnitDimensionless)
+
+	// ReplayedEntries is a measure of the number of spooled entries written
+	// to the logging service.
+	// It is EXPERIMENTAL and subject to change or removal without notice.
+	ReplayedEntries = stats.Int64(statsPrefix+"replayed_entries", "Number of spooled entries written to the logging service", stats.UnitDimensionless)
+
+	// DroppedEntries is a measure of the number of entries passed to Log that
+	// were never written to the logging service: those over the
+	// BufferedByteLimit or SpoolByteLimit, and those of failed writes that
+	// were not spooled.
+	// It is EXPERIMENTAL and subject to change or removal without notice.
+	DroppedEntries = stats.Int64(statsPrefix+"dropped_entries", "Number of entries that were not written to the logging service", stats.UnitDimensionless)
+)
+
+var (
+	// SpooledEntriesView is a cumulative sum of SpooledEntries.
+	// It is EXPERIMENTAL and subject to change or removal without notice.
+	SpooledEntriesView *view.View
+
+	// ReplayedEntriesView is a cumulative sum of ReplayedEntries.
+	// It is EXPERIMENTAL and subject to change or removal without notice.
+	ReplayedEntriesView *view.View
+
+	// DroppedEntriesView is a cumulative sum of DroppedEntries.
+	// It is EXPERIMENTAL and subject to change or removal without notice.
+	DroppedEntriesView *view.View
+)
+
+// DefaultViews holds the default OpenCensus views of Loggers. Register them
+// with view.Register to collect their metrics.
+// It is EXPERIMENTAL and subject to change or removal without notice.
+var DefaultViews []*view.View
+
+func init() {
+	SpooledEntriesView = createCountView(SpooledEntries, keyLog)
+	ReplayedEntriesView = createCountView(ReplayedEntries, keyLog)
+	DroppedEntriesView = createCountView(DroppedEntries, keyLog)
+
+	DefaultViews = []*view.View{
+		SpooledEntriesView,
+		ReplayedEntriesView,
+		DroppedEntriesView,
+	}
+}
+
+func createCountView(m stats.Measure, keys ...tag.Key) *view.View {
+	return &view.View{
+		Name:        m.Name(),
+		Description: m.Description(),
+		TagKeys:     keys,
+		Measure:     m,
+		Aggregation: view.Sum(),
+	}
+}
+
+// recordEntries records n entries of the Logger in m.
+func (l *Logger) recordEntries(m *stats.Int64Measure, n int) {
+	ctx, err := tag.New(context.Background(), tag.Upsert(keyLog, l.logName))
+	if err != nil {
+		// The log name is not a valid tag value; record the measure untagged.
+		ctx = context.Background()
+	}
+	stats.Record(ctx, m.M(int64(n)))
+}
@@ -0,0 +1,264 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logging
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"runtime"
+	"strings"
+
+	"cloud.google.com/go/internal/tracecontext"
+	"go.opencensus.io/trace"
+	logpb "google.golang.org/genproto/googleapis/logging/v2"
+	"google.golang.org/grpc/metadata"
+)
+
+// MessageKey is the key of the message in the JSON payload of entries written
+// by a StructuredLogger.
+const MessageKey = "message"
+
+// A StructuredLogger writes leveled entries with JSON payloads to a Logger.
+// Each entry holds a message and key/value fields, the trace and span of the
+// context it is written with, and the source location of its caller.
+//
+// A StructuredLogger is safe for concurrent use by multiple goroutines.
+type StructuredLogger struct {
+	l      *Logger
+	min    Severity
+	fields []interface{} // key/value pairs added by With
+}
+
+// StructuredLogger returns a StructuredLogger that writes the entries of at
+// least severity min to l. Entries of lower severities are discarded.
+func (l *Logger) StructuredLogger(min Severity) *StructuredLogger {
+	return &StructuredLogger{l: l, min: min}
+}
+
+// With returns a StructuredLogger that adds the given key/value pairs to
+// the fields of every entry, before those passed to each call.
+func (s *StructuredLogger) With(keyvals ...interface{}) *StructuredLogger {
+	s2 := *s
+	s2.fields = append(s.fields[:len(s.fields):len(s.fields)], keyvals...)
+	return &s2
+}
+
+// Enabled reports whether entries of severity sev are written.
+func (s *StructuredLogger) Enabled(sev Severity) bool {
+	return sev >= s.min
+}
+
+// Log writes an entry of severity sev with the message msg and the fields
+// keyvals, which alternate between keys and values. Keys that are not strings
+// are formatted with fmt.Sprint, error values are replaced by their messages
+// and a final key without a value has a null value. Other values must marshal
+// to JSON with the encoding/json package.
+//
+// The trace and span of the entry are those of the OpenCensus span of ctx, if
+// any, or else of the trace context propagated by ctx; see ContextWithTraceHeader.
+//
+// Like Logger.Log, Log buffers the entry and never blocks.
+func (s *StructuredLogger) Log(ctx context.Context, sev Severity, msg string, keyvals ...interface{}) {
+	if !s.Enabled(sev) {
+		return
+	}
+	s.l.Log(s.entry(ctx, sev, msg, keyvals, callerLocation(1)))
+}
+
+// Debug writes an entry of severity Debug. See Log for its arguments.
+func (s *StructuredLogger) Debug(ctx context.Context, msg string, keyvals ...interface{}) {
+	if s.Enabled(Debug) {
+		s.l.Log(s.entry(ctx, Debug, msg, keyvals, callerLocation(1)))
+	}
+}
+
+// Info writes an entry of severity Info. See Log for its arguments.
+func (s *StructuredLogger) Info(ctx context.Context, msg string, keyvals ...interface{}) {
+	if s.Enabled(Info) {
+		s.l.Log(s.entry(ctx, Info, msg, keyvals, callerLocation(1)))
+	}
+}
+
+// Notice writes an entry of severity Notice. See Log for its arguments.
+func (s *StructuredLogger) Notice(ctx context.Context, msg string, keyvals ...interface{}) {
+	if s.Enabled(Notice) {
+		s.l.Log(s.entry(ctx, Notice, msg, keyvals, callerLocation(1)))
+	}
+}
+
+// Warning writes an entry of severity Warning. See Log for its arguments.
+func (s *StructuredLogger) Warning(ctx context.Context, msg string, keyvals ...interface{}) {
+	if s.Enabled(Warning) {
+		s.l.Log(s.entry(ctx, Warning, msg, keyvals, callerLocation(1)))
+	}
+}
+
+// Error writes an entry of severity Error. See Log for its arguments.
+func (s *StructuredLogger) Error(ctx context.Context, msg string, keyvals ...interface{}) {
+	if s.Enabled(Error) {
+		s.l.Log(s.entry(ctx, Error, msg, keyvals, callerLocation(1)))
+	}
+}
+
+// Critical writes an entry of severity Critical. See Log for its arguments.
+func (s *StructuredLogger) Critical(ctx context.Context, msg string, keyvals ...interface{}) {
+	if s.Enabled(Critical) {
+		s.l.Log(s.entry(ctx, Critical, msg, keyvals, callerLocation(1)))
+	}
+}
+
+// StandardLogger returns a *log.Logger that writes each of its lines as an
+// entry of severity sev, with the fields of s and the trace of ctx. The
+// source location of an entry is the caller of the *log.Logger method.
+//
+// Callers may mutate the returned log.Logger (for example by calling SetFlags
+// or SetPrefix).
+func (s *StructuredLogger) StandardLogger(ctx context.Context, sev Severity) *log.Logger {
+	return log.New(structuredWriter{s: s, ctx: ctx, sev: sev}, "", 0)
+}
+
+type structuredWriter struct {
+	s   *StructuredLogger
+	ctx context.Context
+	sev Severity
+}
+
+func (w structuredWriter) Write(p []byte) (n int, err error) {
+	if w.s.Enabled(w.sev) {
+		msg := strings.TrimSuffix(string(p), "\n")
+		w.s.l.Log(w.s.entry(w.ctx, w.sev, msg, nil, stdLoggerCallerLocation()))
+	}
+	return len(p), nil
+}
+
+func (s *StructuredLogger) entry(ctx context.Context, sev Severity, msg string, keyvals []interface{}, loc *logpb.LogEntrySourceLocation) Entry {
+	payload := map[string]interface{}{}
+	addFields(payload, s.fields)
+	addFields(payload, keyvals)
+	payload[MessageKey] = msg
+	e := Entry{
+		Severity:       sev,
+		Payload:        payload,
+		SourceLocation: loc,
+	}
+	if traceID, spanID, sampled := traceFromContext(ctx); traceID != "" {
+		e.Trace = fmt.Sprintf("%s/traces/%s", s.l.client.parent, traceID)
+		e.SpanID = spanID
+		e.TraceSampled = sampled
+	}
+	return e
+}
+
+func addFields(m map[string]interface{}, keyvals []interface{}) {
+	for i := 0; i < len(keyvals); i += 2 {
+		key, ok := keyvals[i].(string)
+		if !ok {
+			key = fmt.Sprint(keyvals[i])
+		}
+		var v interface{}
+		if i+1 < len(keyvals) {
+			v = keyvals[i+1]
+		}
+		if err, ok := v.(error); ok {
+			v = err.Error()
+		}
+		m[key] = v
+	}
+}
+
+// callerLocation returns the source location of the caller skip frames above
+// the caller of callerLocation, or nil if it is unknown.
+func callerLocation(skip int) *logpb.LogEntrySourceLocation {
+	var pcs [1]uintptr
+	if runtime.Callers(skip+2, pcs[:]) == 0 {
+		return nil
+	}
+	frame, _ := runtime.CallersFrames(pcs[:]).Next()
+	return sourceLocation(frame)
+}
+
+// stdLoggerCallerLocation returns the source location of the caller of the
+// log package, or nil if it is unknown.
+func stdLoggerCallerLocation() *logpb.LogEntrySourceLocation {
+	var pcs [16]uintptr
+	frames := runtime.CallersFrames(pcs[:runtime.Callers(2, pcs[:])])
+	inLog := false
+	for {
+		frame, more := frames.Next()
+		if strings.HasPrefix(frame.Function, "log.") {
+			inLog = true
+		} else if inLog {
+			return sourceLocation(frame)
+		}
+		if !more {
+			return nil
+		}
+	}
+}
+
+func sourceLocation(frame runtime.Frame) *logpb.LogEntrySourceLocation {
+	if frame.File == "" {
+		return nil
+	}
+	return &logpb.LogEntrySourceLocation{
+		File:     frame.File,
+		Line:     int64(frame.Line),
+		Function: frame.Function,
+	}
+}
+
+type traceHeaderKey struct{}
+
+// ContextWithTraceHeader returns a copy of ctx that propagates the trace
+// context of an X-Cloud-Trace-Context header, such as that of an incoming
+// HTTP request:
+//
+//	ctx := logging.ContextWithTraceHeader(r.Context(), r.Header.Get("X-Cloud-Trace-Context"))
+//
+// The entries written by a StructuredLogger with the context are associated
+// with the trace, unless the context also holds an OpenCensus span.
+func ContextWithTraceHeader(ctx context.Context, header string) context.Context {
+	return context.WithValue(ctx, traceHeaderKey{}, header)
+}
+
+// traceFromContext returns the trace propagated by ctx. It looks in turn for
+// an OpenCensus span, a header added by ContextWithTraceHeader, and the
+// x-cloud-trace-context and grpc-trace-bin metadata of an incoming gRPC call.
+func traceFromContext(ctx context.Context) (traceID, spanID string, sampled bool) {
+	if span := trace.FromContext(ctx); span != nil {
+		sc := span.SpanContext()
+		return sc.TraceID.String(), sc.SpanID.String(), sc.IsSampled()
+	}
+	if h, ok := ctx.Value(traceHeaderKey{}).(string); ok && h != "" {
+		return deconstructXCloudTraceContext(h)
+	}
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return "", "", false
+	}
+	if h := md.Get("x-cloud-trace-context"); len(h) > 0 {
+		return deconstructXCloudTraceContext(h[0])
+	}
+	if b := md.Get("grpc-trace-bin"); len(b) > 0 {
+		tid, sid, opts, ok := tracecontext.Decode([]byte(b[0]))
+		if !ok || len(tid) == 0 {
+			return "", "", false
+		}
+		return hex.EncodeToString(tid), fmt.Sprintf("%016x", sid), opts&1 != 0
+	}
+	return "", "", false
+}
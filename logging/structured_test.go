@@ -0,0 +1,104 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logging_test
+
+import (
+	"context"
+	"runtime"
+	"strings"
+	"testing"
+
+	"cloud.google.com/go/internal/testutil"
+	"cloud.google.com/go/logging"
+	structpb "github.com/golang/protobuf/ptypes/struct"
+)
+
+func TestStructuredLogger(t *testing.T) {
+	initLogs() // Generate new testLogID
+	ctx := logging.ContextWithTraceHeader(context.Background(), "105445aa7843bc8bf206b120001000/0;o=1")
+	lg := client.Logger(testLogID)
+	slg := lg.StructuredLogger(logging.Info).With("request", "r1")
+
+	slg.Debug(ctx, "discarded")
+	_, _, line, _ := runtime.Caller(0)
+	slg.Warning(ctx, "structured", "n", 2)
+	slg.StandardLogger(ctx, logging.Error).Printf("standard %d", 3)
+	if err := lg.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	var got []*logging.Entry
+	ok := waitFor(func() bool {
+		var err error
+		got, err = allTestLogEntries(ctx)
+		if err != nil {
+			t.Log("fetching log entries: ", err)
+			return false
+		}
+		return len(got) == 2
+	})
+	if !ok {
+		t.Fatalf("timed out; got: %d, want: %d\n", len(got), 2)
+	}
+	want := []struct {
+		sev     logging.Severity
+		payload map[string]interface{}
+		line    int
+	}{
+		{logging.Warning, map[string]interface{}{"message": "structured", "request": "r1", "n": 2.0}, line + 1},
+		{logging.Error, map[string]interface{}{"message": "standard 3", "request": "r1"}, line + 2},
+	}
+	for _, w := range want {
+		var e *logging.Entry
+		for _, g := range got {
+			if g.Severity == w.sev {
+				e = g
+			}
+		}
+		if e == nil {
+			t.Errorf("no entry of severity %s", w.sev)
+			continue
+		}
+		if got := structFields(e.Payload); !testutil.Equal(got, w.payload) {
+			t.Errorf("%s: payload: got %v, want %v", w.sev, got, w.payload)
+		}
+		if got, want := e.Trace, "projects/"+testProjectID+"/traces/105445aa7843bc8bf206b120001000"; got != want {
+			t.Errorf("%s: trace: got %q, want %q", w.sev, got, want)
+		}
+		loc := e.SourceLocation
+		if loc == nil || !strings.HasSuffix(loc.File, "structured_test.go") || loc.Line != int64(w.line) ||
+			!strings.HasSuffix(loc.Function, "TestStructuredLogger") {
+			t.Errorf("%s: source location: got %v, want structured_test.go:%d in TestStructuredLogger", w.sev, loc, w.line)
+		}
+	}
+}
+
+// structFields returns the string and number fields of a JSON payload.
+func structFields(payload interface{}) map[string]interface{} {
+	s, ok := payload.(*structpb.Struct)
+	if !ok {
+		return nil
+	}
+	m := map[string]interface{}{}
+	for k, v := range s.Fields {
+		switch v := v.Kind.(type) {
+		case *structpb.Value_StringValue:
+			m[k] = v.StringValue
+		case *structpb.Value_NumberValue:
+			m[k] = v.NumberValue
+		}
+	}
+	return m
+}
@@ -0,0 +1,428 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"cloud.google.com/go/internal/trace"
+	"google.golang.org/api/iterator"
+)
+
+// DefaultBulkConcurrency is the number of object operations a bulk operation
+// runs at once when BulkOptions.Concurrency is zero.
+const DefaultBulkConcurrency = 16
+
+// BulkOptions configures the bulk operations DeletePrefix, CopyPrefix and
+// SyncDir.
+//
+// This type is EXPERIMENTAL and subject to change or removal without notice.
+type BulkOptions struct {
+	// Concurrency is the maximum number of object operations that run at
+	// the same time. If zero, DefaultBulkConcurrency is used.
+	Concurrency int
+
+	// DryRun, if true, makes the bulk operation list and compare objects as
+	// usual without modifying anything. The returned results describe the
+	// operations that would have been performed.
+	DryRun bool
+
+	// ProgressFunc, if non-nil, is invoked with the result of each object
+	// operation as soon as it completes. It may be called concurrently from
+	// several goroutines and should return quickly without blocking.
+	ProgressFunc func(BulkResult)
+}
+
+func (o *BulkOptions) concurrency() int {
+	if o == nil || o.Concurrency <= 0 {
+		return DefaultBulkConcurrency
+	}
+	return o.Concurrency
+}
+
+// BulkAction is the kind of operation a bulk operation performed on a single
+// object.
+//
+// This type is EXPERIMENTAL and subject to change or removal without notice.
+type BulkAction int
+
+const (
+	// BulkDelete means the object was deleted.
+	BulkDelete BulkAction = iota + 1
+
+	// BulkCopy means the object was copied to another object.
+	BulkCopy
+
+	// BulkUpload means a local file was uploaded to the object.
+	BulkUpload
+
+	// BulkSkip means the object was left unchanged because it already
+	// matched its source.
+	BulkSkip
+)
+
+func (a BulkAction) String() string {
+	switch a {
+	case BulkDelete:
+		return "delete"
+	case BulkCopy:
+		return "copy"
+	case BulkUpload:
+		return "upload"
+	case BulkSkip:
+		return "skip"
+	}
+	return fmt.Sprintf("BulkAction(%d)", int(a))
+}
+
+// BulkResult describes the outcome of a bulk operation for one object.
+//
+// This type is EXPERIMENTAL and subject to change or removal without notice.
+type BulkResult struct {
+	// Action is the operation that was performed, or that would have been
+	// performed in dry-run mode.
+	Action BulkAction
+
+	// Source is the name of the source object for copies, or the local file
+	// path for uploads. It is empty for deletes.
+	Source string
+
+	// Name is the name of the object that was deleted, written or skipped.
+	Name string
+
+	// Attrs holds the attributes of the written object after a successful
+	// copy or upload. It is nil otherwise, and always nil in dry-run mode.
+	Attrs *ObjectAttrs
+
+	// Err is the error encountered while performing Action, if any.
+	Err error
+}
+
+// BulkError is returned by bulk operations when the operations on one or more
+// objects failed. Failed holds the result for each of those objects.
+//
+// This type is EXPERIMENTAL and subject to change or removal without notice.
+type BulkError struct {
+	Failed []BulkResult
+}
+
+func (e *BulkError) Error() string {
+	if len(e.Failed) == 1 {
+		r := e.Failed[0]
+		return fmt.Sprintf("storage: %s of %q failed: %v", r.Action, r.Name, r.Err)
+	}
+	return fmt.Sprintf("storage: %d object operations failed; first: %s of %q: %v",
+		len(e.Failed), e.Failed[0].Action, e.Failed[0].Name, e.Failed[0].Err)
+}
+
+// bulkRunner runs per-object operations with bounded concurrency and collects
+// their results.
+type bulkRunner struct {
+	ctx  context.Context
+	opts *BulkOptions
+	sem  chan struct{}
+	wg   sync.WaitGroup
+
+	mu      sync.Mutex
+	results []BulkResult
+}
+
+func newBulkRunner(ctx context.Context, opts *BulkOptions) *bulkRunner {
+	return &bulkRunner{
+		ctx:  ctx,
+		opts: opts,
+		sem:  make(chan struct{}, opts.concurrency()),
+	}
+}
+
+func (r *bulkRunner) dryRun() bool {
+	return r.opts != nil && r.opts.DryRun
+}
+
+// run schedules op for execution. It blocks while the maximum number of
+// operations are in flight, and returns the context's error if the context is
+// done before op could be scheduled. In dry-run mode op is not called.
+func (r *bulkRunner) run(res BulkResult, op func() (*ObjectAttrs, error)) error {
+	if r.dryRun() || op == nil {
+		r.record(res)
+		return nil
+	}
+	select {
+	case r.sem <- struct{}{}:
+	case <-r.ctx.Done():
+		return r.ctx.Err()
+	}
+	r.wg.Add(1)
+	go func() {
+		defer func() {
+			<-r.sem
+			r.wg.Done()
+		}()
+		res.Attrs, res.Err = op()
+		r.record(res)
+	}()
+	return nil
+}
+
+func (r *bulkRunner) record(res BulkResult) {
+	r.mu.Lock()
+	r.results = append(r.results, res)
+	r.mu.Unlock()
+	if r.opts != nil && r.opts.ProgressFunc != nil {
+		r.opts.ProgressFunc(res)
+	}
+}
+
+// wait waits for all scheduled operations and returns their results sorted by
+// object name. If err is nil and some operations failed, it returns a
+// *BulkError.
+func (r *bulkRunner) wait(err error) ([]BulkResult, error) {
+	r.wg.Wait()
+	sort.Slice(r.results, func(i, j int) bool { return r.results[i].Name < r.results[j].Name })
+	if err != nil {
+		return r.results, err
+	}
+	var failed []BulkResult
+	for _, res := range r.results {
+		if res.Err != nil {
+			failed = append(failed, res)
+		}
+	}
+	if len(failed) > 0 {
+		return r.results, &BulkError{Failed: failed}
+	}
+	return r.results, nil
+}
+
+// DeletePrefix deletes every object in the bucket whose name begins with
+// prefix. An empty prefix deletes every object in the bucket.
+//
+// Each object is deleted only if its generation still matches the one that was
+// listed, so objects overwritten during the operation are left alone.
+//
+// The returned results describe each object, sorted by name. If deleting any
+// object failed, the returned error is a *BulkError. If listing the bucket
+// failed, the results of the deletes that were started are returned along with
+// the listing error.
+//
+// This method is EXPERIMENTAL and subject to change or removal without notice.
+func (b *BucketHandle) DeletePrefix(ctx context.Context, prefix string, opts *BulkOptions) (results []BulkResult, err error) {
+	ctx = trace.StartSpan(ctx, "cloud.google.com/go/storage.Bucket.DeletePrefix")
+	defer func() { trace.EndSpan(ctx, err) }()
+
+	q := &Query{Prefix: prefix}
+	if err := q.SetAttrSelection([]string{"Name", "Generation"}); err != nil {
+		return nil, err
+	}
+	r := newBulkRunner(ctx, opts)
+	it := b.Objects(ctx, q)
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return r.wait(err)
+		}
+		obj := b.Object(attrs.Name).If(Conditions{GenerationMatch: attrs.Generation})
+		err = r.run(BulkResult{Action: BulkDelete, Name: attrs.Name}, func() (*ObjectAttrs, error) {
+			return nil, obj.Delete(ctx)
+		})
+		if err != nil {
+			return r.wait(err)
+		}
+	}
+	return r.wait(nil)
+}
+
+// CopyPrefix copies every object in the bucket whose name begins with prefix to
+// the bucket dst, which may be the same bucket. The destination name of each
+// object is formed by replacing prefix with dstPrefix. Objects are copied with
+// the rewrite API, so copies between locations and storage classes are
+// supported.
+//
+// Copying an object onto itself is reported as an error for that object.
+//
+// The returned results and errors are as for DeletePrefix.
+//
+// This method is EXPERIMENTAL and subject to change or removal without notice.
+func (b *BucketHandle) CopyPrefix(ctx context.Context, prefix string, dst *BucketHandle, dstPrefix string, opts *BulkOptions) (results []BulkResult, err error) {
+	ctx = trace.StartSpan(ctx, "cloud.google.com/go/storage.Bucket.CopyPrefix")
+	defer func() { trace.EndSpan(ctx, err) }()
+
+	q := &Query{Prefix: prefix}
+	if err := q.SetAttrSelection([]string{"Name", "Generation"}); err != nil {
+		return nil, err
+	}
+	r := newBulkRunner(ctx, opts)
+	it := b.Objects(ctx, q)
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return r.wait(err)
+		}
+		name := dstPrefix + strings.TrimPrefix(attrs.Name, prefix)
+		res := BulkResult{Action: BulkCopy, Source: attrs.Name, Name: name}
+		if b.name == dst.name && name == attrs.Name {
+			res.Err = fmt.Errorf("storage: cannot copy %q onto itself", name)
+			r.record(res)
+			continue
+		}
+		src := b.Object(attrs.Name).Generation(attrs.Generation)
+		copier := dst.Object(name).CopierFrom(src)
+		if err := r.run(res, func() (*ObjectAttrs, error) { return copier.Run(ctx) }); err != nil {
+			return r.wait(err)
+		}
+	}
+	return r.wait(nil)
+}
+
+// SyncDir uploads the regular files below the local directory dir to the
+// bucket, naming each object by appending the file's slash-separated path
+// relative to dir to prefix.
+//
+// A file is uploaded only if no object of that name exists, or if the object's
+// size or CRC32C checksum differ from the file's, or if the object has an MD5
+// hash that differs from the file's. Objects are never deleted. Unchanged files
+// are reported with the BulkSkip action.
+//
+// The returned results and errors are as for DeletePrefix.
+//
+// This method is EXPERIMENTAL and subject to change or removal without notice.
+func (b *BucketHandle) SyncDir(ctx context.Context, dir, prefix string, opts *BulkOptions) (results []BulkResult, err error) {
+	ctx = trace.StartSpan(ctx, "cloud.google.com/go/storage.Bucket.SyncDir")
+	defer func() { trace.EndSpan(ctx, err) }()
+
+	q := &Query{Prefix: prefix}
+	if err := q.SetAttrSelection([]string{"Name", "Size", "CRC32C", "MD5"}); err != nil {
+		return nil, err
+	}
+	existing := map[string]*ObjectAttrs{}
+	it := b.Objects(ctx, q)
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		existing[attrs.Name] = attrs
+	}
+
+	r := newBulkRunner(ctx, opts)
+	err = filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		name := prefix + filepath.ToSlash(rel)
+		res := BulkResult{Action: BulkUpload, Source: path, Name: name}
+		if attrs, ok := existing[name]; ok && attrs.Size == info.Size() {
+			sum, err := fileChecksums(path)
+			if err != nil {
+				res.Err = err
+				r.record(res)
+				return nil
+			}
+			if sum.matches(attrs) {
+				res.Action = BulkSkip
+				r.record(res)
+				return nil
+			}
+		}
+		obj := b.Object(name)
+		return r.run(res, func() (*ObjectAttrs, error) { return uploadFile(ctx, obj, path) })
+	})
+	return r.wait(err)
+}
+
+// checksums holds the checksums of a local file in the form they are reported
+// for objects.
+type checksums struct {
+	crc32c uint32
+	md5    []byte
+}
+
+func fileChecksums(path string) (checksums, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return checksums{}, err
+	}
+	defer f.Close()
+	crc := crc32.New(crc32cTable)
+	md := md5.New()
+	if _, err := io.Copy(io.MultiWriter(crc, md), f); err != nil {
+		return checksums{}, err
+	}
+	return checksums{crc32c: crc.Sum32(), md5: md.Sum(nil)}, nil
+}
+
+// matches reports whether the checksums match those of attrs. Composite
+// objects have no MD5 hash, so only the CRC32C is compared for them.
+func (c checksums) matches(attrs *ObjectAttrs) bool {
+	if c.crc32c != attrs.CRC32C {
+		return false
+	}
+	return len(attrs.MD5) == 0 || bytes.Equal(c.md5, attrs.MD5)
+}
+
+// uploadFile writes the contents of the file at path to obj. The file's CRC32C
+// is sent along with the data so that corrupted uploads are rejected.
+func uploadFile(ctx context.Context, obj *ObjectHandle, path string) (*ObjectAttrs, error) {
+	sum, err := fileChecksums(path)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	// Canceling the context aborts the upload if the file can't be read.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	w := obj.NewWriter(ctx)
+	w.CRC32C = sum.crc32c
+	w.SendCRC32C = true
+	if _, err := io.Copy(w, f); err != nil {
+		cancel()
+		w.Close()
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return w.Attrs(), nil
+}
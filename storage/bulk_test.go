@@ -0,0 +1,351 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/json"
+	"hash/crc32"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"cloud.google.com/go/internal/testutil"
+	"google.golang.org/api/option"
+	raw "google.golang.org/api/storage/v1"
+)
+
+// fakeObjectServer is a minimal in-memory implementation of the object list,
+// delete, rewrite and multipart upload JSON API calls.
+type fakeObjectServer struct {
+	mu      sync.Mutex
+	gen     int64
+	objects map[string]map[string]*raw.Object // bucket -> name -> object
+	data    map[string][]byte                 // bucket/name -> contents
+	fail    map[string]bool                   // object names whose writes fail
+}
+
+func newFakeObjectServer() *fakeObjectServer {
+	return &fakeObjectServer{
+		objects: map[string]map[string]*raw.Object{},
+		data:    map[string][]byte{},
+		fail:    map[string]bool{},
+	}
+}
+
+func (s *fakeObjectServer) put(bucket, name string, contents []byte) *raw.Object {
+	s.gen++
+	crc := crc32.Checksum(contents, crc32cTable)
+	sum := md5.Sum(contents)
+	o := &raw.Object{
+		Bucket:     bucket,
+		Name:       name,
+		Size:       uint64(len(contents)),
+		Generation: s.gen,
+		Crc32c:     encodeUint32(crc),
+		Md5Hash:    base64.StdEncoding.EncodeToString(sum[:]),
+	}
+	if s.objects[bucket] == nil {
+		s.objects[bucket] = map[string]*raw.Object{}
+	}
+	s.objects[bucket][name] = o
+	s.data[bucket+"/"+name] = contents
+	return o
+}
+
+func (s *fakeObjectServer) names(bucket string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var names []string
+	for n := range s.objects[bucket] {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (s *fakeObjectServer) writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+func (s *fakeObjectServer) handle(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var parts []string
+	for _, p := range strings.Split(strings.Trim(r.URL.EscapedPath(), "/"), "/") {
+		u, _ := url.PathUnescape(p)
+		parts = append(parts, u)
+	}
+	switch {
+	case r.Method == "GET" && len(parts) == 5 && parts[4] == "o":
+		prefix := r.URL.Query().Get("prefix")
+		res := &raw.Objects{}
+		for _, o := range s.objects[parts[3]] {
+			if strings.HasPrefix(o.Name, prefix) {
+				res.Items = append(res.Items, o)
+			}
+		}
+		sort.Slice(res.Items, func(i, j int) bool { return res.Items[i].Name < res.Items[j].Name })
+		s.writeJSON(w, res)
+
+	case r.Method == "DELETE" && len(parts) == 6:
+		o, ok := s.objects[parts[3]][parts[5]]
+		if !ok || s.fail[parts[5]] {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		if g := r.URL.Query().Get("ifGenerationMatch"); g != "" && g != encodeInt(o.Generation) {
+			http.Error(w, "precondition failed", http.StatusPreconditionFailed)
+			return
+		}
+		delete(s.objects[parts[3]], parts[5])
+		w.WriteHeader(http.StatusNoContent)
+
+	case r.Method == "POST" && len(parts) == 11 && parts[6] == "rewriteTo":
+		if s.fail[parts[10]] {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		src := s.objects[parts[3]][parts[5]]
+		o := s.put(parts[8], parts[10], s.data[parts[3]+"/"+src.Name])
+		s.writeJSON(w, &raw.RewriteResponse{Done: true, Resource: o, ObjectSize: int64(o.Size), TotalBytesRewritten: int64(o.Size)})
+
+	case r.Method == "POST" && len(parts) == 6 && parts[0] == "upload":
+		_, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		mr := multipart.NewReader(r.Body, params["boundary"])
+		p, err := mr.NextPart()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var meta raw.Object
+		if err := json.NewDecoder(p).Decode(&meta); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if s.fail[meta.Name] {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		p, err = mr.NextPart()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		contents, _ := ioutil.ReadAll(p)
+		s.writeJSON(w, s.put(parts[4], meta.Name, contents))
+
+	default:
+		http.Error(w, "unexpected request "+r.Method+" "+r.URL.String(), http.StatusBadRequest)
+	}
+}
+
+func encodeInt(n int64) string {
+	b, _ := json.Marshal(n)
+	return string(b)
+}
+
+func newFakeObjectClient(t *testing.T) (*Client, *fakeObjectServer, func()) {
+	s := newFakeObjectServer()
+	hc, close := newTestServer(s.handle)
+	c, err := NewClient(context.Background(), option.WithHTTPClient(hc))
+	if err != nil {
+		close()
+		t.Fatal(err)
+	}
+	return c, s, close
+}
+
+func TestDeletePrefix(t *testing.T) {
+	ctx := context.Background()
+	c, s, close := newFakeObjectClient(t)
+	defer close()
+	for _, n := range []string{"a/1", "a/2", "a/b/3", "ab", "c"} {
+		s.put("bucket", n, []byte(n))
+	}
+
+	// A dry run changes nothing.
+	var progress []string
+	var mu sync.Mutex
+	opts := &BulkOptions{DryRun: true, ProgressFunc: func(r BulkResult) {
+		mu.Lock()
+		progress = append(progress, r.Name)
+		mu.Unlock()
+	}}
+	res, err := c.Bucket("bucket").DeletePrefix(ctx, "a/", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := resultNames(res), []string{"a/1", "a/2", "a/b/3"}; !testutil.Equal(got, want) {
+		t.Errorf("dry run: got %v, want %v", got, want)
+	}
+	if len(progress) != 3 {
+		t.Errorf("dry run: got %d progress calls, want 3", len(progress))
+	}
+	if got := len(s.names("bucket")); got != 5 {
+		t.Fatalf("dry run deleted objects: %d remain", got)
+	}
+
+	s.fail["a/2"] = true
+	res, err = c.Bucket("bucket").DeletePrefix(ctx, "a/", &BulkOptions{Concurrency: 2})
+	berr, ok := err.(*BulkError)
+	if !ok {
+		t.Fatalf("got error %v, want *BulkError", err)
+	}
+	if len(berr.Failed) != 1 || berr.Failed[0].Name != "a/2" || berr.Failed[0].Err != ErrObjectNotExist {
+		t.Errorf("got failures %+v, want a/2 with ErrObjectNotExist", berr.Failed)
+	}
+	if len(res) != 3 {
+		t.Errorf("got %d results, want 3", len(res))
+	}
+	if got, want := s.names("bucket"), []string{"a/2", "ab", "c"}; !testutil.Equal(got, want) {
+		t.Errorf("remaining objects: got %v, want %v", got, want)
+	}
+}
+
+func TestCopyPrefix(t *testing.T) {
+	ctx := context.Background()
+	c, s, close := newFakeObjectClient(t)
+	defer close()
+	for _, n := range []string{"src/x", "src/y/z", "other"} {
+		s.put("b1", n, []byte(n))
+	}
+	res, err := c.Bucket("b1").CopyPrefix(ctx, "src/", c.Bucket("b2"), "dst/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range res {
+		if r.Action != BulkCopy || r.Attrs == nil || r.Attrs.Bucket != "b2" {
+			t.Errorf("unexpected result %+v", r)
+		}
+	}
+	if got, want := resultNames(res), []string{"dst/x", "dst/y/z"}; !testutil.Equal(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := string(s.data["b2/dst/y/z"]), "src/y/z"; got != want {
+		t.Errorf("copied contents: got %q, want %q", got, want)
+	}
+
+	// Copying onto the same names in the same bucket fails per object.
+	_, err = c.Bucket("b1").CopyPrefix(ctx, "src/", c.Bucket("b1"), "src/", nil)
+	if berr, ok := err.(*BulkError); !ok || len(berr.Failed) != 2 {
+		t.Errorf("got %v, want *BulkError with 2 failures", err)
+	}
+}
+
+func TestSyncDir(t *testing.T) {
+	ctx := context.Background()
+	c, s, close := newFakeObjectClient(t)
+	defer close()
+
+	dir, err := ioutil.TempDir("", "storage-sync")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	files := map[string]string{
+		"same":        "unchanged",
+		"changed":     "new contents",
+		"samesize":    "aaaa",
+		"sub/new.txt": "brand new",
+	}
+	for name, contents := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s.put("bucket", "p/same", []byte("unchanged"))
+	s.put("bucket", "p/changed", []byte("old"))
+	s.put("bucket", "p/samesize", []byte("bbbb"))
+	s.put("bucket", "p/extra", []byte("left alone"))
+
+	wantActions := map[string]BulkAction{
+		"p/changed":     BulkUpload,
+		"p/same":        BulkSkip,
+		"p/samesize":    BulkUpload,
+		"p/sub/new.txt": BulkUpload,
+	}
+	checkActions := func(res []BulkResult) {
+		t.Helper()
+		got := map[string]BulkAction{}
+		for _, r := range res {
+			got[r.Name] = r.Action
+		}
+		if !testutil.Equal(got, wantActions) {
+			t.Errorf("got actions %v, want %v", got, wantActions)
+		}
+	}
+
+	res, err := c.Bucket("bucket").SyncDir(ctx, dir, "p/", &BulkOptions{DryRun: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkActions(res)
+	if got := string(s.data["bucket/p/changed"]); got != "old" {
+		t.Errorf("dry run uploaded %q", got)
+	}
+
+	res, err = c.Bucket("bucket").SyncDir(ctx, dir, "p/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkActions(res)
+	for name, contents := range files {
+		if got := string(s.data["bucket/p/"+name]); got != contents {
+			t.Errorf("%s: got %q, want %q", name, got, contents)
+		}
+	}
+	if got := string(s.data["bucket/p/extra"]); got != "left alone" {
+		t.Errorf("extra object changed to %q", got)
+	}
+
+	// A second sync uploads nothing.
+	res, err = c.Bucket("bucket").SyncDir(ctx, dir, "p/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range res {
+		if r.Action != BulkSkip {
+			t.Errorf("%s: got action %v, want skip", r.Name, r.Action)
+		}
+	}
+}
+
+func resultNames(res []BulkResult) []string {
+	var names []string
+	for _, r := range res {
+		names = append(names, r.Name)
+	}
+	return names
+}